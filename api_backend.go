@@ -104,6 +104,8 @@ type BackendRoomInviteRequest struct {
 	// notify existing users the room has changed and they need to update it.
 	AllUserIds []string         `json:"alluserids,omitempty"`
 	Properties *json.RawMessage `json:"properties,omitempty"`
+	// Federation is set if the room is hosted on a remote signaling server.
+	Federation *RoomFederationServerMessage `json:"federation,omitempty"`
 }
 
 type BackendRoomDisinviteRequest struct {
@@ -118,6 +120,9 @@ type BackendRoomDisinviteRequest struct {
 type BackendRoomUpdateRequest struct {
 	UserIds    []string         `json:"userids,omitempty"`
 	Properties *json.RawMessage `json:"properties,omitempty"`
+	// PropertiesPatch is applied to the current properties if no full
+	// properties are given, see "Room.PatchProperties".
+	PropertiesPatch *json.RawMessage `json:"propertiespatch,omitempty"`
 }
 
 type BackendRoomDeleteRequest struct {
@@ -125,7 +130,8 @@ type BackendRoomDeleteRequest struct {
 }
 
 type BackendRoomInCallRequest struct {
-	// TODO(jojo): Change "InCall" to "int" when #914 has landed in NC Talk.
+	// InCall is either a boolean or the in-call flags, use "ParseInCall" to
+	// get the typed value.
 	InCall  json.RawMessage          `json:"incall,omitempty"`
 	Changed []map[string]interface{} `json:"changed,omitempty"`
 	Users   []map[string]interface{} `json:"users,omitempty"`
@@ -187,6 +193,10 @@ type BackendClientAuthResponse struct {
 	Version string           `json:"version"`
 	UserId  string           `json:"userid"`
 	User    *json.RawMessage `json:"user"`
+
+	// Observer must be set by the backend to allow clients to connect as
+	// read-only observer.
+	Observer bool `json:"observer,omitempty"`
 }
 
 type BackendClientRoomRequest struct {
@@ -45,6 +45,12 @@ type ProxyClientMessage struct {
 }
 
 func (m *ProxyClientMessage) CheckValid() error {
+	if err := validateString("id", m.Id); err != nil {
+		return err
+	} else if err := validateString("type", m.Type); err != nil {
+		return err
+	}
+
 	switch m.Type {
 	case "":
 		return fmt.Errorf("type missing")
@@ -86,7 +92,7 @@ func (m *ProxyClientMessage) NewErrorServerMessage(e *Error) *ProxyServerMessage
 }
 
 func (m *ProxyClientMessage) NewWrappedErrorServerMessage(e error) *ProxyServerMessage {
-	return m.NewErrorServerMessage(NewError("internal_error", e.Error()))
+	return m.NewErrorServerMessage(NewError(ErrorCodeInternalError, e.Error()))
 }
 
 // ProxyServerMessage is a message that is sent from the server to a client.
@@ -108,7 +114,7 @@ type ProxyServerMessage struct {
 	Event *EventProxyServerMessage `json:"event,omitempty"`
 }
 
-func (r *ProxyServerMessage) CloseAfterSend(session Session) bool {
+func (r *ProxyServerMessage) CloseAfterSend(session MessageSession) bool {
 	switch r.Type {
 	case "bye":
 		return true
@@ -136,7 +142,14 @@ type HelloProxyClientMessage struct {
 
 func (m *HelloProxyClientMessage) CheckValid() error {
 	if m.Version != HelloVersion {
-		return fmt.Errorf("unsupported hello version: %s", m.Version)
+		return fmt.Errorf("unsupported hello version: %q", m.Version)
+	}
+	if err := validateString("resumeid", m.ResumeId); err != nil {
+		return err
+	} else if err := validateString("token", m.Token); err != nil {
+		return err
+	} else if err := validateStrings("feature", m.Features); err != nil {
+		return err
 	}
 	if m.ResumeId == "" {
 		if m.Token == "" {
@@ -180,6 +193,16 @@ type CommandProxyClientMessage struct {
 }
 
 func (m *CommandProxyClientMessage) CheckValid() error {
+	if err := validateString("type", m.Type); err != nil {
+		return err
+	} else if err := validateString("stream type", m.StreamType); err != nil {
+		return err
+	} else if err := validateString("publisher id", m.PublisherId); err != nil {
+		return err
+	} else if err := validateString("client id", m.ClientId); err != nil {
+		return err
+	}
+
 	switch m.Type {
 	case "":
 		return fmt.Errorf("type missing")
@@ -218,6 +241,12 @@ type PayloadProxyClientMessage struct {
 }
 
 func (m *PayloadProxyClientMessage) CheckValid() error {
+	if err := validateString("type", m.Type); err != nil {
+		return err
+	} else if err := validateString("client id", m.ClientId); err != nil {
+		return err
+	}
+
 	switch m.Type {
 	case "":
 		return fmt.Errorf("type missing")
@@ -265,6 +294,8 @@ type ProxyInformationEtcd struct {
 func (p *ProxyInformationEtcd) CheckValid() error {
 	if p.Address == "" {
 		return fmt.Errorf("address missing")
+	} else if err := validateString("address", p.Address); err != nil {
+		return err
 	}
 	if p.Address[len(p.Address)-1] != '/' {
 		p.Address += "/"
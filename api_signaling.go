@@ -22,15 +22,28 @@
 package signaling
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"path"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	// Version that must be sent in a "hello" message.
 	HelloVersion = "1.0"
+
+	// Maximum length of the request id of a client message.
+	maxClientMessageIdLength = 256
+)
+
+var (
+	// ErrInvalidMessageId is returned if the request id of a client message is
+	// too long or contains invalid characters.
+	ErrInvalidMessageId = fmt.Errorf("invalid message id")
 )
 
 // ClientMessage is a message that is sent from a client to the server.
@@ -41,6 +54,9 @@ type ClientMessage struct {
 	// The type of the request.
 	Type string `json:"type"`
 
+	// Only validate the request without processing it (optional).
+	Dry bool `json:"dry,omitempty"`
+
 	// Filled for type "hello"
 	Hello *HelloClientMessage `json:"hello,omitempty"`
 
@@ -55,9 +71,50 @@ type ClientMessage struct {
 	Internal *InternalClientMessage `json:"internal,omitempty"`
 
 	TransientData *TransientDataClientMessage `json:"transient,omitempty"`
+
+	Capabilities *CapabilitiesClientMessage `json:"capabilities,omitempty"`
+
+	Kick *KickClientMessage `json:"kick,omitempty"`
+
+	Move *MoveClientMessage `json:"move,omitempty"`
+
+	Presence *PresenceClientMessage `json:"presence,omitempty"`
+
+	Echo *EchoClientMessage `json:"echo,omitempty"`
+
+	Participants *ParticipantsClientMessage `json:"participants,omitempty"`
+
+	// Payload of registered custom message types.
+	customPayload *json.RawMessage
+
+	// fromInternal is set by the hub if the message was received from an
+	// internal client.
+	fromInternal bool
+}
+
+// isValidClientMessageId checks that the id only contains printable ASCII
+// characters (without whitespace) and doesn't exceed the maximum length.
+func isValidClientMessageId(id string) bool {
+	if len(id) > maxClientMessageIdLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
 }
 
 func (m *ClientMessage) CheckValid() error {
+	if !isValidClientMessageId(m.Id) {
+		return ErrInvalidMessageId
+	}
+	if err := validateString("type", m.Type); err != nil {
+		return err
+	}
+
 	switch m.Type {
 	case "":
 		return fmt.Errorf("type missing")
@@ -99,10 +156,92 @@ func (m *ClientMessage) CheckValid() error {
 		} else if err := m.TransientData.CheckValid(); err != nil {
 			return err
 		}
+	case "capabilities":
+		// The request has no required parameters, so the payload is optional.
+		if m.Capabilities != nil {
+			if err := m.Capabilities.CheckValid(); err != nil {
+				return err
+			} else if len(m.Capabilities.Backends) > 0 && !m.fromInternal {
+				return fmt.Errorf("capabilities of other backends can only be requested by internal clients")
+			}
+		}
+	case "kick":
+		if m.Kick == nil {
+			return fmt.Errorf("kick missing")
+		} else if err := m.Kick.CheckValid(); err != nil {
+			return err
+		}
+	case "move":
+		if m.Move == nil {
+			return fmt.Errorf("move missing")
+		} else if err := m.Move.CheckValid(); err != nil {
+			return err
+		}
+	case "presence":
+		if m.Presence == nil {
+			return fmt.Errorf("presence missing")
+		} else if err := m.Presence.CheckValid(); err != nil {
+			return err
+		}
+	case "echo":
+		// Don't reflect the payload to regular clients, so echo requests can't
+		// be used to amplify traffic.
+		if !m.fromInternal {
+			return fmt.Errorf("echo requests can only be sent by internal clients")
+		}
+		// The payload is optional.
+		if m.Echo != nil {
+			if err := m.Echo.CheckValid(); err != nil {
+				return err
+			}
+		}
+	case "participants":
+		if m.Participants == nil {
+			return fmt.Errorf("participants missing")
+		} else if err := m.Participants.CheckValid(); err != nil {
+			return err
+		}
+	default:
+		customType := getCustomMessageType(m.Type)
+		if customType == nil {
+			return fmt.Errorf("unsupported type %s", m.Type)
+		} else if err := customType.validator(m.customPayload); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// clientMessageTypes contains the client message types that are handled by
+// the server itself and must be kept in sync with "CheckValid". These types
+// can't be registered as custom message types and are used as labels of the
+// message metrics.
+var clientMessageTypes = []string{
+	"hello",
+	"bye",
+	"room",
+	"message",
+	"control",
+	"internal",
+	"transient",
+	"capabilities",
+	"kick",
+	"move",
+	"presence",
+	"echo",
+	"participants",
+}
+
+// getClientMessageTypes returns the client message types that are handled by
+// the server itself.
+func getClientMessageTypes() map[string]bool {
+	result := make(map[string]bool, len(clientMessageTypes))
+	for _, messageType := range clientMessageTypes {
+		result[messageType] = true
+	}
+	return result
+}
+
 func (m *ClientMessage) String() string {
 	data, err := json.Marshal(m)
 	if err != nil {
@@ -124,7 +263,18 @@ func (m *ClientMessage) NewWrappedErrorServerMessage(e error) *ServerMessage {
 		return m.NewErrorServerMessage(e)
 	}
 
-	return m.NewErrorServerMessage(NewError("internal_error", e.Error()))
+	return m.NewErrorServerMessage(NewError(ErrorCodeInternalError, e.Error()))
+}
+
+// NewRoomErrorServerMessage returns an error that is not a response to a
+// request but sent to all sessions of a room.
+func NewRoomErrorServerMessage(code string, message string) *ServerMessage {
+	e := NewError(code, message)
+	e.Target = ErrorTargetRoom
+	return &ServerMessage{
+		Type:  "error",
+		Error: e,
+	}
 }
 
 // ServerMessage is a message that is sent from the server to a client.
@@ -148,9 +298,45 @@ type ServerMessage struct {
 	Event *EventServerMessage `json:"event,omitempty"`
 
 	TransientData *TransientDataServerMessage `json:"transient,omitempty"`
+
+	Receipt *ReceiptServerMessage `json:"receipt,omitempty"`
+
+	Capabilities *CapabilitiesServerMessage `json:"capabilities,omitempty"`
+
+	Renegotiate *RenegotiateServerMessage `json:"renegotiate,omitempty"`
+
+	Presence *PresenceServerMessage `json:"presence,omitempty"`
+
+	Echo *EchoServerMessage `json:"echo,omitempty"`
+
+	Validate *ValidateServerMessage `json:"validate,omitempty"`
+
+	Notify *NotifyServerMessage `json:"notify,omitempty"`
+
+	Move *MoveServerMessage `json:"move,omitempty"`
+
+	Internal *InternalServerMessage `json:"internal,omitempty"`
+}
+
+// MessageRoom is the minimal view of a room the protocol messages depend on.
+type MessageRoom interface {
+	// Id returns the id of the room as used by the clients and backends.
+	Id() string
+}
+
+// MessageSession is the minimal view of a session the protocol messages
+// depend on, so they can be checked without a running hub. All "Session"
+// implementations fulfill it.
+type MessageSession interface {
+	// CurrentRoom returns the room the session is currently in. It must
+	// return an untyped nil if the session is not in a room.
+	CurrentRoom() MessageRoom
 }
 
-func (r *ServerMessage) CloseAfterSend(session Session) bool {
+// CloseAfterSend returns true if the connection of the session (which may be
+// nil if no session has been created yet) must be closed after the message
+// has been sent.
+func (r *ServerMessage) CloseAfterSend(session MessageSession) bool {
 	if r.Type == "bye" {
 		return true
 	}
@@ -160,7 +346,7 @@ func (r *ServerMessage) CloseAfterSend(session Session) bool {
 			// Only close session / connection if the disinvite was for the room
 			// the session is currently in.
 			if session != nil && evt.Disinvite != nil {
-				if room := session.GetRoom(); room != nil && evt.Disinvite.RoomId == room.Id() {
+				if room := session.CurrentRoom(); room != nil && evt.Disinvite.RoomId == room.Id() {
 					return true
 				}
 			}
@@ -170,23 +356,44 @@ func (r *ServerMessage) CloseAfterSend(session Session) bool {
 	return false
 }
 
-func (r *ServerMessage) IsChatRefresh() bool {
-	if r.Type != "message" || r.Message == nil || r.Message.Data == nil || len(*r.Message.Data) == 0 {
-		return false
+func (r *ServerMessage) getMessageData() *MessageServerMessageData {
+	if r.Type != "message" || r.Message == nil {
+		return nil
 	}
 
-	var data MessageServerMessageData
-	if err := json.Unmarshal(*r.Message.Data, &data); err != nil {
-		return false
-	}
+	return r.Message.ParsedData()
+}
+
+func (r *ServerMessage) isMessageDataType(dataType string) bool {
+	data := r.getMessageData()
+	return data != nil && data.Type == dataType
+}
 
-	if data.Type != "chat" || data.Chat == nil {
+func (r *ServerMessage) IsChatRefresh() bool {
+	data := r.getMessageData()
+	if data == nil || data.Type != "chat" || data.Chat == nil {
 		return false
 	}
 
 	return data.Chat.Refresh
 }
 
+func (r *ServerMessage) IsOffer() bool {
+	return r.isMessageDataType("offer")
+}
+
+func (r *ServerMessage) IsAnswer() bool {
+	return r.isMessageDataType("answer")
+}
+
+func (r *ServerMessage) IsCandidate() bool {
+	return r.isMessageDataType("candidate")
+}
+
+func (r *ServerMessage) IsUnshareScreen() bool {
+	return r.isMessageDataType("unshareScreen")
+}
+
 func (r *ServerMessage) IsParticipantsUpdate() bool {
 	if r.Type != "event" || r.Event == nil {
 		return false
@@ -197,6 +404,10 @@ func (r *ServerMessage) IsParticipantsUpdate() bool {
 	return true
 }
 
+func (r *ServerMessage) IsPresence() bool {
+	return r.Type == "presence"
+}
+
 func (r *ServerMessage) String() string {
 	data, err := json.Marshal(r)
 	if err != nil {
@@ -205,17 +416,33 @@ func (r *ServerMessage) String() string {
 	return string(data)
 }
 
+const (
+	// ErrorTargetRoom is used for errors that were sent to all sessions of
+	// a room.
+	ErrorTargetRoom = "room"
+)
+
 type Error struct {
 	Code    string      `json:"code"`
 	Message string      `json:"message"`
 	Details interface{} `json:"details,omitempty"`
+	// Target is set if the error was not sent as response to a request.
+	Target string `json:"target,omitempty"`
+	// Retryable is set if the request failed because of a temporary condition
+	// and may be sent again later.
+	Retryable bool `json:"retryable,omitempty"`
 }
 
+// NewError returns an error with the given code. The default message of the
+// code is used if no message is given.
 func NewError(code string, message string) *Error {
 	return NewErrorDetail(code, message, nil)
 }
 
 func NewErrorDetail(code string, message string, details interface{}) *Error {
+	if message == "" {
+		message = DefaultErrorMessage(code)
+	}
 	return &Error{
 		Code:    code,
 		Message: message,
@@ -223,10 +450,116 @@ func NewErrorDetail(code string, message string, details interface{}) *Error {
 	}
 }
 
+const (
+	// ResumeFailedReasonExpired is used if the session existed but has
+	// expired or was closed.
+	ResumeFailedReasonExpired = "expired"
+	// ResumeFailedReasonUnknown is used if the resume id is not known to the
+	// server.
+	ResumeFailedReasonUnknown = "unknown"
+)
+
+// ResumeFailedErrorDetails are sent as details of "resume_failed" errors.
+type ResumeFailedErrorDetails struct {
+	Reason string `json:"reason"`
+}
+
+// NewResumeFailedError returns a "resume_failed" error with the given reason.
+func NewResumeFailedError(message string, reason string) *Error {
+	return NewErrorDetail(ErrorCodeResumeFailed, message, &ResumeFailedErrorDetails{
+		Reason: reason,
+	})
+}
+
+// MissingRequiredFeatureErrorDetails are sent as details of
+// "missing_required_feature" errors.
+type MissingRequiredFeatureErrorDetails struct {
+	Features []string `json:"features"`
+}
+
+// NewMissingRequiredFeatureError returns a "missing_required_feature" error
+// with the given feature ids that are missing.
+func NewMissingRequiredFeatureError(features []string) *Error {
+	return NewErrorDetail(ErrorCodeMissingRequiredFeature, "", &MissingRequiredFeatureErrorDetails{
+		Features: features,
+	})
+}
+
+// RateLimitedErrorDetails are sent as details of "rate_limited" errors.
+type RateLimitedErrorDetails struct {
+	// RetryAfter is the number of seconds after which the request may be sent
+	// again.
+	RetryAfter int `json:"retryafter"`
+}
+
+// NewRateLimitedError returns a retryable "rate_limited" error. The duration
+// is rounded up to full seconds.
+func NewRateLimitedError(retryAfter time.Duration) *Error {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	result := NewErrorDetail(ErrorCodeRateLimited, "", &RateLimitedErrorDetails{
+		RetryAfter: seconds,
+	})
+	result.Retryable = true
+	return result
+}
+
+// TooManySessionsErrorDetails are sent as details of "too_many_sessions"
+// errors.
+type TooManySessionsErrorDetails struct {
+	// Limit is the maximum number of sessions that would have been exceeded.
+	Limit int `json:"limit"`
+}
+
+// NewTooManySessionsError returns a "too_many_sessions" error for the given
+// limit. The default message of the code is used if no message is given.
+func NewTooManySessionsError(message string, limit int) *Error {
+	return NewErrorDetail(ErrorCodeTooManySessions, message, &TooManySessionsErrorDetails{
+		Limit: limit,
+	})
+}
+
+// DecodeDetails decodes the details of the error into the given value, e.g.
+// one of the "...ErrorDetails" structs for the code of the error.
+func (e *Error) DecodeDetails(details interface{}) error {
+	if e.Details == nil {
+		return fmt.Errorf("no details")
+	}
+
+	data, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, details)
+}
+
+// NewRetryableError returns an error with the given code that is marked as
+// retryable for the client.
+func NewRetryableError(code string, message string) *Error {
+	result := NewError(code, message)
+	result.Retryable = true
+	return result
+}
+
 func (e *Error) Error() string {
 	return e.Message
 }
 
+// Is checks if the target is a signaling error with the same code, so errors
+// can be compared with "errors.Is".
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	} else if e == nil || t == nil {
+		return e == t
+	}
+
+	return e.Code == t.Code
+}
+
 const (
 	HelloClientTypeClient   = "client"
 	HelloClientTypeInternal = "internal"
@@ -245,6 +578,46 @@ func hasStandardPort(u *url.URL) bool {
 	}
 }
 
+// trimHostTrailingDot removes the trailing dot of a fully qualified hostname,
+// an optional port is preserved.
+func trimHostTrailingDot(host string) string {
+	hostname := host
+	if idx := strings.LastIndexByte(host, ':'); idx != -1 {
+		hostname = host[:idx]
+	}
+	if len(hostname) <= 1 || hostname[len(hostname)-1] != '.' {
+		return host
+	}
+
+	return hostname[:len(hostname)-1] + host[len(hostname):]
+}
+
+// normalizeUrlHost lowercases the host of the given url, removes a trailing dot
+// from the hostname and removes the port if it is the default port of the
+// scheme (or empty), so urls with an implicit and an explicit default port or
+// with different case are treated the same.
+// Returns true if the host was changed.
+func normalizeUrlHost(u *url.URL) bool {
+	host := trimHostTrailingDot(strings.ToLower(u.Host))
+	changed := host != u.Host
+	u.Host = host
+	if port := u.Port(); port != "" {
+		if !hasStandardPort(u) {
+			return changed
+		}
+	} else if !strings.HasSuffix(u.Host, ":") {
+		return changed
+	}
+
+	hostname := u.Hostname()
+	if strings.Contains(hostname, ":") {
+		// IPv6 address literal.
+		hostname = "[" + hostname + "]"
+	}
+	u.Host = hostname
+	return true
+}
+
 type ClientTypeInternalAuthParams struct {
 	Random string `json:"random"`
 	Token  string `json:"token"`
@@ -254,14 +627,19 @@ type ClientTypeInternalAuthParams struct {
 }
 
 func (p *ClientTypeInternalAuthParams) CheckValid() error {
+	if err := validateString("random", p.Random); err != nil {
+		return err
+	} else if err := validateString("token", p.Token); err != nil {
+		return err
+	} else if err := validateString("backend", p.Backend); err != nil {
+		return err
+	}
 	if p.Backend == "" {
 		return fmt.Errorf("backend missing")
 	} else if u, err := url.Parse(p.Backend); err != nil {
 		return err
 	} else {
-		if strings.Contains(u.Host, ":") && hasStandardPort(u) {
-			u.Host = u.Hostname()
-		}
+		normalizeUrlHost(u)
 
 		p.parsedBackend = u
 	}
@@ -283,6 +661,59 @@ type HelloClientMessageAuth struct {
 
 // Type "hello"
 
+const (
+	maxHelloClientInfoNameLength    = 64
+	maxHelloClientInfoVersionLength = 64
+
+	maxHelloFeatures      = 64
+	maxHelloFeatureLength = 64
+)
+
+// HelloClientInfo contains optional information about the client
+// implementation that is connecting.
+type HelloClientInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func isValidHelloClientInfoValue(s string) bool {
+	for _, ch := range s {
+		switch {
+		case ch >= 'a' && ch <= 'z':
+		case ch >= 'A' && ch <= 'Z':
+		case ch >= '0' && ch <= '9':
+		case strings.ContainsRune(" .-_+/()", ch):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (i *HelloClientInfo) CheckValid() error {
+	if i.Name == "" {
+		return fmt.Errorf("client name missing")
+	} else if len(i.Name) > maxHelloClientInfoNameLength {
+		return fmt.Errorf("client name too long")
+	} else if !isValidHelloClientInfoValue(i.Name) {
+		return fmt.Errorf("invalid client name")
+	}
+	if len(i.Version) > maxHelloClientInfoVersionLength {
+		return fmt.Errorf("client version too long")
+	} else if !isValidHelloClientInfoValue(i.Version) {
+		return fmt.Errorf("invalid client version")
+	}
+	return nil
+}
+
+func (i *HelloClientInfo) String() string {
+	if i.Version == "" {
+		return i.Name
+	}
+
+	return i.Name + "/" + i.Version
+}
+
 type HelloClientMessage struct {
 	Version string `json:"version"`
 
@@ -290,13 +721,60 @@ type HelloClientMessage struct {
 
 	Features []string `json:"features,omitempty"`
 
+	// Optional level of room events the client is interested in, defaults
+	// to receiving all events.
+	Subscription string `json:"subscription,omitempty"`
+
+	// Optional information about the client implementation.
+	Client *HelloClientInfo `json:"client,omitempty"`
+
+	// Observers receive room events but may not send messages or publish
+	// media and are not visible to other sessions.
+	Observer bool `json:"observer,omitempty"`
+
 	// The authentication credentials.
 	Auth HelloClientMessageAuth `json:"auth"`
 }
 
 func (m *HelloClientMessage) CheckValid() error {
 	if m.Version != HelloVersion {
-		return fmt.Errorf("unsupported hello version: %s", m.Version)
+		return fmt.Errorf("unsupported hello version: %q", m.Version)
+	}
+	if err := validateString("resumeid", m.ResumeId); err != nil {
+		return err
+	} else if err := validateString("auth type", m.Auth.Type); err != nil {
+		return err
+	} else if err := validateString("auth url", m.Auth.Url); err != nil {
+		return err
+	}
+	if m.Client != nil {
+		if err := m.Client.CheckValid(); err != nil {
+			return err
+		}
+	}
+	if len(m.Features) > maxHelloFeatures {
+		return fmt.Errorf("too many features (max %d)", maxHelloFeatures)
+	} else if len(m.Features) > 0 {
+		features := make([]string, 0, len(m.Features))
+		seen := make(map[string]bool, len(m.Features))
+		for _, feature := range m.Features {
+			if feature == "" {
+				return fmt.Errorf("empty feature")
+			} else if len(feature) > maxHelloFeatureLength {
+				return fmt.Errorf("feature too long (max %d characters)", maxHelloFeatureLength)
+			} else if err := validateString("feature", feature); err != nil {
+				return err
+			}
+
+			if !seen[feature] {
+				seen[feature] = true
+				features = append(features, feature)
+			}
+		}
+		m.Features = features
+	}
+	if m.Subscription != "" && !IsValidSubscriptionLevel(m.Subscription) {
+		return fmt.Errorf("unsupported subscription level: %s", m.Subscription)
 	}
 	if m.ResumeId == "" {
 		if m.Auth.Params == nil || len(*m.Auth.Params) == 0 {
@@ -312,13 +790,14 @@ func (m *HelloClientMessage) CheckValid() error {
 			} else if u, err := url.ParseRequestURI(m.Auth.Url); err != nil {
 				return err
 			} else {
-				if strings.Contains(u.Host, ":") && hasStandardPort(u) {
-					u.Host = u.Hostname()
-				}
+				normalizeUrlHost(u)
 
 				m.Auth.parsedUrl = u
 			}
 		case HelloClientTypeInternal:
+			if m.Observer {
+				return fmt.Errorf("observer is only supported for client sessions")
+			}
 			if err := json.Unmarshal(*m.Auth.Params, &m.Auth.internalParams); err != nil {
 				return err
 			} else if err := m.Auth.internalParams.CheckValid(); err != nil {
@@ -338,22 +817,82 @@ const (
 	ServerFeatureUpdateSdp             = "update-sdp"
 	ServerFeatureAudioVideoPermissions = "audio-video-permissions"
 	ServerFeatureTransientData         = "transient-data"
+	ServerFeatureCapabilities          = "capabilities"
+	ServerFeatureSubscriptions         = "subscriptions"
+	ServerFeaturePresence              = "presence"
+	ServerFeatureObservers             = "observers"
+	ServerFeatureDryRun                = "dry-run"
+	ServerFeatureRoomPropertiesPatch   = "room-properties-patch"
+	ServerFeatureChangePrevious        = "change-previous"
+	ServerFeatureLeaveReasons          = "leave-reasons"
+	ServerFeatureCandidates            = "candidates"
+	ServerFeatureParticipantsSnapshot  = "participants-snapshot"
+	ServerFeatureMoveSessions          = "move-sessions"
 
 	// Features for internal clients only.
 	ServerFeatureInternalVirtualSessions = "virtual-sessions"
+	ServerFeatureInternalEcho            = "echo"
 )
 
 var (
+	// NegotiatedFeatures are only enabled for a session if the client also
+	// included them in the "features" of its "hello" request.
+	NegotiatedFeatures = []string{
+		ServerFeatureRoomPropertiesPatch,
+		ServerFeatureChangePrevious,
+		ServerFeatureLeaveReasons,
+		ServerFeatureCandidates,
+	}
+
 	DefaultFeatures = []string{
 		ServerFeatureAudioVideoPermissions,
 		ServerFeatureTransientData,
+		ServerFeatureCapabilities,
+		ServerFeatureSubscriptions,
+		ServerFeaturePresence,
+		ServerFeatureObservers,
+		ServerFeatureDryRun,
+		ServerFeatureRoomPropertiesPatch,
+		ServerFeatureChangePrevious,
+		ServerFeatureLeaveReasons,
+		ServerFeatureParticipantsSnapshot,
+		ServerFeatureMoveSessions,
 	}
 	DefaultFeaturesInternal = []string{
 		ServerFeatureInternalVirtualSessions,
+		ServerFeatureInternalEcho,
 		ServerFeatureTransientData,
+		ServerFeatureCapabilities,
+		ServerFeatureSubscriptions,
+		ServerFeaturePresence,
+		ServerFeatureDryRun,
+		ServerFeatureRoomPropertiesPatch,
+		ServerFeatureChangePrevious,
+		ServerFeatureLeaveReasons,
+		ServerFeatureParticipantsSnapshot,
+		ServerFeatureMoveSessions,
 	}
 )
 
+const (
+	// Receive all room events (default).
+	SubscriptionLevelAll = "all"
+	// Only receive the number of joined / left sessions instead of the
+	// per-participant room events.
+	SubscriptionLevelCounts = "counts"
+)
+
+func IsValidSubscriptionLevel(level string) bool {
+	switch level {
+	case SubscriptionLevelAll:
+		fallthrough
+	case SubscriptionLevelCounts:
+		return true
+	default:
+		return false
+	}
+}
+
 type HelloServerMessageServer struct {
 	Version  string   `json:"version"`
 	Features []string `json:"features,omitempty"`
@@ -367,6 +906,21 @@ type HelloServerMessage struct {
 	ResumeId  string                    `json:"resumeid"`
 	UserId    string                    `json:"userid"`
 	Server    *HelloServerMessageServer `json:"server,omitempty"`
+
+	// Number of messages that were dropped while the session was
+	// disconnected, only set when resuming a session.
+	DroppedMessages int `json:"droppedmessages,omitempty"`
+
+	// Maximum number of messages per second the session may send, omitted
+	// if unlimited.
+	MaxMessageRate int `json:"maxmessagerate,omitempty"`
+
+	// Features that are enabled for this session specifically.
+	Features []string `json:"features,omitempty"`
+
+	// Current time of the server as Unix timestamp in milliseconds, can be
+	// used by clients to detect a skewed local clock.
+	ServerTime int64 `json:"servertime,omitempty"`
 }
 
 // Type "bye"
@@ -379,8 +933,21 @@ func (m *ByeClientMessage) CheckValid() error {
 	return nil
 }
 
+const (
+	ByeCodeKicked                 = "kicked"
+	ByeCodeRoomSessionReconnected = "room_session_reconnected"
+	ByeCodeSessionResumed         = "session_resumed"
+	ByeCodeRoomJoinTimeout        = "room_join_timeout"
+	ByeCodeHelloTimeout           = "hello_timeout"
+	ByeCodeShutdown               = "shutdown"
+	ByeCodeBackendChanged         = "backend_changed"
+)
+
 type ByeServerMessage struct {
 	Reason string `json:"reason"`
+
+	// Optional message for the user, e.g. provided by a moderator.
+	Message string `json:"message,omitempty"`
 }
 
 // Type "room"
@@ -390,14 +957,32 @@ type RoomClientMessage struct {
 	SessionId string `json:"sessionid,omitempty"`
 }
 
+const (
+	// Maximum length of the room session id passed when joining a room.
+	maxRoomSessionIdLength = 512
+)
+
 func (m *RoomClientMessage) CheckValid() error {
-	// No additional validation required.
+	if len(m.SessionId) > maxRoomSessionIdLength {
+		return fmt.Errorf("sessionid too long")
+	} else if err := validateString("roomid", m.RoomId); err != nil {
+		return err
+	} else if err := validateString("sessionid", m.SessionId); err != nil {
+		return err
+	}
+	// Ownership of the session id is checked by the hub.
 	return nil
 }
 
 type RoomServerMessage struct {
 	RoomId     string           `json:"roomid"`
 	Properties *json.RawMessage `json:"properties,omitempty"`
+	// PropertiesPatch contains only the properties that were changed, it is
+	// sent instead of the full properties to clients supporting the feature
+	// "room-properties-patch".
+	PropertiesPatch *json.RawMessage `json:"propertiespatch,omitempty"`
+	// PropertiesVersion is increased with every change of the properties.
+	PropertiesVersion uint64 `json:"propertiesversion,omitempty"`
 }
 
 // Type "message"
@@ -413,12 +998,35 @@ type MessageClientMessageRecipient struct {
 
 	SessionId string `json:"sessionid,omitempty"`
 	UserId    string `json:"userid,omitempty"`
+
+	// ExcludeSelf can be set for room recipients to make explicit that the
+	// message must not be sent back to the sending session.
+	ExcludeSelf bool `json:"excludeself,omitempty"`
+}
+
+func (r *MessageClientMessageRecipient) checkStrings() error {
+	if err := validateString("recipient type", r.Type); err != nil {
+		return err
+	} else if err := validateString("recipient sessionid", r.SessionId); err != nil {
+		return err
+	} else if err := validateString("recipient userid", r.UserId); err != nil {
+		return err
+	}
+	return nil
 }
 
 type MessageClientMessage struct {
 	Recipient MessageClientMessageRecipient `json:"recipient"`
 
+	// RequestReceipt can be set by internal clients to get a "receipt"
+	// response with the delivery status of the message.
+	RequestReceipt bool `json:"requestreceipt,omitempty"`
+
 	Data *json.RawMessage `json:"data"`
+
+	// fromInternal is set by the hub if the message was received from an
+	// internal client.
+	fromInternal bool
 }
 
 type MessageClientMessageData struct {
@@ -429,10 +1037,94 @@ type MessageClientMessageData struct {
 	Payload  map[string]interface{} `json:"payload"`
 }
 
+const (
+	maxMcuSidLength = 64
+
+	// Maximum number of ICE candidates in a "candidates" message.
+	maxCandidatesPerMessage = 64
+)
+
+// CheckValid checks the stream id if the data is for an operation of the MCU,
+// other messages are not required to contain it.
+func (m *MessageClientMessageData) CheckValid() error {
+	if err := validateString("type", m.Type); err != nil {
+		return err
+	} else if err := validateString("roomType", m.RoomType); err != nil {
+		return err
+	}
+
+	switch m.Type {
+	case "offer", "answer", "candidate", "candidates", "endOfCandidates", "selectStream", "requestoffer", "sendoffer":
+		// Operations of the MCU must identify the stream.
+	default:
+		return nil
+	}
+
+	if m.Type == "candidates" {
+		if _, err := m.getCandidates(); err != nil {
+			return err
+		}
+	}
+
+	if m.Sid == "" {
+		return fmt.Errorf("sid missing")
+	} else if len(m.Sid) > maxMcuSidLength {
+		return fmt.Errorf("sid too long")
+	}
+	for _, c := range m.Sid {
+		if !isValidSidCharacter(c) {
+			return fmt.Errorf("sid contains invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+func (m *MessageClientMessageData) getCandidates() ([]interface{}, error) {
+	candidates, ok := m.Payload["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return nil, fmt.Errorf("candidates missing")
+	} else if len(candidates) > maxCandidatesPerMessage {
+		return nil, fmt.Errorf("too many candidates")
+	}
+	return candidates, nil
+}
+
+// SplitCandidates returns a "candidate" message for each of the ICE candidates
+// in a "candidates" message.
+func (m *MessageClientMessageData) SplitCandidates() ([]*MessageClientMessageData, error) {
+	candidates, err := m.getCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*MessageClientMessageData, 0, len(candidates))
+	for _, candidate := range candidates {
+		result = append(result, &MessageClientMessageData{
+			Type:     "candidate",
+			Sid:      m.Sid,
+			RoomType: m.RoomType,
+			Payload: map[string]interface{}{
+				"candidate": candidate,
+			},
+		})
+	}
+	return result, nil
+}
+
+func isValidSidCharacter(c rune) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.'
+}
+
 func (m *MessageClientMessage) CheckValid() error {
 	if m.Data == nil || len(*m.Data) == 0 {
 		return fmt.Errorf("message empty")
 	}
+	if err := m.Recipient.checkStrings(); err != nil {
+		return err
+	}
 	switch m.Recipient.Type {
 	case RecipientTypeRoom:
 		// No additional checks required.
@@ -447,8 +1139,18 @@ func (m *MessageClientMessage) CheckValid() error {
 	default:
 		return fmt.Errorf("unsupported recipient type %v", m.Recipient.Type)
 	}
-	return nil
-}
+	if m.RequestReceipt {
+		if !m.fromInternal {
+			return fmt.Errorf("receipts can only be requested by internal clients")
+		} else if m.Recipient.Type != RecipientTypeSession {
+			return fmt.Errorf("receipts are only supported for session recipients")
+		}
+	}
+	if m.Recipient.ExcludeSelf && m.Recipient.Type != RecipientTypeRoom {
+		return fmt.Errorf("excludeself is only supported for room recipients")
+	}
+	return nil
+}
 
 type MessageServerMessageSender struct {
 	Type string `json:"type"`
@@ -465,6 +1167,12 @@ type MessageServerMessageData struct {
 	Type string `json:"type"`
 
 	Chat *MessageServerMessageDataChat `json:"chat,omitempty"`
+
+	// Used by WebRTC signaling messages, e.g. "offer" or "candidate".
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Sid      string `json:"sid,omitempty"`
+	RoomType string `json:"roomType,omitempty"`
 }
 
 type MessageServerMessage struct {
@@ -472,18 +1180,87 @@ type MessageServerMessage struct {
 	Recipient *MessageClientMessageRecipient `json:"recipient,omitempty"`
 
 	Data *json.RawMessage `json:"data"`
+
+	parsedData atomic.Value
+}
+
+// ParsedData returns the data of the message in parsed form or nil if it could
+// not be parsed. The result is cached, so the data must not be modified after
+// this has been called.
+func (m *MessageServerMessage) ParsedData() *MessageServerMessageData {
+	if m.Data == nil || len(*m.Data) == 0 {
+		return nil
+	}
+
+	if data, ok := m.parsedData.Load().(*MessageServerMessageData); ok {
+		return data
+	}
+
+	var data MessageServerMessageData
+	if err := json.Unmarshal(*m.Data, &data); err != nil {
+		// Remember invalid data so it doesn't get parsed again.
+		m.parsedData.Store((*MessageServerMessageData)(nil))
+		return nil
+	}
+
+	m.parsedData.Store(&data)
+	return &data
+}
+
+// Type "receipt"
+
+const (
+	// The message was sent to a session connected to this server.
+	ReceiptStatusDelivered = "delivered"
+	// The message was forwarded to a session that is not connected to this
+	// server.
+	ReceiptStatusForwarded = "forwarded"
+	// The recipient session does not exist.
+	ReceiptStatusNotFound = "not-found"
+	// The message was processed by the MCU.
+	ReceiptStatusProcessed = "processed"
+)
+
+type ReceiptServerMessage struct {
+	Recipient *MessageClientMessageRecipient `json:"recipient"`
+
+	Status string `json:"status"`
 }
 
 // Type "control"
 
+var (
+	// ControlAllowedRoles contains the session roles that may send control
+	// messages.
+	ControlAllowedRoles = []SessionRole{
+		SessionRoleModerator,
+	}
+)
+
 type ControlClientMessage struct {
 	MessageClientMessage
 }
 
 func (m *ControlClientMessage) CheckValid() error {
+	if m.Recipient.Type == "" {
+		return fmt.Errorf("recipient missing")
+	} else if m.RequestReceipt {
+		return fmt.Errorf("receipts are not supported for control messages")
+	}
 	return m.MessageClientMessage.CheckValid()
 }
 
+// IsAllowedFrom checks if a session with the given role may send control
+// messages.
+func (m *ControlClientMessage) IsAllowedFrom(role SessionRole) bool {
+	for _, r := range ControlAllowedRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 type ControlServerMessage struct {
 	Sender    *MessageServerMessageSender    `json:"sender"`
 	Recipient *MessageClientMessageRecipient `json:"recipient,omitempty"`
@@ -502,9 +1279,13 @@ type CommonSessionInternalClientMessage struct {
 func (m *CommonSessionInternalClientMessage) CheckValid() error {
 	if m.SessionId == "" {
 		return fmt.Errorf("sessionid missing")
+	} else if err := validateString("sessionid", m.SessionId); err != nil {
+		return err
 	}
 	if m.RoomId == "" {
 		return fmt.Errorf("roomid missing")
+	} else if err := validateString("roomid", m.RoomId); err != nil {
+		return err
 	}
 	return nil
 }
@@ -525,13 +1306,24 @@ type AddSessionInternalClientMessage struct {
 }
 
 func (m *AddSessionInternalClientMessage) CheckValid() error {
+	if err := validateString("userid", m.UserId); err != nil {
+		return err
+	}
+	if m.Options != nil {
+		if err := validateString("actorId", m.Options.ActorId); err != nil {
+			return err
+		} else if err := validateString("actorType", m.Options.ActorType); err != nil {
+			return err
+		}
+	}
 	return m.CommonSessionInternalClientMessage.CheckValid()
 }
 
 type UpdateSessionInternalClientMessage struct {
 	CommonSessionInternalClientMessage
 
-	Flags *uint32 `json:"flags,omitempty"`
+	User  *json.RawMessage `json:"user,omitempty"`
+	Flags *uint32          `json:"flags,omitempty"`
 }
 
 func (m *UpdateSessionInternalClientMessage) CheckValid() error {
@@ -545,9 +1337,76 @@ type RemoveSessionInternalClientMessage struct {
 }
 
 func (m *RemoveSessionInternalClientMessage) CheckValid() error {
+	if err := validateString("userid", m.UserId); err != nil {
+		return err
+	}
 	return m.CommonSessionInternalClientMessage.CheckValid()
 }
 
+const (
+	// MaxBroadcastDataSize is the maximum size in bytes of the data of a
+	// broadcast request.
+	MaxBroadcastDataSize = 4096
+
+	// MaxBroadcastSessions is the maximum number of sessions a broadcast
+	// request may be sent to.
+	MaxBroadcastSessions = 10000
+)
+
+// BroadcastInternalClientMessage sends data to all client sessions that match
+// the given filter. At least one of "backend" and "roomid" must be set.
+type BroadcastInternalClientMessage struct {
+	// Backend is the id or url of the backend the sessions are connected to.
+	Backend string `json:"backend,omitempty"`
+	// RoomId is a glob pattern of the rooms the sessions have joined.
+	RoomId string `json:"roomid,omitempty"`
+
+	Data *json.RawMessage `json:"data"`
+}
+
+func (m *BroadcastInternalClientMessage) CheckValid() error {
+	if err := validateString("backend", m.Backend); err != nil {
+		return err
+	} else if err := validateString("roomid", m.RoomId); err != nil {
+		return err
+	}
+
+	if m.Backend == "" && m.RoomId == "" {
+		return fmt.Errorf("filter missing")
+	}
+	if m.RoomId != "" {
+		if _, err := path.Match(m.RoomId, ""); err != nil {
+			return fmt.Errorf("invalid roomid pattern %q", m.RoomId)
+		}
+	}
+
+	if m.Data == nil || len(*m.Data) == 0 {
+		return fmt.Errorf("data missing")
+	} else if len(*m.Data) > MaxBroadcastDataSize {
+		return fmt.Errorf("data exceeds %d bytes", MaxBroadcastDataSize)
+	}
+	return nil
+}
+
+// MatchesRoom returns true if a session in the given room matches the room
+// filter of the broadcast.
+func (m *BroadcastInternalClientMessage) MatchesRoom(roomId string) bool {
+	if m.RoomId == "" {
+		return true
+	} else if roomId == "" {
+		return false
+	}
+
+	matches, _ := path.Match(m.RoomId, roomId)
+	return matches
+}
+
+// InternalServerMessage is sent to internal clients to acknowledge internal
+// requests that have no other response.
+type InternalServerMessage struct {
+	Type string `json:"type"`
+}
+
 type InternalClientMessage struct {
 	Type string `json:"type"`
 
@@ -556,9 +1415,15 @@ type InternalClientMessage struct {
 	UpdateSession *UpdateSessionInternalClientMessage `json:"updatesession,omitempty"`
 
 	RemoveSession *RemoveSessionInternalClientMessage `json:"removesession,omitempty"`
+
+	Broadcast *BroadcastInternalClientMessage `json:"broadcast,omitempty"`
 }
 
 func (m *InternalClientMessage) CheckValid() error {
+	if err := validateString("type", m.Type); err != nil {
+		return err
+	}
+
 	switch m.Type {
 	case "addsession":
 		if m.AddSession == nil {
@@ -578,6 +1443,12 @@ func (m *InternalClientMessage) CheckValid() error {
 		} else if err := m.RemoveSession.CheckValid(); err != nil {
 			return err
 		}
+	case "broadcast":
+		if m.Broadcast == nil {
+			return fmt.Errorf("broadcast missing")
+		} else if err := m.Broadcast.CheckValid(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -587,10 +1458,77 @@ func (m *InternalClientMessage) CheckValid() error {
 type RoomEventServerMessage struct {
 	RoomId     string           `json:"roomid"`
 	Properties *json.RawMessage `json:"properties,omitempty"`
-	// TODO(jojo): Change "InCall" to "int" when #914 has landed in NC Talk.
-	InCall  *json.RawMessage         `json:"incall,omitempty"`
-	Changed []map[string]interface{} `json:"changed,omitempty"`
-	Users   []map[string]interface{} `json:"users,omitempty"`
+	// InCall contains the raw value as sent by the backend, either a boolean
+	// (older versions of Nextcloud Talk) or the in-call flags. It is kept for
+	// compatibility, new clients should use "InCallState".
+	InCall      *json.RawMessage         `json:"incall,omitempty"`
+	InCallState *bool                    `json:"incallstate,omitempty"`
+	Changed     []map[string]interface{} `json:"changed,omitempty"`
+	Users       []map[string]interface{} `json:"users,omitempty"`
+
+	// Federation is set for invites to rooms that are hosted on a remote
+	// signaling server.
+	Federation *RoomFederationServerMessage `json:"federation,omitempty"`
+}
+
+// RoomFederationServerMessage contains the information required to join a
+// room on a remote signaling server.
+type RoomFederationServerMessage struct {
+	// SignalingUrl is the url of the remote signaling server.
+	SignalingUrl string `json:"signaling"`
+	// Url is the url of the remote backend to send in the "hello" request.
+	Url string `json:"url"`
+	// Token authenticates the federated user on the remote backend.
+	Token string `json:"token"`
+}
+
+func (m *RoomFederationServerMessage) CheckValid() error {
+	if err := validateString("signaling url", m.SignalingUrl); err != nil {
+		return err
+	} else if err := validateString("url", m.Url); err != nil {
+		return err
+	} else if err := validateString("token", m.Token); err != nil {
+		return err
+	}
+
+	if m.SignalingUrl == "" {
+		return fmt.Errorf("signaling url missing")
+	} else if u, err := url.ParseRequestURI(m.SignalingUrl); err != nil {
+		return fmt.Errorf("invalid signaling url: %w", err)
+	} else if u.Scheme != "ws" && u.Scheme != "wss" && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported signaling url scheme %s", u.Scheme)
+	} else if u.Host == "" {
+		return fmt.Errorf("signaling url host missing")
+	}
+
+	if m.Url == "" {
+		return fmt.Errorf("url missing")
+	} else if u, err := url.ParseRequestURI(m.Url); err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme %s", u.Scheme)
+	} else if u.Host == "" {
+		return fmt.Errorf("url host missing")
+	}
+
+	if m.Token == "" {
+		return fmt.Errorf("token missing")
+	}
+	return nil
+}
+
+// SetInCall stores the raw "incall" value and its typed representation.
+func (m *RoomEventServerMessage) SetInCall(raw json.RawMessage) error {
+	inCall, err := ParseInCall(raw)
+	if err != nil {
+		return err
+	}
+
+	value := make(json.RawMessage, len(raw))
+	copy(value, raw)
+	m.InCall = &value
+	m.InCallState = &inCall
+	return nil
 }
 
 const (
@@ -598,12 +1536,122 @@ const (
 	DisinviteReasonDeleted    = "deleted"
 )
 
+// NewInviteEvent returns a "roomlist" event notifying a user that it has been
+// invited to a room.
+func NewInviteEvent(roomId string, properties *json.RawMessage) *ServerMessage {
+	return &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "roomlist",
+			Type:   "invite",
+			Invite: &RoomEventServerMessage{
+				RoomId:     roomId,
+				Properties: properties,
+			},
+		},
+	}
+}
+
+// NewFederatedInviteEvent returns a "roomlist" event inviting a user to a room
+// that is hosted on a remote signaling server.
+func NewFederatedInviteEvent(roomId string, properties *json.RawMessage, federation *RoomFederationServerMessage) *ServerMessage {
+	message := NewInviteEvent(roomId, properties)
+	message.Event.Invite.Federation = federation
+	return message
+}
+
+// NewDisinviteEvent returns a "roomlist" event notifying a user that it is no
+// longer invited to a room. Sessions currently in that room will be closed
+// after the event has been sent (see "CloseAfterSend").
+func NewDisinviteEvent(roomId string, reason string) *ServerMessage {
+	return &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "roomlist",
+			Type:   "disinvite",
+			Disinvite: &RoomDisinviteEventServerMessage{
+				RoomEventServerMessage: RoomEventServerMessage{
+					RoomId: roomId,
+				},
+				Reason: reason,
+			},
+		},
+	}
+}
+
+// NewUpdateEvent returns a "roomlist" event notifying a user that the
+// properties of a room have changed.
+func NewUpdateEvent(roomId string, properties *json.RawMessage) *ServerMessage {
+	return &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "roomlist",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId:     roomId,
+				Properties: properties,
+			},
+		},
+	}
+}
+
 type RoomDisinviteEventServerMessage struct {
 	RoomEventServerMessage
 
 	Reason string `json:"reason"`
 }
 
+type RoomKickedServerMessage struct {
+	SessionId string `json:"sessionid"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// RoomSwitchToServerMessage instructs a session to join a different room.
+type RoomSwitchToServerMessage struct {
+	RoomId string `json:"roomid"`
+}
+
+const (
+	maxRoomStatsSessions = 1 << 20
+)
+
+type RoomStatsServerMessage struct {
+	RoomId string `json:"roomid"`
+
+	// Number of sessions in the room and number of sessions in the call.
+	Sessions int `json:"sessions"`
+	InCall   int `json:"incall"`
+
+	// Set if sessions in the room are publishing streams through the MCU.
+	Mcu bool `json:"mcu"`
+
+	// Maximum bitrates (in bits/sec) for publishing streams, 0 if unlimited.
+	MaxStreamBitrate int `json:"maxstreambitrate,omitempty"`
+	MaxScreenBitrate int `json:"maxscreenbitrate,omitempty"`
+}
+
+func (m *RoomStatsServerMessage) CheckValid() error {
+	if m.RoomId == "" {
+		return fmt.Errorf("roomid missing")
+	} else if m.Sessions < 0 || m.Sessions > maxRoomStatsSessions {
+		return fmt.Errorf("invalid number of sessions %d", m.Sessions)
+	} else if m.InCall < 0 || m.InCall > m.Sessions {
+		return fmt.Errorf("invalid number of sessions in call %d", m.InCall)
+	} else if m.MaxStreamBitrate < 0 || m.MaxScreenBitrate < 0 {
+		return fmt.Errorf("invalid bitrates")
+	}
+	return nil
+}
+
+type RoomCountsServerMessage struct {
+	// Number of sessions that joined / left the room with this event.
+	Joined int `json:"joined,omitempty"`
+	Left   int `json:"left,omitempty"`
+
+	// Number of sessions currently in the room.
+	Sessions int `json:"sessions"`
+}
+
 type RoomEventMessage struct {
 	RoomId string           `json:"roomid"`
 	Data   *json.RawMessage `json:"data,omitempty"`
@@ -615,6 +1663,45 @@ type RoomFlagsServerMessage struct {
 	Flags     uint32 `json:"flags"`
 }
 
+const (
+	ConnectionQualityGood   = "good"
+	ConnectionQualityMedium = "medium"
+	ConnectionQualityPoor   = "poor"
+)
+
+func IsValidConnectionQuality(quality string) bool {
+	switch quality {
+	case ConnectionQualityGood, ConnectionQualityMedium, ConnectionQualityPoor:
+		return true
+	default:
+		return false
+	}
+}
+
+type RoomQualityServerMessageEntry struct {
+	SessionId string `json:"sessionid"`
+	Quality   string `json:"quality"`
+}
+
+type RoomQualityServerMessage struct {
+	RoomId   string                           `json:"roomid"`
+	Sessions []*RoomQualityServerMessageEntry `json:"sessions"`
+}
+
+func (m *RoomQualityServerMessage) CheckValid() error {
+	if len(m.Sessions) == 0 {
+		return fmt.Errorf("sessions missing")
+	}
+	for _, entry := range m.Sessions {
+		if entry == nil || entry.SessionId == "" {
+			return fmt.Errorf("sessionid missing")
+		} else if !IsValidConnectionQuality(entry.Quality) {
+			return fmt.Errorf("unsupported quality %s", entry.Quality)
+		}
+	}
+	return nil
+}
+
 type EventServerMessage struct {
 	Target string `json:"target"`
 	Type   string `json:"type"`
@@ -623,15 +1710,167 @@ type EventServerMessage struct {
 	Join   []*EventServerMessageSessionEntry `json:"join,omitempty"`
 	Leave  []string                          `json:"leave,omitempty"`
 	Change []*EventServerMessageSessionEntry `json:"change,omitempty"`
+	// LeaveReasons contains the reasons of the sessions in "Leave" by their
+	// session id.
+	LeaveReasons map[string]string `json:"leavereasons,omitempty"`
 
 	// Used for target "roomlist" / "participants"
 	Invite    *RoomEventServerMessage          `json:"invite,omitempty"`
 	Disinvite *RoomDisinviteEventServerMessage `json:"disinvite,omitempty"`
 	Update    *RoomEventServerMessage          `json:"update,omitempty"`
 	Flags     *RoomFlagsServerMessage          `json:"flags,omitempty"`
+	Quality   *RoomQualityServerMessage        `json:"quality,omitempty"`
 
 	// Used for target "message"
 	Message *RoomEventMessage `json:"message,omitempty"`
+
+	// Used for target "room" and type "kicked"
+	Kicked *RoomKickedServerMessage `json:"kicked,omitempty"`
+
+	// Used for target "room" and type "switchto"
+	SwitchTo *RoomSwitchToServerMessage `json:"switchto,omitempty"`
+
+	// Used for target "room" and type "stats"
+	Stats *RoomStatsServerMessage `json:"stats,omitempty"`
+
+	// Used for target "room" and type "counts"
+	Counts *RoomCountsServerMessage `json:"counts,omitempty"`
+
+	// Set if the event was split into multiple messages.
+	Chunk *EventServerMessageChunk `json:"chunk,omitempty"`
+}
+
+const (
+	// The session disconnected or expired without leaving the room.
+	LeaveReasonDisconnected = "disconnected"
+	// The session was kicked from the room.
+	LeaveReasonKicked = "kicked"
+	// The session left the room, sent a "bye" or the room was deleted.
+	LeaveReasonLeft = "left"
+	// The session left the room to join a different room.
+	LeaveReasonMoved = "moved"
+)
+
+type EventServerMessageChunk struct {
+	Sequence int  `json:"sequence"`
+	Final    bool `json:"final,omitempty"`
+}
+
+const (
+	// Additional (estimated) size of the chunk information and the wrapping
+	// ServerMessage.
+	eventChunkOverhead = 64
+)
+
+func (m *EventServerMessage) numEntries() int {
+	switch {
+	case len(m.Join) > 0:
+		return len(m.Join)
+	case len(m.Leave) > 0:
+		return len(m.Leave)
+	case m.Update != nil && len(m.Update.Users) > 0:
+		return len(m.Update.Users)
+	default:
+		return 0
+	}
+}
+
+func (m *EventServerMessage) getEntry(idx int) interface{} {
+	switch {
+	case len(m.Join) > 0:
+		return m.Join[idx]
+	case len(m.Leave) > 0:
+		if reason, found := m.LeaveReasons[m.Leave[idx]]; found {
+			return []string{m.Leave[idx], reason}
+		}
+		return m.Leave[idx]
+	default:
+		return m.Update.Users[idx]
+	}
+}
+
+func (m *EventServerMessage) withEntries(start int, end int) *EventServerMessage {
+	result := *m
+	result.Chunk = nil
+	switch {
+	case len(m.Join) > 0:
+		result.Join = m.Join[start:end]
+	case len(m.Leave) > 0:
+		result.Leave = m.Leave[start:end]
+		if m.LeaveReasons != nil {
+			result.LeaveReasons = make(map[string]string, end-start)
+			for _, sessionId := range result.Leave {
+				if reason, found := m.LeaveReasons[sessionId]; found {
+					result.LeaveReasons[sessionId] = reason
+				}
+			}
+		}
+	default:
+		update := *m.Update
+		update.Users = m.Update.Users[start:end]
+		if start > 0 {
+			// Only send the changed users once.
+			update.Changed = nil
+		}
+		result.Update = &update
+	}
+	return &result
+}
+
+// Split returns a list of events where each event has the given maximum size
+// when serialized. Only the "join", "leave" and "users" lists are split, all
+// other events are returned unmodified. If the event needs to be split, the
+// resulting events contain sequenced chunk information.
+func (m *EventServerMessage) Split(maxSize int) []*EventServerMessage {
+	count := m.numEntries()
+	if maxSize <= 0 || count <= 1 {
+		return []*EventServerMessage{m}
+	}
+
+	data, err := json.Marshal(m.withEntries(0, 0))
+	if err != nil {
+		return []*EventServerMessage{m}
+	}
+	overhead := len(data) + eventChunkOverhead
+
+	var result []*EventServerMessage
+	start := 0
+	size := overhead
+	for idx := 0; idx < count; idx++ {
+		var data []byte
+		var err error
+		entry := m.getEntry(idx)
+		if marshaler, ok := entry.(json.Marshaler); ok {
+			// Avoid the additional validation of "json.Marshal".
+			data, err = marshaler.MarshalJSON()
+		} else {
+			data, err = json.Marshal(entry)
+		}
+		if err != nil {
+			return []*EventServerMessage{m}
+		}
+
+		// Entries are separated by commas.
+		entrySize := len(data) + 1
+		if idx > start && size+entrySize > maxSize {
+			result = append(result, m.withEntries(start, idx))
+			start = idx
+			size = overhead
+		}
+		size += entrySize
+	}
+	if len(result) == 0 {
+		return []*EventServerMessage{m}
+	}
+
+	result = append(result, m.withEntries(start, count))
+	for idx, event := range result {
+		event.Chunk = &EventServerMessageChunk{
+			Sequence: idx,
+			Final:    idx == len(result)-1,
+		}
+	}
+	return result
 }
 
 type EventServerMessageSessionEntry struct {
@@ -639,6 +1878,68 @@ type EventServerMessageSessionEntry struct {
 	UserId        string           `json:"userid"`
 	User          *json.RawMessage `json:"user,omitempty"`
 	RoomSessionId string           `json:"roomsessionid,omitempty"`
+	// Resumed is set if the session replaces a previous connection of the
+	// same room session, i.e. it is not a new participant.
+	Resumed bool `json:"resumed,omitempty"`
+	// DisplayName is taken from the "displayname" of the user data, it is not
+	// set for anonymous sessions.
+	DisplayName string `json:"displayname,omitempty"`
+	// Previous contains the previous values of the changed fields in "change"
+	// events, only sent to clients supporting "change-previous".
+	Previous *EventServerMessageSessionPrevious `json:"previous,omitempty"`
+}
+
+const (
+	// Previous user data larger than this is not included in "change" events.
+	maxChangePreviousUserSize = 1024
+)
+
+// EventServerMessageSessionPrevious contains the previous values of the fields
+// of a session entry that changed. Only "user" and "displayname" are diffable,
+// unchanged fields are omitted.
+type EventServerMessageSessionPrevious struct {
+	User        *json.RawMessage `json:"user,omitempty"`
+	DisplayName *string          `json:"displayname,omitempty"`
+	// UserTruncated is set if the user data changed but the previous value
+	// was too large to be included.
+	UserTruncated bool `json:"usertruncated,omitempty"`
+}
+
+// newEventServerMessageSessionPrevious returns the previous values of the
+// fields that differ between the entries or nil if nothing changed.
+func newEventServerMessageSessionPrevious(previous *EventServerMessageSessionEntry, current *EventServerMessageSessionEntry) *EventServerMessageSessionPrevious {
+	result := &EventServerMessageSessionPrevious{}
+	changed := false
+	if !equalRawMessage(previous.User, current.User) {
+		changed = true
+		switch {
+		case previous.User == nil || len(*previous.User) == 0:
+			null := json.RawMessage("null")
+			result.User = &null
+		case len(*previous.User) > maxChangePreviousUserSize:
+			result.UserTruncated = true
+		default:
+			result.User = previous.User
+		}
+	}
+	if previous.DisplayName != current.DisplayName {
+		changed = true
+		displayName := previous.DisplayName
+		result.DisplayName = &displayName
+	}
+	if !changed {
+		return nil
+	}
+
+	return result
+}
+
+func equalRawMessage(a *json.RawMessage, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return (a == nil || len(*a) == 0) && (b == nil || len(*b) == 0)
+	}
+
+	return bytes.Equal(*a, *b)
 }
 
 // MCU-related types
@@ -652,22 +1953,318 @@ type AnswerOfferMessage struct {
 	Update   bool                   `json:"update,omitempty"`
 }
 
+func newSdpMessage(messageType string, to string, from string, roomType string, sdp string) (*AnswerOfferMessage, error) {
+	if to == "" {
+		return nil, fmt.Errorf("to missing")
+	} else if sdp == "" {
+		return nil, fmt.Errorf("sdp missing")
+	}
+
+	return &AnswerOfferMessage{
+		To:       to,
+		From:     from,
+		Type:     messageType,
+		RoomType: roomType,
+		Payload: map[string]interface{}{
+			"type": messageType,
+			"sdp":  sdp,
+		},
+	}, nil
+}
+
+// NewOffer returns an "offer" message with the given SDP from one session to
+// another one.
+func NewOffer(to string, from string, roomType string, sdp string) (*AnswerOfferMessage, error) {
+	return newSdpMessage("offer", to, from, roomType, sdp)
+}
+
+// NewAnswer returns an "answer" message with the given SDP from one session to
+// another one.
+func NewAnswer(to string, from string, roomType string, sdp string) (*AnswerOfferMessage, error) {
+	return newSdpMessage("answer", to, from, roomType, sdp)
+}
+
+// NewCandidate returns a "candidate" message with the given ICE candidate from
+// one session to another one.
+func NewCandidate(to string, from string, roomType string, candidate string, sdpMid string, sdpMLineIndex int) (*AnswerOfferMessage, error) {
+	if to == "" {
+		return nil, fmt.Errorf("to missing")
+	} else if candidate == "" {
+		return nil, fmt.Errorf("candidate missing")
+	} else if sdpMLineIndex < 0 {
+		return nil, fmt.Errorf("invalid sdpMLineIndex %d", sdpMLineIndex)
+	}
+
+	return &AnswerOfferMessage{
+		To:       to,
+		From:     from,
+		Type:     "candidate",
+		RoomType: roomType,
+		Payload: map[string]interface{}{
+			"candidate": map[string]interface{}{
+				"candidate":     candidate,
+				"sdpMid":        sdpMid,
+				"sdpMLineIndex": sdpMLineIndex,
+			},
+		},
+	}, nil
+}
+
+// Type "presence"
+
+const (
+	PresenceStateActive = "active"
+	PresenceStateTyping = "typing"
+	PresenceStateAway   = "away"
+)
+
+func IsValidPresenceState(state string) bool {
+	switch state {
+	case PresenceStateActive:
+		fallthrough
+	case PresenceStateTyping:
+		fallthrough
+	case PresenceStateAway:
+		return true
+	default:
+		return false
+	}
+}
+
+type PresenceClientMessage struct {
+	State string `json:"state"`
+}
+
+func (m *PresenceClientMessage) CheckValid() error {
+	if m.State == "" {
+		return fmt.Errorf("state missing")
+	} else if !IsValidPresenceState(m.State) {
+		return fmt.Errorf("unsupported state %s", m.State)
+	}
+	return nil
+}
+
+type PresenceServerMessage struct {
+	SessionId string `json:"sessionid"`
+	UserId    string `json:"userid,omitempty"`
+	State     string `json:"state"`
+}
+
+// Type "participants"
+
+// ParticipantsClientMessage requests a snapshot of the sessions that are
+// currently in the room. The session must have joined the given room, this is
+// checked when processing the message.
+type ParticipantsClientMessage struct {
+	RoomId string `json:"roomid"`
+}
+
+func (m *ParticipantsClientMessage) CheckValid() error {
+	if m.RoomId == "" {
+		return fmt.Errorf("roomid missing")
+	} else if err := validateString("roomid", m.RoomId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Type "echo"
+
+const (
+	// MaxEchoDataSize is the maximum size in bytes of the data of an echo
+	// request.
+	MaxEchoDataSize = 1024
+)
+
+type EchoClientMessage struct {
+	Data *json.RawMessage `json:"data,omitempty"`
+}
+
+func (m *EchoClientMessage) CheckValid() error {
+	if m.Data != nil && len(*m.Data) > MaxEchoDataSize {
+		return fmt.Errorf("data exceeds %d bytes", MaxEchoDataSize)
+	}
+	return nil
+}
+
+type EchoServerMessage struct {
+	Data *json.RawMessage `json:"data,omitempty"`
+
+	// Time the request was processed by the server in milliseconds since the
+	// epoch.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Type "validate"
+
+// ValidateServerMessage is sent as response to a dry request that passed
+// validation.
+type ValidateServerMessage struct {
+	Type string `json:"type"`
+}
+
+// Type "notify"
+
+const (
+	// Values of the "fallback" option in the "mcu" section.
+	McuFallbackNone     = ""
+	McuFallbackFeatures = "features"
+	McuFallbackNotify   = "notify"
+
+	// The MCU is no longer available, clients should use peer-to-peer
+	// connections instead.
+	NotifyTypeMcuUnavailable = "mcu-unavailable"
+	// The MCU is available again.
+	NotifyTypeMcuAvailable = "mcu-available"
+	// An internal client broadcasted data to the session.
+	NotifyTypeBroadcast = "broadcast"
+)
+
+// NotifyServerMessage informs sessions about changes of the server state.
+type NotifyServerMessage struct {
+	Type string `json:"type"`
+
+	Data *json.RawMessage `json:"data,omitempty"`
+}
+
+// Type "kick"
+
+const (
+	maxKickReasonLength = 256
+)
+
+type KickClientMessage struct {
+	SessionId string `json:"sessionid"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (m *KickClientMessage) CheckValid() error {
+	if m.SessionId == "" {
+		return fmt.Errorf("sessionid missing")
+	} else if err := validateString("sessionid", m.SessionId); err != nil {
+		return err
+	} else if len(m.Reason) > maxKickReasonLength {
+		return fmt.Errorf("reason too long")
+	} else if err := validateText("reason", m.Reason); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Type "move"
+
+type MoveClientMessage struct {
+	// SessionId is the public id of the session to move.
+	SessionId string `json:"sessionid"`
+	// RoomId is the id of the room to move the session to.
+	RoomId string `json:"roomid"`
+}
+
+func (m *MoveClientMessage) CheckValid() error {
+	if m.SessionId == "" {
+		return fmt.Errorf("sessionid missing")
+	} else if err := validateString("sessionid", m.SessionId); err != nil {
+		return err
+	}
+	if m.RoomId == "" {
+		return fmt.Errorf("roomid missing")
+	} else if err := validateString("roomid", m.RoomId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MoveServerMessage confirms to the moderator that the session to move was
+// instructed to join the room.
+type MoveServerMessage struct {
+	SessionId string `json:"sessionid"`
+	RoomId    string `json:"roomid"`
+}
+
+// Type "renegotiate"
+
+const (
+	// The MCU connection of the stream was re-established.
+	RenegotiateReasonMcuReconnected = "mcu-reconnected"
+	// The MCU lost the connection to its upstream backend.
+	RenegotiateReasonMcuDisconnected = "mcu-disconnected"
+	// The publisher has changed its stream (e.g. the resolution).
+	RenegotiateReasonPublisherChanged = "publisher-changed"
+)
+
+func IsValidRenegotiateReason(reason string) bool {
+	switch reason {
+	case RenegotiateReasonMcuReconnected, RenegotiateReasonMcuDisconnected, RenegotiateReasonPublisherChanged:
+		return true
+	default:
+		return false
+	}
+}
+
+type RenegotiateServerMessage struct {
+	// The publisher of the stream, can be the own session id.
+	From     string `json:"from"`
+	RoomType string `json:"roomType"`
+	Reason   string `json:"reason"`
+}
+
+func (m *RenegotiateServerMessage) CheckValid() error {
+	if m.From == "" {
+		return fmt.Errorf("from missing")
+	} else if err := validateString("from", m.From); err != nil {
+		return err
+	} else if m.RoomType == "" {
+		return fmt.Errorf("roomType missing")
+	} else if err := validateString("roomType", m.RoomType); err != nil {
+		return err
+	} else if !IsValidRenegotiateReason(m.Reason) {
+		return fmt.Errorf("unsupported reason %s", m.Reason)
+	}
+	return nil
+}
+
 // Type "transient"
 
+const (
+	maxTransientDataKeyLength = 256
+	maxTransientDataValueSize = 8 * 1024
+
+	// Limits of the time-to-live of transient data (in seconds).
+	minTransientDataTTL = 1
+	maxTransientDataTTL = 24 * 60 * 60
+)
+
 type TransientDataClientMessage struct {
 	Type string `json:"type"`
 
 	Key   string           `json:"key,omitempty"`
 	Value *json.RawMessage `json:"value,omitempty"`
+
+	// Optional time-to-live of the value in seconds.
+	TTL int `json:"ttl,omitempty"`
 }
 
 func (m *TransientDataClientMessage) CheckValid() error {
+	if err := validateString("type", m.Type); err != nil {
+		return err
+	} else if err := validateString("key", m.Key); err != nil {
+		return err
+	}
+
 	switch m.Type {
 	case "set":
 		if m.Key == "" {
 			return fmt.Errorf("key missing")
+		} else if len(m.Key) > maxTransientDataKeyLength {
+			return fmt.Errorf("key too long")
 		}
 		// A "nil" value is allowed and will remove the key.
+		if m.Value != nil && len(*m.Value) > maxTransientDataValueSize {
+			return fmt.Errorf("value too large")
+		}
+		if m.TTL != 0 && (m.TTL < minTransientDataTTL || m.TTL > maxTransientDataTTL) {
+			return fmt.Errorf("ttl must be between %d and %d seconds", minTransientDataTTL, maxTransientDataTTL)
+		}
 	case "remove":
 		if m.Key == "" {
 			return fmt.Errorf("key missing")
@@ -676,6 +2273,10 @@ func (m *TransientDataClientMessage) CheckValid() error {
 	return nil
 }
 
+func (m *TransientDataClientMessage) GetTTL() time.Duration {
+	return time.Duration(m.TTL) * time.Second
+}
+
 type TransientDataServerMessage struct {
 	Type string `json:"type"`
 
@@ -684,3 +2285,70 @@ type TransientDataServerMessage struct {
 	Value    interface{}            `json:"value,omitempty"`
 	Data     map[string]interface{} `json:"data,omitempty"`
 }
+
+// Type "capabilities"
+
+const (
+	// Maximum number of backends that can be requested in a single
+	// "capabilities" request.
+	MaxCapabilitiesBackends = 50
+)
+
+type CapabilitiesClientMessage struct {
+	// Backends contains ids or urls of backends to return the capabilities
+	// for (optional, only for internal clients).
+	Backends []string `json:"backends,omitempty"`
+}
+
+func (m *CapabilitiesClientMessage) CheckValid() error {
+	if len(m.Backends) > MaxCapabilitiesBackends {
+		return fmt.Errorf("too many backends, at most %d are allowed", MaxCapabilitiesBackends)
+	}
+
+	for _, backend := range m.Backends {
+		if backend == "" {
+			return fmt.Errorf("backend missing")
+		}
+	}
+	return validateStrings("backend", m.Backends)
+}
+
+type CapabilitiesServerMessage struct {
+	Version  string   `json:"version"`
+	Features []string `json:"features,omitempty"`
+
+	// Maximum bitrates (in bits/sec) for publishing streams, 0 if unlimited.
+	MaxStreamBitrate int `json:"maxstreambitrate,omitempty"`
+	MaxScreenBitrate int `json:"maxscreenbitrate,omitempty"`
+
+	// Maximum number of sessions of the backend, 0 if unlimited.
+	SessionLimit uint64 `json:"sessionlimit,omitempty"`
+
+	// Maximum number of participants in a room of the backend, 0 if
+	// unlimited.
+	MaxParticipants int `json:"maxparticipants,omitempty"`
+
+	// Maximum size of a message that can be sent to the server.
+	MaxMessageSize int `json:"maxmessagesize"`
+
+	// Codecs that can be used for publishing, empty if no MCU is available.
+	Codecs *CapabilitiesCodecs `json:"codecs"`
+
+	// Capabilities of the requested backends in the order of the request.
+	Backends []*CapabilitiesBackendServerMessage `json:"backends,omitempty"`
+}
+
+type CapabilitiesBackendServerMessage struct {
+	// Backend is the id or url as sent in the request.
+	Backend string `json:"backend"`
+
+	// Error is set if the backend is not known.
+	Error *Error `json:"error,omitempty"`
+
+	Capabilities *CapabilitiesServerMessage `json:"capabilities,omitempty"`
+}
+
+type CapabilitiesCodecs struct {
+	Audio []string `json:"audio"`
+	Video []string `json:"video"`
+}
@@ -22,9 +22,15 @@
 package signaling
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testCheckValid interface {
@@ -33,17 +39,40 @@ type testCheckValid interface {
 
 func wrapMessage(messageType string, msg testCheckValid) *ClientMessage {
 	wrapped := &ClientMessage{
-		Type: messageType,
+		Type:         messageType,
+		fromInternal: true,
 	}
 	switch messageType {
 	case "hello":
 		wrapped.Hello = msg.(*HelloClientMessage)
 	case "message":
 		wrapped.Message = msg.(*MessageClientMessage)
+	case "control":
+		wrapped.Control = msg.(*ControlClientMessage)
 	case "bye":
 		wrapped.Bye = msg.(*ByeClientMessage)
 	case "room":
 		wrapped.Room = msg.(*RoomClientMessage)
+	case "transient":
+		wrapped.TransientData = msg.(*TransientDataClientMessage)
+	case "capabilities":
+		wrapped.Capabilities = msg.(*CapabilitiesClientMessage)
+	case "kick":
+		wrapped.Kick = msg.(*KickClientMessage)
+	case "move":
+		wrapped.Move = msg.(*MoveClientMessage)
+	case "presence":
+		wrapped.Presence = msg.(*PresenceClientMessage)
+	case "echo":
+		wrapped.Echo = msg.(*EchoClientMessage)
+	case "participants":
+		wrapped.Participants = msg.(*ParticipantsClientMessage)
+	case "broadcast":
+		wrapped.Type = "internal"
+		wrapped.Internal = &InternalClientMessage{
+			Type:      "broadcast",
+			Broadcast: msg.(*BroadcastInternalClientMessage),
+		}
 	default:
 		return nil
 	}
@@ -86,6 +115,44 @@ func TestClientMessage(t *testing.T) {
 	}
 }
 
+func TestClientMessageId(t *testing.T) {
+	valid := []string{
+		"",
+		"1",
+		"unique-request-id",
+		"123-abc_DEF.4:5/6+7=",
+		strings.Repeat("x", maxClientMessageIdLength),
+	}
+	for _, id := range valid {
+		msg := ClientMessage{
+			Id:   id,
+			Type: "bye",
+		}
+		if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message with id %q should be valid, got %s", id, err)
+		}
+	}
+
+	invalid := []string{
+		strings.Repeat("x", maxClientMessageIdLength+1),
+		strings.Repeat("x", 1024*1024),
+		"with space",
+		"with\ttab",
+		"with\nnewline",
+		"non-ascii-\u00e4",
+		"control-\x00",
+	}
+	for _, id := range invalid {
+		msg := ClientMessage{
+			Id:   id,
+			Type: "bye",
+		}
+		if err := msg.CheckValid(); err != ErrInvalidMessageId {
+			t.Errorf("Message with id %q should be invalid, got %v", id, err)
+		}
+	}
+}
+
 func TestHelloClientMessage(t *testing.T) {
 	internalAuthParams := []byte("{\"backend\":\"https://domain.invalid\"}")
 	valid_messages := []testCheckValid{
@@ -115,9 +182,100 @@ func TestHelloClientMessage(t *testing.T) {
 			Version:  HelloVersion,
 			ResumeId: "the-resume-id",
 		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client: &HelloClientInfo{
+				Name:    "Talk Desktop",
+				Version: "1.0.0-beta.1 (linux)",
+			},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client: &HelloClientInfo{
+				Name: "talk-android",
+			},
+		},
+		&HelloClientMessage{
+			Version:      HelloVersion,
+			ResumeId:     "the-resume-id",
+			Subscription: SubscriptionLevelAll,
+		},
+		&HelloClientMessage{
+			Version:      HelloVersion,
+			ResumeId:     "the-resume-id",
+			Subscription: SubscriptionLevelCounts,
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			Observer: true,
+			Auth: HelloClientMessageAuth{
+				Params: &json.RawMessage{'{', '}'},
+				Url:    "https://domain.invalid",
+			},
+		},
 	}
 	invalid_messages := []testCheckValid{
 		&HelloClientMessage{},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Features: []string{""},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Features: []string{strings.Repeat("f", maxHelloFeatureLength+1)},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			Observer: true,
+			Auth: HelloClientMessageAuth{
+				Type:   "internal",
+				Params: (*json.RawMessage)(&internalAuthParams),
+			},
+		},
+		&HelloClientMessage{
+			Version:      HelloVersion,
+			ResumeId:     "the-resume-id",
+			Subscription: "invalid-level",
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client:   &HelloClientInfo{},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client: &HelloClientInfo{
+				Name: strings.Repeat("a", maxHelloClientInfoNameLength+1),
+			},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client: &HelloClientInfo{
+				Name:    "talk-android",
+				Version: strings.Repeat("1", maxHelloClientInfoVersionLength+1),
+			},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client: &HelloClientInfo{
+				Name: "talk\nandroid",
+			},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Client: &HelloClientInfo{
+				Name:    "talk-android",
+				Version: "<script>",
+			},
+		},
 		&HelloClientMessage{Version: "0.0"},
 		&HelloClientMessage{Version: HelloVersion},
 		&HelloClientMessage{
@@ -173,6 +331,89 @@ func TestHelloClientMessage(t *testing.T) {
 	}
 }
 
+func TestMessageClientMessageData(t *testing.T) {
+	valid_data := []*MessageClientMessageData{
+		{
+			Type:     "offer",
+			Sid:      "12345",
+			RoomType: "video",
+		},
+		{
+			Type: "candidate",
+			Sid:  "abc-DEF_1.2",
+		},
+		{
+			Type: "candidates",
+			Sid:  "12345",
+			Payload: map[string]interface{}{
+				"candidates": []interface{}{"candidate:0", "candidate:1"},
+			},
+		},
+		{
+			Type: "requestoffer",
+			Sid:  strings.Repeat("a", maxMcuSidLength),
+		},
+		// Other messages don't need a sid.
+		{
+			Type: "chat",
+		},
+		{
+			Type: "nickChanged",
+			Sid:  "any value { }",
+		},
+	}
+	invalid_data := []*MessageClientMessageData{
+		{
+			Type:     "offer",
+			RoomType: "video",
+		},
+		{
+			Type: "answer",
+			Sid:  strings.Repeat("a", maxMcuSidLength+1),
+		},
+		{
+			Type: "candidate",
+			Sid:  "foo bar",
+		},
+		{
+			Type: "candidates",
+			Sid:  "12345",
+		},
+		{
+			Type: "candidates",
+			Sid:  "12345",
+			Payload: map[string]interface{}{
+				"candidates": []interface{}{},
+			},
+		},
+		{
+			Type: "candidates",
+			Sid:  "12345",
+			Payload: map[string]interface{}{
+				"candidates": make([]interface{}, maxCandidatesPerMessage+1),
+			},
+		},
+		{
+			Type: "selectStream",
+			Sid:  "foo/bar",
+		},
+		{
+			Type: "sendoffer",
+			Sid:  "sid\u00e4",
+		},
+	}
+	for _, data := range valid_data {
+		if err := data.CheckValid(); err != nil {
+			t.Errorf("Data %+v should be valid, got %s", data, err)
+		}
+	}
+	for _, data := range invalid_data {
+		if err := data.CheckValid(); err == nil {
+			t.Errorf("Data %+v should not be valid", data)
+		}
+	}
+}
+
 func TestMessageClientMessage(t *testing.T) {
 	valid_messages := []testCheckValid{
 		&MessageClientMessage{
@@ -195,9 +436,58 @@ func TestMessageClientMessage(t *testing.T) {
 			},
 			Data: &json.RawMessage{'{', '}'},
 		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:        "room",
+				ExcludeSelf: true,
+			},
+			Data: &json.RawMessage{'{', '}'},
+		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: "the-session-id",
+			},
+			RequestReceipt: true,
+			Data:           &json.RawMessage{'{', '}'},
+			fromInternal:   true,
+		},
 	}
 	invalid_messages := []testCheckValid{
 		&MessageClientMessage{},
+		// Receipts are only supported for internal clients.
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: "the-session-id",
+			},
+			RequestReceipt: true,
+			Data:           &json.RawMessage{'{', '}'},
+		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type: "room",
+			},
+			RequestReceipt: true,
+			Data:           &json.RawMessage{'{', '}'},
+			fromInternal:   true,
+		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:        "session",
+				SessionId:   "the-session-id",
+				ExcludeSelf: true,
+			},
+			Data: &json.RawMessage{'{', '}'},
+		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:        "user",
+				UserId:      "the-user-id",
+				ExcludeSelf: true,
+			},
+			Data: &json.RawMessage{'{', '}'},
+		},
 		&MessageClientMessage{
 			Recipient: MessageClientMessageRecipient{
 				Type:      "session",
@@ -254,6 +544,83 @@ func TestMessageClientMessage(t *testing.T) {
 	}
 }
 
+func TestHelloClientMessageFeatures(t *testing.T) {
+	features := make([]string, 0, maxHelloFeatures+1)
+	for i := 0; i <= maxHelloFeatures; i++ {
+		features = append(features, "feature-"+strconv.Itoa(i))
+	}
+	msg := &HelloClientMessage{
+		Version:  HelloVersion,
+		ResumeId: "the-resume-id",
+		Features: features,
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message with %d features should not be valid", len(features))
+	}
+
+	msg.Features = features[:maxHelloFeatures]
+	if err := msg.CheckValid(); err != nil {
+		t.Errorf("Message with %d features should be valid, got %s", len(msg.Features), err)
+	}
+
+	msg.Features = []string{"foo", "bar", "foo", "baz", "bar"}
+	if err := msg.CheckValid(); err != nil {
+		t.Error(err)
+	} else if expected := []string{"foo", "bar", "baz"}; !reflect.DeepEqual(msg.Features, expected) {
+		t.Errorf("Expected features %+v, got %+v", expected, msg.Features)
+	}
+}
+
+func TestControlClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: "the-session-id",
+				},
+				Data: &json.RawMessage{'{', '}'},
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type: "room",
+				},
+				Data: &json.RawMessage{'{', '}'},
+			},
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&ControlClientMessage{},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Data: &json.RawMessage{'{', '}'},
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: "the-session-id",
+				},
+				RequestReceipt: true,
+				Data:           &json.RawMessage{'{', '}'},
+			},
+		},
+	}
+
+	testMessages(t, "control", valid_messages, invalid_messages)
+
+	msg := &ControlClientMessage{}
+	if !msg.IsAllowedFrom(SessionRoleModerator) {
+		t.Errorf("Moderators should be allowed to send control messages")
+	}
+	if msg.IsAllowedFrom(SessionRoleParticipant) {
+		t.Errorf("Participants should not be allowed to send control messages")
+	}
+}
+
 func TestByeClientMessage(t *testing.T) {
 	// Any "bye" message is valid.
 	valid_messages := []testCheckValid{
@@ -273,11 +640,19 @@ func TestByeClientMessage(t *testing.T) {
 }
 
 func TestRoomClientMessage(t *testing.T) {
-	// Any "room" message is valid.
 	valid_messages := []testCheckValid{
 		&RoomClientMessage{},
+		&RoomClientMessage{
+			RoomId:    "the-room-id",
+			SessionId: strings.Repeat("a", maxRoomSessionIdLength),
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&RoomClientMessage{
+			RoomId:    "the-room-id",
+			SessionId: strings.Repeat("a", maxRoomSessionIdLength+1),
+		},
 	}
-	invalid_messages := []testCheckValid{}
 
 	testMessages(t, "room", valid_messages, invalid_messages)
 
@@ -346,3 +721,1160 @@ func TestIsChatRefresh(t *testing.T) {
 		t.Error("message should not be detected as chat refresh")
 	}
 }
+
+func TestServerMessageDataPredicates(t *testing.T) {
+	testcases := []struct {
+		data      string
+		offer     bool
+		answer    bool
+		candidate bool
+		unshare   bool
+	}{
+		{"{\"type\":\"offer\",\"from\":\"session1\",\"roomType\":\"video\"}", true, false, false, false},
+		{"{\"type\":\"answer\",\"to\":\"session1\",\"roomType\":\"video\"}", false, true, false, false},
+		{"{\"type\":\"candidate\",\"sid\":\"12345\"}", false, false, true, false},
+		{"{\"type\":\"unshareScreen\"}", false, false, false, true},
+		{"{\"type\":\"chat\",\"chat\":{\"refresh\":true}}", false, false, false, false},
+		{"\"invalid\"", false, false, false, false},
+	}
+
+	for _, test := range testcases {
+		data := []byte(test.data)
+		msg := &ServerMessage{
+			Type: "message",
+			Message: &MessageServerMessage{
+				Data: (*json.RawMessage)(&data),
+			},
+		}
+		// Call the predicates twice so the cached data is also checked.
+		for i := 0; i < 2; i++ {
+			if msg.IsOffer() != test.offer {
+				t.Errorf("Expected offer %t for %s", test.offer, test.data)
+			}
+			if msg.IsAnswer() != test.answer {
+				t.Errorf("Expected answer %t for %s", test.answer, test.data)
+			}
+			if msg.IsCandidate() != test.candidate {
+				t.Errorf("Expected candidate %t for %s", test.candidate, test.data)
+			}
+			if msg.IsUnshareScreen() != test.unshare {
+				t.Errorf("Expected unshareScreen %t for %s", test.unshare, test.data)
+			}
+		}
+	}
+
+	data := []byte("{\"type\":\"offer\",\"from\":\"session1\",\"to\":\"session2\",\"sid\":\"12345\",\"roomType\":\"screen\"}")
+	msg := &MessageServerMessage{
+		Data: (*json.RawMessage)(&data),
+	}
+	parsed := msg.ParsedData()
+	if parsed == nil {
+		t.Fatal("Expected parsed data")
+	} else if parsed.From != "session1" || parsed.To != "session2" || parsed.Sid != "12345" || parsed.RoomType != "screen" {
+		t.Errorf("Unexpected parsed data %+v", parsed)
+	}
+	if cached := msg.ParsedData(); cached != parsed {
+		t.Errorf("Expected cached data %p, got %p", parsed, cached)
+	}
+
+	// Non-message types never match.
+	other := &ServerMessage{
+		Type: "control",
+	}
+	if other.IsOffer() || other.IsChatRefresh() {
+		t.Error("Only messages should be checked")
+	}
+}
+
+func TestRoomQualityServerMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&RoomQualityServerMessage{
+			Sessions: []*RoomQualityServerMessageEntry{
+				{SessionId: "session1", Quality: ConnectionQualityGood},
+			},
+		},
+		&RoomQualityServerMessage{
+			Sessions: []*RoomQualityServerMessageEntry{
+				{SessionId: "session1", Quality: ConnectionQualityMedium},
+				{SessionId: "session2", Quality: ConnectionQualityPoor},
+			},
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&RoomQualityServerMessage{},
+		&RoomQualityServerMessage{
+			Sessions: []*RoomQualityServerMessageEntry{
+				{Quality: ConnectionQualityGood},
+			},
+		},
+		&RoomQualityServerMessage{
+			Sessions: []*RoomQualityServerMessageEntry{
+				{SessionId: "session1"},
+			},
+		},
+		&RoomQualityServerMessage{
+			Sessions: []*RoomQualityServerMessageEntry{
+				{SessionId: "session1", Quality: "excellent"},
+			},
+		},
+	}
+	for _, msg := range valid_messages {
+		if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message %+v should be valid, got %s", msg, err)
+		}
+	}
+	for _, msg := range invalid_messages {
+		if err := msg.CheckValid(); err == nil {
+			t.Errorf("Message %+v should not be valid", msg)
+		}
+	}
+}
+
+func TestRoomStatsServerMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&RoomStatsServerMessage{
+			RoomId: "the-room-id",
+		},
+		&RoomStatsServerMessage{
+			RoomId:           "the-room-id",
+			Sessions:         10,
+			InCall:           5,
+			Mcu:              true,
+			MaxStreamBitrate: 1000,
+			MaxScreenBitrate: 2000,
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&RoomStatsServerMessage{},
+		&RoomStatsServerMessage{
+			RoomId:   "the-room-id",
+			Sessions: -1,
+		},
+		&RoomStatsServerMessage{
+			RoomId:   "the-room-id",
+			Sessions: maxRoomStatsSessions + 1,
+		},
+		&RoomStatsServerMessage{
+			RoomId:   "the-room-id",
+			Sessions: 1,
+			InCall:   2,
+		},
+		&RoomStatsServerMessage{
+			RoomId:           "the-room-id",
+			MaxStreamBitrate: -1,
+		},
+	}
+
+	for _, msg := range valid_messages {
+		if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message %+v should be valid, got %s", msg, err)
+		}
+	}
+	for _, msg := range invalid_messages {
+		if err := msg.CheckValid(); err == nil {
+			t.Errorf("Message %+v should not be valid", msg)
+		}
+	}
+}
+
+func TestTransientDataClientMessage(t *testing.T) {
+	value := json.RawMessage("\"bar\"")
+	largeValue := json.RawMessage("\"" + strings.Repeat("x", maxTransientDataValueSize) + "\"")
+	valid_messages := []testCheckValid{
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &value,
+		},
+		&TransientDataClientMessage{
+			Type: "set",
+			Key:  "foo",
+		},
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &value,
+			TTL:   minTransientDataTTL,
+		},
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &value,
+			TTL:   maxTransientDataTTL,
+		},
+		&TransientDataClientMessage{
+			Type: "remove",
+			Key:  "foo",
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&TransientDataClientMessage{
+			Type:  "set",
+			Value: &value,
+		},
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   strings.Repeat("k", maxTransientDataKeyLength+1),
+			Value: &value,
+		},
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &largeValue,
+		},
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &value,
+			TTL:   -1,
+		},
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &value,
+			TTL:   maxTransientDataTTL + 1,
+		},
+		&TransientDataClientMessage{
+			Type: "remove",
+		},
+	}
+
+	testMessages(t, "transient", valid_messages, invalid_messages)
+}
+
+func TestKickClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&KickClientMessage{
+			SessionId: "the-session-id",
+		},
+		&KickClientMessage{
+			SessionId: "the-session-id",
+			Reason:    "the-reason",
+		},
+		&KickClientMessage{
+			SessionId: "the-session-id",
+			Reason:    strings.Repeat("x", maxKickReasonLength),
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&KickClientMessage{},
+		&KickClientMessage{
+			Reason: "the-reason",
+		},
+		&KickClientMessage{
+			SessionId: "the-session-id",
+			Reason:    strings.Repeat("x", maxKickReasonLength+1),
+		},
+	}
+
+	testMessages(t, "kick", valid_messages, invalid_messages)
+
+	// "kick" requires a payload.
+	msg := ClientMessage{
+		Type: "kick",
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	}
+}
+
+func TestMoveClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&MoveClientMessage{
+			SessionId: "the-session-id",
+			RoomId:    "the-room-id",
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&MoveClientMessage{},
+		&MoveClientMessage{
+			SessionId: "the-session-id",
+		},
+		&MoveClientMessage{
+			RoomId: "the-room-id",
+		},
+		&MoveClientMessage{
+			SessionId: "the-session-id",
+			RoomId:    "the-room\x00id",
+		},
+	}
+
+	testMessages(t, "move", valid_messages, invalid_messages)
+
+	// "move" requires a payload.
+	msg := ClientMessage{
+		Type: "move",
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	}
+}
+
+func TestPresenceClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&PresenceClientMessage{
+			State: PresenceStateActive,
+		},
+		&PresenceClientMessage{
+			State: PresenceStateTyping,
+		},
+		&PresenceClientMessage{
+			State: PresenceStateAway,
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&PresenceClientMessage{},
+		&PresenceClientMessage{
+			State: "offline",
+		},
+	}
+
+	testMessages(t, "presence", valid_messages, invalid_messages)
+
+	// "presence" requires a payload.
+	msg := ClientMessage{
+		Type: "presence",
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	}
+}
+
+func TestParticipantsClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&ParticipantsClientMessage{
+			RoomId: "the-room-id",
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&ParticipantsClientMessage{},
+	}
+
+	testMessages(t, "participants", valid_messages, invalid_messages)
+
+	// "participants" requires a payload.
+	msg := ClientMessage{
+		Type: "participants",
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	}
+}
+
+func TestCapabilitiesClientMessage(t *testing.T) {
+	maxBackends := make([]string, MaxCapabilitiesBackends)
+	for i := range maxBackends {
+		maxBackends[i] = fmt.Sprintf("backend%d", i)
+	}
+	valid_messages := []testCheckValid{
+		&CapabilitiesClientMessage{},
+		&CapabilitiesClientMessage{
+			Backends: []string{"backend1", "https://domain.invalid"},
+		},
+		&CapabilitiesClientMessage{
+			Backends: maxBackends,
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&CapabilitiesClientMessage{
+			Backends: []string{"backend1", ""},
+		},
+		&CapabilitiesClientMessage{
+			Backends: append(maxBackends, "one-more"),
+		},
+	}
+
+	testMessages(t, "capabilities", valid_messages, invalid_messages)
+
+	// Only internal clients may request the capabilities of other backends.
+	msg := ClientMessage{
+		Type:         "capabilities",
+		Capabilities: &CapabilitiesClientMessage{},
+	}
+	if err := msg.CheckValid(); err != nil {
+		t.Errorf("Message %+v should be valid, got %s", msg, err)
+	}
+	msg.Capabilities.Backends = []string{"backend1"}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	}
+}
+
+func TestErrorDetailsRoundTrip(t *testing.T) {
+	testcases := []struct {
+		err      *Error
+		code     string
+		expected interface{}
+		decoded  interface{}
+	}{
+		{
+			NewRateLimitedError(1500 * time.Millisecond),
+			ErrorCodeRateLimited,
+			&RateLimitedErrorDetails{RetryAfter: 2},
+			&RateLimitedErrorDetails{},
+		},
+		{
+			NewRateLimitedError(0),
+			ErrorCodeRateLimited,
+			&RateLimitedErrorDetails{RetryAfter: 1},
+			&RateLimitedErrorDetails{},
+		},
+		{
+			NewTooManySessionsError("", 5),
+			ErrorCodeTooManySessions,
+			&TooManySessionsErrorDetails{Limit: 5},
+			&TooManySessionsErrorDetails{},
+		},
+		{
+			NewResumeFailedError("", ResumeFailedReasonExpired),
+			ErrorCodeResumeFailed,
+			&ResumeFailedErrorDetails{Reason: ResumeFailedReasonExpired},
+			&ResumeFailedErrorDetails{},
+		},
+		{
+			NewMissingRequiredFeatureError([]string{"foo", "bar"}),
+			ErrorCodeMissingRequiredFeature,
+			&MissingRequiredFeatureErrorDetails{Features: []string{"foo", "bar"}},
+			&MissingRequiredFeatureErrorDetails{},
+		},
+	}
+	for idx, tc := range testcases {
+		if tc.err.Code != tc.code {
+			t.Errorf("(%d) Expected code %s, got %+v", idx, tc.code, tc.err)
+		} else if tc.err.Message != DefaultErrorMessage(tc.code) {
+			t.Errorf("(%d) Expected default message, got %+v", idx, tc.err)
+		}
+
+		data, err := json.Marshal(&ServerMessage{
+			Type:  "error",
+			Error: tc.err,
+		})
+		if err != nil {
+			t.Fatalf("(%d) Could not marshal %+v: %s", idx, tc.err, err)
+		}
+
+		var msg ServerMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("(%d) Could not unmarshal %s: %s", idx, string(data), err)
+		} else if msg.Error == nil || msg.Error.Code != tc.code || msg.Error.Retryable != tc.err.Retryable {
+			t.Errorf("(%d) Expected %+v, got %+v", idx, tc.err, msg.Error)
+			continue
+		}
+
+		if err := msg.Error.DecodeDetails(tc.decoded); err != nil {
+			t.Errorf("(%d) Could not decode details of %s: %s", idx, string(data), err)
+		} else if !reflect.DeepEqual(tc.decoded, tc.expected) {
+			t.Errorf("(%d) Expected details %+v, got %+v", idx, tc.expected, tc.decoded)
+		}
+	}
+
+	if !NewRateLimitedError(time.Second).Retryable {
+		t.Error("Rate limited errors should be retryable")
+	}
+
+	var details RateLimitedErrorDetails
+	if err := NewErrorCode(ErrorCodeRateLimited).DecodeDetails(&details); err == nil {
+		t.Error("Decoding missing details should fail")
+	}
+}
+
+func TestBroadcastInternalClientMessage(t *testing.T) {
+	data := json.RawMessage(`{"text":"hello"}`)
+	large := json.RawMessage("\"" + strings.Repeat("x", MaxBroadcastDataSize) + "\"")
+	valid_messages := []testCheckValid{
+		&BroadcastInternalClientMessage{
+			Backend: "the-backend",
+			Data:    &data,
+		},
+		&BroadcastInternalClientMessage{
+			RoomId: "the-room-*",
+			Data:   &data,
+		},
+		&BroadcastInternalClientMessage{
+			Backend: "https://domain.invalid/",
+			RoomId:  "room-[ab]",
+			Data:    &data,
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&BroadcastInternalClientMessage{},
+		&BroadcastInternalClientMessage{
+			Data: &data,
+		},
+		&BroadcastInternalClientMessage{
+			Backend: "the-backend",
+		},
+		&BroadcastInternalClientMessage{
+			RoomId: "room-[",
+			Data:   &data,
+		},
+		&BroadcastInternalClientMessage{
+			Backend: "the-backend",
+			Data:    &large,
+		},
+		&BroadcastInternalClientMessage{
+			Backend: "the\nbackend",
+			Data:    &data,
+		},
+	}
+
+	testMessages(t, "broadcast", valid_messages, invalid_messages)
+
+	msg := &BroadcastInternalClientMessage{
+		RoomId: "room-*",
+	}
+	if !msg.MatchesRoom("room-1") {
+		t.Errorf("%s should match room-1", msg.RoomId)
+	}
+	if msg.MatchesRoom("other-room") {
+		t.Errorf("%s should not match other-room", msg.RoomId)
+	}
+	if msg.MatchesRoom("") {
+		t.Errorf("%s should not match sessions outside of rooms", msg.RoomId)
+	}
+	msg.RoomId = ""
+	if !msg.MatchesRoom("") || !msg.MatchesRoom("room-1") {
+		t.Error("empty filter should match all rooms")
+	}
+}
+
+func TestRoomFederationServerMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&RoomFederationServerMessage{
+			SignalingUrl: "wss://signaling.remote.invalid/spreed",
+			Url:          "https://cloud.remote.invalid",
+			Token:        "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "https://signaling.remote.invalid",
+			Url:          "http://cloud.remote.invalid:8080/nextcloud/",
+			Token:        "the-token",
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&RoomFederationServerMessage{},
+		&RoomFederationServerMessage{
+			Url:   "https://cloud.remote.invalid",
+			Token: "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "signaling.remote.invalid",
+			Url:          "https://cloud.remote.invalid",
+			Token:        "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "ftp://signaling.remote.invalid",
+			Url:          "https://cloud.remote.invalid",
+			Token:        "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "wss:///spreed",
+			Url:          "https://cloud.remote.invalid",
+			Token:        "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "wss://signaling.remote.invalid",
+			Token:        "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "wss://signaling.remote.invalid",
+			Url:          "wss://cloud.remote.invalid",
+			Token:        "the-token",
+		},
+		&RoomFederationServerMessage{
+			SignalingUrl: "wss://signaling.remote.invalid",
+			Url:          "https://cloud.remote.invalid",
+		},
+	}
+
+	for _, msg := range valid_messages {
+		if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message %+v should be valid, got %s", msg, err)
+		}
+	}
+	for _, msg := range invalid_messages {
+		if err := msg.CheckValid(); err == nil {
+			t.Errorf("Message %+v should not be valid", msg)
+		}
+	}
+}
+
+func TestEchoClientMessage(t *testing.T) {
+	data := json.RawMessage(`{"foo":"bar"}`)
+	maxData := json.RawMessage(`"` + strings.Repeat("x", MaxEchoDataSize-2) + `"`)
+	tooLarge := json.RawMessage(`"` + strings.Repeat("x", MaxEchoDataSize-1) + `"`)
+	valid_messages := []testCheckValid{
+		&EchoClientMessage{},
+		&EchoClientMessage{
+			Data: &data,
+		},
+		&EchoClientMessage{
+			Data: &maxData,
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&EchoClientMessage{
+			Data: &tooLarge,
+		},
+	}
+
+	testMessages(t, "echo", valid_messages, invalid_messages)
+
+	// "echo" doesn't require a payload.
+	msg := ClientMessage{
+		Type:         "echo",
+		fromInternal: true,
+	}
+	if err := msg.CheckValid(); err != nil {
+		t.Errorf("Message %+v should be valid, got %s", msg, err)
+	}
+
+	// Only internal clients may send echo requests.
+	msg = ClientMessage{
+		Type: "echo",
+		Echo: &EchoClientMessage{
+			Data: &data,
+		},
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	}
+}
+
+func TestRenegotiateServerMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&RenegotiateServerMessage{
+			From:     "the-publisher-id",
+			RoomType: "video",
+			Reason:   RenegotiateReasonMcuReconnected,
+		},
+		&RenegotiateServerMessage{
+			From:     "the-publisher-id",
+			RoomType: "video",
+			Reason:   RenegotiateReasonMcuDisconnected,
+		},
+		&RenegotiateServerMessage{
+			From:     "the-publisher-id",
+			RoomType: "screen",
+			Reason:   RenegotiateReasonMcuReconnected,
+		},
+		&RenegotiateServerMessage{
+			From:     "the-publisher-id",
+			RoomType: "video",
+			Reason:   RenegotiateReasonPublisherChanged,
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&RenegotiateServerMessage{},
+		&RenegotiateServerMessage{
+			RoomType: "video",
+			Reason:   RenegotiateReasonMcuReconnected,
+		},
+		&RenegotiateServerMessage{
+			From:   "the-publisher-id",
+			Reason: RenegotiateReasonMcuReconnected,
+		},
+		&RenegotiateServerMessage{
+			From:     "the-publisher-id",
+			RoomType: "video",
+		},
+		&RenegotiateServerMessage{
+			From:     "the-publisher-id",
+			RoomType: "video",
+			Reason:   "unknown-reason",
+		},
+	}
+
+	for _, msg := range valid_messages {
+		if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message %+v should be valid, got %s", msg, err)
+		}
+	}
+	for _, msg := range invalid_messages {
+		if err := msg.CheckValid(); err == nil {
+			t.Errorf("Message %+v should not be valid", msg)
+		}
+	}
+}
+
+// Examples of each client message type, also used as seed corpus for fuzzing.
+var testClientMessages = []string{
+	`{"id":"1","type":"hello","hello":{"version":"1.0","auth":{"url":"https://domain.invalid","params":{"token":"the-token"}}}}`,
+	`{"id":"2","type":"hello","hello":{"version":"1.0","features":["foo"],"client":{"name":"test","version":"1.0"},"auth":{"type":"client","url":"https://domain.invalid:443/","params":{}}}}`,
+	`{"id":"3","type":"hello","hello":{"version":"1.0","auth":{"type":"internal","params":{"random":"abc","token":"def","backend":"https://domain.invalid"}}}}`,
+	`{"id":"4","type":"hello","hello":{"version":"1.0","resumeid":"the-resume-id"}}`,
+	`{"id":"5","type":"bye","bye":{}}`,
+	`{"id":"6","type":"room","room":{"roomid":"the-room-id","sessionid":"the-room-session-id"}}`,
+	`{"id":"7","type":"room","room":{"roomid":""}}`,
+	`{"id":"8","type":"message","message":{"recipient":{"type":"session","sessionid":"the-session-id"},"data":{"type":"offer","payload":{"sdp":"v=0"}}}}`,
+	`{"id":"9","type":"message","message":{"recipient":{"type":"user","userid":"the-user-id"},"data":"hello"}}`,
+	`{"id":"10","type":"message","message":{"recipient":{"type":"room"},"requestreceipt":false,"data":{}}}`,
+	`{"id":"11","type":"control","control":{"recipient":{"type":"session","sessionid":"the-session-id"},"data":{"type":"mute"}}}`,
+	`{"id":"12","type":"internal","internal":{"type":"addsession","addsession":{"sessionid":"the-session-id","roomid":"the-room-id","userid":"the-user-id","user":{},"flags":1,"options":{"actorId":"actor","actorType":"guests"}}}}`,
+	`{"id":"13","type":"internal","internal":{"type":"updatesession","updatesession":{"sessionid":"the-session-id","roomid":"the-room-id","flags":0}}}`,
+	`{"id":"14","type":"internal","internal":{"type":"removesession","removesession":{"sessionid":"the-session-id","roomid":"the-room-id","userid":"the-user-id"}}}`,
+	`{"id":"15","type":"transient","transient":{"type":"set","key":"foo","value":{"bar":[1,2,3]},"ttl":60}}`,
+	`{"id":"16","type":"transient","transient":{"type":"remove","key":"foo"}}`,
+	`{"id":"17","type":"capabilities"}`,
+	`{"id":"18","type":"capabilities","capabilities":{}}`,
+	`{"id":"19","type":"kick","kick":{"sessionid":"the-session-id","reason":"the-reason"}}`,
+	`{"id":"20","type":"echo","echo":{"data":{"foo":["bar",1]}}}`,
+	`{"id":"21","type":"echo"}`,
+	`{"id":"22","type":"internal","internal":{"type":"broadcast","broadcast":{"backend":"the-backend","roomid":"room-*","data":{"text":"hello"}}}}`,
+	`{"id":"23","type":"move","move":{"sessionid":"the-session-id","roomid":"the-room-id"}}`,
+}
+
+// checkClientMessageRoundTrip unmarshals the given data and checks that valid
+// messages serialize to the same data after another round-trip.
+func checkClientMessageRoundTrip(t *testing.T, data []byte) {
+	var msg ClientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	if err := msg.CheckValid(); err != nil {
+		return
+	}
+
+	encoded, err := json.Marshal(&msg)
+	if err != nil {
+		t.Fatalf("Could not marshal valid message %+v: %s", msg, err)
+	}
+
+	var msg2 ClientMessage
+	if err := json.Unmarshal(encoded, &msg2); err != nil {
+		t.Fatalf("Could not unmarshal %s: %s", string(encoded), err)
+	}
+	if err := msg2.CheckValid(); err != nil {
+		t.Fatalf("Message %s should still be valid, got %s", string(encoded), err)
+	}
+
+	encoded2, err := json.Marshal(&msg2)
+	if err != nil {
+		t.Fatalf("Could not marshal message %+v: %s", msg2, err)
+	}
+	if bytes.Equal(encoded, encoded2) {
+		return
+	}
+
+	// The encoding may differ (e.g. for escaped characters), so compare the
+	// decoded values.
+	var decoded interface{}
+	var decoded2 interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Could not decode %s: %s", string(encoded), err)
+	}
+	if err := json.Unmarshal(encoded2, &decoded2); err != nil {
+		t.Fatalf("Could not decode %s: %s", string(encoded2), err)
+	}
+	if !reflect.DeepEqual(decoded, decoded2) {
+		t.Errorf("Message changed after round-trip, expected %s, got %s", string(encoded), string(encoded2))
+	}
+}
+
+func TestClientMessageRoundTrip(t *testing.T) {
+	for _, data := range testClientMessages {
+		// Some messages may only be sent by internal clients.
+		msg := ClientMessage{
+			fromInternal: true,
+		}
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			t.Errorf("Could not unmarshal %s: %s", data, err)
+		} else if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message %s should be valid, got %s", data, err)
+		}
+
+		checkClientMessageRoundTrip(t, []byte(data))
+	}
+}
+
+func newTestJoinEvent(count int) *EventServerMessage {
+	user := json.RawMessage(`{"displayname":"Test User with a rather long display name"}`)
+	event := &EventServerMessage{
+		Target: "room",
+		Type:   "join",
+	}
+	for i := 0; i < count; i++ {
+		event.Join = append(event.Join, &EventServerMessageSessionEntry{
+			SessionId:     fmt.Sprintf("session-%d", i),
+			UserId:        fmt.Sprintf("user-%d", i),
+			User:          &user,
+			RoomSessionId: fmt.Sprintf("room-session-%d", i),
+		})
+	}
+	return event
+}
+
+func TestEventServerMessageSplit(t *testing.T) {
+	event := newTestJoinEvent(500)
+	if events := event.Split(0); len(events) != 1 || events[0] != event {
+		t.Errorf("Expected unmodified event, got %+v", events)
+	}
+	if events := event.Split(1024 * 1024); len(events) != 1 || events[0] != event {
+		t.Errorf("Expected unmodified event, got %+v", events)
+	}
+
+	maxSize := 4096
+	events := event.Split(maxSize)
+	if len(events) < 2 {
+		t.Fatalf("Expected multiple events, got %+v", events)
+	}
+
+	var join []*EventServerMessageSessionEntry
+	for idx, e := range events {
+		if e.Target != event.Target || e.Type != event.Type {
+			t.Errorf("Expected %s/%s event, got %+v", event.Target, event.Type, e)
+		}
+		if e.Chunk == nil {
+			t.Fatalf("Expected chunk information in %+v", e)
+		} else if e.Chunk.Sequence != idx {
+			t.Errorf("Expected sequence %d, got %+v", idx, e.Chunk)
+		} else if e.Chunk.Final != (idx == len(events)-1) {
+			t.Errorf("Unexpected final flag in chunk %d, got %+v", idx, e.Chunk)
+		}
+
+		data, err := json.Marshal(&ServerMessage{
+			Type:  "event",
+			Event: e,
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(data) > maxSize {
+			t.Errorf("Chunk %d has %d bytes, expected at most %d", idx, len(data), maxSize)
+		}
+		join = append(join, e.Join...)
+	}
+
+	if !reflect.DeepEqual(join, event.Join) {
+		t.Errorf("Expected reassembled entries to match original %+v, got %+v", event.Join, join)
+	}
+	if event.Chunk != nil {
+		t.Errorf("Original event should not be modified, got %+v", event.Chunk)
+	}
+}
+
+func TestEventServerMessageSplitLeaveReasons(t *testing.T) {
+	event := &EventServerMessage{
+		Target:       "room",
+		Type:         "leave",
+		LeaveReasons: make(map[string]string),
+	}
+	for i := 0; i < 500; i++ {
+		sessionId := fmt.Sprintf("session-%d", i)
+		event.Leave = append(event.Leave, sessionId)
+		if i%2 == 0 {
+			event.LeaveReasons[sessionId] = LeaveReasonDisconnected
+		}
+	}
+
+	events := event.Split(1024)
+	if len(events) < 2 {
+		t.Fatalf("Expected multiple events, got %+v", events)
+	}
+
+	var leave []string
+	reasons := make(map[string]string)
+	for idx, e := range events {
+		for sessionId, reason := range e.LeaveReasons {
+			found := false
+			for _, s := range e.Leave {
+				if s == sessionId {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("Chunk %d contains reason for session %s that is not in %+v", idx, sessionId, e.Leave)
+			}
+			reasons[sessionId] = reason
+		}
+		leave = append(leave, e.Leave...)
+	}
+
+	if !reflect.DeepEqual(leave, event.Leave) {
+		t.Errorf("Expected reassembled entries to match original %+v, got %+v", event.Leave, leave)
+	}
+	if !reflect.DeepEqual(reasons, event.LeaveReasons) {
+		t.Errorf("Expected reassembled reasons to match original %+v, got %+v", event.LeaveReasons, reasons)
+	}
+}
+
+func TestEventServerMessageSplitUsers(t *testing.T) {
+	event := &EventServerMessage{
+		Target: "participants",
+		Type:   "update",
+		Update: &RoomEventServerMessage{
+			RoomId: "the-room-id",
+			Changed: []map[string]interface{}{
+				{"sessionId": "session-0", "inCall": 1},
+			},
+		},
+	}
+	for i := 0; i < 100; i++ {
+		event.Update.Users = append(event.Update.Users, map[string]interface{}{
+			"sessionId": fmt.Sprintf("session-%d", i),
+			"inCall":    1,
+		})
+	}
+
+	events := event.Split(1024)
+	if len(events) < 2 {
+		t.Fatalf("Expected multiple events, got %+v", events)
+	}
+
+	var users []map[string]interface{}
+	for idx, e := range events {
+		if e.Update.RoomId != event.Update.RoomId {
+			t.Errorf("Expected room %s, got %+v", event.Update.RoomId, e.Update)
+		}
+		if idx == 0 {
+			if !reflect.DeepEqual(e.Update.Changed, event.Update.Changed) {
+				t.Errorf("Expected changed %+v in first chunk, got %+v", event.Update.Changed, e.Update.Changed)
+			}
+		} else if len(e.Update.Changed) > 0 {
+			t.Errorf("Expected no changed entries in chunk %d, got %+v", idx, e.Update.Changed)
+		}
+		users = append(users, e.Update.Users...)
+	}
+
+	if !reflect.DeepEqual(users, event.Update.Users) {
+		t.Errorf("Expected reassembled users to match original %+v, got %+v", event.Update.Users, users)
+	}
+}
+
+func benchmarkJoinEvent(b *testing.B, maxSize int) {
+	event := newTestJoinEvent(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range event.Split(maxSize) {
+			if _, err := json.Marshal(&ServerMessage{
+				Type:  "event",
+				Event: e,
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkJoinEventMonolithic(b *testing.B) {
+	benchmarkJoinEvent(b, 0)
+}
+
+func BenchmarkJoinEventChunked(b *testing.B) {
+	benchmarkJoinEvent(b, 16*1024)
+}
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("could not join room: %w", NewError("no_such_room", "The room does not exist."))
+	if !errors.Is(err, &Error{Code: "no_such_room"}) {
+		t.Errorf("Expected %s to match by code", err)
+	}
+	if errors.Is(err, &Error{Code: "room_join_failed"}) {
+		t.Errorf("Expected %s not to match other code", err)
+	}
+	if errors.Is(err, errors.New("no_such_room")) {
+		t.Errorf("Expected %s not to match other error types", err)
+	}
+
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Errorf("Expected %s to contain a signaling error", err)
+	} else if e.Message != "The room does not exist." {
+		t.Errorf("Unexpected message %s", e.Message)
+	}
+}
+
+func TestAnswerOfferMessageConstructors(t *testing.T) {
+	offer, err := NewOffer("to", "from", "video", "v=0")
+	if err != nil {
+		t.Fatal(err)
+	} else if offer.Type != "offer" || offer.To != "to" || offer.From != "from" || offer.RoomType != "video" {
+		t.Errorf("Unexpected offer %+v", offer)
+	} else if offer.Payload["type"] != "offer" || offer.Payload["sdp"] != "v=0" {
+		t.Errorf("Unexpected offer payload %+v", offer.Payload)
+	}
+
+	answer, err := NewAnswer("to", "from", "screen", "v=0")
+	if err != nil {
+		t.Fatal(err)
+	} else if answer.Type != "answer" || answer.RoomType != "screen" {
+		t.Errorf("Unexpected answer %+v", answer)
+	} else if answer.Payload["type"] != "answer" || answer.Payload["sdp"] != "v=0" {
+		t.Errorf("Unexpected answer payload %+v", answer.Payload)
+	}
+
+	candidate, err := NewCandidate("to", "from", "video", "candidate:0 1 UDP 2122252543 192.0.2.1 12345 typ host", "0", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if candidate.Type != "candidate" {
+		t.Errorf("Unexpected candidate %+v", candidate)
+	} else if data, err := json.Marshal(candidate.Payload); err != nil {
+		t.Error(err)
+	} else if expected := `{"candidate":{"candidate":"candidate:0 1 UDP 2122252543 192.0.2.1 12345 typ host","sdpMLineIndex":0,"sdpMid":"0"}}`; string(data) != expected {
+		t.Errorf("Expected payload %s, got %s", expected, string(data))
+	}
+
+	if _, err := NewOffer("to", "from", "video", ""); err == nil {
+		t.Error("Offers need a sdp")
+	}
+	if _, err := NewAnswer("to", "from", "video", ""); err == nil {
+		t.Error("Answers need a sdp")
+	}
+	if _, err := NewOffer("", "from", "video", "v=0"); err == nil {
+		t.Error("Offers need a recipient")
+	}
+	if _, err := NewCandidate("to", "from", "video", "", "0", 0); err == nil {
+		t.Error("Candidates need a candidate")
+	}
+	if _, err := NewCandidate("to", "from", "video", "candidate:0", "0", -1); err == nil {
+		t.Error("Candidates need a valid sdpMLineIndex")
+	}
+}
+
+func TestRoomErrorServerMessage(t *testing.T) {
+	msg := NewRoomErrorServerMessage("mcu_unavailable", "The MCU is not available.")
+	if msg.Id != "" {
+		t.Errorf("Room errors should not have an id, got %s", msg.Id)
+	}
+	if msg.Type != "error" || msg.Error.Code != "mcu_unavailable" || msg.Error.Target != ErrorTargetRoom {
+		t.Errorf("Unexpected room error %+v", msg)
+	}
+
+	session := &DummySession{}
+	if msg.CloseAfterSend(session) {
+		t.Errorf("Room errors should not close the session")
+	}
+}
+
+func TestRoomlistEvents(t *testing.T) {
+	properties := json.RawMessage(`{"foo":"bar"}`)
+
+	invite := NewInviteEvent("room-1", &properties)
+	if invite.Type != "event" || invite.Event.Target != "roomlist" || invite.Event.Type != "invite" {
+		t.Errorf("Unexpected invite event %+v", invite)
+	} else if invite.Event.Invite == nil || invite.Event.Invite.RoomId != "room-1" || invite.Event.Invite.Properties != &properties {
+		t.Errorf("Unexpected invite payload %+v", invite.Event.Invite)
+	}
+
+	update := NewUpdateEvent("room-1", &properties)
+	if update.Type != "event" || update.Event.Target != "roomlist" || update.Event.Type != "update" {
+		t.Errorf("Unexpected update event %+v", update)
+	} else if update.Event.Update == nil || update.Event.Update.RoomId != "room-1" || update.Event.Update.Properties != &properties {
+		t.Errorf("Unexpected update payload %+v", update.Event.Update)
+	}
+
+	disinvite := NewDisinviteEvent("room-1", DisinviteReasonDeleted)
+	if disinvite.Type != "event" || disinvite.Event.Target != "roomlist" || disinvite.Event.Type != "disinvite" {
+		t.Errorf("Unexpected disinvite event %+v", disinvite)
+	} else if disinvite.Event.Disinvite == nil || disinvite.Event.Disinvite.RoomId != "room-1" || disinvite.Event.Disinvite.Reason != DisinviteReasonDeleted {
+		t.Errorf("Unexpected disinvite payload %+v", disinvite.Event.Disinvite)
+	}
+}
+
+// testMessageRoom is a fake "MessageRoom" with the given id.
+type testMessageRoom string
+
+func (r testMessageRoom) Id() string {
+	return string(r)
+}
+
+// testMessageSession is a fake "MessageSession" that can be used to check
+// protocol messages without a hub.
+type testMessageSession struct {
+	room MessageRoom
+}
+
+func (s *testMessageSession) CurrentRoom() MessageRoom {
+	return s.room
+}
+
+func TestRoomlistEventsCloseAfterSend(t *testing.T) {
+	testcases := []struct {
+		msg     *ServerMessage
+		room    string
+		closing bool
+	}{
+		{NewDisinviteEvent("room-1", DisinviteReasonDisinvited), "room-1", true},
+		{NewDisinviteEvent("room-1", DisinviteReasonDeleted), "room-1", true},
+		{NewDisinviteEvent("room-1", DisinviteReasonDisinvited), "room-2", false},
+		{NewDisinviteEvent("room-1", DisinviteReasonDisinvited), "", false},
+		{NewInviteEvent("room-1", nil), "room-1", false},
+		{NewUpdateEvent("room-1", nil), "room-1", false},
+	}
+
+	for idx, tc := range testcases {
+		session := &testMessageSession{}
+		if tc.room != "" {
+			session.room = testMessageRoom(tc.room)
+		}
+		if closing := tc.msg.CloseAfterSend(session); closing != tc.closing {
+			t.Errorf("%d: expected CloseAfterSend %v for %s in room %q, got %v", idx, tc.closing, tc.msg.Event.Type, tc.room, closing)
+		}
+	}
+
+	if NewDisinviteEvent("room-1", DisinviteReasonDisinvited).CloseAfterSend(nil) {
+		t.Errorf("Disinvite should not close without a session")
+	}
+}
+
+func TestSessionsImplementMessageSession(t *testing.T) {
+	// Sessions that are not in a room must return an untyped nil.
+	sessions := []Session{
+		&ClientSession{},
+		&VirtualSession{},
+		&DummySession{},
+	}
+	for _, session := range sessions {
+		if room := session.CurrentRoom(); room != nil {
+			t.Errorf("Expected no room for %T, got %+v", session, room)
+		}
+	}
+
+	bye := &ServerMessage{
+		Type: "bye",
+	}
+	if !bye.CloseAfterSend(nil) || !bye.CloseAfterSend(&testMessageSession{}) {
+		t.Errorf("A bye should always close the connection")
+	}
+}
+
+func TestEventServerMessageSessionPrevious(t *testing.T) {
+	user1 := json.RawMessage(`{"displayname":"Alice"}`)
+	user2 := json.RawMessage(`{"displayname":"Bob"}`)
+	large := json.RawMessage(`{"data":"` + strings.Repeat("x", maxChangePreviousUserSize) + `"}`)
+	null := json.RawMessage("null")
+	alice := "Alice"
+	empty := ""
+
+	testcases := []struct {
+		previous *EventServerMessageSessionEntry
+		current  *EventServerMessageSessionEntry
+		expected *EventServerMessageSessionPrevious
+	}{
+		{
+			&EventServerMessageSessionEntry{User: &user1, DisplayName: "Alice"},
+			&EventServerMessageSessionEntry{User: &user1, DisplayName: "Alice"},
+			nil,
+		},
+		{
+			&EventServerMessageSessionEntry{User: &user1, DisplayName: "Alice"},
+			&EventServerMessageSessionEntry{User: &user2, DisplayName: "Bob"},
+			&EventServerMessageSessionPrevious{User: &user1, DisplayName: &alice},
+		},
+		{
+			&EventServerMessageSessionEntry{},
+			&EventServerMessageSessionEntry{User: &user2, DisplayName: "Bob"},
+			&EventServerMessageSessionPrevious{User: &null, DisplayName: &empty},
+		},
+		{
+			&EventServerMessageSessionEntry{User: &large},
+			&EventServerMessageSessionEntry{User: &user2},
+			&EventServerMessageSessionPrevious{UserTruncated: true},
+		},
+	}
+	for idx, tc := range testcases {
+		if previous := newEventServerMessageSessionPrevious(tc.previous, tc.current); !reflect.DeepEqual(previous, tc.expected) {
+			t.Errorf("Expected %+v for %d, got %+v", tc.expected, idx, previous)
+		}
+	}
+}
@@ -42,6 +42,7 @@ import (
 var (
 	ErrNotRedirecting         = errors.New("not redirecting to different host")
 	ErrUnsupportedContentType = errors.New("unsupported_content_type")
+	ErrBackendUnhealthy       = errors.New("backend_unhealthy")
 )
 
 const (
@@ -51,6 +52,9 @@ const (
 	// Name of capability to enable the "v3" API for the signaling endpoint.
 	FeatureSignalingV3Api = "signaling-v3"
 
+	// Path of the capabilities endpoint relative to the Nextcloud url.
+	PathToOcsCapabilities = "ocs/v2.php/cloud/capabilities"
+
 	// Cache received capabilities for one hour.
 	CapabilitiesCacheDuration = time.Hour
 )
@@ -59,16 +63,18 @@ type BackendClient struct {
 	hub       *Hub
 	transport *http.Transport
 	version   string
-	backends  *BackendConfiguration
+	backends  BackendResolver
 	clients   map[string]*HttpClientPool
 
 	mu sync.Mutex
 
 	maxConcurrentRequestsPerHost int
 
-	capabilitiesLock sync.RWMutex
-	capabilities     map[string]map[string]interface{}
-	nextCapabilities map[string]time.Time
+	capabilitiesLock   sync.RWMutex
+	capabilities       map[string]map[string]interface{}
+	nextCapabilities   map[string]time.Time
+	healthConfig       BackendHealthConfig
+	capabilitiesHealth map[string]*backendHealth
 }
 
 func NewBackendClient(config *goconf.ConfigFile, maxConcurrentRequestsPerHost int, version string) (*BackendClient, error) {
@@ -77,6 +83,12 @@ func NewBackendClient(config *goconf.ConfigFile, maxConcurrentRequestsPerHost in
 		return nil, err
 	}
 
+	return NewBackendClientWithResolver(config, backends, maxConcurrentRequestsPerHost, version)
+}
+
+// NewBackendClientWithResolver creates a client that uses the given resolver
+// to get the backends instead of the backends from the configuration.
+func NewBackendClientWithResolver(config *goconf.ConfigFile, backends BackendResolver, maxConcurrentRequestsPerHost int, version string) (*BackendClient, error) {
 	skipverify, _ := config.GetBool("backend", "skipverify")
 	if skipverify {
 		log.Println("WARNING: Backend verification is disabled!")
@@ -98,13 +110,142 @@ func NewBackendClient(config *goconf.ConfigFile, maxConcurrentRequestsPerHost in
 
 		maxConcurrentRequestsPerHost: maxConcurrentRequestsPerHost,
 
-		capabilities:     make(map[string]map[string]interface{}),
-		nextCapabilities: make(map[string]time.Time),
+		capabilities:       make(map[string]map[string]interface{}),
+		nextCapabilities:   make(map[string]time.Time),
+		healthConfig:       getConfiguredBackendHealth(config),
+		capabilitiesHealth: make(map[string]*backendHealth),
 	}, nil
 }
 
 func (b *BackendClient) Reload(config *goconf.ConfigFile) {
-	b.backends.Reload(config)
+	if _, ok := b.backends.(BackendReloader); !ok {
+		// The backends are not loaded from the configuration.
+		return
+	}
+
+	changes, err := b.ReloadBackends(config)
+	if err != nil {
+		log.Printf("Could not reload backends, keeping current configuration: %s", err)
+	} else if !changes.IsEmpty() {
+		log.Printf("Reloaded backends: %s", changes)
+	}
+}
+
+// ReloadBackends updates the backends from the given configuration and returns
+// the changes, see BackendReloader.ReloadBackends for details.
+func (b *BackendClient) ReloadBackends(config *goconf.ConfigFile) (*BackendChanges, error) {
+	reloader, ok := b.backends.(BackendReloader)
+	if !ok {
+		return nil, fmt.Errorf("backends can't be reloaded from the configuration")
+	}
+
+	changes, err := reloader.ReloadBackends(config)
+	if err != nil {
+		return nil, err
+	}
+
+	b.pruneCapabilities(changes)
+	b.prunePools()
+	return changes, nil
+}
+
+// SetUrlChangedHandler sets the handler that is called when the url of a
+// backend changed, see BackendReloader.SetUrlChangedHandler for details. The
+// urls of backends that can't be reloaded never change.
+func (b *BackendClient) SetUrlChangedHandler(handler BackendUrlChangedHandler) {
+	if reloader, ok := b.backends.(BackendReloader); ok {
+		reloader.SetUrlChangedHandler(handler)
+	}
+}
+
+// ReplaceBackends switches to the given backends and returns the changes, see
+// BackendReloader.ReplaceBackends for details.
+func (b *BackendClient) ReplaceBackends(backends *BackendConfiguration) (*BackendChanges, error) {
+	reloader, ok := b.backends.(BackendReloader)
+	if !ok {
+		return nil, fmt.Errorf("backends can't be replaced")
+	}
+
+	changes, err := reloader.ReplaceBackends(backends)
+	if err != nil {
+		return nil, err
+	}
+
+	b.pruneCapabilities(changes)
+	b.prunePools()
+	return changes, nil
+}
+
+// pruneCapabilities removes the cached capabilities and health states of urls
+// that are no longer handled by a backend or whose backend was modified.
+func (b *BackendClient) pruneCapabilities(changes *BackendChanges) {
+	modified := make(map[string]bool)
+	if changes != nil {
+		for _, id := range changes.Modified {
+			modified[id] = true
+		}
+	}
+
+	isStale := func(key string) bool {
+		u, err := url.Parse(key)
+		if err != nil {
+			return true
+		}
+
+		backend := b.GetBackend(u)
+		return backend == nil || modified[backend.Id()]
+	}
+
+	b.capabilitiesLock.Lock()
+	defer b.capabilitiesLock.Unlock()
+
+	for key := range b.capabilities {
+		if isStale(key) {
+			delete(b.capabilities, key)
+			delete(b.nextCapabilities, key)
+		}
+	}
+	for key := range b.capabilitiesHealth {
+		if isStale(key) {
+			delete(b.capabilitiesHealth, key)
+		}
+	}
+}
+
+// prunePools releases the client pools and idle connections of hosts that are
+// no longer handled by a backend.
+func (b *BackendClient) prunePools() {
+	reloader, ok := b.backends.(BackendReloader)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	removed := false
+	for host := range b.clients {
+		if !reloader.HasBackendsForHost(host) {
+			delete(b.clients, host)
+			removed = true
+		}
+	}
+	b.mu.Unlock()
+
+	if removed {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// Close releases the configured backends and closes any idle connections to
+// them.
+func (b *BackendClient) Close() {
+	if reloader, ok := b.backends.(BackendReloader); ok {
+		reloader.Close()
+	}
+
+	b.mu.Lock()
+	b.clients = make(map[string]*HttpClientPool)
+	b.mu.Unlock()
+	b.transport.CloseIdleConnections()
 }
 
 func (b *BackendClient) getPool(url *url.URL) (*HttpClientPool, error) {
@@ -139,19 +280,45 @@ func (b *BackendClient) getPool(url *url.URL) (*HttpClientPool, error) {
 	return pool, nil
 }
 
+// GetCompatBackend returns the backend of the deprecated compat configuration
+// or nil if no such backend is configured.
 func (b *BackendClient) GetCompatBackend() *Backend {
-	return b.backends.GetCompatBackend()
+	if compat, ok := b.backends.(BackendCompatResolver); ok {
+		return compat.GetCompatBackend()
+	}
+
+	return nil
+}
+
+// SetAllowAll enables or disables that all backend hosts are allowed and
+// returns the previous state.
+func (b *BackendClient) SetAllowAll(allow bool) (bool, error) {
+	compat, ok := b.backends.(BackendCompatResolver)
+	if !ok {
+		return false, fmt.Errorf("backends don't support changing allowall")
+	}
+
+	return compat.SetAllowAll(allow)
 }
 
 func (b *BackendClient) GetBackend(u *url.URL) *Backend {
+	if u == nil {
+		return nil
+	}
+
 	return b.backends.GetBackend(u)
 }
 
+// GetBackends returns all known backends.
 func (b *BackendClient) GetBackends() []*Backend {
 	return b.backends.GetBackends()
 }
 
 func (b *BackendClient) IsUrlAllowed(u *url.URL) bool {
+	if u == nil {
+		return false
+	}
+
 	return b.backends.IsUrlAllowed(u)
 }
 
@@ -178,7 +345,8 @@ func (b *BackendClient) getCapabilities(ctx context.Context, u *url.URL) (map[st
 	now := time.Now()
 
 	b.capabilitiesLock.RLock()
-	if caps, found := b.capabilities[key]; found {
+	caps, found := b.capabilities[key]
+	if found {
 		if next, found := b.nextCapabilities[key]; found && next.After(now) {
 			b.capabilitiesLock.RUnlock()
 			return caps, nil
@@ -188,17 +356,88 @@ func (b *BackendClient) getCapabilities(ctx context.Context, u *url.URL) (map[st
 
 	capUrl := *u
 	if !strings.Contains(capUrl.Path, "ocs/v2.php") {
-		if !strings.HasSuffix(capUrl.Path, "/") {
-			capUrl.Path += "/"
+		if requestUrl := b.GetBackend(u).requestURLFor(u, PathToOcsCapabilities); requestUrl == "" {
+			capUrl.Path = joinUrlPath(capUrl.Path, PathToOcsCapabilities)
+		} else if parsed, err := url.Parse(requestUrl); err != nil {
+			return nil, err
+		} else {
+			capUrl = *parsed
 		}
-		capUrl.Path = capUrl.Path + "ocs/v2.php/cloud/capabilities"
 	} else if pos := strings.Index(capUrl.Path, "/ocs/v2.php/"); pos >= 0 {
 		capUrl.Path = capUrl.Path[:pos+11] + "/cloud/capabilities"
 	}
 
+	health := b.getCapabilitiesHealth(capUrl.String())
+	if !health.CanRetry(now) {
+		// Don't send requests to a backend that failed recently, use the
+		// previous capabilities (if available) until it may be retried.
+		if found {
+			return caps, nil
+		}
+		return nil, ErrBackendUnhealthy
+	}
+
+	if backend := b.GetBackend(u); backend != nil {
+		var release func()
+		var err error
+		if found {
+			// Don't wait for a saturated backend, use the previous
+			// capabilities until a request slot is available.
+			if release, err = backend.TryAcquireRequest(); err != nil {
+				return caps, nil
+			}
+		} else if release, err = backend.AcquireRequest(ctx); err != nil {
+			log.Printf("Could not acquire request slot for backend %s: %s", backend.Id(), err)
+			return nil, err
+		}
+		defer release()
+	}
+
 	log.Printf("Capabilities expired for %s, updating", capUrl.String())
+	capa, err := b.fetchCapabilities(ctx, &capUrl)
+	if err != nil {
+		if ctx.Err() == nil && health.RecordFailure(time.Now()) {
+			log.Printf("Backend %s is unhealthy, retrying after %s", capUrl.Host, health.RetryAfter())
+		}
+		return nil, err
+	}
 
-	pool, err := b.getPool(&capUrl)
+	if health.RecordSuccess(time.Now()) {
+		log.Printf("Backend %s is healthy again", capUrl.Host)
+	}
+	if capa == nil {
+		return nil, nil
+	}
+
+	cacheDuration := CapabilitiesCacheDuration
+	if !health.IsHealthy() {
+		// Probe a recovering backend again soon until it reached the number of
+		// consecutive successes to be healthy.
+		cacheDuration = b.healthConfig.InitialBackoff
+	}
+
+	log.Printf("Received capabilities %+v from %s", capa, capUrl.String())
+	b.capabilitiesLock.Lock()
+	b.capabilities[key] = capa
+	b.nextCapabilities[key] = now.Add(cacheDuration)
+	b.capabilitiesLock.Unlock()
+	return capa, nil
+}
+
+func (b *BackendClient) getCapabilitiesHealth(key string) *backendHealth {
+	b.capabilitiesLock.Lock()
+	defer b.capabilitiesLock.Unlock()
+
+	health, found := b.capabilitiesHealth[key]
+	if !found {
+		health = newBackendHealth(b.healthConfig)
+		b.capabilitiesHealth[key] = health
+	}
+	return health
+}
+
+func (b *BackendClient) fetchCapabilities(ctx context.Context, capUrl *url.URL) (map[string]interface{}, error) {
+	pool, err := b.getPool(capUrl)
 	if err != nil {
 		log.Printf("Could not get client pool for host %s: %s", capUrl.Host, err)
 		return nil, err
@@ -213,7 +452,7 @@ func (b *BackendClient) getCapabilities(ctx context.Context, u *url.URL) (map[st
 
 	req, err := http.NewRequestWithContext(ctx, "GET", capUrl.String(), nil)
 	if err != nil {
-		log.Printf("Could not create request to %s: %s", &capUrl, err)
+		log.Printf("Could not create request to %s: %s", capUrl, err)
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
@@ -243,7 +482,7 @@ func (b *BackendClient) getCapabilities(ctx context.Context, u *url.URL) (map[st
 		log.Printf("Could not decode OCS response %s from %s: %s", string(body), capUrl.String(), err)
 		return nil, err
 	} else if ocs.Ocs == nil || ocs.Ocs.Data == nil {
-		log.Printf("Incomplete OCS response %s from %s", string(body), u)
+		log.Printf("Incomplete OCS response %s from %s", string(body), capUrl.String())
 		return nil, fmt.Errorf("incomplete OCS response")
 	}
 
@@ -259,11 +498,6 @@ func (b *BackendClient) getCapabilities(ctx context.Context, u *url.URL) (map[st
 		return nil, nil
 	}
 
-	log.Printf("Received capabilities %+v from %s", capa, capUrl.String())
-	b.capabilitiesLock.Lock()
-	b.capabilities[key] = capa
-	b.nextCapabilities[key] = now.Add(CapabilitiesCacheDuration)
-	b.capabilitiesLock.Unlock()
 	return capa, nil
 }
 
@@ -315,6 +549,15 @@ func (b *BackendClient) PerformJSONRequest(ctx context.Context, u *url.URL, requ
 		requestUrl = u
 	}
 
+	if backend := b.backends.GetBackend(u); backend != nil {
+		release, err := backend.AcquireRequest(ctx)
+		if err != nil {
+			log.Printf("Could not acquire request slot for backend %s: %s", backend.Id(), err)
+			return err
+		}
+		defer release()
+	}
+
 	pool, err := b.getPool(u)
 	if err != nil {
 		log.Printf("Could not get client pool for host %s: %s", u.Host, err)
@@ -30,7 +30,10 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
@@ -206,3 +209,467 @@ func TestPostOnRedirectStatusFound(t *testing.T) {
 		t.Errorf("Expected empty response, got %+v", response)
 	}
 }
+
+type testBackendResolver struct {
+	backend *Backend
+}
+
+func (r *testBackendResolver) GetBackend(u *url.URL) *Backend {
+	if u.Host != r.backend.ParsedURL().Host {
+		return nil
+	}
+
+	return r.backend
+}
+
+func (r *testBackendResolver) GetSecret(u *url.URL) []byte {
+	if backend := r.GetBackend(u); backend != nil {
+		return backend.Secret()
+	}
+
+	return nil
+}
+
+func (r *testBackendResolver) GetBackends() []*Backend {
+	return []*Backend{r.backend}
+}
+
+func (r *testBackendResolver) IsUrlAllowed(u *url.URL) bool {
+	return r.GetBackend(u) != nil
+}
+
+func TestBackendClientWithResolver(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/one", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+
+		if !ValidateBackendChecksum(r, body, testBackendSecret) {
+			t.Error("Request should be signed with the secret of the resolver")
+		}
+
+		returnOCS(t, w, body)
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/ocs/v2.php/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &testBackendResolver{
+		backend: &Backend{
+			id:        "dynamic",
+			url:       server.URL + "/",
+			parsedUrl: u,
+			secret:    testBackendSecret,
+			allowHttp: true,
+		},
+	}
+	client, err := NewBackendClientWithResolver(goconf.NewConfigFile(), resolver, 1, "0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if backend := client.GetBackend(u); backend != resolver.backend {
+		t.Errorf("Expected backend %+v, got %+v", resolver.backend, backend)
+	}
+	if other, _ := url.Parse("https://domain.invalid/ocs/v2.php/one"); client.IsUrlAllowed(other) {
+		t.Errorf("The url %s should not be allowed", other)
+	}
+	if backends := client.GetBackends(); len(backends) != 1 || backends[0] != resolver.backend {
+		t.Errorf("Expected backends %+v, got %+v", resolver.backend, backends)
+	}
+	if compat := client.GetCompatBackend(); compat != nil {
+		t.Errorf("Expected no compat backend, got %+v", compat)
+	}
+	if _, err := client.SetAllowAll(true); err == nil {
+		t.Error("Changing allowall should fail")
+	}
+	if _, err := client.ReloadBackends(goconf.NewConfigFile()); err == nil {
+		t.Error("Reloading the backends should fail")
+	}
+
+	ctx := context.Background()
+	request := map[string]string{
+		"foo": "bar",
+	}
+	var response map[string]string
+	if err := client.PerformJSONRequest(ctx, u, request, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response == nil || !reflect.DeepEqual(request, response) {
+		t.Errorf("Expected %+v, got %+v", request, response)
+	}
+}
+
+func TestBackendClientCapabilitiesBackoff(t *testing.T) {
+	var mu sync.Mutex
+	failing := true
+	capabilitiesRequests := 0
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/cloud/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		capabilitiesRequests++
+		if failing {
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		returnOCS(t, w, []byte(`{"version":{},"capabilities":{"spreed":{"features":["signaling-v3"]}}}`))
+	})
+	r.HandleFunc("/ocs/v2.php/one", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+
+		returnOCS(t, w, body)
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/ocs/v2.php/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "allowed", u.Host)
+	config.AddOption("backend", "secret", string(testBackendSecret))
+	config.AddOption("backend", "allowhttp", "true")
+	config.AddOption("backend", "health_threshold", "1")
+	client, err := NewBackendClient(config, 1, "0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if client.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) {
+			t.Errorf("Should not have capability while backend is failing")
+		}
+	}
+
+	mu.Lock()
+	if capabilitiesRequests != 1 {
+		t.Errorf("Expected one capabilities request while in backoff, got %d", capabilitiesRequests)
+	}
+	failing = false
+	mu.Unlock()
+
+	// Skip the backoff of the unhealthy backend.
+	client.capabilitiesLock.Lock()
+	for _, health := range client.capabilitiesHealth {
+		health.mu.Lock()
+		health.retryAfter = time.Time{}
+		health.mu.Unlock()
+	}
+	client.capabilitiesLock.Unlock()
+
+	if !client.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) {
+		t.Errorf("Should have capability after backend recovered")
+	}
+
+	mu.Lock()
+	if capabilitiesRequests != 2 {
+		t.Errorf("Expected two capabilities requests, got %d", capabilitiesRequests)
+	}
+	mu.Unlock()
+}
+
+func TestBackendClientCapabilitiesRecovering(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/cloud/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		returnOCS(t, w, []byte(`{"version":{},"capabilities":{"spreed":{"features":["signaling-v3"]}}}`))
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/ocs/v2.php/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "allowed", u.Host)
+	config.AddOption("backend", "secret", string(testBackendSecret))
+	config.AddOption("backend", "allowhttp", "true")
+	config.AddOption("backend", "health_threshold", "3")
+	client, err := NewBackendClient(config, 1, "0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Simulate a backend that failed before.
+	health := client.getCapabilitiesHealth(server.URL + "/ocs/v2.php/cloud/capabilities")
+	health.RecordFailure(time.Now())
+	health.mu.Lock()
+	health.retryAfter = time.Time{}
+	health.mu.Unlock()
+
+	checkNextCapabilities := func(minDuration time.Duration, maxDuration time.Duration) {
+		t.Helper()
+		client.capabilitiesLock.Lock()
+		defer client.capabilitiesLock.Unlock()
+		next, found := client.nextCapabilities[u.String()]
+		if !found {
+			t.Fatalf("Expected cached capabilities for %s", u)
+		} else if d := time.Until(next); d < minDuration || d > maxDuration {
+			t.Errorf("Expected capabilities to expire within %s and %s, got %s", minDuration, maxDuration, d)
+		}
+		// Expire the capabilities, so they are requested again.
+		client.nextCapabilities[u.String()] = time.Time{}
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if !client.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) {
+			t.Errorf("Should have capability of recovering backend")
+		}
+		if health.IsHealthy() {
+			t.Errorf("Backend should still be unhealthy after %d successes", i+1)
+		}
+		// Capabilities of recovering backends are only cached until the
+		// next probe.
+		checkNextCapabilities(0, defaultHealthInitialBackoff)
+	}
+
+	if !client.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) {
+		t.Errorf("Should have capability of recovered backend")
+	}
+	if !health.IsHealthy() {
+		t.Error("Backend should be healthy again")
+	}
+	checkNextCapabilities(CapabilitiesCacheDuration-time.Minute, CapabilitiesCacheDuration)
+}
+
+func TestBackendClientCapabilitiesRequestLimit(t *testing.T) {
+	var mu sync.Mutex
+	capabilitiesRequests := 0
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/cloud/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		capabilitiesRequests++
+		mu.Unlock()
+		returnOCS(t, w, []byte(`{"version":{},"capabilities":{"spreed":{"features":["signaling-v3"]}}}`))
+	})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/ocs/v2.php/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend", "allowhttp", "true")
+	config.AddOption("backend1", "url", server.URL)
+	config.AddOption("backend1", "secret", string(testBackendSecret))
+	config.AddOption("backend1", "max_concurrent_requests", "1")
+	client, err := NewBackendClient(config, 1, "0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	backend := client.GetBackend(u)
+	if backend == nil {
+		t.Fatal("Expected backend")
+	}
+	release, err := backend.TryAcquireRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Capabilities are not fetched while all request slots are taken.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.getCapabilities(ctx, u); err != context.DeadlineExceeded {
+		t.Errorf("Expected error %s, got %s", context.DeadlineExceeded, err)
+	}
+
+	release()
+	if !client.HasCapabilityFeature(context.Background(), u, FeatureSignalingV3Api) {
+		t.Error("Should have capability")
+	}
+
+	// Expired capabilities are used until a request slot is available.
+	client.capabilitiesLock.Lock()
+	client.nextCapabilities[u.String()] = time.Time{}
+	client.capabilitiesLock.Unlock()
+	if release, err = backend.TryAcquireRequest(); err != nil {
+		t.Fatal(err)
+	}
+	if !client.HasCapabilityFeature(context.Background(), u, FeatureSignalingV3Api) {
+		t.Error("Should have previous capability while backend is saturated")
+	}
+	release()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if capabilitiesRequests != 1 {
+		t.Errorf("Expected one capabilities request, got %d", capabilitiesRequests)
+	}
+}
+
+func TestBackendClientPruneCapabilities(t *testing.T) {
+	r := mux.NewRouter()
+	for _, prefix := range []string{"/one", "/two"} {
+		r.HandleFunc(prefix+"/ocs/v2.php/cloud/capabilities", func(w http.ResponseWriter, r *http.Request) {
+			returnOCS(t, w, []byte(`{"version":{},"capabilities":{"spreed":{"features":["signaling-v3"]}}}`))
+		})
+	}
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	u1, err := url.Parse(server.URL + "/one/ocs/v2.php/apps/spreed/api/v3/signaling/backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := url.Parse(server.URL + "/two/ocs/v2.php/apps/spreed/api/v3/signaling/backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getConfig := func(backends ...string) *goconf.ConfigFile {
+		config := goconf.NewConfigFile()
+		config.AddOption("backend", "backends", strings.Join(backends, ", "))
+		config.AddOption("backend", "allowhttp", "true")
+		config.AddOption("backend1", "url", server.URL+"/one")
+		config.AddOption("backend1", "secret", string(testBackendSecret))
+		config.AddOption("backend2", "url", server.URL+"/two")
+		config.AddOption("backend2", "secret", string(testBackendSecret))
+		return config
+	}
+
+	client, err := NewBackendClient(getConfig("backend1", "backend2"), 1, "0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for _, u := range []*url.URL{u1, u2} {
+		if !client.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) {
+			t.Errorf("Should have capability for %s", u)
+		}
+	}
+
+	checkCapabilities := func(expected int) {
+		t.Helper()
+		client.capabilitiesLock.RLock()
+		defer client.capabilitiesLock.RUnlock()
+		if len(client.capabilities) != expected || len(client.nextCapabilities) != expected {
+			t.Errorf("Expected %d cached capabilities, got %d / %d", expected, len(client.capabilities), len(client.nextCapabilities))
+		}
+		if len(client.capabilitiesHealth) != expected {
+			t.Errorf("Expected %d health entries, got %d", expected, len(client.capabilitiesHealth))
+		}
+	}
+
+	checkCapabilities(2)
+
+	// Unchanged backends keep their entries.
+	if _, err := client.ReloadBackends(getConfig("backend1", "backend2")); err != nil {
+		t.Fatal(err)
+	}
+	checkCapabilities(2)
+
+	if _, err := client.ReloadBackends(getConfig("backend1")); err != nil {
+		t.Fatal(err)
+	}
+	checkCapabilities(1)
+
+	client.capabilitiesLock.RLock()
+	if _, found := client.capabilities[u1.String()]; !found {
+		t.Errorf("Capabilities of %s should still be cached", u1)
+	}
+	client.capabilitiesLock.RUnlock()
+
+	// Modified backends are reset.
+	config := getConfig("backend1")
+	config.AddOption("backend1", "secret", string(testBackendSecret)+"-changed")
+	if _, err := client.ReloadBackends(config); err != nil {
+		t.Fatal(err)
+	}
+	checkCapabilities(0)
+}
+
+func TestBackendClientPrunePools(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/cloud/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		returnOCS(t, w, []byte(`{"version":{},"capabilities":{"spreed":{"features":["signaling-v3"]}}}`))
+	})
+
+	server1 := httptest.NewServer(r)
+	defer server1.Close()
+	server2 := httptest.NewServer(r)
+	defer server2.Close()
+
+	getConfig := func(backends ...string) *goconf.ConfigFile {
+		config := goconf.NewConfigFile()
+		config.AddOption("backend", "backends", strings.Join(backends, ", "))
+		config.AddOption("backend", "allowhttp", "true")
+		config.AddOption("backend1", "url", server1.URL)
+		config.AddOption("backend1", "secret", string(testBackendSecret))
+		config.AddOption("backend2", "url", server2.URL)
+		config.AddOption("backend2", "secret", string(testBackendSecret))
+		return config
+	}
+
+	client, err := NewBackendClient(getConfig("backend1", "backend2"), 1, "0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for _, s := range []*httptest.Server{server1, server2} {
+		u, err := url.Parse(s.URL + "/ocs/v2.php/apps/spreed/api/v3/signaling/backend")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !client.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) {
+			t.Errorf("Should have capability for %s", u)
+		}
+	}
+
+	checkPools := func(expected ...*httptest.Server) {
+		t.Helper()
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		if len(client.clients) != len(expected) {
+			t.Errorf("Expected %d pools, got %+v", len(expected), client.clients)
+		}
+		for _, s := range expected {
+			u, _ := url.Parse(s.URL)
+			if _, found := client.clients[u.Host]; !found {
+				t.Errorf("Expected pool for %s, got %+v", u.Host, client.clients)
+			}
+		}
+	}
+
+	checkPools(server1, server2)
+
+	if _, err := client.ReloadBackends(getConfig("backend1")); err != nil {
+		t.Fatal(err)
+	}
+	checkPools(server1)
+}
@@ -22,47 +22,367 @@
 package signaling
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
-	"reflect"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dlintw/goconf"
 )
 
 var (
-	SessionLimitExceeded = NewError("session_limit_exceeded", "Too many sessions connected for this backend.")
+	SessionLimitExceeded = NewErrorCode(ErrorCodeSessionLimitExceeded)
+	BackendClosed        = NewError(ErrorCodeInvalidBackend, "The backend is no longer configured.")
+
+	ErrBackendRequestsSaturated = fmt.Errorf("too many concurrent requests to backend")
+)
+
+const (
+	// Maximum number of messages that are stored for sessions while they are
+	// disconnected and can be resumed.
+	defaultResumeBufferSize = 1024
+
+	// Maximum number of concurrent outbound requests to a backend.
+	defaultMaxConcurrentRequests = 32
+
+	// Time allowed to write a message to a client of a backend.
+	defaultWriteTimeout = writeWait
+
+	// Time a session is kept after its client disconnected so it can be resumed.
+	defaultResumeGracePeriod = 30 * time.Second
 )
 
 type Backend struct {
-	id     string
-	url    string
-	secret []byte
-	compat bool
+	// Traffic of all sessions of the backend, must be first for 64-bit
+	// alignment of the counters.
+	trafficCounter
+
+	id        string
+	url       string
+	parsedUrl *url.URL
+	secret    []byte
+	secrets   [][]byte
+	compat    bool
 
 	allowHttp bool
 
 	maxStreamBitrate int
 	maxScreenBitrate int
 
+	features         []string
+	disabledFeatures []string
+	requiredFeatures []string
+
+	allowedAuthTypes []string
+
+	deniedUsers *UserDenylist
+
+	resumeBufferSize int
+
+	maxParticipants int
+
+	messageRate int
+
+	roomSwitchRate int
+
+	writeTimeout time.Duration
+
+	resumeGracePeriod time.Duration
+
+	maxConcurrentRequests int
+	requestsLock          sync.Mutex
+	requests              chan struct{}
+
 	sessionLimit uint64
 	sessionsLock sync.Mutex
 	sessions     map[string]bool
+	closed       bool
+
+	sessionLimitPerAddress int
+}
+
+// NewBackend creates a backend with the given id, url and secret. All other
+// settings use their default values.
+func NewBackend(id string, u string, secret string) (*Backend, error) {
+	if id == "" {
+		return nil, fmt.Errorf("backend id missing")
+	} else if secret == "" {
+		return nil, fmt.Errorf("secret of backend %s missing", id)
+	}
+
+	u, parsed, err := parseBackendUrl(u)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s has an invalid url %s configured (%s)", id, u, err)
+	}
+
+	return &Backend{
+		id:        id,
+		url:       u,
+		parsedUrl: parsed,
+		secret:    []byte(secret),
+
+		allowHttp: parsed.Scheme == "http",
+
+		resumeBufferSize: defaultResumeBufferSize,
+
+		writeTimeout: defaultWriteTimeout,
+
+		resumeGracePeriod: defaultResumeGracePeriod,
+
+		maxConcurrentRequests: defaultMaxConcurrentRequests,
+	}, nil
+}
+
+// parseBackendUrl returns the normalized and the parsed url of a backend.
+func parseBackendUrl(u string) (string, *url.URL, error) {
+	if u == "" {
+		return u, nil, fmt.Errorf("url missing")
+	}
+
+	if u[len(u)-1] != '/' {
+		u += "/"
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u, nil, err
+	}
+
+	changed := normalizeUrlHost(parsed)
+	if cleaned := cleanUrlPath(parsed.Path); cleaned != parsed.Path {
+		parsed.Path = cleaned
+		parsed.RawPath = ""
+		changed = true
+	}
+	if changed {
+		u = parsed.String()
+	}
+	return u, parsed, nil
+}
+
+// cleanUrlPath resolves "." and ".." elements and duplicate slashes of the
+// given url path and makes sure it ends with a slash. This is used for prefix
+// matching, so "/one/../two/" doesn't match a backend configured for "/one/".
+func cleanUrlPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// joinUrlPath appends the path "p" to the url (or url path) "base" with
+// exactly one slash between them.
+func joinUrlPath(base string, p string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(p, "/")
 }
 
 func (b *Backend) Id() string {
 	return b.id
 }
 
+// RequestURL returns the url to use for outgoing requests to the given path of
+// the backend, which is resolved relative to the normalized backend url. An
+// empty string is returned for old-style backends where only hosts are
+// configured.
+func (b *Backend) RequestURL(p string) string {
+	if b.url == "" {
+		return ""
+	}
+
+	return joinUrlPath(b.url, p)
+}
+
+// requestURLFor returns the url to use for outgoing requests to the given path
+// if "u" is the base url of the backend. An empty string is returned if "u"
+// points to a different location, e.g. a subfolder of the backend url.
+func (b *Backend) requestURLFor(u *url.URL, p string) string {
+	if b == nil || b.parsedUrl == nil || u == nil || u.Scheme != b.parsedUrl.Scheme || u.RawQuery != "" {
+		return ""
+	}
+
+	normalized := *u
+	normalizeUrlHost(&normalized)
+	if normalized.Host != b.parsedUrl.Host || cleanUrlPath(normalized.Path) != b.parsedUrl.Path {
+		return ""
+	}
+
+	return b.RequestURL(p)
+}
+
+// String returns a representation of the backend that is safe to be logged,
+// the secret is never included.
+func (b *Backend) String() string {
+	if b == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("Backend{id:%s url:%s secret:<redacted> compat:%t}", b.id, b.url, b.compat)
+}
+
+func (b *Backend) GoString() string {
+	if b == nil {
+		return "(*signaling.Backend)(nil)"
+	}
+
+	return fmt.Sprintf("&signaling.Backend{id:%q, url:%q, secret:<redacted>, compat:%t}", b.id, b.url, b.compat)
+}
+
+// ParsedURL returns the parsed and normalized url of the backend or nil for
+// old-style backends where only hosts are configured. The returned value is
+// shared and must not be modified.
+func (b *Backend) ParsedURL() *url.URL {
+	return b.parsedUrl
+}
+
+// Secret returns the secret that is used to sign requests to the backend.
 func (b *Backend) Secret() []byte {
 	return b.secret
 }
 
+// Secrets returns all secrets that are accepted for requests from the backend.
+// The first entry is the one returned by "Secret".
+func (b *Backend) Secrets() [][]byte {
+	if len(b.secrets) == 0 {
+		return [][]byte{b.secret}
+	}
+
+	return b.secrets
+}
+
+// ValidateChecksum checks if the request was signed with one of the secrets
+// of the backend.
+func (b *Backend) ValidateChecksum(r *http.Request, body []byte) bool {
+	for _, secret := range b.Secrets() {
+		if ValidateBackendChecksum(r, body, secret) {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Backend) IsCompat() bool {
 	return b.compat
 }
 
+// Features returns the list of server features that may be advertised to
+// clients of the backend or nil if all features are allowed.
+func (b *Backend) Features() []string {
+	return b.features
+}
+
+// DisabledFeatures returns the list of client features that are disabled for
+// the backend or nil if the global configuration should be used.
+func (b *Backend) DisabledFeatures() []string {
+	return b.disabledFeatures
+}
+
+// RequiredFeatures returns the list of client features that clients of the
+// backend must support or nil if the global configuration should be used.
+func (b *Backend) RequiredFeatures() []string {
+	return b.requiredFeatures
+}
+
+// AllowedAuthTypes returns the list of hello auth types that are accepted for
+// the backend or nil if the global configuration should be used.
+func (b *Backend) AllowedAuthTypes() []string {
+	return b.allowedAuthTypes
+}
+
+// DeniedUsers returns the patterns of user ids that may not connect to the
+// backend (in addition to the global denylist) or nil if none are denied.
+func (b *Backend) DeniedUsers() *UserDenylist {
+	return b.deniedUsers
+}
+
+// SessionLimitPerAddress returns the maximum number of sessions of the backend
+// that may be connected from the same address or 0 if not limited.
+func (b *Backend) SessionLimitPerAddress() int {
+	return b.sessionLimitPerAddress
+}
+
+// ResumeBufferSize returns the maximum number of messages that are stored for
+// disconnected sessions of the backend until they are resumed.
+func (b *Backend) ResumeBufferSize() int {
+	if b.resumeBufferSize <= 0 {
+		return defaultResumeBufferSize
+	}
+
+	return b.resumeBufferSize
+}
+
+// MaxParticipants returns the maximum number of participants that may join a
+// room of the backend or 0 if unlimited.
+func (b *Backend) MaxParticipants() int {
+	return b.maxParticipants
+}
+
+// MessageRate returns the maximum number of messages per second a session of
+// the backend may send or 0 if unlimited.
+func (b *Backend) MessageRate() int {
+	return b.messageRate
+}
+
+// RoomSwitchRate returns the maximum number of rooms per minute a session of
+// the backend may join or leave or 0 if unlimited.
+func (b *Backend) RoomSwitchRate() int {
+	return b.roomSwitchRate
+}
+
+// WriteTimeout returns the time allowed to write a message to a client of the
+// backend before it is disconnected as being too slow.
+func (b *Backend) WriteTimeout() time.Duration {
+	if b.writeTimeout <= 0 {
+		return defaultWriteTimeout
+	}
+	return b.writeTimeout
+}
+
+// ResumeGracePeriod returns the time a session of the backend is kept after
+// its client disconnected. The session stays in its room and can be resumed
+// without other participants noticing, it is closed after the time expired.
+func (b *Backend) ResumeGracePeriod() time.Duration {
+	if b.resumeGracePeriod <= 0 {
+		return defaultResumeGracePeriod
+	}
+	return b.resumeGracePeriod
+}
+
+// HasFeature checks if the given server feature is allowed for the backend.
+func (b *Backend) HasFeature(feature string) bool {
+	if b.features == nil {
+		return true
+	}
+
+	for _, f := range b.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesScheme returns true if urls with the given scheme belong to the
+// backend. The scheme must be the same as the one of the configured url, "http"
+// urls also belong to "https" backends that have "allowhttp" enabled. This
+// doesn't apply to old-style backends without a configured url.
+func (b *Backend) matchesScheme(scheme string) bool {
+	if b.parsedUrl == nil || scheme == b.parsedUrl.Scheme {
+		return true
+	}
+
+	return scheme == "http" && b.allowHttp
+}
+
 func (b *Backend) IsUrlAllowed(u *url.URL) bool {
 	switch u.Scheme {
 	case "https":
@@ -80,13 +400,17 @@ func (b *Backend) AddSession(session Session) error {
 		return nil
 	}
 
+	b.sessionsLock.Lock()
+	defer b.sessionsLock.Unlock()
+	if b.closed {
+		return BackendClosed
+	}
+
 	if b.sessionLimit == 0 {
 		// Not limited
 		return nil
 	}
 
-	b.sessionsLock.Lock()
-	defer b.sessionsLock.Unlock()
 	if b.sessions == nil {
 		b.sessions = make(map[string]bool)
 	} else if uint64(len(b.sessions)) >= b.sessionLimit {
@@ -98,6 +422,61 @@ func (b *Backend) AddSession(session Session) error {
 	return nil
 }
 
+func (b *Backend) getRequestsSemaphore() chan struct{} {
+	if b.maxConcurrentRequests <= 0 {
+		// Not limited
+		return nil
+	}
+
+	b.requestsLock.Lock()
+	defer b.requestsLock.Unlock()
+	if b.requests == nil {
+		b.requests = make(chan struct{}, b.maxConcurrentRequests)
+	}
+	return b.requests
+}
+
+// AcquireRequest reserves a slot for an outbound request to the backend. It
+// waits until a slot is available or the context is done. The returned
+// function must be called once the request has completed.
+func (b *Backend) AcquireRequest(ctx context.Context) (func(), error) {
+	requests := b.getRequestsSemaphore()
+	if requests == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case requests <- struct{}{}:
+		return func() { <-requests }, nil
+	default:
+	}
+
+	statsBackendRequestsSaturatedTotal.WithLabelValues(b.id).Inc()
+	select {
+	case requests <- struct{}{}:
+		return func() { <-requests }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquireRequest is like AcquireRequest but fails immediately with
+// ErrBackendRequestsSaturated if no slot is available.
+func (b *Backend) TryAcquireRequest() (func(), error) {
+	requests := b.getRequestsSemaphore()
+	if requests == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case requests <- struct{}{}:
+		return func() { <-requests }, nil
+	default:
+		statsBackendRequestsSaturatedTotal.WithLabelValues(b.id).Inc()
+		return nil, ErrBackendRequestsSaturated
+	}
+}
+
 func (b *Backend) RemoveSession(session Session) {
 	b.sessionsLock.Lock()
 	defer b.sessionsLock.Unlock()
@@ -105,189 +484,1209 @@ func (b *Backend) RemoveSession(session Session) {
 	delete(b.sessions, session.PublicId())
 }
 
+// Close releases resources of a backend that is no longer configured. Sessions
+// that are still connected to the backend are not affected, but no new sessions
+// can be added.
+func (b *Backend) Close() {
+	b.sessionsLock.Lock()
+	defer b.sessionsLock.Unlock()
+
+	b.closed = true
+	b.sessions = nil
+}
+
+// countBytesSent adds the number of bytes sent to a client of the backend.
+func (b *Backend) countBytesSent(n int) {
+	b.addBytesSent(n)
+	statsBackendBytesSentTotal.WithLabelValues(b.id).Add(float64(n))
+}
+
+// countBytesReceived adds the number of bytes received from a client of the
+// backend.
+func (b *Backend) countBytesReceived(n int) {
+	b.addBytesReceived(n)
+	statsBackendBytesReceivedTotal.WithLabelValues(b.id).Add(float64(n))
+}
+
+func equalStringSlices(a []string, b []string) bool {
+	if (a == nil) != (b == nil) || len(a) != len(b) {
+		return false
+	}
+
+	for idx, v := range a {
+		if b[idx] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func equalSecrets(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx, v := range a {
+		if !bytes.Equal(b[idx], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal checks if the other backend has the same configuration. Runtime state
+// like connected sessions is not compared.
+func (b *Backend) Equal(other *Backend) bool {
+	if b == other {
+		return true
+	} else if b == nil || other == nil {
+		return false
+	}
+
+	return b.id == other.id &&
+		b.url == other.url &&
+		bytes.Equal(b.secret, other.secret) &&
+		equalSecrets(b.secrets, other.secrets) &&
+		b.compat == other.compat &&
+		b.allowHttp == other.allowHttp &&
+		b.maxStreamBitrate == other.maxStreamBitrate &&
+		b.maxScreenBitrate == other.maxScreenBitrate &&
+		equalStringSlices(b.features, other.features) &&
+		equalStringSlices(b.disabledFeatures, other.disabledFeatures) &&
+		equalStringSlices(b.requiredFeatures, other.requiredFeatures) &&
+		equalStringSlices(b.allowedAuthTypes, other.allowedAuthTypes) &&
+		b.deniedUsers.Equal(other.deniedUsers) &&
+		b.resumeBufferSize == other.resumeBufferSize &&
+		b.maxParticipants == other.maxParticipants &&
+		b.messageRate == other.messageRate &&
+		b.roomSwitchRate == other.roomSwitchRate &&
+		b.writeTimeout == other.writeTimeout &&
+		b.resumeGracePeriod == other.resumeGracePeriod &&
+		b.maxConcurrentRequests == other.maxConcurrentRequests &&
+		b.sessionLimit == other.sessionLimit &&
+		b.sessionLimitPerAddress == other.sessionLimitPerAddress
+}
+
+// clone returns a copy of the backend configuration without any sessions.
+func (b *Backend) clone() *Backend {
+	return &Backend{
+		id:        b.id,
+		url:       b.url,
+		parsedUrl: b.parsedUrl,
+		secret:    b.secret,
+		secrets:   b.secrets,
+		compat:    b.compat,
+
+		allowHttp: b.allowHttp,
+
+		maxStreamBitrate: b.maxStreamBitrate,
+		maxScreenBitrate: b.maxScreenBitrate,
+
+		features:         b.features,
+		disabledFeatures: b.disabledFeatures,
+		requiredFeatures: b.requiredFeatures,
+
+		allowedAuthTypes: b.allowedAuthTypes,
+
+		deniedUsers: b.deniedUsers,
+
+		resumeBufferSize: b.resumeBufferSize,
+
+		maxParticipants: b.maxParticipants,
+
+		messageRate: b.messageRate,
+
+		roomSwitchRate: b.roomSwitchRate,
+
+		writeTimeout: b.writeTimeout,
+
+		resumeGracePeriod: b.resumeGracePeriod,
+
+		maxConcurrentRequests: b.maxConcurrentRequests,
+
+		sessionLimit: b.sessionLimit,
+
+		sessionLimitPerAddress: b.sessionLimitPerAddress,
+	}
+}
+
+// BackendResolver returns the backend and its secret for backend urls. It can
+// be implemented to load backends from a different source than the server
+// configuration.
+type BackendResolver interface {
+	// GetBackend returns the backend for the given url or nil if the url is
+	// not allowed.
+	GetBackend(u *url.URL) *Backend
+
+	// GetSecret returns the secret to sign requests to the backend of the
+	// given url or nil if the url is not allowed.
+	GetSecret(u *url.URL) []byte
+
+	// GetBackends returns all known backends.
+	GetBackends() []*Backend
+
+	// IsUrlAllowed returns true if the given url belongs to a backend.
+	IsUrlAllowed(u *url.URL) bool
+}
+
+// BackendReloader can be implemented by a BackendResolver whose backends can
+// be updated at runtime from the server configuration.
+type BackendReloader interface {
+	// ReloadBackends updates the backends from the given configuration and
+	// returns the changes.
+	ReloadBackends(config *goconf.ConfigFile) (*BackendChanges, error)
+
+	// ReplaceBackends switches to the given backends and returns the changes.
+	ReplaceBackends(next *BackendConfiguration) (*BackendChanges, error)
+
+	// SetUrlChangedHandler sets the handler that is called when the url of a
+	// backend changed.
+	SetUrlChangedHandler(handler BackendUrlChangedHandler)
+
+	// HasBackendsForHost returns true if requests to the given host are
+	// allowed for any backend.
+	HasBackendsForHost(host string) bool
+
+	// Close releases the resources of all backends.
+	Close()
+}
+
+// BackendCompatResolver can be implemented by a BackendResolver that supports
+// the deprecated compat configuration with a common secret.
+type BackendCompatResolver interface {
+	// GetCompatBackend returns the backend of the deprecated compat
+	// configuration or nil if no such backend exists.
+	GetCompatBackend() *Backend
+
+	// SetAllowAll enables or disables that all backend hosts are allowed and
+	// returns the previous state.
+	SetAllowAll(allow bool) (bool, error)
+}
+
 type BackendConfiguration struct {
+	mu       sync.RWMutex
 	backends map[string][]*Backend
 
+	// strict is set if "strict_backends" was enabled when loading.
+	strict bool
+	// debug is set if each changed backend should be logged.
+	debug bool
+
 	// Deprecated
-	allowAll      bool
-	commonSecret  []byte
+	allowAll bool
+	// compatConfig contains the configured settings for compat backends, it
+	// is not registered for any hosts.
+	compatConfig  *Backend
 	compatBackend *Backend
+	// compatRuntime is set if the compat backend was created by "SetAllowAll".
+	compatRuntime bool
+
+	urlChangedHandler BackendUrlChangedHandler
+
+	// snapshot is set for configurations created through "Clone", their
+	// backends are not counted as they are not registered anywhere.
+	snapshot bool
+
+	closed bool
+}
+
+// BackendUrlChange describes a backend whose url changed while its id was
+// kept when updating the configuration.
+type BackendUrlChange struct {
+	Id     string
+	OldUrl string
+	NewUrl string
+}
+
+// BackendUrlChangedHandler is called for backends whose url changed. Sessions
+// that were created for the old url are still associated with the backend.
+type BackendUrlChangedHandler func(change BackendUrlChange)
+
+var (
+	_ BackendResolver       = (*BackendConfiguration)(nil)
+	_ BackendReloader       = (*BackendConfiguration)(nil)
+	_ BackendCompatResolver = (*BackendConfiguration)(nil)
+)
+
+// getBackendModeWarnings checks if more than one of the mutually exclusive
+// backend configuration modes is set. Only one of them is used with the
+// precedence "allowall", "backends" and then "allowed", the returned warnings
+// describe which of them takes effect.
+func getBackendModeWarnings(config *goconf.ConfigFile) []string {
+	allowAll, _ := config.GetBool("backend", "allowall")
+	backendIds, _ := config.GetString("backend", "backends")
+	hasBackends := strings.TrimSpace(backendIds) != ""
+	allowedUrls, _ := config.GetString("backend", "allowed")
+	hasAllowed := strings.TrimSpace(allowedUrls) != ""
+
+	var warnings []string
+	if allowAll {
+		if hasBackends {
+			warnings = append(warnings, "\"allowall\" and \"backends\" are both set in section \"backend\", \"allowall\" takes effect and \"backends\" is ignored")
+		}
+		if hasAllowed {
+			warnings = append(warnings, "\"allowall\" and \"allowed\" are both set in section \"backend\", \"allowall\" takes effect and \"allowed\" is ignored")
+		}
+	} else if hasBackends && hasAllowed {
+		warnings = append(warnings, "\"backends\" and \"allowed\" are both set in section \"backend\", \"backends\" takes effect and \"allowed\" is ignored")
+	}
+	return warnings
+}
+
+func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration, error) {
+	config, err := loadBackendIncludes(config)
+	if err != nil {
+		return nil, err
+	}
+
+	allowAll, _ := config.GetBool("backend", "allowall")
+	strict, _ := config.GetBool("backend", "strict_backends")
+	debug := getConfiguredBackendDebug(config)
+	if strict {
+		if allowAll {
+			return nil, fmt.Errorf("\"allowall\" in section \"backend\" is not allowed if \"strict_backends\" is enabled")
+		}
+		if allowed, _ := config.GetString("backend", "allowed"); strings.TrimSpace(allowed) != "" {
+			return nil, fmt.Errorf("\"allowed\" in section \"backend\" is not allowed if \"strict_backends\" is enabled, use \"backends\" instead")
+		}
+	}
+	for _, warning := range getBackendModeWarnings(config) {
+		log.Printf("WARNING: %s, check your configuration!", warning)
+	}
+	compatConfig := newCompatBackend(config)
+	sessionLimit := compatConfig.sessionLimit
+	backends := make(map[string][]*Backend)
+	var compatBackend *Backend
+	numBackends := 0
+	if allowAll {
+		log.Println("WARNING: All backend hostnames are allowed, only use for development!")
+		compatBackend = compatConfig.clone()
+		if sessionLimit > 0 {
+			log.Printf("Allow a maximum of %d sessions", sessionLimit)
+		}
+		numBackends++
+	} else if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
+		configuredHosts, err := getConfiguredHosts(backendIds, config)
+		if err != nil {
+			return nil, err
+		}
+
+		for host, configuredBackends := range configuredHosts {
+			backends[host] = append(backends[host], configuredBackends...)
+			if debug {
+				for _, be := range configuredBackends {
+					log.Printf("Backend %s added for %s", be.id, be.url)
+				}
+			}
+			numBackends += len(configuredBackends)
+		}
+		log.Printf("Loaded %d backends across %d hosts", numBackends, len(configuredHosts))
+	} else if allowedUrls, _ := config.GetString("backend", "allowed"); allowedUrls != "" {
+		// Old-style configuration, only hosts are configured and are using a common secret.
+		allowMap := make(map[string]bool)
+		for _, u := range strings.Split(allowedUrls, ",") {
+			u = strings.TrimSpace(u)
+			if idx := strings.IndexByte(u, '/'); idx != -1 {
+				log.Printf("WARNING: Removing path from allowed hostname \"%s\", check your configuration!", u)
+				u = u[:idx]
+			}
+			if u != "" {
+				allowMap[trimHostTrailingDot(strings.ToLower(u))] = true
+			}
+		}
+
+		if len(allowMap) == 0 {
+			log.Println("WARNING: No backend hostnames are allowed, check your configuration!")
+		} else {
+			compatBackend = compatConfig.clone()
+			hosts := make([]string, 0, len(allowMap))
+			for host := range allowMap {
+				hosts = append(hosts, host)
+				backends[host] = []*Backend{compatBackend}
+			}
+			if len(hosts) > 1 {
+				log.Println("WARNING: Using deprecated backend configuration. Please migrate the \"allowed\" setting to the new \"backends\" configuration.")
+			}
+			log.Printf("Allowed backend hostnames: %s", hosts)
+			if sessionLimit > 0 {
+				log.Printf("Allow a maximum of %d sessions", sessionLimit)
+			}
+			numBackends++
+		}
+	}
+
+	RegisterBackendConfigurationStats()
+	statsBackendsCurrent.Add(float64(numBackends))
+
+	return &BackendConfiguration{
+		backends: backends,
+
+		strict: strict,
+		debug:  debug,
+
+		allowAll:      allowAll,
+		compatConfig:  compatConfig,
+		compatBackend: compatBackend,
+	}, nil
+}
+
+// newCompatBackend creates the compat backend with the common secret and the
+// settings configured in section "backend".
+func newCompatBackend(config *goconf.ConfigFile) *Backend {
+	allowHttp, _ := config.GetBool("backend", "allowhttp")
+	commonSecrets := getConfiguredCommonSecrets(config)
+	sessionLimit, err := config.GetInt("backend", "sessionlimit")
+	if err != nil || sessionLimit < 0 {
+		sessionLimit = 0
+	}
+
+	return &Backend{
+		id:      "compat",
+		secret:  commonSecrets[0],
+		secrets: commonSecrets,
+		compat:  true,
+
+		allowHttp: allowHttp,
+
+		resumeBufferSize: getConfiguredResumeBufferSize(config),
+
+		maxParticipants: getConfiguredMaxParticipants(config),
+
+		messageRate: getConfiguredMessageRate(config),
+
+		roomSwitchRate: getConfiguredRoomSwitchRate(config),
+
+		writeTimeout: getConfiguredWriteTimeout(config),
+
+		resumeGracePeriod: getConfiguredResumeGracePeriod(config),
+
+		// The compat backend is shared by all allowed hosts, so requests are
+		// not limited to prevent one host from blocking the others.
+		maxConcurrentRequests: 0,
+
+		sessionLimit: uint64(sessionLimit),
+	}
+}
+
+// NewBackendConfigurationForTest creates a configuration containing the given
+// backends, e.g. created with "NewBackend". The backends must not be shared
+// with other configurations.
+func NewBackendConfigurationForTest(backends ...*Backend) *BackendConfiguration {
+	result := &BackendConfiguration{
+		backends: make(map[string][]*Backend),
+	}
+	for _, backend := range backends {
+		host := backend.parsedUrl.Host
+		result.backends[host] = append(result.backends[host], backend)
+	}
+
+	RegisterBackendConfigurationStats()
+	statsBackendsCurrent.Add(float64(len(backends)))
+	return result
+}
+
+// Close releases the resources of all configured backends. No backends will
+// be returned afterwards. It is safe to call Close multiple times.
+func (b *BackendConfiguration) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.clearLocked()
+}
+
+// Clear removes all backends and resets the compat state, no backends will be
+// returned afterwards until they are added again. Sessions that are already
+// connected to one of the removed backends are not affected.
+func (b *BackendConfiguration) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.clearLocked()
+}
+
+func (b *BackendConfiguration) clearLocked() {
+	if b.compatRuntime {
+		// The compat backend is not registered for any hosts, the configured
+		// backends are removed below.
+		b.compatBackend.Close()
+		b.compatBackend = nil
+		b.compatRuntime = false
+		b.allowAll = false
+		b.updateBackendsStats(-1)
+	} else if b.compatBackend != nil {
+		// The compat backend is registered for all allowed hosts but only
+		// counted once.
+		b.compatBackend.Close()
+		b.backends = make(map[string][]*Backend)
+		b.compatBackend = nil
+		b.allowAll = false
+		b.updateBackendsStats(-1)
+		return
+	}
+
+	for host := range b.backends {
+		b.removeBackendsForHostLocked(host, nil)
+	}
+}
+
+// Clone returns a snapshot of the current configuration. The backends of the
+// snapshot are copies and don't share any sessions with the original.
+func (b *BackendConfiguration) Clone() *BackendConfiguration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	cloned := make(map[*Backend]*Backend)
+	cloneBackend := func(backend *Backend) *Backend {
+		if backend == nil {
+			return nil
+		}
+
+		if c, found := cloned[backend]; found {
+			return c
+		}
+
+		c := backend.clone()
+		cloned[backend] = c
+		return c
+	}
+
+	result := &BackendConfiguration{
+		backends: make(map[string][]*Backend, len(b.backends)),
+
+		strict: b.strict,
+		debug:  b.debug,
+
+		allowAll:      b.allowAll,
+		compatConfig:  b.compatConfig,
+		compatBackend: cloneBackend(b.compatBackend),
+		compatRuntime: b.compatRuntime,
+
+		snapshot: true,
+		closed:   b.closed,
+	}
+	for host, entries := range b.backends {
+		backends := make([]*Backend, 0, len(entries))
+		for _, entry := range entries {
+			backends = append(backends, cloneBackend(entry))
+		}
+		result.backends[host] = backends
+	}
+	return result
+}
+
+// debugf logs the given message if "debug" is enabled in section "backend".
+func (b *BackendConfiguration) debugf(format string, args ...interface{}) {
+	if b.debug {
+		log.Printf(format, args...)
+	}
+}
+
+// updateBackendsStats adjusts the number of current backends unless the
+// configuration is a snapshot.
+func (b *BackendConfiguration) updateBackendsStats(delta int) {
+	if !b.snapshot {
+		statsBackendsCurrent.Add(float64(delta))
+	}
+}
+
+// Replace atomically switches to the backends of the given configuration,
+// which must have been created completely before, e.g. through
+// NewBackendConfiguration. Backends that are unchanged by identity (same id
+// and Equal) keep the existing instance, so their runtime state like the
+// connected sessions and in-flight requests is transferred. Changed, added
+// and removed backends start with a fresh state, removed backends are closed.
+// The given configuration is empty and closed afterwards.
+func (b *BackendConfiguration) Replace(next *BackendConfiguration) error {
+	changes, err := b.ReplaceBackends(next)
+	if err != nil {
+		return err
+	} else if !changes.IsEmpty() {
+		log.Printf("Replaced backends: %s", changes)
+	}
+	return nil
+}
+
+// ReplaceBackends switches to the backends of the given configuration like
+// "Replace" and returns the ids of the backends that were changed. The url
+// changed handler is called for modified backends whose url changed.
+func (b *BackendConfiguration) ReplaceBackends(next *BackendConfiguration) (*BackendChanges, error) {
+	changes, err := b.replaceBackends(next)
+	if err != nil {
+		return nil, err
+	}
+
+	b.notifyUrlChanges(changes)
+	return changes, nil
+}
+
+func (b *BackendConfiguration) replaceBackends(next *BackendConfiguration) (*BackendChanges, error) {
+	if b == next {
+		return nil, fmt.Errorf("can't replace backend configuration with itself")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	next.mu.Lock()
+	defer next.mu.Unlock()
+
+	if b.closed {
+		return nil, fmt.Errorf("backend configuration is closed")
+	} else if next.closed {
+		return nil, fmt.Errorf("replacement backend configuration is closed")
+	}
+
+	b.debug = next.debug
+
+	existing := make(map[string]*Backend)
+	for _, entries := range b.backends {
+		for _, entry := range entries {
+			existing[entry.id] = entry
+		}
+	}
+	if b.compatBackend != nil {
+		existing[b.compatBackend.id] = b.compatBackend
+	}
+
+	changes := &BackendChanges{}
+	replaced := make(map[*Backend]*Backend)
+	kept := make(map[*Backend]bool)
+	configured := make(map[string]bool)
+	replaceBackend := func(backend *Backend) *Backend {
+		if backend == nil {
+			return nil
+		}
+
+		if r, found := replaced[backend]; found {
+			return r
+		}
+
+		configured[backend.id] = true
+		r := backend
+		if old, found := existing[backend.id]; found && old.Equal(backend) {
+			r = old
+			kept[old] = true
+		} else if found {
+			b.debugf("Backend %s updated for %s", backend.id, backend.url)
+			r.addTraffic(&old.trafficCounter)
+			changes.modified(old, backend)
+		} else {
+			b.debugf("Backend %s added for %s", backend.id, backend.url)
+			changes.added(backend)
+		}
+		replaced[backend] = r
+		return r
+	}
+
+	backends := make(map[string][]*Backend, len(next.backends))
+	for host, entries := range next.backends {
+		replacedEntries := make([]*Backend, 0, len(entries))
+		for _, entry := range entries {
+			replacedEntries = append(replacedEntries, replaceBackend(entry))
+		}
+		backends[host] = replacedEntries
+	}
+	compatBackend := replaceBackend(next.compatBackend)
+
+	for id, backend := range existing {
+		if kept[backend] {
+			continue
+		}
+
+		if !configured[id] {
+			b.debugf("Backend %s removed for %s", backend.id, backend.url)
+			changes.removed(backend)
+		}
+		backend.Close()
+	}
+	// The backends of the replacement are now owned by this configuration.
+	b.updateBackendsStats(len(replaced) - len(existing))
+	next.updateBackendsStats(-len(replaced))
+
+	b.backends = backends
+	b.strict = next.strict
+	b.allowAll = next.allowAll
+	b.compatConfig = next.compatConfig
+	b.compatBackend = compatBackend
+	b.compatRuntime = next.compatRuntime
+
+	next.backends = make(map[string][]*Backend)
+	next.compatBackend = nil
+	next.allowAll = false
+	next.closed = true
+
+	changes.finish()
+	return changes, nil
+}
+
+func (b *BackendConfiguration) RemoveBackendsForHost(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.removeBackendsForHostLocked(host, nil)
+}
+
+func (b *BackendConfiguration) removeBackendsForHostLocked(host string, changes *BackendChanges) {
+	if oldBackends := b.backends[host]; len(oldBackends) > 0 {
+		for _, backend := range oldBackends {
+			b.debugf("Backend %s removed for %s", backend.id, backend.url)
+			changes.removed(backend)
+			backend.Close()
+		}
+		b.updateBackendsStats(-len(oldBackends))
+	}
+	delete(b.backends, host)
+}
+
+func (b *BackendConfiguration) UpsertHost(host string, backends []*Backend) {
+	changes := &BackendChanges{}
+	b.mu.Lock()
+	b.upsertHostLocked(host, backends, changes)
+	b.mu.Unlock()
+
+	changes.finish()
+	b.notifyUrlChanges(changes)
+}
+
+// SetUrlChangedHandler sets the handler that is called when the url of a
+// backend changes in "Reload", "ReloadBackends", "Replace", "ReplaceBackends"
+// or "UpsertHost".
+func (b *BackendConfiguration) SetUrlChangedHandler(handler BackendUrlChangedHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.urlChangedHandler = handler
+}
+
+// notifyUrlChanges must be called without holding the lock, so the handler
+// can access the backends.
+func (b *BackendConfiguration) notifyUrlChanges(changes *BackendChanges) {
+	b.mu.RLock()
+	handler := b.urlChangedHandler
+	b.mu.RUnlock()
+	if handler == nil {
+		return
+	}
+
+	for _, change := range changes.UrlChanges {
+		log.Printf("Backend %s changed url from %s to %s", change.Id, change.OldUrl, change.NewUrl)
+		handler(change)
+	}
+}
+
+func (b *BackendConfiguration) upsertHostLocked(host string, backends []*Backend, changes *BackendChanges) {
+	// Work on a copy, the passed slice is owned by the caller.
+	remaining := make([]*Backend, len(backends))
+	copy(remaining, backends)
+
+	existing := b.backends[host]
+	updated := make([]*Backend, 0, len(existing)+len(remaining))
+	for _, existingBackend := range existing {
+		found := false
+		for index, newBackend := range remaining {
+			if existingBackend.Equal(newBackend) {
+				// Keep the existing backend and its runtime state.
+				found = true
+				updated = append(updated, existingBackend)
+				remaining = append(remaining[:index], remaining[index+1:]...)
+				break
+			} else if newBackend.id == existingBackend.id {
+				found = true
+				existingBackend.Close()
+				newBackend.addTraffic(&existingBackend.trafficCounter)
+				updated = append(updated, newBackend)
+				remaining = append(remaining[:index], remaining[index+1:]...)
+				b.debugf("Backend %s updated for %s", newBackend.id, newBackend.url)
+				changes.modified(existingBackend, newBackend)
+				break
+			}
+		}
+		if !found {
+			b.debugf("Backend %s removed for %s", existingBackend.id, existingBackend.url)
+			changes.removed(existingBackend)
+			existingBackend.Close()
+			b.updateBackendsStats(-1)
+		}
+	}
+
+	for _, added := range remaining {
+		b.debugf("Backend %s added for %s", added.id, added.url)
+		changes.added(added)
+	}
+	b.backends[host] = append(updated, remaining...)
+	b.updateBackendsStats(len(remaining))
+}
+
+// BackendChanges contains the ids of backends that were changed when reloading
+// the configuration.
+type BackendChanges struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+
+	// UrlChanges contains the modified backends whose url changed.
+	UrlChanges []BackendUrlChange
+
+	addedUrls   map[string]string
+	removedUrls map[string]string
+}
+
+func (c *BackendChanges) added(backend *Backend) {
+	if c != nil {
+		c.Added = append(c.Added, backend.id)
+		if c.addedUrls == nil {
+			c.addedUrls = make(map[string]string)
+		}
+		c.addedUrls[backend.id] = backend.url
+	}
+}
+
+func (c *BackendChanges) removed(backend *Backend) {
+	if c != nil {
+		c.Removed = append(c.Removed, backend.id)
+		if c.removedUrls == nil {
+			c.removedUrls = make(map[string]string)
+		}
+		c.removedUrls[backend.id] = backend.url
+	}
+}
+
+func (c *BackendChanges) modified(old *Backend, backend *Backend) {
+	if c != nil {
+		c.Modified = append(c.Modified, backend.id)
+		if old.url != backend.url {
+			c.UrlChanges = append(c.UrlChanges, BackendUrlChange{
+				Id:     backend.id,
+				OldUrl: old.url,
+				NewUrl: backend.url,
+			})
+		}
+	}
+}
+
+// finish reports backends that were removed from one host and added to another
+// host (i.e. their url changed) as modified and sorts the ids.
+func (c *BackendChanges) finish() {
+	removed := make(map[string]bool, len(c.Removed))
+	for _, id := range c.Removed {
+		removed[id] = true
+	}
+
+	var added []string
+	moved := make(map[string]bool)
+	for _, id := range c.Added {
+		if removed[id] {
+			moved[id] = true
+			c.Modified = append(c.Modified, id)
+			c.UrlChanges = append(c.UrlChanges, BackendUrlChange{
+				Id:     id,
+				OldUrl: c.removedUrls[id],
+				NewUrl: c.addedUrls[id],
+			})
+		} else {
+			added = append(added, id)
+		}
+	}
+	c.Added = added
+
+	var stillRemoved []string
+	for _, id := range c.Removed {
+		if !moved[id] {
+			stillRemoved = append(stillRemoved, id)
+		}
+	}
+	c.Removed = stillRemoved
+
+	sort.Strings(c.Added)
+	sort.Strings(c.Removed)
+	sort.Strings(c.Modified)
+	sort.Slice(c.UrlChanges, func(i, j int) bool {
+		return c.UrlChanges[i].Id < c.UrlChanges[j].Id
+	})
+	c.addedUrls = nil
+	c.removedUrls = nil
+}
+
+// IsEmpty returns true if no backends were changed.
+func (c *BackendChanges) IsEmpty() bool {
+	return c == nil || (len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0)
+}
+
+func (c *BackendChanges) String() string {
+	return fmt.Sprintf("added %v, removed %v, modified %v", c.Added, c.Removed, c.Modified)
+}
+
+func getConfiguredValues(value string) (values []string) {
+	seen := make(map[string]bool)
+
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if seen[v] {
+			continue
+		}
+		values = append(values, v)
+		seen[v] = true
+	}
+
+	return values
+}
+
+var (
+	// allAuthTypes contains the hello auth types that can be allowed.
+	allAuthTypes = []string{
+		HelloClientTypeClient,
+		HelloClientTypeInternal,
+	}
+)
+
+// getConfiguredAuthTypes returns the known hello auth types from a comma
+// separated list. The result is never nil, so a list without valid entries
+// doesn't allow any auth type.
+func getConfiguredAuthTypes(value string) []string {
+	result := []string{}
+	for _, authType := range getConfiguredValues(value) {
+		switch authType {
+		case HelloClientTypeClient, HelloClientTypeInternal:
+			result = append(result, authType)
+		default:
+			log.Printf("Ignoring unknown auth type %s", authType)
+		}
+	}
+	return result
+}
+
+func getConfiguredBackendIDs(backendIds string) (ids []string) {
+	return getConfiguredValues(backendIds)
+}
+
+// ReadConfigFile reads the configuration from the given file. Relative paths
+// of "include" in section "backend" are resolved against the directory of the
+// file.
+func ReadConfigFile(filename string) (*goconf.ConfigFile, error) {
+	config, err := goconf.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if include, _ := config.GetString("backend", "include"); include != "" {
+		patterns := resolveIncludePatterns(include, filepath.Dir(filename))
+		config.AddOption("backend", "include", strings.Join(patterns, ", "))
+	}
+	return config, nil
+}
+
+// resolveIncludePatterns returns the comma-separated include patterns with
+// relative patterns joined to the given directory.
+func resolveIncludePatterns(include string, dir string) []string {
+	patterns := getConfiguredValues(include)
+	for idx, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			patterns[idx] = filepath.Join(dir, pattern)
+		}
+	}
+	return patterns
+}
+
+// loadBackendIncludes returns a copy of the given configuration with the
+// backend sections of the files configured with "include" in section
+// "backend" merged into it. Only the sections of backends listed in
+// "backends" of an included file are merged, sections of later files
+// override the ones of earlier files with the same id.
+func loadBackendIncludes(config *goconf.ConfigFile) (*goconf.ConfigFile, error) {
+	include, _ := config.GetString("backend", "include")
+	if include == "" {
+		return config, nil
+	}
+
+	merged := copyConfig(config)
+	if err := mergeBackendIncludes(merged, config, nil); err != nil {
+		return nil, err
+	}
+	return merged, nil
 }
 
-func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration, error) {
-	allowAll, _ := config.GetBool("backend", "allowall")
-	allowHttp, _ := config.GetBool("backend", "allowhttp")
-	commonSecret, _ := config.GetString("backend", "secret")
-	sessionLimit, err := config.GetInt("backend", "sessionlimit")
-	if err != nil || sessionLimit < 0 {
-		sessionLimit = 0
+func copyConfig(config *goconf.ConfigFile) *goconf.ConfigFile {
+	result := goconf.NewConfigFile()
+	for _, section := range config.GetSections() {
+		result.AddSection(section)
+		copySection(result, config, section)
 	}
-	backends := make(map[string][]*Backend)
-	var compatBackend *Backend
-	numBackends := 0
-	if allowAll {
-		log.Println("WARNING: All backend hostnames are allowed, only use for development!")
-		compatBackend = &Backend{
-			id:     "compat",
-			secret: []byte(commonSecret),
-			compat: true,
-
-			allowHttp: allowHttp,
+	return result
+}
 
-			sessionLimit: uint64(sessionLimit),
-		}
-		if sessionLimit > 0 {
-			log.Printf("Allow a maximum of %d sessions", sessionLimit)
-		}
-		numBackends++
-	} else if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
-		for host, configuredBackends := range getConfiguredHosts(backendIds, config) {
-			backends[host] = append(backends[host], configuredBackends...)
-			for _, be := range configuredBackends {
-				log.Printf("Backend %s added for %s", be.id, be.url)
-			}
-			numBackends += len(configuredBackends)
-		}
-	} else if allowedUrls, _ := config.GetString("backend", "allowed"); allowedUrls != "" {
-		// Old-style configuration, only hosts are configured and are using a common secret.
-		allowMap := make(map[string]bool)
-		for _, u := range strings.Split(allowedUrls, ",") {
-			u = strings.TrimSpace(u)
-			if idx := strings.IndexByte(u, '/'); idx != -1 {
-				log.Printf("WARNING: Removing path from allowed hostname \"%s\", check your configuration!", u)
-				u = u[:idx]
-			}
-			if u != "" {
-				allowMap[strings.ToLower(u)] = true
-			}
+func copySection(target *goconf.ConfigFile, source *goconf.ConfigFile, section string) {
+	options, _ := source.GetOptions(section)
+	for _, option := range options {
+		value, err := source.GetRawString(section, option)
+		if err != nil {
+			// Option of the default section.
+			continue
 		}
+		target.AddOption(section, option, value)
+	}
+}
 
-		if len(allowMap) == 0 {
-			log.Println("WARNING: No backend hostnames are allowed, check your configuration!")
-		} else {
-			compatBackend = &Backend{
-				id:     "compat",
-				secret: []byte(commonSecret),
-				compat: true,
-
-				allowHttp: allowHttp,
+func mergeBackendIncludes(target *goconf.ConfigFile, source *goconf.ConfigFile, parents []string) error {
+	include, _ := source.GetString("backend", "include")
+	patterns := getConfiguredValues(include)
+	if len(parents) > 0 {
+		// Includes of included files are relative to the including file.
+		patterns = resolveIncludePatterns(include, filepath.Dir(parents[len(parents)-1]))
+	}
+	for _, pattern := range patterns {
+		filenames, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %s: %w", pattern, err)
+		}
 
-				sessionLimit: uint64(sessionLimit),
+		for _, filename := range filenames {
+			absolute, err := filepath.Abs(filename)
+			if err != nil {
+				return fmt.Errorf("could not resolve included file %s: %w", filename, err)
 			}
-			hosts := make([]string, 0, len(allowMap))
-			for host := range allowMap {
-				hosts = append(hosts, host)
-				backends[host] = []*Backend{compatBackend}
+			for _, parent := range parents {
+				if parent == absolute {
+					return fmt.Errorf("include cycle detected for file %s", filename)
+				}
 			}
-			if len(hosts) > 1 {
-				log.Println("WARNING: Using deprecated backend configuration. Please migrate the \"allowed\" setting to the new \"backends\" configuration.")
+
+			included, err := goconf.ReadConfigFile(filename)
+			if err != nil {
+				return fmt.Errorf("could not parse included file %s: %w", filename, err)
 			}
-			log.Printf("Allowed backend hostnames: %s", hosts)
-			if sessionLimit > 0 {
-				log.Printf("Allow a maximum of %d sessions", sessionLimit)
+
+			nested := make([]string, len(parents), len(parents)+1)
+			copy(nested, parents)
+			if err := mergeBackendIncludes(target, included, append(nested, absolute)); err != nil {
+				return err
 			}
-			numBackends++
+
+			mergeBackendSections(target, included)
+			log.Printf("Included backends from %s", filename)
 		}
 	}
-
-	RegisterBackendConfigurationStats()
-	statsBackendsCurrent.Add(float64(numBackends))
-
-	return &BackendConfiguration{
-		backends: backends,
-
-		allowAll:      allowAll,
-		commonSecret:  []byte(commonSecret),
-		compatBackend: compatBackend,
-	}, nil
+	return nil
 }
 
-func (b *BackendConfiguration) RemoveBackendsForHost(host string) {
-	if oldBackends := b.backends[host]; len(oldBackends) > 0 {
-		for _, backend := range oldBackends {
-			log.Printf("Backend %s removed for %s", backend.id, backend.url)
-		}
-		statsBackendsCurrent.Sub(float64(len(oldBackends)))
+func mergeBackendSections(target *goconf.ConfigFile, source *goconf.ConfigFile) {
+	// Only the list of backends and their sections are merged from included
+	// files, other sections are ignored.
+	includedIds, _ := source.GetString("backend", "backends")
+	if includedIds == "" {
+		return
 	}
-	delete(b.backends, host)
-}
 
-func (b *BackendConfiguration) UpsertHost(host string, backends []*Backend) {
-	for existingIndex, existingBackend := range b.backends[host] {
+	backendIds, _ := target.GetString("backend", "backends")
+	ids := getConfiguredBackendIDs(backendIds)
+	for _, id := range getConfiguredBackendIDs(includedIds) {
 		found := false
-		index := 0
-		for _, newBackend := range backends {
-			if reflect.DeepEqual(existingBackend, newBackend) { // otherwise we could manually compare the struct members here
+		for _, existing := range ids {
+			if existing == id {
 				found = true
-				backends = append(backends[:index], backends[index+1:]...)
-				break
-			} else if newBackend.id == existingBackend.id {
-				found = true
-				b.backends[host][existingIndex] = newBackend
-				backends = append(backends[:index], backends[index+1:]...)
-				log.Printf("Backend %s updated for %s", newBackend.id, newBackend.url)
 				break
 			}
-			index++
 		}
 		if !found {
-			removed := b.backends[host][existingIndex]
-			log.Printf("Backend %s removed for %s", removed.id, removed.url)
-			b.backends[host] = append(b.backends[host][:existingIndex], b.backends[host][existingIndex+1:]...)
-			statsBackendsCurrent.Dec()
+			ids = append(ids, id)
 		}
-	}
 
-	b.backends[host] = append(b.backends[host], backends...)
-	for _, added := range backends {
-		log.Printf("Backend %s added for %s", added.id, added.url)
+		if id == "backend" || !source.HasSection(id) {
+			continue
+		}
+
+		target.RemoveSection(id)
+		target.AddSection(id)
+		copySection(target, source, id)
 	}
-	statsBackendsCurrent.Add(float64(len(backends)))
+	target.AddOption("backend", "backends", strings.Join(ids, ", "))
 }
 
-func getConfiguredBackendIDs(backendIds string) (ids []string) {
-	seen := make(map[string]bool)
+// getConfiguredSecret returns the secret of a backend. The secret can either be
+// configured inline ("secret"), read from an environment variable
+// ("secret_env") or from a file ("secret_file"), but only one of them may be
+// set for a backend.
+func getConfiguredSecret(id string, config *goconf.ConfigFile) (string, error) {
+	secret, _ := config.GetString(id, "secret")
+	secretEnv, _ := config.GetString(id, "secret_env")
+	secretFile, _ := config.GetString(id, "secret_file")
 
-	for _, id := range strings.Split(backendIds, ",") {
-		id = strings.TrimSpace(id)
-		if id == "" {
-			continue
-		}
+	var sources []string
+	if secret != "" {
+		sources = append(sources, "secret")
+	}
+	if secretEnv != "" {
+		sources = append(sources, "secret_env")
+	}
+	if secretFile != "" {
+		sources = append(sources, "secret_file")
+	}
+	if len(sources) > 1 {
+		return "", fmt.Errorf("backend %s has multiple secret sources configured (%s), only one is allowed", id, strings.Join(sources, ", "))
+	}
 
-		if seen[id] {
-			continue
+	switch {
+	case secretEnv != "":
+		value, found := os.LookupEnv(secretEnv)
+		if !found {
+			log.Printf("Environment variable %s for secret of backend %s is not set", secretEnv, id)
+		}
+		return value, nil
+	case secretFile != "":
+		data, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret of backend %s from %s: %s", id, secretFile, err)
 		}
-		ids = append(ids, id)
-		seen[id] = true
+		// Editors usually add a trailing newline which is not part of the secret.
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		return secret, nil
+	}
+}
+
+// getConfiguredCommonSecrets returns the secrets of the deprecated compat
+// configuration. Multiple secrets can be configured as comma-separated list to
+// support rotation, the first one is used to sign requests to the backends.
+func getConfiguredCommonSecrets(config *goconf.ConfigFile) [][]byte {
+	value, _ := config.GetString("backend", "secret")
+	values := getConfiguredValues(value)
+	if len(values) == 0 {
+		return [][]byte{[]byte(value)}
+	}
+
+	secrets := make([][]byte, 0, len(values))
+	for _, v := range values {
+		secrets = append(secrets, []byte(v))
+	}
+	return secrets
+}
+
+// getConfiguredResumeBufferSize returns the global resume buffer size that is
+// used for backends without an explicit configuration.
+func getConfiguredResumeBufferSize(config *goconf.ConfigFile) int {
+	size, err := config.GetInt("backend", "resume_buffer_size")
+	if err != nil || size <= 0 {
+		size = defaultResumeBufferSize
+	}
+	return size
+}
+
+func getConfiguredMaxParticipants(config *goconf.ConfigFile) int {
+	maxParticipants, err := config.GetInt("backend", "maxparticipants")
+	if err != nil || maxParticipants < 0 {
+		maxParticipants = 0
+	}
+	return maxParticipants
+}
+
+func getConfiguredMessageRate(config *goconf.ConfigFile) int {
+	messageRate, err := config.GetInt("backend", "messagerate")
+	if err != nil || messageRate < 0 {
+		messageRate = 0
+	}
+	return messageRate
+}
+
+func getConfiguredRoomSwitchRate(config *goconf.ConfigFile) int {
+	roomSwitchRate, err := config.GetInt("backend", "roomswitchrate")
+	if err != nil || roomSwitchRate < 0 {
+		roomSwitchRate = 0
+	}
+	return roomSwitchRate
+}
+
+// getConfiguredWriteTimeout returns the global time allowed to write a message
+// to a client.
+func getConfiguredWriteTimeout(config *goconf.ConfigFile) time.Duration {
+	timeout, err := config.GetInt("backend", "writetimeout")
+	if err != nil || timeout <= 0 {
+		return defaultWriteTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// getConfiguredResumeGracePeriod returns the global time a session is kept
+// after its client disconnected.
+func getConfiguredResumeGracePeriod(config *goconf.ConfigFile) time.Duration {
+	period, err := config.GetInt("backend", "resume_grace_period")
+	if err != nil || period <= 0 {
+		return defaultResumeGracePeriod
+	}
+	return time.Duration(period) * time.Second
+}
+
+// getConfiguredMaxConcurrentRequests returns the global limit of concurrent
+// outbound requests to a backend, where 0 means unlimited.
+func getConfiguredMaxConcurrentRequests(config *goconf.ConfigFile) int {
+	maxRequests, err := config.GetInt("backend", "max_concurrent_requests")
+	if err != nil || maxRequests < 0 {
+		maxRequests = defaultMaxConcurrentRequests
+	}
+	return maxRequests
+}
+
+// getConfiguredMaxBackends returns the maximum number of backends that may be
+// configured, where 0 means unlimited.
+func getConfiguredMaxBackends(config *goconf.ConfigFile) int {
+	maxBackends, err := config.GetInt("backend", "max_backends")
+	if err != nil || maxBackends < 0 {
+		maxBackends = 0
 	}
+	return maxBackends
+}
 
-	return ids
+// getConfiguredBackendDebug returns true if the settings of each configured
+// backend should be logged.
+func getConfiguredBackendDebug(config *goconf.ConfigFile) bool {
+	debug, _ := config.GetBool("backend", "debug")
+	return debug
 }
 
-func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map[string][]*Backend) {
+func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map[string][]*Backend, err error) {
+	ids := getConfiguredBackendIDs(backendIds)
+	if maxBackends := getConfiguredMaxBackends(config); maxBackends > 0 && len(ids) > maxBackends {
+		return nil, fmt.Errorf("%d backends configured, only %d are allowed by \"max_backends\" in section \"backend\"", len(ids), maxBackends)
+	}
+
+	debug := getConfiguredBackendDebug(config)
+	debugf := func(format string, args ...interface{}) {
+		if debug {
+			log.Printf(format, args...)
+		}
+	}
+
 	hosts = make(map[string][]*Backend)
-	for _, id := range getConfiguredBackendIDs(backendIds) {
+	globalResumeBufferSize := getConfiguredResumeBufferSize(config)
+	globalMaxParticipants := getConfiguredMaxParticipants(config)
+	globalMessageRate := getConfiguredMessageRate(config)
+	globalRoomSwitchRate := getConfiguredRoomSwitchRate(config)
+	globalMaxConcurrentRequests := getConfiguredMaxConcurrentRequests(config)
+	globalWriteTimeout := getConfiguredWriteTimeout(config)
+	globalResumeGracePeriod := getConfiguredResumeGracePeriod(config)
+	for _, id := range ids {
 		u, _ := config.GetString(id, "url")
 		if u == "" {
 			log.Printf("Backend %s is missing or incomplete, skipping", id)
 			continue
 		}
 
-		if u[len(u)-1] != '/' {
-			u += "/"
-		}
-		parsed, err := url.Parse(u)
+		u, parsed, err := parseBackendUrl(u)
 		if err != nil {
 			log.Printf("Backend %s has an invalid url %s configured (%s), skipping", id, u, err)
 			continue
 		}
 
-		if strings.Contains(parsed.Host, ":") && hasStandardPort(parsed) {
-			parsed.Host = parsed.Hostname()
-			u = parsed.String()
+		secret, err := getConfiguredSecret(id, config)
+		if err != nil {
+			return nil, err
 		}
-
-		secret, _ := config.GetString(id, "secret")
 		if u == "" || secret == "" {
 			log.Printf("Backend %s is missing or incomplete, skipping", id)
 			continue
@@ -298,7 +1697,15 @@ func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map
 			sessionLimit = 0
 		}
 		if sessionLimit > 0 {
-			log.Printf("Backend %s allows a maximum of %d sessions", id, sessionLimit)
+			debugf("Backend %s allows a maximum of %d sessions", id, sessionLimit)
+		}
+
+		sessionLimitPerAddress, err := config.GetInt(id, "sessionlimitperaddress")
+		if err != nil || sessionLimitPerAddress < 0 {
+			sessionLimitPerAddress = 0
+		}
+		if sessionLimitPerAddress > 0 {
+			debugf("Backend %s allows a maximum of %d sessions per address", id, sessionLimitPerAddress)
 		}
 
 		maxStreamBitrate, err := config.GetInt(id, "maxstreambitrate")
@@ -310,54 +1717,248 @@ func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map
 			maxScreenBitrate = 0
 		}
 
+		var features []string
+		if value, _ := config.GetString(id, "features"); value != "" {
+			features = getConfiguredValues(value)
+			if features == nil {
+				features = []string{}
+			}
+			debugf("Backend %s only allows features %s", id, features)
+		}
+
+		var disabledFeatures []string
+		if value, err := config.GetString(id, "disabled_features"); err == nil {
+			// An empty value is allowed to enable all features for this backend.
+			disabledFeatures = getConfiguredValues(value)
+			if disabledFeatures == nil {
+				disabledFeatures = []string{}
+			}
+			if len(disabledFeatures) > 0 {
+				debugf("Backend %s disables client features %s", id, disabledFeatures)
+			}
+		}
+
+		var requiredFeatures []string
+		if value, err := config.GetString(id, "required_features"); err == nil {
+			// An empty value is allowed to not require any features for this backend.
+			requiredFeatures = getConfiguredValues(value)
+			if requiredFeatures == nil {
+				requiredFeatures = []string{}
+			}
+			if len(requiredFeatures) > 0 {
+				debugf("Backend %s requires client features %s", id, requiredFeatures)
+			}
+		}
+
+		var allowedAuthTypes []string
+		if value, err := config.GetString(id, "allowed_auth_types"); err == nil {
+			if strings.TrimSpace(value) == "" {
+				// An empty value is allowed to accept all auth types for this backend.
+				allowedAuthTypes = allAuthTypes
+			} else {
+				allowedAuthTypes = getConfiguredAuthTypes(value)
+			}
+			debugf("Backend %s allows auth types %s", id, allowedAuthTypes)
+		}
+
+		var deniedUsers *UserDenylist
+		if value, _ := config.GetString(id, "denied_users"); value != "" {
+			deniedUsers = NewUserDenylist(value)
+			if deniedUsers != nil {
+				debugf("Backend %s denies users %s", id, deniedUsers)
+			}
+		}
+
+		resumeBufferSize, err := config.GetInt(id, "resume_buffer_size")
+		if err != nil || resumeBufferSize <= 0 {
+			resumeBufferSize = globalResumeBufferSize
+		} else {
+			debugf("Backend %s stores up to %d messages for disconnected sessions", id, resumeBufferSize)
+		}
+
+		maxParticipants, err := config.GetInt(id, "maxparticipants")
+		if err != nil || maxParticipants < 0 {
+			maxParticipants = globalMaxParticipants
+		}
+		if maxParticipants > 0 {
+			debugf("Backend %s allows a maximum of %d participants per room", id, maxParticipants)
+		}
+
+		messageRate, err := config.GetInt(id, "messagerate")
+		if err != nil || messageRate < 0 {
+			messageRate = globalMessageRate
+		}
+		if messageRate > 0 {
+			debugf("Backend %s allows a maximum of %d messages per second per session", id, messageRate)
+		}
+
+		roomSwitchRate, err := config.GetInt(id, "roomswitchrate")
+		if err != nil || roomSwitchRate < 0 {
+			roomSwitchRate = globalRoomSwitchRate
+		}
+		if roomSwitchRate > 0 {
+			debugf("Backend %s allows a maximum of %d room switches per minute per session", id, roomSwitchRate)
+		}
+
+		writeTimeout := globalWriteTimeout
+		if timeout, err := config.GetInt(id, "writetimeout"); err == nil && timeout > 0 {
+			writeTimeout = time.Duration(timeout) * time.Second
+			debugf("Backend %s disconnects clients after a write timeout of %s", id, writeTimeout)
+		}
+
+		resumeGracePeriod := globalResumeGracePeriod
+		if period, err := config.GetInt(id, "resume_grace_period"); err == nil && period > 0 {
+			resumeGracePeriod = time.Duration(period) * time.Second
+			debugf("Backend %s keeps disconnected sessions for %s", id, resumeGracePeriod)
+		}
+
+		maxConcurrentRequests, err := config.GetInt(id, "max_concurrent_requests")
+		if err != nil || maxConcurrentRequests < 0 {
+			maxConcurrentRequests = globalMaxConcurrentRequests
+		}
+
+		allowHttp := parsed.Scheme == "http"
+		if value, _ := config.GetBool(id, "allowhttp"); value && !allowHttp {
+			log.Printf("WARNING: Backend %s also allows unencrypted http urls, check your configuration!", id)
+			allowHttp = true
+		}
+
 		hosts[parsed.Host] = append(hosts[parsed.Host], &Backend{
-			id:     id,
-			url:    u,
-			secret: []byte(secret),
+			id:        id,
+			url:       u,
+			parsedUrl: parsed,
+			secret:    []byte(secret),
 
-			allowHttp: parsed.Scheme == "http",
+			allowHttp: allowHttp,
 
 			maxStreamBitrate: maxStreamBitrate,
 			maxScreenBitrate: maxScreenBitrate,
 
+			features:         features,
+			disabledFeatures: disabledFeatures,
+			requiredFeatures: requiredFeatures,
+
+			allowedAuthTypes: allowedAuthTypes,
+
+			deniedUsers: deniedUsers,
+
+			resumeBufferSize: resumeBufferSize,
+
+			maxParticipants: maxParticipants,
+
+			messageRate: messageRate,
+
+			roomSwitchRate: roomSwitchRate,
+
+			writeTimeout: writeTimeout,
+
+			resumeGracePeriod: resumeGracePeriod,
+
+			maxConcurrentRequests: maxConcurrentRequests,
+
 			sessionLimit: uint64(sessionLimit),
+
+			sessionLimitPerAddress: sessionLimitPerAddress,
 		})
 	}
 
-	return hosts
+	return hosts, nil
 }
 
 func (b *BackendConfiguration) Reload(config *goconf.ConfigFile) {
-	if b.compatBackend != nil {
-		log.Println("Old-style configuration active, reload is not supported")
-		return
+	changes, err := b.ReloadBackends(config)
+	if err != nil {
+		log.Printf("Could not reload backends, keeping current configuration: %s", err)
+	} else if !changes.IsEmpty() {
+		log.Printf("Reloaded backends: %s", changes)
+	}
+}
+
+// ReloadBackends updates the backends from the given configuration like
+// "Reload" and returns the ids of the backends that were changed. The current
+// configuration is kept if an error is returned.
+func (b *BackendConfiguration) ReloadBackends(config *goconf.ConfigFile) (*BackendChanges, error) {
+	changes, err := b.reloadBackends(config)
+	if err != nil {
+		return nil, err
+	}
+
+	b.notifyUrlChanges(changes)
+	return changes, nil
+}
+
+func (b *BackendConfiguration) reloadBackends(config *goconf.ConfigFile) (*BackendChanges, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, fmt.Errorf("backend configuration is closed")
+	}
+
+	if b.compatBackend != nil && !b.compatRuntime {
+		return nil, fmt.Errorf("old-style configuration active, reload is not supported")
+	}
+
+	config, err := loadBackendIncludes(config)
+	if err != nil {
+		return nil, err
 	}
 
+	b.debug = getConfiguredBackendDebug(config)
+	changes := &BackendChanges{}
 	if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
-		configuredHosts := getConfiguredHosts(backendIds, config)
+		configuredHosts, err := getConfiguredHosts(backendIds, config)
+		if err != nil {
+			return nil, err
+		}
 
 		// remove backends that are no longer configured
 		for hostname := range b.backends {
 			if _, ok := configuredHosts[hostname]; !ok {
-				b.RemoveBackendsForHost(hostname)
+				b.removeBackendsForHostLocked(hostname, changes)
 			}
 		}
 
 		// rewrite backends adding newly configured ones and rewriting existing ones
 		for hostname, configuredBackends := range configuredHosts {
-			b.UpsertHost(hostname, configuredBackends)
+			b.upsertHostLocked(hostname, configuredBackends, changes)
 		}
 	}
+
+	changes.finish()
+	return changes, nil
 }
 
 func (b *BackendConfiguration) GetCompatBackend() *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	return b.compatBackend
 }
 
-func (b *BackendConfiguration) GetBackend(u *url.URL) *Backend {
-	if strings.Contains(u.Host, ":") && hasStandardPort(u) {
-		u.Host = u.Hostname()
+// HasBackendsForHost returns true if requests to the given host are allowed
+// for any backend.
+func (b *BackendConfiguration) HasBackendsForHost(host string) bool {
+	u := &url.URL{
+		Host: host,
 	}
+	normalizeUrlHost(u)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, found := b.backends[u.Host]
+	return found || b.allowAll
+}
+
+func (b *BackendConfiguration) GetBackend(u *url.URL) *Backend {
+	// Don't modify the url of the caller.
+	normalized := *u
+	u = &normalized
+	normalizeUrlHost(u)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
 	entries, found := b.backends[u.Host]
 	if !found {
@@ -367,19 +1968,16 @@ func (b *BackendConfiguration) GetBackend(u *url.URL) *Backend {
 		return nil
 	}
 
-	s := u.String()
-	if s[len(s)-1] != '/' {
-		s += "/"
-	}
+	path := cleanUrlPath(u.Path)
 	for _, entry := range entries {
 		if !entry.IsUrlAllowed(u) {
 			continue
 		}
 
-		if entry.url == "" {
+		if entry.parsedUrl == nil {
 			// Old-style configuration, only hosts are configured.
 			return entry
-		} else if strings.HasPrefix(s, entry.url) {
+		} else if entry.matchesScheme(u.Scheme) && strings.HasPrefix(path, entry.parsedUrl.Path) {
 			return entry
 		}
 	}
@@ -388,6 +1986,9 @@ func (b *BackendConfiguration) GetBackend(u *url.URL) *Backend {
 }
 
 func (b *BackendConfiguration) GetBackends() []*Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	var result []*Backend
 	for _, entries := range b.backends {
 		result = append(result, entries...)
@@ -395,6 +1996,88 @@ func (b *BackendConfiguration) GetBackends() []*Backend {
 	return result
 }
 
+// ConfiguredHosts returns the sorted list of hosts that backends are
+// configured for. Use "AllowsAll" to check if all hosts are allowed.
+func (b *BackendConfiguration) ConfiguredHosts() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	result := make([]string, 0, len(b.backends))
+	for host := range b.backends {
+		result = append(result, host)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// AllowsAll returns true if the deprecated "allowall" mode is active and any
+// backend host is allowed.
+func (b *BackendConfiguration) AllowsAll() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.allowAll
+}
+
+// SetAllowAll enables or disables the deprecated "allowall" mode at runtime
+// and returns the previous state. If no compat backend exists, one is created
+// with the common secret and configured settings when enabling. Disabling
+// removes the compat backend unless it is registered for the hosts of the
+// deprecated "allowed" setting, sessions connected to it are not affected. The
+// state is kept by "ReloadBackends" and reset by "Replace". Enabling fails if
+// "strict_backends" was enabled when loading the configuration.
+func (b *BackendConfiguration) SetAllowAll(allow bool) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous := b.allowAll
+	if previous == allow {
+		return previous, nil
+	} else if b.closed {
+		return previous, fmt.Errorf("backend configuration is closed")
+	}
+
+	if allow {
+		if b.strict {
+			return previous, fmt.Errorf("all backend hosts can't be allowed if \"strict_backends\" is enabled")
+		}
+
+		if b.compatBackend == nil {
+			if b.compatConfig == nil || len(b.compatConfig.secret) == 0 {
+				return previous, fmt.Errorf("no common secret configured for compat backend")
+			}
+
+			b.compatBackend = b.compatConfig.clone()
+			b.compatRuntime = true
+			b.updateBackendsStats(1)
+		}
+		log.Println("WARNING: All backend hostnames are allowed now, only use for development!")
+	} else {
+		// The compat backend of the deprecated "allowed" setting is registered
+		// for the allowed hosts and must be kept.
+		if b.compatBackend != nil && !b.isCompatBackendRegisteredLocked() {
+			b.compatBackend.Close()
+			b.compatBackend = nil
+			b.compatRuntime = false
+			b.updateBackendsStats(-1)
+		}
+		log.Println("WARNING: Only configured backend hostnames are allowed now")
+	}
+	b.allowAll = allow
+	return previous, nil
+}
+
+func (b *BackendConfiguration) isCompatBackendRegisteredLocked() bool {
+	for _, entries := range b.backends {
+		for _, entry := range entries {
+			if entry == b.compatBackend {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (b *BackendConfiguration) IsUrlAllowed(u *url.URL) bool {
 	if u == nil {
 		// Reject all invalid URLs.
@@ -418,3 +2101,19 @@ func (b *BackendConfiguration) GetSecret(u *url.URL) []byte {
 
 	return entry.secret
 }
+
+// GetSecrets returns all secrets that are accepted for requests from the
+// backend of the given url.
+func (b *BackendConfiguration) GetSecrets(u *url.URL) [][]byte {
+	if u == nil {
+		// Reject all invalid URLs.
+		return nil
+	}
+
+	entry := b.GetBackend(u)
+	if entry == nil {
+		return nil
+	}
+
+	return entry.Secrets()
+}
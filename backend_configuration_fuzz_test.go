@@ -0,0 +1,45 @@
+//go:build go1.18
+// +build go1.18
+
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+)
+
+func FuzzGetBackend(f *testing.F) {
+	for _, value := range testBackendUrls {
+		f.Add(value)
+	}
+
+	cfg := newGetBackendTestConfig(f, false)
+	defer cfg.Close()
+	allowAllCfg := newGetBackendTestConfig(f, true)
+	defer allowAllCfg.Close()
+
+	f.Fuzz(func(t *testing.T, value string) {
+		checkGetBackend(t, cfg, value)
+		checkGetBackend(t, allowAllCfg, value)
+	})
+}
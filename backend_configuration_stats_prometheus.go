@@ -32,6 +32,24 @@ var (
 		Name:      "session_limit_exceeded_total",
 		Help:      "The number of times the session limit exceeded",
 	}, []string{"backend"})
+	statsBackendRequestsSaturatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend",
+		Name:      "requests_saturated_total",
+		Help:      "The number of times the concurrent request limit of a backend was reached",
+	}, []string{"backend"})
+	statsBackendBytesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend",
+		Name:      "bytes_sent_total",
+		Help:      "The total number of bytes sent to clients of a backend",
+	}, []string{"backend"})
+	statsBackendBytesReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend",
+		Name:      "bytes_received_total",
+		Help:      "The total number of bytes received from clients of a backend",
+	}, []string{"backend"})
 	statsBackendsCurrent = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "signaling",
 		Subsystem: "backend",
@@ -41,6 +59,9 @@ var (
 
 	backendConfigurationStats = []prometheus.Collector{
 		statsBackendLimitExceededTotal,
+		statsBackendRequestsSaturatedTotal,
+		statsBackendBytesSentTotal,
+		statsBackendBytesReceivedTotal,
 		statsBackendsCurrent,
 	}
 )
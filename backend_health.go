@@ -0,0 +1,178 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	defaultHealthInitialBackoff = time.Second
+	defaultHealthMaxBackoff     = time.Minute
+	defaultHealthyThreshold     = 3
+
+	// Backoff delays are randomly reduced by up to this fraction, so multiple
+	// signaling servers don't retry an unhealthy backend at the same time.
+	healthBackoffJitter = 0.5
+)
+
+// BackendHealthConfig contains the parameters to detect unhealthy backends.
+type BackendHealthConfig struct {
+	// InitialBackoff is the delay before an unhealthy backend is retried
+	// after the first failure, it is doubled for every further failure.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum delay before an unhealthy backend is retried.
+	MaxBackoff time.Duration
+	// HealthyThreshold is the number of consecutive successes that are
+	// required to mark an unhealthy backend as healthy again.
+	HealthyThreshold int
+}
+
+// getConfiguredBackendHealth returns the health parameters configured in
+// section "backend".
+func getConfiguredBackendHealth(config *goconf.ConfigFile) BackendHealthConfig {
+	result := BackendHealthConfig{
+		InitialBackoff:   defaultHealthInitialBackoff,
+		MaxBackoff:       defaultHealthMaxBackoff,
+		HealthyThreshold: defaultHealthyThreshold,
+	}
+	if value, err := config.GetInt("backend", "health_initial_backoff"); err == nil && value > 0 {
+		result.InitialBackoff = time.Duration(value) * time.Second
+	}
+	if value, err := config.GetInt("backend", "health_max_backoff"); err == nil && value > 0 {
+		result.MaxBackoff = time.Duration(value) * time.Second
+	}
+	if result.MaxBackoff < result.InitialBackoff {
+		result.MaxBackoff = result.InitialBackoff
+	}
+	if value, err := config.GetInt("backend", "health_threshold"); err == nil && value > 0 {
+		result.HealthyThreshold = value
+	}
+	return result
+}
+
+// backendHealth tracks the health of a backend from the results of requests.
+// A single failure marks the backend as unhealthy, it must then succeed for
+// "HealthyThreshold" consecutive times to be healthy again. While unhealthy,
+// requests should only be retried after an exponential backoff with jitter.
+type backendHealth struct {
+	config BackendHealthConfig
+	// random returns a value in [0.0, 1.0), can be overwritten in tests.
+	random func() float64
+
+	mu         sync.Mutex
+	healthy    bool
+	failures   int
+	successes  int
+	retryAfter time.Time
+}
+
+func newBackendHealth(config BackendHealthConfig) *backendHealth {
+	return &backendHealth{
+		config: config,
+		random: rand.Float64,
+
+		healthy: true,
+	}
+}
+
+// IsHealthy returns true if the backend is considered healthy.
+func (h *backendHealth) IsHealthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.healthy
+}
+
+// CanRetry returns true if a request to the backend may be performed.
+func (h *backendHealth) CanRetry(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.healthy || !now.Before(h.retryAfter)
+}
+
+// RetryAfter returns the time after which an unhealthy backend may be retried.
+func (h *backendHealth) RetryAfter() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.retryAfter
+}
+
+func (h *backendHealth) getBackoffLocked() time.Duration {
+	delay := h.config.InitialBackoff
+	for i := 1; i < h.failures && delay < h.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > h.config.MaxBackoff {
+		delay = h.config.MaxBackoff
+	}
+	return delay - time.Duration(float64(delay)*healthBackoffJitter*h.random())
+}
+
+// RecordFailure records a failed request and returns true if the backend was
+// healthy before.
+func (h *backendHealth) RecordFailure(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The backoff is only reset once the backend is healthy again, so it also
+	// increases for backends that are flapping.
+	h.failures++
+	h.successes = 0
+	h.retryAfter = now.Add(h.getBackoffLocked())
+	if !h.healthy {
+		return false
+	}
+
+	h.healthy = false
+	return true
+}
+
+// RecordSuccess records a successful request and returns true if the backend
+// is healthy again.
+func (h *backendHealth) RecordSuccess(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.healthy {
+		return false
+	}
+
+	h.successes++
+	if h.successes < h.config.HealthyThreshold {
+		// The backend responds again, no need to wait for the next probe.
+		h.retryAfter = now
+		return false
+	}
+
+	h.healthy = true
+	h.failures = 0
+	h.successes = 0
+	h.retryAfter = time.Time{}
+	return true
+}
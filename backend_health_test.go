@@ -0,0 +1,193 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func newBackendHealthForTest(random float64) *backendHealth {
+	health := newBackendHealth(BackendHealthConfig{
+		InitialBackoff:   time.Second,
+		MaxBackoff:       10 * time.Second,
+		HealthyThreshold: 3,
+	})
+	health.random = func() float64 {
+		return random
+	}
+	return health
+}
+
+func TestBackendHealthConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	health := getConfiguredBackendHealth(config)
+	if health.InitialBackoff != defaultHealthInitialBackoff {
+		t.Errorf("Expected initial backoff %s, got %s", defaultHealthInitialBackoff, health.InitialBackoff)
+	}
+	if health.MaxBackoff != defaultHealthMaxBackoff {
+		t.Errorf("Expected max backoff %s, got %s", defaultHealthMaxBackoff, health.MaxBackoff)
+	}
+	if health.HealthyThreshold != defaultHealthyThreshold {
+		t.Errorf("Expected threshold %d, got %d", defaultHealthyThreshold, health.HealthyThreshold)
+	}
+
+	config.AddOption("backend", "health_initial_backoff", "5")
+	config.AddOption("backend", "health_max_backoff", "2")
+	config.AddOption("backend", "health_threshold", "1")
+	health = getConfiguredBackendHealth(config)
+	if health.InitialBackoff != 5*time.Second {
+		t.Errorf("Expected initial backoff %s, got %s", 5*time.Second, health.InitialBackoff)
+	}
+	// The maximum backoff may not be less than the initial backoff.
+	if health.MaxBackoff != 5*time.Second {
+		t.Errorf("Expected max backoff %s, got %s", 5*time.Second, health.MaxBackoff)
+	}
+	if health.HealthyThreshold != 1 {
+		t.Errorf("Expected threshold %d, got %d", 1, health.HealthyThreshold)
+	}
+}
+
+func TestBackendHealthBackoff(t *testing.T) {
+	health := newBackendHealthForTest(0)
+	now := time.Now()
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for idx, delay := range expected {
+		if changed := health.RecordFailure(now); changed != (idx == 0) {
+			t.Errorf("Expected changed %v for failure %d, got %v", idx == 0, idx+1, changed)
+		}
+		if health.IsHealthy() {
+			t.Errorf("Should be unhealthy after failure %d", idx+1)
+		}
+		if retry := health.RetryAfter().Sub(now); retry != delay {
+			t.Errorf("Expected backoff %s after failure %d, got %s", delay, idx+1, retry)
+		}
+		if health.CanRetry(now.Add(delay - time.Millisecond)) {
+			t.Errorf("Should not retry before %s after failure %d", delay, idx+1)
+		}
+		if !health.CanRetry(now.Add(delay)) {
+			t.Errorf("Should retry after %s after failure %d", delay, idx+1)
+		}
+	}
+}
+
+func TestBackendHealthJitter(t *testing.T) {
+	now := time.Now()
+	for _, random := range []float64{0, 0.25, 0.5, 0.99} {
+		health := newBackendHealthForTest(random)
+		health.RecordFailure(now)
+		retry := health.RetryAfter().Sub(now)
+		if retry > time.Second || retry < time.Duration(float64(time.Second)*(1-healthBackoffJitter)) {
+			t.Errorf("Backoff %s for random %f is outside of the jitter range", retry, random)
+		}
+	}
+
+	health := newBackendHealth(BackendHealthConfig{
+		InitialBackoff:   time.Second,
+		MaxBackoff:       time.Second,
+		HealthyThreshold: 1,
+	})
+	for i := 0; i < 100; i++ {
+		health.RecordFailure(now)
+		retry := health.RetryAfter().Sub(now)
+		if retry > time.Second || retry < time.Duration(float64(time.Second)*(1-healthBackoffJitter)) {
+			t.Errorf("Backoff %s is outside of the jitter range", retry)
+		}
+	}
+}
+
+func TestBackendHealthRecover(t *testing.T) {
+	health := newBackendHealthForTest(0)
+	now := time.Now()
+	if health.RecordSuccess(now) {
+		t.Error("Should not change if already healthy")
+	}
+	if !health.RecordFailure(now) {
+		t.Error("Should change to unhealthy")
+	}
+
+	now = now.Add(time.Second)
+	for i := 1; i < health.config.HealthyThreshold; i++ {
+		if health.RecordSuccess(now) {
+			t.Errorf("Should not change to healthy after success %d", i)
+		}
+		if health.IsHealthy() {
+			t.Errorf("Should be unhealthy after success %d", i)
+		}
+		if !health.CanRetry(now) {
+			t.Errorf("Should retry after success %d", i)
+		}
+	}
+	if !health.RecordSuccess(now) {
+		t.Error("Should change to healthy")
+	}
+	if !health.IsHealthy() {
+		t.Error("Should be healthy")
+	}
+
+	// The backoff starts again after the backend was healthy.
+	health.RecordFailure(now)
+	if retry := health.RetryAfter().Sub(now); retry != time.Second {
+		t.Errorf("Expected backoff %s, got %s", time.Second, retry)
+	}
+}
+
+func TestBackendHealthFlapping(t *testing.T) {
+	health := newBackendHealthForTest(0)
+	now := time.Now()
+	transitions := 0
+	var lastRetry time.Duration
+	for i := 0; i < 10; i++ {
+		if health.RecordFailure(now) {
+			transitions++
+		}
+		retry := health.RetryAfter().Sub(now)
+		if retry < lastRetry {
+			t.Errorf("Backoff should not decrease while flapping, got %s after %s", retry, lastRetry)
+		}
+		lastRetry = retry
+
+		now = now.Add(retry)
+		if health.RecordSuccess(now) {
+			transitions++
+		}
+		if health.IsHealthy() {
+			t.Errorf("Should not be healthy after a single success in round %d", i+1)
+		}
+	}
+
+	if transitions != 1 {
+		t.Errorf("Expected only one transition while flapping, got %d", transitions)
+	}
+	if lastRetry != health.config.MaxBackoff {
+		t.Errorf("Expected backoff %s, got %s", health.config.MaxBackoff, lastRetry)
+	}
+}
@@ -31,7 +31,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -279,18 +278,8 @@ func (b *BackendServer) parseRequestBody(f func(http.ResponseWriter, *http.Reque
 	}
 }
 
-func (b *BackendServer) sendRoomInvite(roomid string, backend *Backend, userids []string, properties *json.RawMessage) {
-	msg := &ServerMessage{
-		Type: "event",
-		Event: &EventServerMessage{
-			Target: "roomlist",
-			Type:   "invite",
-			Invite: &RoomEventServerMessage{
-				RoomId:     roomid,
-				Properties: properties,
-			},
-		},
-	}
+func (b *BackendServer) sendRoomInvite(roomid string, backend *Backend, userids []string, properties *json.RawMessage, federation *RoomFederationServerMessage) {
+	msg := NewFederatedInviteEvent(roomid, properties, federation)
 	for _, userid := range userids {
 		if err := b.nats.PublishMessage(GetSubjectForUserId(userid, backend), msg); err != nil {
 			log.Printf("Could not publish room invite for user %s in backend %s: %s", userid, backend.Id(), err)
@@ -299,19 +288,7 @@ func (b *BackendServer) sendRoomInvite(roomid string, backend *Backend, userids
 }
 
 func (b *BackendServer) sendRoomDisinvite(roomid string, backend *Backend, reason string, userids []string, sessionids []string) {
-	msg := &ServerMessage{
-		Type: "event",
-		Event: &EventServerMessage{
-			Target: "roomlist",
-			Type:   "disinvite",
-			Disinvite: &RoomDisinviteEventServerMessage{
-				RoomEventServerMessage: RoomEventServerMessage{
-					RoomId: roomid,
-				},
-				Reason: reason,
-			},
-		},
-	}
+	msg := NewDisinviteEvent(roomid, reason)
 	for _, userid := range userids {
 		if err := b.nats.PublishMessage(GetSubjectForUserId(userid, backend), msg); err != nil {
 			log.Printf("Could not publish room disinvite for user %s in backend %s: %s", userid, backend.Id(), err)
@@ -342,17 +319,7 @@ func (b *BackendServer) sendRoomDisinvite(roomid string, backend *Backend, reaso
 }
 
 func (b *BackendServer) sendRoomUpdate(roomid string, backend *Backend, notified_userids []string, all_userids []string, properties *json.RawMessage) {
-	msg := &ServerMessage{
-		Type: "event",
-		Event: &EventServerMessage{
-			Target: "roomlist",
-			Type:   "update",
-			Update: &RoomEventServerMessage{
-				RoomId:     roomid,
-				Properties: properties,
-			},
-		},
-	}
+	msg := NewUpdateEvent(roomid, properties)
 	notified := make(map[string]bool)
 	for _, userid := range notified_userids {
 		notified[userid] = true
@@ -543,7 +510,7 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 			// Old-style Talk, find backend that created the checksum.
 			// TODO(fancycode): Remove once all supported Talk versions send the backend header.
 			for _, b := range b.hub.backend.GetBackends() {
-				if ValidateBackendChecksum(r, body, b.Secret()) {
+				if b.ValidateChecksum(r, body) {
 					backend = b
 					break
 				}
@@ -556,7 +523,7 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 		}
 	}
 
-	if !ValidateBackendChecksum(r, body, backend.Secret()) {
+	if !backend.ValidateChecksum(r, body) {
 		http.Error(w, "Authentication check failed", http.StatusForbidden)
 		return
 	}
@@ -573,13 +540,29 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 	var err error
 	switch request.Type {
 	case "invite":
-		b.sendRoomInvite(roomid, backend, request.Invite.UserIds, request.Invite.Properties)
+		if federation := request.Invite.Federation; federation != nil {
+			if err := federation.CheckValid(); err != nil {
+				log.Printf("Invalid federation with signaling url %q for room %s: %s", federation.SignalingUrl, roomid, err)
+				http.Error(w, "Invalid federation", http.StatusBadRequest)
+				return
+			}
+		}
+		b.sendRoomInvite(roomid, backend, request.Invite.UserIds, request.Invite.Properties, request.Invite.Federation)
 		b.sendRoomUpdate(roomid, backend, request.Invite.UserIds, request.Invite.AllUserIds, request.Invite.Properties)
 	case "disinvite":
 		b.sendRoomDisinvite(roomid, backend, DisinviteReasonDisinvited, request.Disinvite.UserIds, request.Disinvite.SessionIds)
 		b.sendRoomUpdate(roomid, backend, request.Disinvite.UserIds, request.Disinvite.AllUserIds, request.Disinvite.Properties)
 	case "update":
+		if request.Update.Properties == nil && request.Update.PropertiesPatch != nil {
+			if _, err := parsePropertiesPatch(request.Update.PropertiesPatch); err != nil {
+				log.Printf("Invalid properties patch %s for room %s: %s", string(*request.Update.PropertiesPatch), roomid, err)
+				http.Error(w, "Invalid properties patch", http.StatusBadRequest)
+				return
+			}
+		}
 		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), &request)
+		// Room list events don't contain properties for patches as the full
+		// properties are not known here.
 		b.sendRoomUpdate(roomid, backend, nil, request.Update.UserIds, request.Update.Properties)
 	case "delete":
 		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), &request)
@@ -610,12 +593,14 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 
 func (b *BackendServer) validateStatsRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addr := getRealUserIP(r)
-		if strings.Contains(addr, ":") {
-			if host, _, err := net.SplitHostPort(addr); err == nil {
-				addr = host
-			}
+		if b.hub.getTrustedProxies().IsUntrustedForward(r) {
+			// The request was forwarded by a proxy that is not trusted, so the
+			// address of the client that sent it is unknown.
+			http.Error(w, "Authentication check failed", http.StatusForbidden)
+			return
 		}
+
+		addr := b.hub.getRealUserIP(r)
 		if !b.statsAllowedIps[addr] {
 			http.Error(w, "Authentication check failed", http.StatusForbidden)
 			return
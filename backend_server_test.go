@@ -381,6 +381,91 @@ func TestBackendServer_RoomInvite(t *testing.T) {
 	}
 }
 
+func TestBackendServer_RoomInviteFederated(t *testing.T) {
+	_, _, n, hub, _, server, shutdown := CreateBackendServerForTest(t)
+	defer shutdown()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userid := "test-userid"
+	backend := hub.backend.GetBackend(u)
+
+	natsChan := make(chan *nats.Msg, 1)
+	subject := GetSubjectForUserId(userid, backend)
+	sub, err := n.Subscribe(subject, natsChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	federation := &RoomFederationServerMessage{
+		SignalingUrl: "wss://signaling.remote.invalid/spreed",
+		Url:          "https://cloud.remote.invalid",
+		Token:        "the-federation-token",
+	}
+	msg := &BackendServerRoomRequest{
+		Type: "invite",
+		Invite: &BackendRoomInviteRequest{
+			UserIds: []string{
+				userid,
+			},
+			Federation: federation,
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomId := "the-room-id"
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	event, err := expectRoomlistEvent(n, natsChan, subject, "invite")
+	if err != nil {
+		t.Error(err)
+	} else if event.Invite == nil {
+		t.Errorf("Expected invite, got %+v", event)
+	} else if !reflect.DeepEqual(event.Invite.Federation, federation) {
+		t.Errorf("Expected federation %+v, got %+v", federation, event.Invite.Federation)
+	}
+
+	// Invalid federation information is rejected.
+	msg.Invite.Federation = &RoomFederationServerMessage{
+		SignalingUrl: "wss://signaling.remote.invalid/spreed",
+		Url:          "https://cloud.remote.invalid",
+	}
+	data, err = json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res2.Body.Close()
+	if res2.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %s", res2.Status)
+	}
+}
+
 func TestBackendServer_RoomDisinvite(t *testing.T) {
 	_, _, n, hub, _, server, shutdown := CreateBackendServerForTest(t)
 	defer shutdown()
@@ -1148,6 +1233,8 @@ func TestBackendServer_ParticipantsUpdateTimeout(t *testing.T) {
 	}
 	if in_call_1, err := checkMessageParticipantsInCall(msg1_a); err != nil {
 		t.Error(err)
+	} else if in_call_1.InCallState == nil || !*in_call_1.InCallState {
+		t.Errorf("Expected typed in-call state, got %+v", in_call_1)
 	} else if len(in_call_1.Users) != 2 {
 		msg1_b, err := client1.RunUntilMessage(ctx)
 		if err != nil {
@@ -1309,3 +1396,57 @@ func TestBackendServer_TurnCredentials(t *testing.T) {
 		t.Errorf("Expected the list of servers as %s, got %s", turnServers, cred.URIs)
 	}
 }
+
+func TestBackendServer_StatsForwarded(t *testing.T) {
+	_, _, _, hub, _, server, shutdown := CreateBackendServerForTest(t)
+	defer shutdown()
+
+	getStats := func(header http.Header) int {
+		request, err := http.NewRequest("GET", server.URL+"/api/v1/stats", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		client := &http.Client{}
+		res, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if _, err := ioutil.ReadAll(res.Body); err != nil {
+			t.Error(err)
+		}
+		return res.StatusCode
+	}
+
+	if code := getStats(nil); code != http.StatusOK {
+		t.Errorf("Expected successful request, got %d", code)
+	}
+
+	// Requests forwarded by untrusted proxies are rejected, the address of the
+	// client is unknown.
+	for _, header := range []http.Header{
+		{http.CanonicalHeaderKey("x-real-ip"): []string{"1.2.3.4"}},
+		{http.CanonicalHeaderKey("x-forwarded-for"): []string{"1.2.3.4"}},
+		{http.CanonicalHeaderKey("x-forwarded-for"): []string{"127.0.0.1"}},
+	} {
+		if code := getStats(header); code != http.StatusForbidden {
+			t.Errorf("Expected forbidden request for %+v, got %d", header, code)
+		}
+	}
+
+	trustedProxies, err := ParseTrustedProxies("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.trustedProxies.Store(trustedProxies)
+
+	if code := getStats(http.Header{http.CanonicalHeaderKey("x-real-ip"): []string{"127.0.0.1"}}); code != http.StatusOK {
+		t.Errorf("Expected successful request from trusted proxy, got %d", code)
+	}
+	if code := getStats(http.Header{http.CanonicalHeaderKey("x-real-ip"): []string{"1.2.3.4"}}); code != http.StatusForbidden {
+		t.Errorf("Expected forbidden request for other client, got %d", code)
+	}
+}
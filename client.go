@@ -24,7 +24,9 @@ package signaling
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"log"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,6 +50,9 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 64 * 1024
+
+	// Maximum number of dry requests per second before the hello was sent.
+	maxDryMessageRate = 5
 )
 
 var (
@@ -78,7 +83,7 @@ func IsValidCountry(country string) bool {
 }
 
 var (
-	InvalidFormat = NewError("invalid_format", "Invalid data format.")
+	InvalidFormat = NewErrorCode(ErrorCodeInvalidFormat)
 
 	bufferPool = sync.Pool{
 		New: func() interface{} {
@@ -87,10 +92,35 @@ var (
 	}
 )
 
+var (
+	// ByeCloseCodes contains the WebSocket close codes that are sent when a
+	// connection is closed after a "bye" with the given reason. Applications
+	// may override entries before any clients are connected.
+	ByeCloseCodes = map[string]int{
+		ByeCodeKicked:                 4001,
+		ByeCodeRoomSessionReconnected: 4002,
+		ByeCodeSessionResumed:         4003,
+		ByeCodeRoomJoinTimeout:        4004,
+		ByeCodeHelloTimeout:           4005,
+		ByeCodeBackendChanged:         4006,
+		ByeCodeShutdown:               websocket.CloseServiceRestart,
+	}
+)
+
+// GetByeCloseCode returns the WebSocket close code to use when closing a
+// connection after a "bye" with the given reason.
+func GetByeCloseCode(reason string) int {
+	if code, found := ByeCloseCodes[reason]; found {
+		return code
+	}
+
+	return websocket.CloseNormalClosure
+}
+
 type WritableClientMessage interface {
 	json.Marshaler
 
-	CloseAfterSend(session Session) bool
+	CloseAfterSend(session MessageSession) bool
 }
 
 type Client struct {
@@ -100,6 +130,16 @@ type Client struct {
 	closed  uint32
 	country *string
 	logRTT  bool
+	// sharedProxy is true if the client connected through a trusted proxy
+	// that didn't forward the client address, the address is the one of the
+	// proxy in that case.
+	sharedProxy bool
+
+	writeTimeout int64
+	slow         uint32
+
+	// dryLimiter limits the dry requests of clients without a session.
+	dryLimiter *messageRateLimiter
 
 	session unsafe.Pointer
 
@@ -134,6 +174,8 @@ func NewClient(conn *websocket.Conn, remoteAddress string, agent string) (*Clien
 		closeChan:   make(chan bool, 1),
 		messageChan: make(chan *bytes.Buffer, 16),
 
+		dryLimiter: newMessageRateLimiter(maxDryMessageRate),
+
 		OnLookupCountry:   func(client *Client) string { return unknownCountry },
 		OnClosed:          func(client *Client) {},
 		OnMessageReceived: func(client *Client, data []byte) {},
@@ -152,6 +194,19 @@ func (c *Client) SetConn(conn *websocket.Conn, remoteAddress string) {
 	c.OnMessageReceived = func(client *Client, data []byte) {}
 }
 
+// SetWriteTimeout sets the time allowed to write a message to the client. A
+// client that doesn't read its messages within this time will be disconnected.
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.writeTimeout, int64(timeout))
+}
+
+func (c *Client) getWriteTimeout() time.Duration {
+	if timeout := time.Duration(atomic.LoadInt64(&c.writeTimeout)); timeout > 0 {
+		return timeout
+	}
+	return writeWait
+}
+
 func (c *Client) IsConnected() bool {
 	return atomic.LoadUint32(&c.closed) == 0
 }
@@ -334,6 +389,10 @@ func (c *Client) ReadPump() {
 			break
 		}
 
+		if session := c.GetSession(); session != nil {
+			session.countBytesReceived(decodeBuffer.Len())
+		}
+
 		c.messagesDone.Add(1)
 		c.messageChan <- decodeBuffer
 	}
@@ -361,17 +420,34 @@ func (c *Client) processMessages() {
 func (c *Client) writeInternal(message json.Marshaler) bool {
 	var closeData []byte
 
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint
-	writer, err := c.conn.NextWriter(websocket.TextMessage)
-	if err == nil {
-		if m, ok := (interface{}(message)).(easyjson.Marshaler); ok {
-			_, err = easyjson.MarshalToWriter(m, writer)
-		} else {
-			err = json.NewEncoder(writer).Encode(message)
+	c.conn.SetWriteDeadline(time.Now().Add(c.getWriteTimeout())) // nolint
+	var written int
+	var err error
+	if m, ok := message.(*PreparedMessage); ok {
+		// Already serialized, the frame can be reused for all clients.
+		if err = c.conn.WritePreparedMessage(m.prepared); err == nil {
+			if session := c.GetSession(); session != nil {
+				session.countBytesSent(len(m.data))
+			}
+		}
+	} else {
+		var writer io.WriteCloser
+		writer, err = c.conn.NextWriter(websocket.TextMessage)
+		if err == nil {
+			if m, ok := (interface{}(message)).(easyjson.Marshaler); ok {
+				written, err = easyjson.MarshalToWriter(m, writer)
+			} else {
+				counter := &countingWriter{Writer: writer}
+				err = json.NewEncoder(counter).Encode(message)
+				written = counter.written
+			}
+		}
+		if err == nil {
+			if session := c.GetSession(); session != nil {
+				session.countBytesSent(written)
+			}
+			err = writer.Close()
 		}
-	}
-	if err == nil {
-		err = writer.Close()
 	}
 	if err != nil {
 		if err == websocket.ErrCloseSent {
@@ -379,6 +455,21 @@ func (c *Client) writeInternal(message json.Marshaler) bool {
 			return false
 		}
 
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			// The client doesn't read its messages, disconnect it so it can't
+			// block any resources.
+			if atomic.CompareAndSwapUint32(&c.slow, 0, 1) {
+				if session := c.GetSession(); session != nil {
+					log.Printf("Client %s is too slow, disconnecting: %v", session.PublicId(), err)
+					go session.Close()
+				} else {
+					log.Printf("Client %s is too slow, disconnecting: %v", c.RemoteAddr(), err)
+				}
+				go c.Close()
+			}
+			return false
+		}
+
 		if session := c.GetSession(); session != nil {
 			log.Printf("Could not send message %+v to client %s: %v", message, session.PublicId(), err)
 		} else {
@@ -390,7 +481,7 @@ func (c *Client) writeInternal(message json.Marshaler) bool {
 	return true
 
 close:
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint
+	c.conn.SetWriteDeadline(time.Now().Add(c.getWriteTimeout())) // nolint
 	if err := c.conn.WriteMessage(websocket.CloseMessage, closeData); err != nil {
 		if session := c.GetSession(); session != nil {
 			log.Printf("Could not send close message to client %s: %v", session.PublicId(), err)
@@ -404,7 +495,7 @@ close:
 func (c *Client) writeError(e error) bool { // nolint
 	message := &ServerMessage{
 		Type:  "error",
-		Error: NewError("internal_error", e.Error()),
+		Error: NewError(ErrorCodeInternalError, e.Error()),
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -417,7 +508,7 @@ func (c *Client) writeError(e error) bool { // nolint
 	}
 
 	closeData := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, e.Error())
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint
+	c.conn.SetWriteDeadline(time.Now().Add(c.getWriteTimeout())) // nolint
 	if err := c.conn.WriteMessage(websocket.CloseMessage, closeData); err != nil {
 		if session := c.GetSession(); session != nil {
 			log.Printf("Could not send close message to client %s: %v", session.PublicId(), err)
@@ -443,10 +534,35 @@ func (c *Client) writeMessageLocked(message WritableClientMessage) bool {
 		return false
 	}
 
+	switch m := message.(type) {
+	case *ServerMessage:
+		countServerMessage(m)
+	case *PreparedMessage:
+		countServerMessage(m.Message())
+	}
+
 	session := c.GetSession()
-	if message.CloseAfterSend(session) {
-		c.conn.SetWriteDeadline(time.Now().Add(writeWait))    // nolint
-		c.conn.WriteMessage(websocket.CloseMessage, []byte{}) // nolint
+	if session != nil && session.DebugPayloads() {
+		log.Printf("Sent to session %s: %s", session.PublicId(), formatDebugPayload(message))
+	}
+	var messageSession MessageSession
+	if session != nil {
+		// Don't pass a typed nil pointer to the interface.
+		messageSession = session
+	}
+	if message.CloseAfterSend(messageSession) {
+		closeData := []byte{}
+		m, ok := message.(*ServerMessage)
+		if prepared, isPrepared := message.(*PreparedMessage); isPrepared {
+			m, ok = prepared.Message(), true
+		}
+		if ok && m.Type == "bye" && m.Bye != nil {
+			// Clients behind proxies that drop the "bye" can still get the
+			// reason from the close code.
+			closeData = websocket.FormatCloseMessage(GetByeCloseCode(m.Bye.Reason), m.Bye.Reason)
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(c.getWriteTimeout())) // nolint
+		c.conn.WriteMessage(websocket.CloseMessage, closeData)       // nolint
 		if session != nil {
 			go session.Close()
 		}
@@ -466,7 +582,7 @@ func (c *Client) sendPing() bool {
 
 	now := time.Now().UnixNano()
 	msg := strconv.FormatInt(now, 10)
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint
+	c.conn.SetWriteDeadline(time.Now().Add(c.getWriteTimeout())) // nolint
 	if err := c.conn.WriteMessage(websocket.PingMessage, []byte(msg)); err != nil {
 		if session := c.GetSession(); session != nil {
 			log.Printf("Could not send ping to client %s: %v", session.PublicId(), err)
@@ -38,28 +38,53 @@ import (
 )
 
 var (
-	// Sessions expire 30 seconds after the connection closed.
-	sessionExpireDuration = 30 * time.Second
-
 	// Warn if a session has 32 or more pending messages.
 	warnPendingMessagesCount = 32
 
+	// Repeated presence updates with the same state are coalesced.
+	presenceCoalesceInterval = time.Second
+
+	// ICE candidates from the MCU are collected for this duration before
+	// they are sent to clients supporting "candidates" messages.
+	candidatesBatchDelay = 10 * time.Millisecond
+
+	// The connection quality is reset to "good" if the MCU didn't report a
+	// slow link for this duration.
+	connectionQualityResetTimeout = 10 * time.Second
+
 	PathToOcsSignalingBackend = "ocs/v2.php/apps/spreed/api/v1/signaling/backend"
 )
 
 type ClientSession struct {
+	// Must be first for 64-bit alignment of the counters.
+	trafficCounter
 	roomJoinTime int64
 
-	running   int32
+	running int32
+	// debugPayloads is non-zero if all message payloads should be logged.
+	debugPayloads uint32
+
+	sessionMetadata
+
 	hub       *Hub
 	privateId string
 	publicId  string
 	data      *SessionIdData
 
 	clientType string
+	clientInfo *HelloClientInfo
 	features   []string
 	userId     string
 	userData   *json.RawMessage
+	// displayName is parsed once from the user data which doesn't change.
+	displayName string
+
+	subscription string
+	observer     bool
+
+	rateLimiter *messageRateLimiter
+	// roomSwitchLimiter limits the number of rooms joined or left per minute.
+	roomSwitchLimiter *messageRateLimiter
 
 	supportsPermissions bool
 	permissions         map[Permission]bool
@@ -76,6 +101,7 @@ type ClientSession struct {
 	mu sync.Mutex
 
 	client        *Client
+	remoteAddr    string
 	room          unsafe.Pointer
 	roomSessionId string
 
@@ -86,11 +112,42 @@ type ClientSession struct {
 	publishers  map[string]McuPublisher
 	subscribers map[string]McuSubscriber
 
+	pendingCandidates map[string]*candidatesBatch
+
 	pendingClientMessages        []*ServerMessage
 	hasPendingChat               bool
 	hasPendingParticipantsUpdate bool
+	droppedPendingMessages       int
 
 	virtualSessions map[*VirtualSession]bool
+
+	presenceRoom    *Room
+	presenceState   string
+	presenceUpdated time.Time
+
+	quality      string
+	qualityTimer *time.Timer
+
+	// Cached *messageSenders, updates are serialized by sendersMu.
+	senders   atomic.Value
+	sendersMu sync.Mutex
+}
+
+// candidatesBatch contains the ICE candidates of a MCU client that have not
+// been sent yet.
+type candidatesBatch struct {
+	sender     string
+	streamType string
+	candidates []interface{}
+	timer      *time.Timer
+}
+
+// messageSenders contains the senders of messages by recipient type, they are
+// only valid while the session is in the room as the user id of guests is taken
+// from the room session data. The struct is never modified once stored.
+type messageSenders struct {
+	room    *Room
+	senders map[string]*MessageServerMessageSender
 }
 
 func NewClientSession(hub *Hub, privateId string, publicId string, data *SessionIdData, backend *Backend, hello *HelloClientMessage, auth *BackendClientAuthResponse) (*ClientSession, error) {
@@ -101,16 +158,31 @@ func NewClientSession(hub *Hub, privateId string, publicId string, data *Session
 		data:      data,
 
 		clientType: hello.Auth.Type,
-		features:   hello.Features,
+		clientInfo: hello.Client,
+		features:   hub.filterDisabledFeatures(publicId, backend, hello.Features),
 		userId:     auth.UserId,
 		userData:   auth.User,
 
+		displayName: getUserDisplayName(auth.UserId, auth.User),
+
+		subscription: hello.Subscription,
+		observer:     hello.Observer,
+
 		backend: backend,
 
 		natsReceiver: make(chan *nats.Msg, 64),
 		stopRun:      make(chan bool, 1),
 		runStopped:   make(chan bool, 1),
 	}
+	if s.subscription == "" {
+		s.subscription = SubscriptionLevelAll
+	}
+	if backend != nil && backend.MessageRate() > 0 && s.clientType != HelloClientTypeInternal {
+		s.rateLimiter = newMessageRateLimiter(backend.MessageRate())
+	}
+	if backend != nil && backend.RoomSwitchRate() > 0 && s.clientType != HelloClientTypeInternal {
+		s.roomSwitchLimiter = newRateLimiter(backend.RoomSwitchRate(), time.Minute)
+	}
 	if s.clientType == HelloClientTypeInternal {
 		s.backendUrl = hello.Auth.internalParams.Backend
 		s.parsedBackendUrl = hello.Auth.internalParams.parsedBackend
@@ -119,19 +191,16 @@ func NewClientSession(hub *Hub, privateId string, publicId string, data *Session
 		s.parsedBackendUrl = hello.Auth.parsedUrl
 	}
 	if !strings.Contains(s.backendUrl, "/ocs/v2.php/") {
-		backendUrl := s.backendUrl
-		if !strings.HasSuffix(backendUrl, "/") {
-			backendUrl += "/"
+		backendUrl := backend.requestURLFor(s.parsedBackendUrl, PathToOcsSignalingBackend)
+		if backendUrl == "" {
+			backendUrl = joinUrlPath(s.backendUrl, PathToOcsSignalingBackend)
 		}
-		backendUrl += PathToOcsSignalingBackend
 		u, err := url.Parse(backendUrl)
 		if err != nil {
 			return nil, err
 		}
 
-		if strings.Contains(u.Host, ":") && hasStandardPort(u) {
-			u.Host = u.Hostname()
-		}
+		normalizeUrlHost(u)
 
 		s.backendUrl = backendUrl
 		s.parsedBackendUrl = u
@@ -165,6 +234,10 @@ func (s *ClientSession) ClientType() string {
 	return s.clientType
 }
 
+func (s *ClientSession) ClientInfo() *HelloClientInfo {
+	return s.clientInfo
+}
+
 func (s *ClientSession) GetFeatures() []string {
 	return s.features
 }
@@ -178,6 +251,155 @@ func (s *ClientSession) HasFeature(feature string) bool {
 	return false
 }
 
+// SubscriptionLevel returns the level of room events the session subscribed to.
+func (s *ClientSession) SubscriptionLevel() string {
+	return s.subscription
+}
+
+// IsObserver returns true if the session may only receive room events.
+func (s *ClientSession) IsObserver() bool {
+	return s.observer
+}
+
+// MessageRate returns the maximum number of messages per second the session
+// may send or 0 if unlimited.
+func (s *ClientSession) MessageRate() int {
+	if s.rateLimiter == nil {
+		return 0
+	}
+
+	return s.rateLimiter.Rate()
+}
+
+// AllowRoomSwitch checks if the session may join or leave another room without
+// exceeding its room switch rate.
+func (s *ClientSession) AllowRoomSwitch() bool {
+	if s.roomSwitchLimiter == nil {
+		return true
+	}
+
+	return s.roomSwitchLimiter.Allow(time.Now())
+}
+
+// RoomSwitchRate returns the maximum number of rooms per minute the session
+// may join or leave or 0 if unlimited.
+func (s *ClientSession) RoomSwitchRate() int {
+	if s.roomSwitchLimiter == nil {
+		return 0
+	}
+
+	return s.roomSwitchLimiter.Rate()
+}
+
+// RoomSwitchRetryAfter returns the duration after which the session may join
+// or leave another room.
+func (s *ClientSession) RoomSwitchRetryAfter() time.Duration {
+	if s.roomSwitchLimiter == nil {
+		return 0
+	}
+
+	return s.roomSwitchLimiter.RetryAfter(time.Now())
+}
+
+// SetDebugPayloads enables or disables logging of all message payloads that
+// are sent from or to the session.
+func (s *ClientSession) SetDebugPayloads(enabled bool) {
+	if enabled {
+		atomic.StoreUint32(&s.debugPayloads, 1)
+	} else {
+		atomic.StoreUint32(&s.debugPayloads, 0)
+	}
+}
+
+// DebugPayloads returns true if the message payloads of the session should
+// be logged.
+func (s *ClientSession) DebugPayloads() bool {
+	return atomic.LoadUint32(&s.debugPayloads) != 0
+}
+
+// AllowMessage checks if the session may send another message without
+// exceeding its message rate.
+func (s *ClientSession) AllowMessage() bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+
+	return s.rateLimiter.Allow(time.Now())
+}
+
+// MessageRetryAfter returns the duration after which the session may send
+// another message.
+func (s *ClientSession) MessageRetryAfter() time.Duration {
+	if s.rateLimiter == nil {
+		return 0
+	}
+
+	return s.rateLimiter.RetryAfter(time.Now())
+}
+
+// UpdatePresence stores the presence state of the session in the given room.
+// Returns false if the same state was updated recently, so the update can be
+// dropped.
+func (s *ClientSession) UpdatePresence(room *Room, state string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.presenceRoom == room && s.presenceState == state && now.Sub(s.presenceUpdated) < presenceCoalesceInterval {
+		return false
+	}
+
+	s.presenceRoom = room
+	s.presenceState = state
+	s.presenceUpdated = now
+	return true
+}
+
+// filterSubscribedEvent returns the message that should be sent to the session
+// for the given event, depending on the subscription level. Returns nil if the
+// session is not interested in the event.
+func (s *ClientSession) filterSubscribedEvent(message *ServerMessage) *ServerMessage {
+	if s.subscription != SubscriptionLevelCounts || message.Type != "event" || message.Event == nil {
+		return message
+	}
+
+	event := message.Event
+	switch event.Target {
+	case "room":
+		var counts *RoomCountsServerMessage
+		switch event.Type {
+		case "join":
+			counts = &RoomCountsServerMessage{
+				Joined: len(event.Join),
+			}
+		case "leave":
+			counts = &RoomCountsServerMessage{
+				Left: len(event.Leave),
+			}
+		case "change":
+			return nil
+		default:
+			return message
+		}
+
+		if room := s.GetRoom(); room != nil {
+			counts.Sessions = room.NumSessions()
+		}
+		return &ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "room",
+				Type:   "counts",
+				Counts: counts,
+			},
+		}
+	case "participants":
+		if event.Type == "update" {
+			return nil
+		}
+	}
+	return message
+}
+
 // HasPermission checks if the session has the passed permissions.
 func (s *ClientSession) HasPermission(permission Permission) bool {
 	s.mu.Lock()
@@ -291,10 +513,62 @@ func (s *ClientSession) UserId() string {
 	return userId
 }
 
+// GetMessageSender returns the sender of messages with the given recipient type
+// that are sent by the session. The sender is cached until the room of the
+// session or its room session data changes and must not be modified.
+func (s *ClientSession) GetMessageSender(recipientType string) *MessageServerMessageSender {
+	room := s.GetRoom()
+	if cached, _ := s.senders.Load().(*messageSenders); cached != nil && cached.room == room {
+		if sender, found := cached.senders[recipientType]; found {
+			return sender
+		}
+	}
+
+	s.sendersMu.Lock()
+	defer s.sendersMu.Unlock()
+
+	// The room might have changed in the meantime, it is only updated while
+	// holding the lock.
+	room = s.GetRoom()
+	senders := make(map[string]*MessageServerMessageSender)
+	if cached, _ := s.senders.Load().(*messageSenders); cached != nil && cached.room == room {
+		if sender, found := cached.senders[recipientType]; found {
+			return sender
+		}
+
+		for t, sender := range cached.senders {
+			senders[t] = sender
+		}
+	}
+
+	sender := &MessageServerMessageSender{
+		Type:      recipientType,
+		SessionId: s.PublicId(),
+		UserId:    s.UserId(),
+	}
+	senders[recipientType] = sender
+	s.senders.Store(&messageSenders{
+		room:    room,
+		senders: senders,
+	})
+	return sender
+}
+
+func (s *ClientSession) clearMessageSenders() {
+	s.sendersMu.Lock()
+	defer s.sendersMu.Unlock()
+
+	s.senders.Store((*messageSenders)(nil))
+}
+
 func (s *ClientSession) UserData() *json.RawMessage {
 	return s.userData
 }
 
+func (s *ClientSession) DisplayName() string {
+	return s.displayName
+}
+
 func (s *ClientSession) run() {
 loop:
 	for {
@@ -310,7 +584,11 @@ loop:
 
 func (s *ClientSession) StartExpire() {
 	// The hub mutex must be held when calling this method.
-	s.expires = time.Now().Add(sessionExpireDuration)
+	gracePeriod := defaultResumeGracePeriod
+	if s.backend != nil {
+		gracePeriod = s.backend.ResumeGracePeriod()
+	}
+	s.expires = time.Now().Add(gracePeriod)
 	s.hub.expiredSessions[s] = true
 }
 
@@ -324,7 +602,13 @@ func (s *ClientSession) IsExpired(now time.Time) bool {
 }
 
 func (s *ClientSession) SetRoom(room *Room) {
+	// Update the room and clear the cached senders together so no senders of
+	// the previous room are stored for the new room.
+	s.sendersMu.Lock()
 	atomic.StorePointer(&s.room, unsafe.Pointer(room))
+	s.senders.Store((*messageSenders)(nil))
+	s.sendersMu.Unlock()
+
 	if room != nil {
 		atomic.StoreInt64(&s.roomJoinTime, time.Now().UnixNano())
 	} else {
@@ -336,11 +620,21 @@ func (s *ClientSession) GetRoom() *Room {
 	return (*Room)(atomic.LoadPointer(&s.room))
 }
 
+func (s *ClientSession) CurrentRoom() MessageRoom {
+	if room := s.GetRoom(); room != nil {
+		return room
+	}
+
+	return nil
+}
+
 func (s *ClientSession) getRoomJoinTime() time.Time {
 	return time.Unix(0, atomic.LoadInt64(&s.roomJoinTime))
 }
 
 func (s *ClientSession) releaseMcuObjects() {
+	// Candidates of the released clients must not be sent afterwards.
+	s.clearPendingCandidatesLocked()
 	if len(s.publishers) > 0 {
 		go func(publishers map[string]McuPublisher) {
 			ctx := context.TODO()
@@ -362,11 +656,18 @@ func (s *ClientSession) releaseMcuObjects() {
 }
 
 func (s *ClientSession) Close() {
-	s.closeAndWait(true)
+	s.CloseWithReason(LeaveReasonDisconnected)
+}
+
+// CloseWithReason closes the session, the reason is one of the "LeaveReason*"
+// values that is sent to the other sessions of the room.
+func (s *ClientSession) CloseWithReason(reason string) {
+	s.closeAndWait(true, reason)
 }
 
-func (s *ClientSession) closeAndWait(wait bool) {
-	s.hub.removeSession(s)
+func (s *ClientSession) closeAndWait(wait bool, reason string) {
+	s.hub.removeSession(s, reason)
+	s.resetTraffic()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -388,8 +689,10 @@ func (s *ClientSession) closeAndWait(wait bool) {
 		}
 	}(s.virtualSessions)
 	s.virtualSessions = nil
+	s.clearQualityLocked()
 	s.releaseMcuObjects()
 	s.clearClientLocked(nil)
+	s.clearData()
 	s.backend.RemoveSession(s)
 	if atomic.CompareAndSwapInt32(&s.running, 1, 0) {
 		s.stopRun <- true
@@ -462,7 +765,17 @@ func (s *ClientSession) LeaveCall() {
 	s.releaseMcuObjects()
 }
 
-func (s *ClientSession) LeaveRoom(notify bool) *Room {
+func (s *ClientSession) LeaveRoom(notify bool, reason string) *Room {
+	return s.leaveRoom(notify, reason, false)
+}
+
+// LeaveRoomResumed leaves the room without sending a "leave" event to the
+// other participants as a new connection of the same room session will join.
+func (s *ClientSession) LeaveRoomResumed() *Room {
+	return s.leaveRoom(false, LeaveReasonDisconnected, true)
+}
+
+func (s *ClientSession) leaveRoom(notify bool, reason string, resumed bool) *Room {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -474,7 +787,11 @@ func (s *ClientSession) LeaveRoom(notify bool) *Room {
 	s.doUnsubscribeRoomNats(notify)
 	s.SetRoom(nil)
 	s.releaseMcuObjects()
-	room.RemoveSession(s)
+	if resumed {
+		room.RemoveResumedSession(s)
+	} else {
+		room.RemoveSession(s, reason)
+	}
 	return room
 }
 
@@ -495,22 +812,27 @@ func (s *ClientSession) doUnsubscribeRoomNats(notify bool) {
 	s.hub.roomSessions.DeleteRoomSession(s)
 	room := s.GetRoom()
 	if notify && room != nil && s.roomSessionId != "" {
-		// Notify
-		go func(sid string) {
-			ctx := context.Background()
-			request := NewBackendClientRoomRequest(room.Id(), s.userId, sid)
-			request.Room.Action = "leave"
-			var response map[string]interface{}
-			if err := s.hub.backend.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
-				log.Printf("Could not notify about room session %s left room %s: %s", sid, room.Id(), err)
-			} else {
-				log.Printf("Removed room session %s: %+v", sid, response)
-			}
-		}(s.roomSessionId)
+		s.notifyRoomLeave(room.Id(), s.roomSessionId)
 	}
 	s.roomSessionId = ""
 }
 
+// notifyRoomLeave asynchronously notifies the backend that the room session
+// left the room.
+func (s *ClientSession) notifyRoomLeave(roomId string, roomSessionId string) {
+	go func(userId string) {
+		ctx := context.Background()
+		request := NewBackendClientRoomRequest(roomId, userId, roomSessionId)
+		request.Room.Action = "leave"
+		var response map[string]interface{}
+		if err := s.hub.backend.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
+			log.Printf("Could not notify about room session %s left room %s: %s", roomSessionId, roomId, err)
+		} else {
+			log.Printf("Removed room session %s: %+v", roomSessionId, response)
+		}
+	}(s.userId)
+}
+
 func (s *ClientSession) ClearClient(client *Client) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -542,6 +864,23 @@ func (s *ClientSession) getClientUnlocked() *Client {
 	return s.client
 }
 
+// countBytesSent adds the number of bytes sent to the session and its backend.
+func (s *ClientSession) countBytesSent(n int) {
+	s.addBytesSent(n)
+	if s.backend != nil {
+		s.backend.countBytesSent(n)
+	}
+}
+
+// countBytesReceived adds the number of bytes received to the session and its
+// backend.
+func (s *ClientSession) countBytesReceived(n int) {
+	s.addBytesReceived(n)
+	if s.backend != nil {
+		s.backend.countBytesReceived(n)
+	}
+}
+
 func (s *ClientSession) SetClient(client *Client) *Client {
 	if client == nil {
 		panic("Use ClearClient to set the client to nil")
@@ -556,23 +895,44 @@ func (s *ClientSession) SetClient(client *Client) *Client {
 	}
 
 	client.SetSession(s)
+	if s.backend != nil {
+		client.SetWriteTimeout(s.backend.WriteTimeout())
+	}
 	prev := s.client
 	if prev != nil {
 		s.clearClientLocked(prev)
 	}
 	s.client = client
+	s.remoteAddr = client.RemoteAddr()
 	return prev
 }
 
+// RemoteAddr returns the address of the current client or of the last client
+// if the session is not connected.
+func (s *ClientSession) RemoteAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remoteAddr
+}
+
 func (s *ClientSession) sendOffer(client McuClient, sender string, streamType string, offer map[string]interface{}) {
-	offer_message := &AnswerOfferMessage{
-		To:       s.PublicId(),
-		From:     sender,
-		Type:     "offer",
-		RoomType: streamType,
-		Payload:  offer,
-		Update:   true,
+	// Candidates of the previous offer must be sent first.
+	s.flushCandidatesLocked(client.Id())
+
+	sdp, _ := offer["sdp"].(string)
+	offer_message, err := NewOffer(s.PublicId(), sender, streamType, sdp)
+	if err != nil {
+		log.Printf("Invalid offer %+v from %s: %s", offer, sender, err)
+		s.sendMessageUnlocked(&ServerMessage{
+			Type:  "error",
+			Error: NewErrorCode(ErrorCodeProcessingFailed),
+		})
+		return
 	}
+	// Forward the complete payload, the MCU might send additional fields.
+	offer_message.Payload = offer
+	offer_message.Update = true
 	offer_data, err := json.Marshal(offer_message)
 	if err != nil {
 		log.Println("Could not serialize offer", offer_message, err)
@@ -593,32 +953,99 @@ func (s *ClientSession) sendOffer(client McuClient, sender string, streamType st
 }
 
 func (s *ClientSession) sendCandidate(client McuClient, sender string, streamType string, candidate interface{}) {
+	if s.HasFeature(ServerFeatureCandidates) {
+		s.queueCandidateLocked(client, sender, streamType, candidate)
+		return
+	}
+
+	s.sendCandidateMessageLocked(sender, streamType, "candidate", map[string]interface{}{
+		"candidate": candidate,
+	})
+}
+
+func (s *ClientSession) sendCandidateMessageLocked(sender string, streamType string, messageType string, payload map[string]interface{}) {
 	candidate_message := &AnswerOfferMessage{
 		To:       s.PublicId(),
 		From:     sender,
-		Type:     "candidate",
+		Type:     messageType,
 		RoomType: streamType,
-		Payload: map[string]interface{}{
-			"candidate": candidate,
-		},
+		Payload:  payload,
 	}
-	candidate_data, err := json.Marshal(candidate_message)
+	response_message, err := newCandidateServerMessage(candidate_message)
 	if err != nil {
 		log.Println("Could not serialize candidate", candidate_message, err)
 		return
 	}
-	response_message := &ServerMessage{
+
+	s.sendMessageUnlocked(response_message)
+}
+
+func newCandidateServerMessage(candidate_message *AnswerOfferMessage) (*ServerMessage, error) {
+	candidate_data, err := json.Marshal(candidate_message)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServerMessage{
 		Type: "message",
 		Message: &MessageServerMessage{
 			Sender: &MessageServerMessageSender{
 				Type:      "session",
-				SessionId: sender,
+				SessionId: candidate_message.From,
 			},
 			Data: (*json.RawMessage)(&candidate_data),
 		},
+	}, nil
+}
+
+// queueCandidateLocked collects the ICE candidates of a MCU client, so a
+// burst of candidates is sent as one "candidates" message.
+func (s *ClientSession) queueCandidateLocked(client McuClient, sender string, streamType string, candidate interface{}) {
+	id := client.Id()
+	batch, found := s.pendingCandidates[id]
+	if !found {
+		if s.pendingCandidates == nil {
+			s.pendingCandidates = make(map[string]*candidatesBatch)
+		}
+		batch = &candidatesBatch{
+			sender:     sender,
+			streamType: streamType,
+		}
+		batch.timer = time.AfterFunc(candidatesBatchDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.pendingCandidates[id] == batch {
+				s.flushCandidatesLocked(id)
+			}
+		})
+		s.pendingCandidates[id] = batch
 	}
 
-	s.sendMessageUnlocked(response_message)
+	batch.candidates = append(batch.candidates, candidate)
+	if len(batch.candidates) >= maxCandidatesPerMessage {
+		s.flushCandidatesLocked(id)
+	}
+}
+
+func (s *ClientSession) flushCandidatesLocked(id string) {
+	batch, found := s.pendingCandidates[id]
+	if !found {
+		return
+	}
+
+	delete(s.pendingCandidates, id)
+	batch.timer.Stop()
+	s.sendCandidateMessageLocked(batch.sender, batch.streamType, "candidates", map[string]interface{}{
+		"candidates": batch.candidates,
+	})
+}
+
+func (s *ClientSession) clearPendingCandidatesLocked() {
+	for _, batch := range s.pendingCandidates {
+		batch.timer.Stop()
+	}
+	s.pendingCandidates = nil
 }
 
 func (s *ClientSession) sendMessageUnlocked(message *ServerMessage) bool {
@@ -647,6 +1074,22 @@ func (s *ClientSession) SendMessage(message *ServerMessage) bool {
 	return s.sendMessageUnlocked(message)
 }
 
+// SendPreparedMessage sends a message that was serialized before. If the
+// client is not connected, the message will be stored for later delivery.
+func (s *ClientSession) SendPreparedMessage(message *PreparedMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c := s.getClientUnlocked(); c != nil {
+		if c.SendMessage(message) {
+			return true
+		}
+	}
+
+	s.storePendingMessage(message.Message())
+	return true
+}
+
 func (s *ClientSession) SendMessages(messages []*ServerMessage) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -698,6 +1141,103 @@ func (s *ClientSession) OnIceCompleted(client McuClient) {
 	// s.OnIceCandidate(client, nil)
 }
 
+func (s *ClientSession) OnRenegotiate(client McuClient, reason string) {
+	publisherId := s.PublicId()
+	if sub, ok := client.(McuSubscriber); ok {
+		publisherId = sub.Publisher()
+	}
+
+	message := &ServerMessage{
+		Type: "renegotiate",
+		Renegotiate: &RenegotiateServerMessage{
+			From:     publisherId,
+			RoomType: client.StreamType(),
+			Reason:   reason,
+		},
+	}
+	if err := message.Renegotiate.CheckValid(); err != nil {
+		log.Printf("Not sending invalid renegotiate request %+v to %s: %s", message.Renegotiate, s.PublicId(), err)
+		return
+	}
+
+	s.SendMessage(message)
+}
+
+func (s *ClientSession) OnQualityChanged(client McuClient, quality string) {
+	s.mu.Lock()
+	changed := s.setQualityLocked(client, quality)
+	s.mu.Unlock()
+
+	if changed {
+		s.publishQuality(quality)
+	}
+}
+
+// resetQuality is called by the reset timer if the MCU didn't report a new
+// quality in the meantime.
+func (s *ClientSession) resetQuality(client McuClient, timer **time.Timer) {
+	s.mu.Lock()
+	if atomic.LoadInt32(&s.running) == 0 || s.qualityTimer != *timer {
+		// The session was closed or the timer was replaced.
+		s.mu.Unlock()
+		return
+	}
+
+	changed := s.setQualityLocked(client, ConnectionQualityGood)
+	s.mu.Unlock()
+
+	if changed {
+		s.publishQuality(ConnectionQualityGood)
+	}
+}
+
+// setQualityLocked updates the quality of the session and returns true if it
+// changed.
+func (s *ClientSession) setQualityLocked(client McuClient, quality string) bool {
+	if s.qualityTimer != nil {
+		s.qualityTimer.Stop()
+		s.qualityTimer = nil
+	}
+	if quality != ConnectionQualityGood {
+		var timer *time.Timer
+		timer = time.AfterFunc(connectionQualityResetTimeout, func() {
+			s.resetQuality(client, &timer)
+		})
+		s.qualityTimer = timer
+	}
+	previous := s.quality
+	if previous == "" {
+		previous = ConnectionQualityGood
+	}
+	s.quality = quality
+	return previous != quality
+}
+
+func (s *ClientSession) publishQuality(quality string) {
+	room := s.GetRoom()
+	if room == nil {
+		return
+	}
+
+	sessions := []*RoomQualityServerMessageEntry{
+		{
+			SessionId: s.PublicId(),
+			Quality:   quality,
+		},
+	}
+	if err := room.PublishSessionsQualityChanged(sessions); err != nil {
+		log.Printf("Could not publish quality %s of session %s: %s", quality, s.PublicId(), err)
+	}
+}
+
+func (s *ClientSession) clearQualityLocked() {
+	if s.qualityTimer != nil {
+		s.qualityTimer.Stop()
+		s.qualityTimer = nil
+	}
+	s.quality = ""
+}
+
 func (s *ClientSession) PublisherClosed(publisher McuPublisher) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -907,6 +1447,15 @@ func (s *ClientSession) GetPublisher(streamType string) McuPublisher {
 	return s.publishers[streamType]
 }
 
+// HasPublishers checks if the session is publishing any streams through the
+// MCU.
+func (s *ClientSession) HasPublishers() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.publishers) > 0
+}
+
 func (s *ClientSession) GetOrCreateSubscriber(ctx context.Context, mcu Mcu, id string, streamType string) (McuSubscriber, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -987,14 +1536,34 @@ func (s *ClientSession) processClientMessage(msg *nats.Msg) {
 			}
 		}()
 		return
+	case "kick":
+		if message.Kick == nil {
+			log.Printf("Received NATS kick without payload: %+v", message)
+			return
+		}
+
+		if room := s.GetRoom(); room == nil || room.Id() != message.Kick.RoomId {
+			log.Printf("Session %s is not in room %s, ignoring kick", s.PublicId(), message.Kick.RoomId)
+			return
+		} else if s.ClientType() == HelloClientTypeInternal {
+			log.Printf("Internal session %s may not be kicked, ignoring", s.PublicId())
+			return
+		}
+
+		go func() {
+			if err := s.hub.KickSession(s.PublicId(), message.Kick.Reason); err != nil {
+				log.Printf("Could not kick session %s: %s", s.PublicId(), err)
+			}
+		}()
+		return
 	case "message":
-		if message.Message.Type == "bye" && message.Message.Bye.Reason == "room_session_reconnected" {
+		if message.Message.Type == "bye" && message.Message.Bye.Reason == ByeCodeRoomSessionReconnected {
 			s.mu.Lock()
 			roomSessionId := s.RoomSessionId()
 			s.mu.Unlock()
 			log.Printf("Closing session %s because same room session %s connected", s.PublicId(), roomSessionId)
-			s.LeaveRoom(false)
-			defer s.closeAndWait(false)
+			s.LeaveRoom(false, LeaveReasonDisconnected)
+			defer s.closeAndWait(false, LeaveReasonDisconnected)
 		}
 	}
 
@@ -1003,19 +1572,82 @@ func (s *ClientSession) processClientMessage(msg *nats.Msg) {
 		return
 	}
 
+	if serverMessage == message.Message && isRoomSubject(msg.Subject) && s.hub.preparedMessages != nil {
+		// Unfiltered room events are the same for all sessions of the room
+		// and only serialized once.
+		if prepared, err := s.hub.preparedMessages.Get(msg.Data, serverMessage); err != nil {
+			log.Printf("Could not prepare message %+v for session %s: %s", serverMessage, s.PublicId(), err)
+		} else {
+			s.SendPreparedMessage(prepared)
+			return
+		}
+	}
+
 	s.SendMessage(serverMessage)
 }
 
-func (s *ClientSession) storePendingMessage(message *ServerMessage) {
-	if message.IsChatRefresh() {
-		if s.hasPendingChat {
-			// Only send a single "chat-refresh" message on resume.
-			return
+func isRoomSubject(subject string) bool {
+	return strings.HasPrefix(subject, "room.")
+}
+
+func (s *ClientSession) dropOldestPendingMessage() {
+	dropped := s.pendingClientMessages[0]
+	s.pendingClientMessages[0] = nil
+	s.pendingClientMessages = s.pendingClientMessages[1:]
+	if s.droppedPendingMessages == 0 {
+		log.Printf("Resume buffer of session %s is full, dropping oldest messages", s.PublicId())
+	}
+	s.droppedPendingMessages++
+
+	if dropped.IsChatRefresh() || dropped.IsParticipantsUpdate() {
+		s.updatePendingMessageFlags()
+	}
+}
+
+// updatePendingMessageFlags recomputes the flags of the pending messages from
+// the messages that are still queued.
+func (s *ClientSession) updatePendingMessageFlags() {
+	s.hasPendingChat = false
+	s.hasPendingParticipantsUpdate = false
+	for _, m := range s.pendingClientMessages {
+		if m.IsChatRefresh() {
+			s.hasPendingChat = true
+		}
+		if m.IsParticipantsUpdate() {
+			s.hasPendingParticipantsUpdate = true
 		}
+	}
+}
 
+// takeDroppedPendingMessages returns the number of pending messages that were
+// dropped since the last call.
+func (s *ClientSession) takeDroppedPendingMessages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := s.droppedPendingMessages
+	s.droppedPendingMessages = 0
+	return dropped
+}
+
+func (s *ClientSession) storePendingMessage(message *ServerMessage) {
+	if message.IsPresence() {
+		// Presence updates are ephemeral and outdated once the client resumes.
+		return
+	}
+	if message.IsChatRefresh() && s.hasPendingChat {
+		// Only send a single "chat-refresh" message on resume.
+		return
+	}
+	if s.backend != nil && len(s.pendingClientMessages) >= s.backend.ResumeBufferSize() {
+		// Drop before updating the flags, they are recomputed from the
+		// remaining messages if necessary.
+		s.dropOldestPendingMessage()
+	}
+	if message.IsChatRefresh() {
 		s.hasPendingChat = true
 	}
-	if !s.hasPendingParticipantsUpdate && message.IsParticipantsUpdate() {
+	if message.IsParticipantsUpdate() {
 		s.hasPendingParticipantsUpdate = true
 	}
 	s.pendingClientMessages = append(s.pendingClientMessages, message)
@@ -1025,6 +1657,10 @@ func (s *ClientSession) storePendingMessage(message *ServerMessage) {
 }
 
 func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
+	if msg.ExcludeSessionId != "" && msg.ExcludeSessionId == s.PublicId() {
+		return nil
+	}
+
 	switch msg.Type {
 	case "message":
 		if msg.Message == nil {
@@ -1047,7 +1683,44 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 				// Don't send message back to sender (can happen if sent to user or room)
 				return nil
 			}
+		case "presence":
+			if msg.Message.Presence != nil &&
+				msg.Message.Presence.SessionId == s.PublicId() {
+				// Don't send presence back to sender.
+				return nil
+			}
+		case "room":
+			if msg.Message.Room != nil && msg.Message.Room.PropertiesPatch != nil {
+				return s.filterRoomPropertiesPatch(msg.Message)
+			}
 		case "event":
+			if msg.Message.Event.Target == "room" {
+				// Can happen mostly during tests where an older room NATS message
+				// could be received by a subscriber that joined after it was sent.
+				if msg.SendTime.Before(s.getRoomJoinTime()) {
+					log.Printf("Message %+v was sent before room was joined, ignoring", msg.Message)
+					return nil
+				}
+			}
+
+			if s.subscription != SubscriptionLevelAll {
+				// Check subscription before building the full payload.
+				return s.filterSubscribedEvent(msg.Message)
+			}
+
+			if msg.Message.Event.Target == "room" &&
+				msg.Message.Event.Type == "change" &&
+				!s.HasFeature(ServerFeatureChangePrevious) {
+				return s.filterChangePrevious(msg.Message)
+			}
+
+			if msg.Message.Event.Target == "room" &&
+				msg.Message.Event.Type == "leave" &&
+				msg.Message.Event.LeaveReasons != nil &&
+				!s.HasFeature(ServerFeatureLeaveReasons) {
+				return s.filterLeaveReasons(msg.Message)
+			}
+
 			if msg.Message.Event.Target == "participants" &&
 				msg.Message.Event.Type == "update" {
 				m := msg.Message.Event.Update
@@ -1064,13 +1737,6 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 				// TODO(jojo): Only send all users if current session id has
 				// changed its "inCall" flag to true.
 				m.Changed = nil
-			} else if msg.Message.Event.Target == "room" {
-				// Can happen mostly during tests where an older room NATS message
-				// could be received by a subscriber that joined after it was sent.
-				if msg.SendTime.Before(s.getRoomJoinTime()) {
-					log.Printf("Message %+v was sent before room was joined, ignoring", msg.Message)
-					return nil
-				}
 			}
 		}
 
@@ -1081,6 +1747,48 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 	}
 }
 
+// filterRoomPropertiesPatch only sends the changed properties to clients that
+// support patches and the full properties to all others.
+func (s *ClientSession) filterRoomPropertiesPatch(message *ServerMessage) *ServerMessage {
+	room := *message.Room
+	if s.HasFeature(ServerFeatureRoomPropertiesPatch) {
+		room.Properties = nil
+	} else {
+		room.PropertiesPatch = nil
+	}
+
+	result := *message
+	result.Room = &room
+	return &result
+}
+
+// filterLeaveReasons removes the reasons from "leave" events for clients
+// that don't support them.
+func (s *ClientSession) filterLeaveReasons(message *ServerMessage) *ServerMessage {
+	event := *message.Event
+	event.LeaveReasons = nil
+
+	result := *message
+	result.Event = &event
+	return &result
+}
+
+// filterChangePrevious removes the previous values from "change" events for
+// clients that don't support them.
+func (s *ClientSession) filterChangePrevious(message *ServerMessage) *ServerMessage {
+	event := *message.Event
+	event.Change = make([]*EventServerMessageSessionEntry, 0, len(message.Event.Change))
+	for _, entry := range message.Event.Change {
+		e := *entry
+		e.Previous = nil
+		event.Change = append(event.Change, &e)
+	}
+
+	result := *message
+	result.Event = &event
+	return &result
+}
+
 func (s *ClientSession) NotifySessionResumed(client *Client) {
 	s.mu.Lock()
 	if len(s.pendingClientMessages) == 0 {
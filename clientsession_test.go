@@ -23,9 +23,13 @@ package signaling
 
 import (
 	"context"
+	"encoding/json"
 	"net/url"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
+	"unsafe"
 )
 
 var (
@@ -300,3 +304,275 @@ func TestBandwidth_Backend(t *testing.T) {
 		})
 	}
 }
+
+func TestClientSessionMessageSender(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(authAnonymousUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, ok := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+	}
+
+	sender := session.GetMessageSender(RecipientTypeSession)
+	if sender.Type != RecipientTypeSession || sender.SessionId != hello.Hello.SessionId || sender.UserId != "" {
+		t.Errorf("Unexpected sender %+v", sender)
+	}
+	if cached := session.GetMessageSender(RecipientTypeSession); cached != sender {
+		t.Errorf("Expected cached sender %+v, got %+v", sender, cached)
+	}
+	if other := session.GetMessageSender(RecipientTypeRoom); other.Type != RecipientTypeRoom || other.SessionId != hello.Hello.SessionId {
+		t.Errorf("Unexpected sender %+v", other)
+	}
+
+	// The user id of the anonymous session is taken from the room session data.
+	roomId := "test-room-with-sessiondata"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if _, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	joined := session.GetMessageSender(RecipientTypeSession)
+	if joined == sender {
+		t.Error("Expected new sender after joining the room")
+	} else if joined.UserId != "userid-from-sessiondata" {
+		t.Errorf("Expected user id from session data, got %+v", joined)
+	}
+
+	if room, err := client.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+
+	if left := session.GetMessageSender(RecipientTypeSession); left == joined {
+		t.Error("Expected new sender after leaving the room")
+	} else if left.UserId != "" {
+		t.Errorf("Expected no user id after leaving the room, got %+v", left)
+	}
+}
+
+func TestClientSessionPendingPresence(t *testing.T) {
+	session := &ClientSession{
+		publicId: "the-session-id",
+	}
+
+	session.SendMessage(&ServerMessage{
+		Type: "presence",
+		Presence: &PresenceServerMessage{
+			SessionId: "other-session-id",
+			State:     PresenceStateTyping,
+		},
+	})
+	if count := len(session.pendingClientMessages); count != 0 {
+		t.Errorf("Expected no pending messages, got %d", count)
+	}
+
+	data := json.RawMessage(`"hello"`)
+	session.SendMessage(&ServerMessage{
+		Type: "message",
+		Message: &MessageServerMessage{
+			Data: &data,
+		},
+	})
+	if count := len(session.pendingClientMessages); count != 1 {
+		t.Errorf("Expected one pending message, got %d", count)
+	}
+}
+
+func TestClientSessionPendingOverflow(t *testing.T) {
+	session := &ClientSession{
+		publicId: "the-session-id",
+		backend: &Backend{
+			resumeBufferSize: 2,
+		},
+	}
+
+	newMessage := func(payload string) *ServerMessage {
+		data := json.RawMessage(payload)
+		return &ServerMessage{
+			Type: "message",
+			Message: &MessageServerMessage{
+				Data: &data,
+			},
+		}
+	}
+	newParticipantsUpdate := func() *ServerMessage {
+		return &ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "participants",
+				Type:   "update",
+				Update: &RoomEventServerMessage{
+					RoomId: "the-room-id",
+				},
+			},
+		}
+	}
+	chatRefresh := `{"type":"chat","chat":{"refresh":true}}`
+	checkPending := func(chat bool, participants bool, expected ...*ServerMessage) {
+		t.Helper()
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		if !reflect.DeepEqual(session.pendingClientMessages, expected) {
+			t.Errorf("Expected pending messages %+v, got %+v", expected, session.pendingClientMessages)
+		}
+		if session.hasPendingChat != chat {
+			t.Errorf("Expected pending chat %t, got %t", chat, session.hasPendingChat)
+		}
+		if session.hasPendingParticipantsUpdate != participants {
+			t.Errorf("Expected pending participants update %t, got %t", participants, session.hasPendingParticipantsUpdate)
+		}
+	}
+
+	update1 := newParticipantsUpdate()
+	message1 := newMessage(`"message-1"`)
+	session.SendMessage(update1)
+	session.SendMessage(message1)
+	checkPending(false, true, update1, message1)
+
+	// The new update is still pending after the old one was dropped.
+	update2 := newParticipantsUpdate()
+	session.SendMessage(update2)
+	checkPending(false, true, message1, update2)
+
+	chat1 := newMessage(chatRefresh)
+	session.SendMessage(chat1)
+	checkPending(true, true, update2, chat1)
+
+	message2 := newMessage(`"message-2"`)
+	session.SendMessage(message2)
+	checkPending(true, false, chat1, message2)
+
+	message3 := newMessage(`"message-3"`)
+	session.SendMessage(message3)
+	checkPending(false, false, message2, message3)
+
+	// Chat refreshes are coalesced again after the previous one was dropped.
+	chat2 := newMessage(chatRefresh)
+	session.SendMessage(chat2)
+	checkPending(true, false, message3, chat2)
+	session.SendMessage(newMessage(chatRefresh))
+	checkPending(true, false, message3, chat2)
+}
+
+var benchmarkMessageSender *MessageServerMessageSender
+
+func newBenchmarkMessageSenderSession() *ClientSession {
+	session := &ClientSession{
+		publicId: "the-session-id",
+	}
+	room := &Room{
+		mu: &sync.RWMutex{},
+		roomSessionData: map[string]*RoomSessionData{
+			session.publicId: {
+				UserId: "the-user-id",
+			},
+		},
+	}
+	session.room = unsafe.Pointer(room)
+	return session
+}
+
+func BenchmarkMessageSenderUncached(b *testing.B) {
+	session := newBenchmarkMessageSenderSession()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The sender is referenced by the sent message.
+		benchmarkMessageSender = &MessageServerMessageSender{
+			Type:      RecipientTypeSession,
+			SessionId: session.PublicId(),
+			UserId:    session.UserId(),
+		}
+	}
+}
+
+func BenchmarkMessageSenderCached(b *testing.B) {
+	session := newBenchmarkMessageSenderSession()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkMessageSender = session.GetMessageSender(RecipientTypeSession)
+	}
+}
+
+// benchmarkCandidates serializes the frames that are sent to a client for the
+// ICE candidates of a call setup.
+func benchmarkCandidates(b *testing.B, batch bool) {
+	candidates := make([]interface{}, 20)
+	for i := range candidates {
+		candidates[i] = map[string]interface{}{
+			"candidate":     "candidate:" + strconv.Itoa(i) + " 1 UDP 2122194687 192.0.2.1 " + strconv.Itoa(50000+i) + " typ host",
+			"sdpMid":        "0",
+			"sdpMLineIndex": 0,
+		}
+	}
+
+	newMessage := func(messageType string, payload map[string]interface{}) *AnswerOfferMessage {
+		return &AnswerOfferMessage{
+			To:       "the-session-id",
+			From:     "the-publisher-id",
+			Type:     messageType,
+			RoomType: "video",
+			Payload:  payload,
+		}
+	}
+
+	var size int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var messages []*AnswerOfferMessage
+		if batch {
+			messages = append(messages, newMessage("candidates", map[string]interface{}{
+				"candidates": candidates,
+			}))
+		} else {
+			for _, candidate := range candidates {
+				messages = append(messages, newMessage("candidate", map[string]interface{}{
+					"candidate": candidate,
+				}))
+			}
+		}
+
+		size = 0
+		for _, message := range messages {
+			msg, err := newCandidateServerMessage(message)
+			if err != nil {
+				b.Fatal(err)
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			size += len(data)
+		}
+	}
+	b.ReportMetric(float64(size), "bytes/setup")
+}
+
+func BenchmarkCandidatesSingle(b *testing.B) {
+	benchmarkCandidates(b, false)
+}
+
+func BenchmarkCandidatesBatch(b *testing.B) {
+	benchmarkCandidates(b, true)
+}
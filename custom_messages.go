@@ -0,0 +1,109 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// CustomMessageValidator checks the payload of a custom client message. The
+// payload is the value stored with the message type as key and is nil if the
+// message doesn't contain it.
+type CustomMessageValidator func(payload *json.RawMessage) error
+
+// CustomMessageHandler processes a valid custom client message that was sent
+// by an authenticated session.
+type CustomMessageHandler func(hub *Hub, session *ClientSession, message *ClientMessage, payload *json.RawMessage)
+
+type customMessageType struct {
+	validator CustomMessageValidator
+	handler   CustomMessageHandler
+}
+
+var (
+	// Message types that are handled by the server itself and can't be
+	// registered as custom types.
+	coreClientMessageTypes = getClientMessageTypes()
+
+	customMessageTypesLock sync.RWMutex
+	customMessageTypes     = make(map[string]*customMessageType)
+)
+
+// RegisterCustomMessageType registers a client message type that is not
+// supported by the server itself. Messages of the type are checked with the
+// validator and dispatched to the handler.
+//
+// The registry is safe for concurrent use, but types should be registered
+// before clients are connected. Validators and handlers are called from the
+// message processing of the sending client, so they are called concurrently
+// for different clients, must be safe for concurrent use and should not block
+// as no other messages of the client are processed meanwhile.
+func RegisterCustomMessageType(messageType string, validator CustomMessageValidator, handler CustomMessageHandler) error {
+	if messageType == "" {
+		return fmt.Errorf("message type missing")
+	} else if coreClientMessageTypes[messageType] {
+		return fmt.Errorf("message type %s is handled by the server", messageType)
+	} else if validator == nil || handler == nil {
+		return fmt.Errorf("validator and handler for message type %s are required", messageType)
+	}
+
+	customMessageTypesLock.Lock()
+	defer customMessageTypesLock.Unlock()
+	if _, found := customMessageTypes[messageType]; found {
+		return fmt.Errorf("message type %s is already registered", messageType)
+	}
+
+	customMessageTypes[messageType] = &customMessageType{
+		validator: validator,
+		handler:   handler,
+	}
+	return nil
+}
+
+// UnregisterCustomMessageType removes a previously registered custom message
+// type. Messages of the type are rejected afterwards.
+func UnregisterCustomMessageType(messageType string) {
+	customMessageTypesLock.Lock()
+	defer customMessageTypesLock.Unlock()
+
+	delete(customMessageTypes, messageType)
+}
+
+func getCustomMessageType(messageType string) *customMessageType {
+	customMessageTypesLock.RLock()
+	defer customMessageTypesLock.RUnlock()
+
+	return customMessageTypes[messageType]
+}
+
+// getCustomMessagePayload returns the payload of a custom message type from
+// the raw message data.
+func getCustomMessagePayload(data []byte, messageType string) (*json.RawMessage, error) {
+	var fields map[string]*json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	return fields[messageType], nil
+}
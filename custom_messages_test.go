@@ -0,0 +1,109 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func validateTestCustomPayload(payload *json.RawMessage) error {
+	if payload == nil {
+		return fmt.Errorf("payload missing")
+	}
+	return nil
+}
+
+func handleTestCustomMessage(hub *Hub, session *ClientSession, message *ClientMessage, payload *json.RawMessage) {
+}
+
+func TestCustomMessageTypeRegistry(t *testing.T) {
+	const messageType = "x-test-registry"
+	if err := RegisterCustomMessageType("", validateTestCustomPayload, handleTestCustomMessage); err == nil {
+		t.Error("Should not be able to register empty type")
+	}
+	if err := RegisterCustomMessageType("hello", validateTestCustomPayload, handleTestCustomMessage); err == nil {
+		t.Error("Should not be able to register core type")
+	}
+	if err := RegisterCustomMessageType(messageType, nil, handleTestCustomMessage); err == nil {
+		t.Error("Should not be able to register without validator")
+	}
+
+	msg := &ClientMessage{
+		Type: messageType,
+	}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Unregistered type %s should not be valid", messageType)
+	}
+
+	if err := RegisterCustomMessageType(messageType, validateTestCustomPayload, handleTestCustomMessage); err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterCustomMessageType(messageType)
+	if err := RegisterCustomMessageType(messageType, validateTestCustomPayload, handleTestCustomMessage); err == nil {
+		t.Error("Should not be able to register type twice")
+	}
+
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v without payload should not be valid", msg)
+	}
+
+	payload, err := getCustomMessagePayload([]byte(`{"type":"`+messageType+`","`+messageType+`":{"foo":"bar"}}`), messageType)
+	if err != nil {
+		t.Fatal(err)
+	} else if payload == nil || string(*payload) != `{"foo":"bar"}` {
+		t.Fatalf("Unexpected payload %s", payload)
+	}
+	msg.customPayload = payload
+	if err := msg.CheckValid(); err != nil {
+		t.Errorf("Message %+v should be valid, got %s", msg, err)
+	}
+
+	UnregisterCustomMessageType(messageType)
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Unregistered type %s should not be valid", messageType)
+	}
+}
+
+func TestCustomMessageTypeCoreTypes(t *testing.T) {
+	for _, messageType := range clientMessageTypes {
+		if err := RegisterCustomMessageType(messageType, validateTestCustomPayload, handleTestCustomMessage); err == nil {
+			UnregisterCustomMessageType(messageType)
+			t.Errorf("Should not be able to register core type %s", messageType)
+		}
+		if !statsKnownClientMessageTypes[messageType] {
+			t.Errorf("Core type %s should be a known stats label", messageType)
+		}
+
+		msg := &ClientMessage{
+			Type: messageType,
+		}
+		if err := msg.CheckValid(); err != nil && err.Error() == "unsupported type "+messageType {
+			t.Errorf("Core type %s should be supported", messageType)
+		}
+	}
+
+	if !coreClientMessageTypes["participants"] {
+		t.Error("Participants should be a core type")
+	}
+}
@@ -0,0 +1,128 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Maximum number of bytes of a payload that will be logged for sessions
+	// with payload debugging enabled.
+	maxDebugPayloadSize = 4096
+
+	redactedDebugValue = "(redacted)"
+)
+
+var (
+	redactedDebugParams = json.RawMessage(`"` + redactedDebugValue + `"`)
+)
+
+// getConfiguredDebugSessions returns the public session ids and the users (in
+// the form "backend-id:user-id") for which the full message payloads should be
+// logged.
+func getConfiguredDebugSessions(config *goconf.ConfigFile) map[string]bool {
+	value, _ := config.GetString("app", "debugsessions")
+	result := make(map[string]bool)
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			result[id] = true
+		}
+	}
+	if len(result) > 0 {
+		log.Printf("Logging message payloads of %d sessions or users", len(result))
+	}
+	return result
+}
+
+// isDebugSession checks if the message payloads of the given session should
+// be logged. Public session ids are only known after the session was created,
+// so sessions can also be matched by the id of their backend and user.
+func isDebugSession(debugSessions map[string]bool, session *ClientSession) bool {
+	if len(debugSessions) == 0 {
+		return false
+	} else if debugSessions[session.PublicId()] {
+		return true
+	}
+
+	backend := session.Backend()
+	userId := session.AuthUserId()
+	if backend == nil || userId == "" {
+		return false
+	}
+
+	return debugSessions[backend.Id()+":"+userId]
+}
+
+// redactDebugPayload returns a copy of the message that can be logged, i.e.
+// credentials and resume ids are removed from "hello" messages.
+func redactDebugPayload(message interface{}) interface{} {
+	switch m := message.(type) {
+	case *ClientMessage:
+		if m.Type != "hello" || m.Hello == nil {
+			return m
+		}
+
+		msg := *m
+		hello := *m.Hello
+		if hello.ResumeId != "" {
+			hello.ResumeId = redactedDebugValue
+		}
+		if hello.Auth.Params != nil {
+			hello.Auth.Params = &redactedDebugParams
+		}
+		msg.Hello = &hello
+		return &msg
+	case *ServerMessage:
+		if m.Type != "hello" || m.Hello == nil || m.Hello.ResumeId == "" {
+			return m
+		}
+
+		msg := *m
+		hello := *m.Hello
+		hello.ResumeId = redactedDebugValue
+		msg.Hello = &hello
+		return &msg
+	default:
+		return message
+	}
+}
+
+// formatDebugPayload returns the redacted JSON of a message, truncated to
+// "maxDebugPayloadSize" bytes.
+func formatDebugPayload(message interface{}) string {
+	data, err := json.Marshal(redactDebugPayload(message))
+	if err != nil {
+		return fmt.Sprintf("(could not serialize: %s)", err)
+	}
+
+	if len(data) > maxDebugPayloadSize {
+		return fmt.Sprintf("%s... (%d bytes)", string(data[:maxDebugPayloadSize]), len(data))
+	}
+	return string(data)
+}
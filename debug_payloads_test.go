@@ -0,0 +1,106 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestGetConfiguredDebugSessions(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if sessions := getConfiguredDebugSessions(config); len(sessions) != 0 {
+		t.Errorf("Expected no debug sessions, got %+v", sessions)
+	}
+
+	config.AddOption("app", "debugsessions", " session1, ,session2 ")
+	sessions := getConfiguredDebugSessions(config)
+	if len(sessions) != 2 || !sessions["session1"] || !sessions["session2"] {
+		t.Errorf("Expected session1 and session2, got %+v", sessions)
+	}
+}
+
+func TestFormatDebugPayloadRedactsHello(t *testing.T) {
+	params := json.RawMessage(`{"ticket":"the-secret-ticket"}`)
+	client := &ClientMessage{
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume-id",
+			Auth: HelloClientMessageAuth{
+				Params: &params,
+				Url:    "https://domain.invalid/ocs",
+			},
+		},
+	}
+	payload := formatDebugPayload(client)
+	if strings.Contains(payload, "the-secret-ticket") || strings.Contains(payload, "the-resume-id") {
+		t.Errorf("Credentials should be redacted, got %s", payload)
+	}
+	if !strings.Contains(payload, "https://domain.invalid/ocs") || !strings.Contains(payload, redactedDebugValue) {
+		t.Errorf("Expected redacted hello, got %s", payload)
+	}
+	// The original message must not be modified.
+	if client.Hello.ResumeId != "the-resume-id" || client.Hello.Auth.Params != &params {
+		t.Errorf("Original message was modified: %+v", client.Hello)
+	}
+
+	server := &ServerMessage{
+		Type: "hello",
+		Hello: &HelloServerMessage{
+			Version:   HelloVersion,
+			SessionId: "the-session-id",
+			ResumeId:  "the-resume-id",
+		},
+	}
+	payload = formatDebugPayload(server)
+	if strings.Contains(payload, "the-resume-id") || !strings.Contains(payload, "the-session-id") {
+		t.Errorf("Expected redacted hello, got %s", payload)
+	}
+	if server.Hello.ResumeId != "the-resume-id" {
+		t.Errorf("Original message was modified: %+v", server.Hello)
+	}
+}
+
+func TestFormatDebugPayloadTruncates(t *testing.T) {
+	data := json.RawMessage(`"` + strings.Repeat("x", maxDebugPayloadSize) + `"`)
+	msg := &ServerMessage{
+		Type: "message",
+		Message: &MessageServerMessage{
+			Data: &data,
+		},
+	}
+	payload := formatDebugPayload(msg)
+	if !strings.HasSuffix(payload, " bytes)") || len(payload) > maxDebugPayloadSize+32 {
+		t.Errorf("Expected truncated payload, got %d bytes", len(payload))
+	}
+
+	small := &ServerMessage{
+		Type: "bye",
+	}
+	if payload := formatDebugPayload(small); payload != `{"type":"bye"}` {
+		t.Errorf("Unexpected payload %s", payload)
+	}
+}
@@ -0,0 +1,121 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+// Error codes that are sent to clients. The codes are part of the API and
+// must not be changed, clients can use them to show localized messages
+// instead of the default messages below.
+const (
+	ErrorCodeAddFailed              = "add_failed"
+	ErrorCodeAlreadyJoined          = "already_joined"
+	ErrorCodeAuthFailed             = "auth_failed"
+	ErrorCodeBadRequest             = "bad_request"
+	ErrorCodeClientNotFound         = "client_not_found"
+	ErrorCodeDuplicateClient        = "duplicate_client"
+	ErrorCodeForbidden              = "forbidden"
+	ErrorCodeHelloExpected          = "hello_expected"
+	ErrorCodeIgnored                = "ignored"
+	ErrorCodeInternalError          = "internal_error"
+	ErrorCodeInvalidBackend         = "invalid_backend"
+	ErrorCodeInvalidClientType      = "invalid_client_type"
+	ErrorCodeInvalidFormat          = "invalid_format"
+	ErrorCodeInvalidToken           = "invalid_token"
+	ErrorCodeMcuUnavailable         = "mcu_unavailable"
+	ErrorCodeMissingRequiredFeature = "missing_required_feature"
+	ErrorCodeNoSuchRoom             = "no_such_room"
+	ErrorCodeNoSuchSession          = "no_such_session"
+	ErrorCodeNotAllowed             = "not_allowed"
+	ErrorCodeNotInRoom              = "not_in_room"
+	ErrorCodeProcessingFailed       = "processing_failed"
+	ErrorCodeRateLimited            = "rate_limited"
+	ErrorCodeReadOnly               = "read_only"
+	ErrorCodeRemoveFailed           = "remove_failed"
+	ErrorCodeResumeFailed           = "resume_failed"
+	ErrorCodeRoomFull               = "room_full"
+	ErrorCodeRoomJoinFailed         = "room_join_failed"
+	ErrorCodeSessionLimitExceeded   = "session_limit_exceeded"
+	ErrorCodeShutdownScheduled      = "shutdown_scheduled"
+	ErrorCodeTimeout                = "timeout"
+	ErrorCodeTokenExpired           = "token_expired"
+	ErrorCodeTooManyRecipients      = "too_many_recipients"
+	ErrorCodeTooManySessions        = "too_many_sessions"
+	ErrorCodeUnknownClient          = "unknown_client"
+	ErrorCodeUnsupportedPayload     = "unsupported_payload"
+)
+
+var (
+	// errorMessages contains the default message of all known error codes.
+	errorMessages = map[string]string{
+		ErrorCodeAddFailed:              "Could not add virtual session.",
+		ErrorCodeAlreadyJoined:          "The connection is already authenticated.",
+		ErrorCodeAuthFailed:             "The user could not be authenticated.",
+		ErrorCodeBadRequest:             "The request is not supported.",
+		ErrorCodeClientNotFound:         "No MCU client found to send message to.",
+		ErrorCodeDuplicateClient:        "Client already registered.",
+		ErrorCodeForbidden:              "Access to the requested resource is forbidden.",
+		ErrorCodeHelloExpected:          "Expected Hello request.",
+		ErrorCodeIgnored:                "Unsupported message type.",
+		ErrorCodeInternalError:          "An internal error occurred.",
+		ErrorCodeInvalidBackend:         "The backend URL is not supported.",
+		ErrorCodeInvalidClientType:      "The client type is not supported.",
+		ErrorCodeInvalidFormat:          "Invalid data format.",
+		ErrorCodeInvalidToken:           "The passed token is invalid.",
+		ErrorCodeMcuUnavailable:         "The MCU is not available, please try again later.",
+		ErrorCodeMissingRequiredFeature: "The client doesn't support all required features.",
+		ErrorCodeNoSuchRoom:             "The room does not exist.",
+		ErrorCodeNoSuchSession:          "The session does not exist.",
+		ErrorCodeNotAllowed:             "The request is not allowed.",
+		ErrorCodeNotInRoom:              "No room joined yet.",
+		ErrorCodeProcessingFailed:       "Processing of the message failed, please check server logs.",
+		ErrorCodeRateLimited:            "Too many messages, please slow down.",
+		ErrorCodeReadOnly:               "The server is read-only, please connect to a different server.",
+		ErrorCodeRemoveFailed:           "Could not remove virtual session from backend.",
+		ErrorCodeResumeFailed:           "The session could not be resumed.",
+		ErrorCodeRoomFull:               "The room is full.",
+		ErrorCodeRoomJoinFailed:         "Could not join the room.",
+		ErrorCodeSessionLimitExceeded:   "Too many sessions connected for this backend.",
+		ErrorCodeShutdownScheduled:      "The server is scheduled to shutdown.",
+		ErrorCodeTimeout:                "Timeout while processing the request.",
+		ErrorCodeTokenExpired:           "The token is expired.",
+		ErrorCodeTooManyRecipients:      "The message would be sent to too many sessions.",
+		ErrorCodeTooManySessions:        "Too many sessions connected from this address.",
+		ErrorCodeUnknownClient:          "Unknown client id given.",
+		ErrorCodeUnsupportedPayload:     "Unsupported payload type.",
+	}
+)
+
+// IsKnownErrorCode returns true if the code is part of the error catalog.
+func IsKnownErrorCode(code string) bool {
+	_, found := errorMessages[code]
+	return found
+}
+
+// DefaultErrorMessage returns the default message of the given error code or
+// an empty string if the code is not known.
+func DefaultErrorMessage(code string) string {
+	return errorMessages[code]
+}
+
+// NewErrorCode returns an error with the default message of the given code.
+func NewErrorCode(code string) *Error {
+	return NewError(code, "")
+}
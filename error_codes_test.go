@@ -0,0 +1,95 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorCatalog(t *testing.T) {
+	validCode := regexp.MustCompile("^[a-z]+(_[a-z]+)*$")
+	for code, message := range errorMessages {
+		if !validCode.MatchString(code) {
+			t.Errorf("Error code %s is not valid", code)
+		}
+		if message == "" || !strings.HasSuffix(message, ".") {
+			t.Errorf("Error code %s has an invalid default message \"%s\"", code, message)
+		}
+	}
+
+	errors := []*Error{
+		DuplicateClient,
+		HelloExpected,
+		UserAuthFailed,
+		RoomJoinFailed,
+		InvalidClientType,
+		InvalidBackendUrl,
+		InvalidToken,
+		NoSuchSession,
+		ResumeExpired,
+		ResumeUnknown,
+		NoSuchKickSession,
+		RoomFull,
+		NewRateLimitedError(time.Second),
+		NewTooManySessionsError("", 1),
+		NewMissingRequiredFeatureError([]string{"foo"}),
+		AlreadyJoined,
+		InvalidFormat,
+		SessionLimitExceeded,
+		ReadOnly,
+	}
+	for _, e := range errors {
+		if !IsKnownErrorCode(e.Code) {
+			t.Errorf("Error %+v uses an unknown code", e)
+		}
+	}
+
+	if IsKnownErrorCode("unknown_code") {
+		t.Error("Code should not be known")
+	} else if message := DefaultErrorMessage("unknown_code"); message != "" {
+		t.Errorf("Expected no default message, got %s", message)
+	}
+}
+
+func TestNewErrorCode(t *testing.T) {
+	e := NewErrorCode(ErrorCodeNotInRoom)
+	if e.Code != ErrorCodeNotInRoom {
+		t.Errorf("Expected code %s, got %s", ErrorCodeNotInRoom, e.Code)
+	} else if e.Message != DefaultErrorMessage(ErrorCodeNotInRoom) {
+		t.Errorf("Expected default message, got %s", e.Message)
+	}
+
+	e = NewError(ErrorCodeNotAllowed, "Custom message.")
+	if e.Message != "Custom message." {
+		t.Errorf("Expected custom message, got %s", e.Message)
+	}
+
+	e = NewErrorDetail(ErrorCodeRoomFull, "", map[string]string{"foo": "bar"})
+	if e.Message != DefaultErrorMessage(ErrorCodeRoomFull) {
+		t.Errorf("Expected default message, got %s", e.Message)
+	} else if e.Details == nil {
+		t.Error("Expected details")
+	}
+}
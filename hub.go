@@ -28,11 +28,13 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -42,17 +44,28 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
 )
 
 var (
-	DuplicateClient   = NewError("duplicate_client", "Client already registered.")
-	HelloExpected     = NewError("hello_expected", "Expected Hello request.")
-	UserAuthFailed    = NewError("auth_failed", "The user could not be authenticated.")
-	RoomJoinFailed    = NewError("room_join_failed", "Could not join the room.")
-	InvalidClientType = NewError("invalid_client_type", "The client type is not supported.")
-	InvalidBackendUrl = NewError("invalid_backend", "The backend URL is not supported.")
-	InvalidToken      = NewError("invalid_token", "The passed token is invalid.")
-	NoSuchSession     = NewError("no_such_session", "The session to resume does not exist.")
+	DuplicateClient      = NewErrorCode(ErrorCodeDuplicateClient)
+	HelloExpected        = NewErrorCode(ErrorCodeHelloExpected)
+	UserAuthFailed       = NewErrorCode(ErrorCodeAuthFailed)
+	RoomJoinFailed       = NewErrorCode(ErrorCodeRoomJoinFailed)
+	InvalidClientType    = NewErrorCode(ErrorCodeInvalidClientType)
+	InvalidBackendUrl    = NewErrorCode(ErrorCodeInvalidBackend)
+	InvalidToken         = NewErrorCode(ErrorCodeInvalidToken)
+	NoSuchSession        = NewError(ErrorCodeNoSuchSession, "The session to resume does not exist.")
+	ResumeExpired        = NewResumeFailedError("The session to resume has expired.", ResumeFailedReasonExpired)
+	ResumeUnknown        = NewResumeFailedError("The session to resume is not known.", ResumeFailedReasonUnknown)
+	NoSuchKickSession    = NewError(ErrorCodeNoSuchSession, "The session to kick does not exist.")
+	NoSuchMoveSession    = NewError(ErrorCodeNoSuchSession, "The session to move does not exist.")
+	ReadOnly             = NewErrorCode(ErrorCodeReadOnly)
+	RoomFull             = NewErrorCode(ErrorCodeRoomFull)
+	AlreadyJoined        = NewErrorCode(ErrorCodeAlreadyJoined)
+	RoomSessionForbidden = NewError(ErrorCodeForbidden, "The room session belongs to another user.")
+	UserForbidden        = NewError(ErrorCodeForbidden, "The user may not connect.")
+	ObserverNotAllowed   = NewError(ErrorCodeNotAllowed, "The user may not connect as observer.")
 
 	// Maximum number of concurrent requests to a backend.
 	defaultMaxConcurrentRequestsPerHost = 8
@@ -63,6 +76,10 @@ var (
 	// MCU requests will be cancelled if they take too long.
 	defaultMcuTimeoutSeconds = 10
 
+	// Maximum number of sessions that may be connected from the same address,
+	// generous to not affect multiple users behind a NAT.
+	defaultSessionLimitPerAddress = 100
+
 	// New connections have to send a "Hello" request after 2 seconds.
 	initialHelloTimeout = 2 * time.Second
 
@@ -82,12 +99,19 @@ var (
 	// be selected based on the cache key to avoid lock contention.
 	numDecodeCaches = 32
 
-	// Buffer sizes when reading/writing websocket connections.
-	websocketReadBufferSize  = 4096
-	websocketWriteBufferSize = 4096
+	// Default buffer sizes when reading/writing websocket connections.
+	defaultWebsocketReadBufferSize  = 4096
+	defaultWebsocketWriteBufferSize = 4096
+
+	// Maximum buffer size when reading/writing websocket connections.
+	maxWebsocketBufferSize = 1024 * 1024
 
 	// Delay after which a screen publisher should be cleaned up.
 	cleanupScreenPublisherDelay = time.Second
+
+	// NATS subject that broadcasts of internal clients are sent to, so they
+	// reach the sessions of all servers.
+	internalBroadcastSubject = "internal.broadcast"
 )
 
 const (
@@ -99,16 +123,32 @@ func init() {
 	RegisterHubStats()
 }
 
+// TimeSource returns the current time, can be replaced in tests to get
+// deterministic values.
+type TimeSource interface {
+	Now() time.Time
+}
+
+type systemTimeSource struct{}
+
+func (s systemTimeSource) Now() time.Time {
+	return time.Now()
+}
+
 type Hub struct {
 	// 64-bit members that are accessed atomically must be 64-bit aligned.
 	sid uint64
 
 	nats         NatsClient
+	timeSource   TimeSource
 	upgrader     websocket.Upgrader
 	cookie       *securecookie.SecureCookie
 	info         *HelloServerMessageServer
 	infoInternal *HelloServerMessageServer
 
+	// Prepared messages of room events that are sent to many sessions.
+	preparedMessages *preparedMessageCache
+
 	stopped         int32
 	stopChan        chan bool
 	readPumpActive  uint32
@@ -119,6 +159,9 @@ type Hub struct {
 	roomInCall       chan *BackendServerRoomRequest
 	roomParticipants chan *BackendServerRoomRequest
 
+	broadcastReceiver     chan *nats.Msg
+	broadcastSubscription NatsSubscription
+
 	mu sync.RWMutex
 	ru sync.RWMutex
 
@@ -129,13 +172,40 @@ type Hub struct {
 	roomSessions    RoomSessions
 	virtualSessions map[string]uint64
 
+	// Sessions by backend and room id (and the key of a session), protected
+	// by "mu".
+	backendSessions    map[backendRoomKey]map[Session]bool
+	sessionBackendKeys map[Session]backendRoomKey
+	// Client sessions by remote address (and the address of a session),
+	// protected by "mu".
+	addressSessions        map[string]map[Session]bool
+	sessionAddresses       map[Session]string
+	sessionLimitPerAddress int
+
 	decodeCaches []*LruCache
 
 	mcu                   Mcu
 	mcuTimeout            time.Duration
+	mcuFallback           string
+	mcuUnavailable        uint32
 	internalClientsSecret []byte
+	disabledFeatures      []string
+	requiredFeatures      []string
+	allowedAuthTypes      []string
+	maxEventSize          int
+	roomStatsInterval     time.Duration
+	emptyRoomTimeout      time.Duration
 
 	allowSubscribeAnyStream bool
+	trustedProxies          atomic.Value
+	// Public ids of sessions to log message payloads for, protected by "mu".
+	debugSessions map[string]bool
+	// Global denylist of user ids (*UserDenylist), can be reloaded.
+	deniedUsers atomic.Value
+	// Set to 1 if state-changing messages are rejected, can be reloaded.
+	readOnly uint32
+	// Set to 1 if "debug" is enabled in section "backend", can be reloaded.
+	backendDebug uint32
 
 	expiredSessions    map[Session]bool
 	expectHelloClients map[*Client]time.Time
@@ -150,6 +220,13 @@ type Hub struct {
 }
 
 func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version string) (*Hub, error) {
+	return NewHubWithResolver(config, nats, r, version, nil)
+}
+
+// NewHubWithResolver creates a hub that uses the given resolver to get the
+// backends. The backends from the configuration are used if no resolver is
+// passed.
+func NewHubWithResolver(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version string, backends BackendResolver) (*Hub, error) {
 	hashKey, _ := config.GetString("sessions", "hashkey")
 	switch len(hashKey) {
 	case 32:
@@ -175,12 +252,66 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		log.Println("WARNING: No shared secret has been set for internal clients.")
 	}
 
+	disabledFeaturesValue, _ := config.GetString("clients", "disabled_features")
+	disabledFeatures := getConfiguredValues(disabledFeaturesValue)
+	if len(disabledFeatures) > 0 {
+		log.Printf("Disabled client features: %s", disabledFeatures)
+	}
+
+	requiredFeaturesValue, _ := config.GetString("clients", "required_features")
+	requiredFeatures := getConfiguredValues(requiredFeaturesValue)
+	if len(requiredFeatures) > 0 {
+		log.Printf("Required client features: %s", requiredFeatures)
+	}
+
+	var allowedAuthTypes []string
+	if value, _ := config.GetString("clients", "allowed_auth_types"); value != "" {
+		allowedAuthTypes = getConfiguredAuthTypes(value)
+		log.Printf("Allowed auth types: %s", allowedAuthTypes)
+	}
+
+	sessionLimitPerAddress, err := config.GetInt("clients", "sessionlimitperaddress")
+	if err != nil || sessionLimitPerAddress < 0 {
+		sessionLimitPerAddress = defaultSessionLimitPerAddress
+	}
+	if sessionLimitPerAddress > 0 {
+		log.Printf("Allow a maximum of %d sessions per address", sessionLimitPerAddress)
+	} else {
+		log.Printf("Not limiting the number of sessions per address")
+	}
+
+	maxEventSize, _ := config.GetInt("clients", "maxeventsize")
+	if maxEventSize > 0 {
+		log.Printf("Splitting events larger than %d bytes", maxEventSize)
+	} else {
+		maxEventSize = 0
+	}
+
+	roomStatsIntervalSeconds, _ := config.GetInt("clients", "roomstatsinterval")
+	var roomStatsInterval time.Duration
+	if roomStatsIntervalSeconds > 0 {
+		roomStatsInterval = time.Duration(roomStatsIntervalSeconds) * time.Second
+		log.Printf("Publishing room stats every %s", roomStatsInterval)
+	}
+
+	emptyRoomTimeoutSeconds, _ := config.GetInt("clients", "emptyroomtimeout")
+	var emptyRoomTimeout time.Duration
+	if emptyRoomTimeoutSeconds > 0 {
+		emptyRoomTimeout = time.Duration(emptyRoomTimeoutSeconds) * time.Second
+		log.Printf("Keeping empty rooms for %s", emptyRoomTimeout)
+	}
+
 	maxConcurrentRequestsPerHost, _ := config.GetInt("backend", "connectionsperhost")
 	if maxConcurrentRequestsPerHost <= 0 {
 		maxConcurrentRequestsPerHost = defaultMaxConcurrentRequestsPerHost
 	}
 
-	backend, err := NewBackendClient(config, maxConcurrentRequestsPerHost, version)
+	var backend *BackendClient
+	if backends != nil {
+		backend, err = NewBackendClientWithResolver(config, backends, maxConcurrentRequestsPerHost, version)
+	} else {
+		backend, err = NewBackendClient(config, maxConcurrentRequestsPerHost, version)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -198,12 +329,25 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		mcuTimeoutSeconds = defaultMcuTimeoutSeconds
 	}
 	mcuTimeout := time.Duration(mcuTimeoutSeconds) * time.Second
+	mcuFallback := getConfiguredMcuFallback(config)
+
+	websocketReadBufferSize := getConfiguredBufferSize(config, "websocketreadbuffersize", defaultWebsocketReadBufferSize)
+	websocketWriteBufferSize := getConfiguredBufferSize(config, "websocketwritebuffersize", defaultWebsocketWriteBufferSize)
+	log.Printf("Using websocket buffer sizes of %d bytes for reading and %d bytes for writing", websocketReadBufferSize, websocketWriteBufferSize)
 
 	allowSubscribeAnyStream, _ := config.GetBool("app", "allowsubscribeany")
 	if allowSubscribeAnyStream {
 		log.Printf("WARNING: Allow subscribing any streams, this is insecure and should only be enabled for testing")
 	}
 
+	trustedProxies, err := getConfiguredTrustedProxies(config)
+	if err != nil {
+		return nil, err
+	}
+
+	debugSessions := getConfiguredDebugSessions(config)
+	deniedUsers := getConfiguredDeniedUsers(config)
+
 	decodeCaches := make([]*LruCache, 0, numDecodeCaches)
 	for i := 0; i < numDecodeCaches; i++ {
 		decodeCaches = append(decodeCaches, NewLruCache(decodeCacheSize))
@@ -242,29 +386,9 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		if options, _ := config.GetOptions("geoip-overrides"); len(options) > 0 {
 			geoipOverrides = make(map[*net.IPNet]string)
 			for _, option := range options {
-				var ip net.IP
-				var ipNet *net.IPNet
-				if strings.Contains(option, "/") {
-					_, ipNet, err = net.ParseCIDR(option)
-					if err != nil {
-						return nil, fmt.Errorf("could not parse CIDR %s: %s", option, err)
-					}
-				} else {
-					ip = net.ParseIP(option)
-					if ip == nil {
-						return nil, fmt.Errorf("could not parse IP %s", option)
-					}
-
-					var mask net.IPMask
-					if ipv4 := ip.To4(); ipv4 != nil {
-						mask = net.CIDRMask(32, 32)
-					} else {
-						mask = net.CIDRMask(128, 128)
-					}
-					ipNet = &net.IPNet{
-						IP:   ip,
-						Mask: mask,
-					}
+				ipNet, err := parseIPNet(option)
+				if err != nil {
+					return nil, err
 				}
 
 				value, _ := config.GetString("geoip-overrides", option)
@@ -286,7 +410,9 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 	}
 
 	hub := &Hub{
-		nats: nats,
+		nats:             nats,
+		timeSource:       systemTimeSource{},
+		preparedMessages: newPreparedMessageCache(preparedMessageCacheSize),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  websocketReadBufferSize,
 			WriteBufferSize: websocketWriteBufferSize,
@@ -315,12 +441,27 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		roomSessions:    roomSessions,
 		virtualSessions: make(map[string]uint64),
 
+		backendSessions:    make(map[backendRoomKey]map[Session]bool),
+		sessionBackendKeys: make(map[Session]backendRoomKey),
+
+		addressSessions:        make(map[string]map[Session]bool),
+		sessionAddresses:       make(map[Session]string),
+		sessionLimitPerAddress: sessionLimitPerAddress,
+
 		decodeCaches: decodeCaches,
 
 		mcuTimeout:            mcuTimeout,
+		mcuFallback:           mcuFallback,
 		internalClientsSecret: []byte(internalClientsSecret),
+		disabledFeatures:      disabledFeatures,
+		requiredFeatures:      requiredFeatures,
+		allowedAuthTypes:      allowedAuthTypes,
+		maxEventSize:          maxEventSize,
+		roomStatsInterval:     roomStatsInterval,
+		emptyRoomTimeout:      emptyRoomTimeout,
 
 		allowSubscribeAnyStream: allowSubscribeAnyStream,
+		debugSessions:           debugSessions,
 
 		expiredSessions:    make(map[Session]bool),
 		anonymousClients:   make(map[*Client]time.Time),
@@ -333,7 +474,15 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		geoipOverrides: geoipOverrides,
 	}
 	backend.hub = hub
+	backend.SetUrlChangedHandler(hub.onBackendUrlChanged)
+	hub.trustedProxies.Store(trustedProxies)
+	hub.deniedUsers.Store(deniedUsers)
+	hub.setReadOnly(getConfiguredReadOnly(config))
+	hub.setBackendDebug(getConfiguredBackendDebug(config))
 	hub.upgrader.CheckOrigin = hub.checkOrigin
+	if err := hub.subscribeBroadcasts(); err != nil {
+		return nil, err
+	}
 	r.HandleFunc("/spreed", func(w http.ResponseWriter, r *http.Request) {
 		hub.serveWs(w, r)
 	})
@@ -372,18 +521,106 @@ func (h *Hub) SetMcu(mcu Mcu) {
 		removeFeature(h.info, ServerFeatureMcu)
 		removeFeature(h.info, ServerFeatureSimulcast)
 		removeFeature(h.info, ServerFeatureUpdateSdp)
+		removeFeature(h.info, ServerFeatureCandidates)
 		removeFeature(h.infoInternal, ServerFeatureMcu)
 		removeFeature(h.infoInternal, ServerFeatureSimulcast)
 		removeFeature(h.infoInternal, ServerFeatureUpdateSdp)
+		removeFeature(h.infoInternal, ServerFeatureCandidates)
 	} else {
 		log.Printf("Using a timeout of %s for MCU requests", h.mcuTimeout)
+		atomic.StoreUint32(&h.mcuUnavailable, 0)
+		mcu.SetOnConnected(h.onMcuConnected)
+		mcu.SetOnDisconnected(h.onMcuDisconnected)
 		addFeature(h.info, ServerFeatureMcu)
 		addFeature(h.info, ServerFeatureSimulcast)
 		addFeature(h.info, ServerFeatureUpdateSdp)
+		addFeature(h.info, ServerFeatureCandidates)
 		addFeature(h.infoInternal, ServerFeatureMcu)
 		addFeature(h.infoInternal, ServerFeatureSimulcast)
 		addFeature(h.infoInternal, ServerFeatureUpdateSdp)
+		addFeature(h.infoInternal, ServerFeatureCandidates)
+	}
+}
+
+// filterDisabledFeatures removes client features that have been disabled
+// globally or for the given backend.
+func (h *Hub) filterDisabledFeatures(sessionId string, backend *Backend, features []string) []string {
+	disabled := h.disabledFeatures
+	if backend != nil && backend.DisabledFeatures() != nil {
+		disabled = backend.DisabledFeatures()
+	}
+	restricted := backend != nil && backend.Features() != nil
+	if (len(disabled) == 0 && !restricted) || len(features) == 0 {
+		return features
+	}
+
+	var result []string
+	for _, f := range features {
+		suppressed := false
+		for _, d := range disabled {
+			if f == d {
+				suppressed = true
+				break
+			}
+		}
+		if suppressed {
+			if h.isBackendDebug() {
+				log.Printf("Feature %s is disabled for session %s", f, sessionId)
+			}
+			continue
+		}
+		if restricted && isNegotiatedFeature(f) && !backend.HasFeature(f) {
+			if h.isBackendDebug() {
+				log.Printf("Feature %s is not allowed for backend of session %s", f, sessionId)
+			}
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// isAuthTypeAllowed checks if hello requests with the given auth type are
+// accepted globally or for the given backend.
+func (h *Hub) isAuthTypeAllowed(backend *Backend, authType string) bool {
+	allowed := h.allowedAuthTypes
+	if backend != nil && backend.AllowedAuthTypes() != nil {
+		allowed = backend.AllowedAuthTypes()
 	}
+	if allowed == nil {
+		return true
+	}
+
+	for _, a := range allowed {
+		if a == authType {
+			return true
+		}
+	}
+	return false
+}
+
+// getMissingRequiredFeatures returns the client features that are required
+// globally or for the given backend but are not included in the features.
+func (h *Hub) getMissingRequiredFeatures(backend *Backend, features []string) []string {
+	required := h.requiredFeatures
+	if backend != nil && backend.RequiredFeatures() != nil {
+		required = backend.RequiredFeatures()
+	}
+
+	var missing []string
+	for _, r := range required {
+		found := false
+		for _, f := range features {
+			if f == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
 }
 
 func (h *Hub) checkOrigin(r *http.Request) bool {
@@ -392,11 +629,168 @@ func (h *Hub) checkOrigin(r *http.Request) bool {
 }
 
 func (h *Hub) GetServerInfo(session Session) *HelloServerMessageServer {
+	info := h.info
 	if session.ClientType() == HelloClientTypeInternal {
-		return h.infoInternal
+		info = h.infoInternal
+	}
+
+	return h.getServerInfoForBackend(info, session.Backend())
+}
+
+// getServerInfoForBackend returns the server information with the features
+// that are available for sessions of the given backend.
+func (h *Hub) getServerInfoForBackend(info *HelloServerMessageServer, backend *Backend) *HelloServerMessageServer {
+	if h.isMcuUnavailable() {
+		info = removeMcuFeatures(info)
+	}
+	return filterServerInfo(info, backend)
+}
+
+// getConfiguredBufferSize returns the buffer size configured in the "app"
+// section with the given option, clamped to maxWebsocketBufferSize.
+func getConfiguredBufferSize(config *goconf.ConfigFile, option string, defaultSize int) int {
+	size, _ := config.GetInt("app", option)
+	if size <= 0 {
+		return defaultSize
+	} else if size > maxWebsocketBufferSize {
+		log.Printf("Buffer size %d for %s exceeds the maximum of %d bytes, limiting", size, option, maxWebsocketBufferSize)
+		return maxWebsocketBufferSize
+	}
+	return size
+}
+
+func getConfiguredMcuFallback(config *goconf.ConfigFile) string {
+	fallback, _ := config.GetString("mcu", "fallback")
+	switch fallback = strings.TrimSpace(fallback); fallback {
+	case McuFallbackNone, "none":
+		fallback = McuFallbackNone
+	case McuFallbackFeatures:
+		log.Printf("Not advertising MCU features while the MCU is unavailable")
+	case McuFallbackNotify:
+		log.Printf("Not advertising MCU features and notifying sessions while the MCU is unavailable")
+	default:
+		log.Printf("Unsupported MCU fallback %s, ignoring", fallback)
+		fallback = McuFallbackNone
+	}
+	return fallback
+}
+
+// isMcuUnavailable returns true if the MCU features should not be advertised
+// as the connection to the MCU is lost.
+func (h *Hub) isMcuUnavailable() bool {
+	return atomic.LoadUint32(&h.mcuUnavailable) != 0
+}
+
+// removeMcuFeatures returns the server information without the features that
+// require a working MCU.
+func removeMcuFeatures(info *HelloServerMessageServer) *HelloServerMessageServer {
+	filtered := *info
+	filtered.Features = nil
+	for _, f := range info.Features {
+		if !isMcuFeature(f) {
+			filtered.Features = append(filtered.Features, f)
+		}
+	}
+	return &filtered
+}
+
+// isMcuEnabled returns true if messages of the session should be processed
+// by the MCU, i.e. a MCU is configured and allowed for the backend.
+func (h *Hub) isMcuEnabled(session Session) bool {
+	if h.mcu == nil {
+		return false
+	}
+
+	backend := session.Backend()
+	return backend == nil || backend.HasFeature(ServerFeatureMcu)
+}
+
+func isMcuFeature(feature string) bool {
+	switch feature {
+	case ServerFeatureMcu, ServerFeatureSimulcast, ServerFeatureUpdateSdp, ServerFeatureCandidates:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *Hub) onMcuConnected() {
+	if !atomic.CompareAndSwapUint32(&h.mcuUnavailable, 1, 0) {
+		return
+	}
+
+	log.Printf("MCU is available again, advertising MCU features")
+	if h.mcuFallback == McuFallbackNotify {
+		h.notifyClientSessions(NotifyTypeMcuAvailable)
+	}
+}
+
+func (h *Hub) onMcuDisconnected() {
+	if h.mcuFallback == McuFallbackNone || !atomic.CompareAndSwapUint32(&h.mcuUnavailable, 0, 1) {
+		return
+	}
+
+	log.Printf("MCU is unavailable, no longer advertising MCU features")
+	if h.mcuFallback == McuFallbackNotify {
+		h.notifyClientSessions(NotifyTypeMcuUnavailable)
+		h.notifyRoomsMcuUnavailable()
+	}
+}
+
+// notifyRoomsMcuUnavailable sends an error to all rooms with sessions in the
+// call as their streams can no longer be published through the MCU.
+func (h *Hub) notifyRoomsMcuUnavailable() {
+	h.ru.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	h.ru.RUnlock()
+
+	for _, room := range rooms {
+		if room.GetStats().InCall == 0 {
+			continue
+		}
+
+		h.SendRoomError(room.Id(), room.Backend(), ErrorCodeMcuUnavailable, "")
 	}
+}
+
+// notifyClientSessions sends a "notify" message of the given type to all
+// client sessions that are connected locally.
+func (h *Hub) notifyClientSessions(notifyType string) {
+	h.mu.RLock()
+	sessions := make([]*ClientSession, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		if clientSession, ok := session.(*ClientSession); ok && clientSession.ClientType() == HelloClientTypeClient {
+			sessions = append(sessions, clientSession)
+		}
+	}
+	h.mu.RUnlock()
+
+	broadcastMessage(sessions, &ServerMessage{
+		Type: "notify",
+		Notify: &NotifyServerMessage{
+			Type: notifyType,
+		},
+	})
+}
 
-	return h.info
+// filterServerInfo returns the server information with only the features that
+// are allowed for the backend.
+func filterServerInfo(info *HelloServerMessageServer, backend *Backend) *HelloServerMessageServer {
+	if backend == nil || backend.Features() == nil {
+		return info
+	}
+
+	filtered := *info
+	filtered.Features = nil
+	for _, f := range info.Features {
+		if backend.HasFeature(f) {
+			filtered.Features = append(filtered.Features, f)
+		}
+	}
+	return &filtered
 }
 
 func (h *Hub) updateGeoDatabase() {
@@ -444,6 +838,8 @@ loop:
 			h.processRoomInCallChanged(message)
 		case message := <-h.roomParticipants:
 			h.processRoomParticipants(message)
+		case message := <-h.broadcastReceiver:
+			h.processNatsBroadcast(message)
 		// Periodic internal housekeeping.
 		case now := <-housekeeping.C:
 			h.performHousekeeping(now)
@@ -453,142 +849,534 @@ loop:
 			break loop
 		}
 	}
+	if h.broadcastSubscription != nil {
+		if err := h.broadcastSubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing broadcast subscription: %s", err)
+		}
+	}
 	if h.geoip != nil {
 		h.geoip.Close()
 	}
 }
 
+// Stop stops processing backend notifications. Connected clients receive a
+// "bye" so they can reconnect, e.g. after the server was restarted.
 func (h *Hub) Stop() {
-	atomic.StoreInt32(&h.stopped, 1)
+	if !atomic.CompareAndSwapInt32(&h.stopped, 0, 1) {
+		return
+	}
+
 	select {
 	case h.stopChan <- true:
 	default:
 	}
-}
 
-func (h *Hub) Reload(config *goconf.ConfigFile) {
-	if h.mcu != nil {
-		h.mcu.Reload(config)
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.SendByeResponseWithReason(nil, ByeCodeShutdown)
 	}
-	h.backend.Reload(config)
 }
 
-func reverseSessionId(s string) (string, error) {
-	// Note that we are assuming base64 encoded strings here.
-	decoded, err := base64.URLEncoding.DecodeString(s)
+func getConfiguredTrustedProxies(config *goconf.ConfigFile) (*TrustedProxies, error) {
+	value, _ := config.GetString("app", "trustedproxies")
+	trustedProxies, err := ParseTrustedProxies(value)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	for i, j := 0, len(decoded)-1; i < j; i, j = i+1, j-1 {
-		decoded[i], decoded[j] = decoded[j], decoded[i]
+	if trustedProxies.Empty() {
+		log.Printf("No trusted proxies configured, forwarding headers will be ignored")
+	} else {
+		log.Printf("Trusting forwarding headers from proxies %s", trustedProxies)
 	}
-	return base64.URLEncoding.EncodeToString(decoded), nil
+	return trustedProxies, nil
 }
 
-func (h *Hub) encodeSessionId(data *SessionIdData, sessionType string) (string, error) {
-	encoded, err := h.cookie.Encode(sessionType, data)
-	if err != nil {
-		return "", err
+func (h *Hub) getTrustedProxies() *TrustedProxies {
+	trustedProxies, _ := h.trustedProxies.Load().(*TrustedProxies)
+	return trustedProxies
+}
+
+func (h *Hub) Reload(config *goconf.ConfigFile) {
+	if trustedProxies, err := getConfiguredTrustedProxies(config); err != nil {
+		log.Printf("Could not parse trusted proxies, keeping current list: %s", err)
+	} else {
+		h.trustedProxies.Store(trustedProxies)
 	}
-	if sessionType == publicSessionName {
-		// We are reversing the public session ids because clients compare them
-		// to decide who calls whom. The prefix of the session id is increasing
-		// (a timestamp) but the suffix the (random) hash.
-		// By reversing we move the hash to the front, making the comparison of
-		// session ids "random".
-		encoded, err = reverseSessionId(encoded)
+	if h.mcu != nil {
+		h.mcu.Reload(config)
 	}
-	return encoded, err
+	h.backend.Reload(config)
+	h.removeStaleBackendSessions()
+	h.setDebugSessions(getConfiguredDebugSessions(config))
+	h.deniedUsers.Store(getConfiguredDeniedUsers(config))
+	h.setReadOnly(getConfiguredReadOnly(config))
+	h.setBackendDebug(getConfiguredBackendDebug(config))
 }
 
-func (h *Hub) getDecodeCache(cache_key string) *LruCache {
-	hash := fnv.New32a()
-	hash.Write([]byte(cache_key)) // nolint
-	idx := hash.Sum32() % uint32(len(h.decodeCaches))
-	return h.decodeCaches[idx]
+func getConfiguredReadOnly(config *goconf.ConfigFile) bool {
+	readOnly, _ := config.GetBool("app", "readonly")
+	return readOnly
 }
 
-func (h *Hub) invalidateSessionId(id string, sessionType string) {
-	if len(id) == 0 {
+// setReadOnly enables or disables the read-only mode.
+func (h *Hub) setReadOnly(readOnly bool) {
+	var value uint32
+	if readOnly {
+		value = 1
+	}
+	if old := atomic.SwapUint32(&h.readOnly, value); old == value {
 		return
 	}
 
-	cache_key := id + "|" + sessionType
-	cache := h.getDecodeCache(cache_key)
-	cache.Remove(cache_key)
+	if readOnly {
+		log.Printf("Server is read-only, rejecting state-changing messages")
+	} else {
+		log.Printf("Server is no longer read-only")
+	}
 }
 
-func (h *Hub) setDecodedSessionId(id string, sessionType string, data *SessionIdData) {
-	if len(id) == 0 {
-		return
+func (h *Hub) setBackendDebug(debug bool) {
+	var value uint32
+	if debug {
+		value = 1
 	}
+	atomic.StoreUint32(&h.backendDebug, value)
+}
 
-	cache_key := id + "|" + sessionType
-	cache := h.getDecodeCache(cache_key)
-	cache.Set(cache_key, data)
+// isBackendDebug returns true if details about the features of sessions and
+// backends should be logged.
+func (h *Hub) isBackendDebug() bool {
+	return atomic.LoadUint32(&h.backendDebug) != 0
 }
 
-func (h *Hub) decodeSessionId(id string, sessionType string) *SessionIdData {
-	if len(id) == 0 {
-		return nil
-	}
+// isReadOnly returns true if state-changing messages should be rejected.
+func (h *Hub) isReadOnly() bool {
+	return atomic.LoadUint32(&h.readOnly) != 0
+}
 
-	cache_key := id + "|" + sessionType
-	cache := h.getDecodeCache(cache_key)
-	if result := cache.Get(cache_key); result != nil {
-		return result.(*SessionIdData)
+// isAllowedWhenReadOnly returns true if the message doesn't change the state
+// of the server, so it may be processed in read-only mode.
+func isAllowedWhenReadOnly(message *ClientMessage) bool {
+	switch message.Type {
+	case "room":
+		// Sessions may still leave rooms, e.g. while the server is drained.
+		return message.Room.RoomId == ""
+	case "capabilities", "echo", "participants", "bye", "hello":
+		return true
+	default:
+		return false
 	}
+}
 
-	if sessionType == publicSessionName {
-		var err error
-		id, err = reverseSessionId(id)
-		if err != nil {
-			return nil
-		}
+func getConfiguredDeniedUsers(config *goconf.ConfigFile) *UserDenylist {
+	value, _ := config.GetString("clients", "denied_users")
+	deniedUsers := NewUserDenylist(value)
+	if deniedUsers != nil {
+		log.Printf("Denying users %s", deniedUsers)
 	}
+	return deniedUsers
+}
 
-	var data SessionIdData
-	if h.cookie.Decode(sessionType, id, &data) != nil {
-		return nil
+// isUserDenied checks if the user id is denied globally or for the backend.
+func (h *Hub) isUserDenied(backend *Backend, userId string) bool {
+	if deniedUsers, _ := h.deniedUsers.Load().(*UserDenylist); deniedUsers.Matches(userId) {
+		return true
 	}
 
-	cache.Set(cache_key, &data)
-	return &data
+	return backend != nil && backend.DeniedUsers().Matches(userId)
 }
 
-func (h *Hub) GetSessionByPublicId(sessionId string) Session {
-	data := h.decodeSessionId(sessionId, publicSessionName)
-	if data == nil {
-		return nil
-	}
-
+// setDebugSessions updates the sessions for which message payloads should be
+// logged. Only the listed sessions are affected, no additional work is done
+// for other sessions.
+func (h *Hub) setDebugSessions(debugSessions map[string]bool) {
 	h.mu.Lock()
-	session := h.sessions[data.Sid]
-	h.mu.Unlock()
-	return session
-}
+	defer h.mu.Unlock()
 
-func (h *Hub) checkExpiredSessions(now time.Time) {
-	for s := range h.expiredSessions {
-		if s.IsExpired(now) {
-			h.mu.Unlock()
-			log.Printf("Closing expired session %s (private=%s)", s.PublicId(), s.PrivateId())
-			s.Close()
-			h.mu.Lock()
-			// Should already be deleted by the close code, but better be sure.
-			delete(h.expiredSessions, s)
+	h.debugSessions = debugSessions
+	for _, session := range h.sessions {
+		if clientSession, ok := session.(*ClientSession); ok {
+			enabled := isDebugSession(debugSessions, clientSession)
+			if enabled != clientSession.DebugPayloads() {
+				if enabled {
+					log.Printf("Logging message payloads of session %s", clientSession.PublicId())
+				} else {
+					log.Printf("No longer logging message payloads of session %s", clientSession.PublicId())
+				}
+				clientSession.SetDebugPayloads(enabled)
+			}
 		}
 	}
 }
 
-func (h *Hub) checkExpireClients(now time.Time, clients map[*Client]time.Time, reason string) {
-	for client, timeout := range clients {
-		if now.After(timeout) {
-			// This will close the client connection.
-			h.mu.Unlock()
+// SwapBackends replaces the active backends with a completely loaded new
+// configuration as an alternative to the in-place update of "Reload". Runtime
+// state is only transferred for unchanged backends. Like with "Reload",
+// sessions of backends whose url changed are disconnected.
+func (h *Hub) SwapBackends(backends *BackendConfiguration) error {
+	changes, err := h.backend.ReplaceBackends(backends)
+	if err != nil {
+		return err
+	} else if !changes.IsEmpty() {
+		log.Printf("Swapped backends: %s", changes)
+	}
+
+	h.removeStaleBackendSessions()
+	return nil
+}
+
+// backendRoomKey identifies the sessions of a backend in a room. Sessions that
+// are not in a room use an empty room id.
+type backendRoomKey struct {
+	backendId string
+	roomId    string
+}
+
+func (h *Hub) addBackendSessionLocked(session Session) {
+	backend := session.Backend()
+	if backend == nil {
+		return
+	}
+
+	var roomId string
+	if room := session.GetRoom(); room != nil {
+		roomId = room.Id()
+	}
+	h.setBackendSessionKeyLocked(session, backendRoomKey{
+		backendId: backend.Id(),
+		roomId:    roomId,
+	})
+}
+
+func (h *Hub) setBackendSessionKeyLocked(session Session, key backendRoomKey) {
+	h.removeBackendSessionLocked(session)
+	sessions, found := h.backendSessions[key]
+	if !found {
+		sessions = make(map[Session]bool)
+		h.backendSessions[key] = sessions
+	}
+	sessions[session] = true
+	h.sessionBackendKeys[session] = key
+}
+
+func (h *Hub) removeBackendSessionLocked(session Session) {
+	key, found := h.sessionBackendKeys[session]
+	if !found {
+		return
+	}
+
+	delete(h.sessionBackendKeys, session)
+	if sessions, found := h.backendSessions[key]; found {
+		delete(sessions, session)
+		if len(sessions) == 0 {
+			delete(h.backendSessions, key)
+		}
+	}
+}
+
+// updateBackendSessionRoom moves a session that is listed for the room
+// "fromRoomId" of its backend to the room "toRoomId".
+func (h *Hub) updateBackendSessionRoom(session Session, fromRoomId string, toRoomId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key, found := h.sessionBackendKeys[session]
+	if !found || key.roomId != fromRoomId {
+		return
+	}
+
+	key.roomId = toRoomId
+	h.setBackendSessionKeyLocked(session, key)
+}
+
+// getSessionLimitAddress returns the address that is used to limit the number
+// of sessions of the given client. An empty address is returned for clients
+// connecting from loopback addresses or through trusted proxies that didn't
+// forward the client address, their address is shared by all clients.
+// Forwarding headers of untrusted peers are ignored, so these are limited by
+// the address of the peer.
+func getSessionLimitAddress(client *Client) string {
+	if client.sharedProxy {
+		return ""
+	}
+
+	addr := client.RemoteAddr()
+	if ip := net.ParseIP(addr); ip == nil || ip.IsLoopback() {
+		return ""
+	}
+	return addr
+}
+
+// isSessionLimitPerAddressExceededLocked returns true and the exceeded limit if
+// no more sessions of the given backend may be connected from the address.
+func (h *Hub) isSessionLimitPerAddressExceededLocked(address string, backend *Backend) (int, bool) {
+	if address == "" {
+		return 0, false
+	}
+
+	sessions := h.addressSessions[address]
+	if h.sessionLimitPerAddress > 0 && len(sessions) >= h.sessionLimitPerAddress {
+		return h.sessionLimitPerAddress, true
+	}
+
+	if limit := backend.SessionLimitPerAddress(); limit > 0 {
+		count := 0
+		for session := range sessions {
+			if session.Backend().Id() == backend.Id() {
+				count++
+			}
+		}
+		if count >= limit {
+			return limit, true
+		}
+	}
+	return 0, false
+}
+
+func (h *Hub) isSessionLimitPerAddressExceeded(address string, backend *Backend) (int, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.isSessionLimitPerAddressExceededLocked(address, backend)
+}
+
+func (h *Hub) addAddressSessionLocked(session Session, address string) {
+	if address == "" {
+		return
+	}
+
+	sessions, found := h.addressSessions[address]
+	if !found {
+		sessions = make(map[Session]bool)
+		h.addressSessions[address] = sessions
+	}
+	sessions[session] = true
+	h.sessionAddresses[session] = address
+}
+
+func (h *Hub) removeAddressSessionLocked(session Session) {
+	address, found := h.sessionAddresses[session]
+	if !found {
+		return
+	}
+
+	delete(h.sessionAddresses, session)
+	if sessions, found := h.addressSessions[address]; found {
+		delete(sessions, session)
+		if len(sessions) == 0 {
+			delete(h.addressSessions, address)
+		}
+	}
+}
+
+// removeStaleBackendSessions removes sessions of backends that are no longer
+// configured from the index, the sessions themselves are not closed.
+func (h *Hub) removeStaleBackendSessions() {
+	configured := make(map[string]bool)
+	for _, backend := range h.backend.GetBackends() {
+		configured[backend.Id()] = true
+	}
+	if compat := h.backend.GetCompatBackend(); compat != nil {
+		configured[compat.Id()] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed := make(map[string]int)
+	for key, sessions := range h.backendSessions {
+		if !configured[key.backendId] {
+			removed[key.backendId] += len(sessions)
+			for session := range sessions {
+				delete(h.sessionBackendKeys, session)
+			}
+			delete(h.backendSessions, key)
+		}
+	}
+	for id, count := range removed {
+		log.Printf("Backend %s was removed, %d sessions are no longer listed", id, count)
+	}
+}
+
+// onBackendUrlChanged disconnects the sessions of a backend whose url changed.
+// They were authenticated against the old url and need to connect again so
+// they are validated by the new url.
+func (h *Hub) onBackendUrlChanged(change BackendUrlChange) {
+	sessions := h.SessionsForBackend(change.Id)
+	if len(sessions) == 0 {
+		return
+	}
+
+	log.Printf("Url of backend %s changed from %s to %s, disconnecting %d sessions", change.Id, change.OldUrl, change.NewUrl, len(sessions))
+	for _, session := range sessions {
+		if clientSession, ok := session.(*ClientSession); ok {
+			if client := clientSession.GetClient(); client != nil {
+				client.SendByeResponseWithReason(nil, ByeCodeBackendChanged)
+			}
+		}
+		session.Close()
+	}
+}
+
+// SessionsForBackend returns a snapshot of the sessions that are connected
+// for the backend with the given id.
+func (h *Hub) SessionsForBackend(id string) []Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var result []Session
+	for key, sessions := range h.backendSessions {
+		if key.backendId != id {
+			continue
+		}
+
+		for session := range sessions {
+			result = append(result, session)
+		}
+	}
+	return result
+}
+
+// SessionsForBackendRoom returns a snapshot of the sessions of the backend
+// with the given id that are in the given room. Sessions that are not in a
+// room are returned for an empty room id.
+func (h *Hub) SessionsForBackendRoom(id string, roomId string) []Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sessions := h.backendSessions[backendRoomKey{
+		backendId: id,
+		roomId:    roomId,
+	}]
+	result := make([]Session, 0, len(sessions))
+	for session := range sessions {
+		result = append(result, session)
+	}
+	return result
+}
+
+func reverseSessionId(s string) (string, error) {
+	// Note that we are assuming base64 encoded strings here.
+	decoded, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+
+	for i, j := 0, len(decoded)-1; i < j; i, j = i+1, j-1 {
+		decoded[i], decoded[j] = decoded[j], decoded[i]
+	}
+	return base64.URLEncoding.EncodeToString(decoded), nil
+}
+
+func (h *Hub) encodeSessionId(data *SessionIdData, sessionType string) (string, error) {
+	encoded, err := h.cookie.Encode(sessionType, data)
+	if err != nil {
+		return "", err
+	}
+	if sessionType == publicSessionName {
+		// We are reversing the public session ids because clients compare them
+		// to decide who calls whom. The prefix of the session id is increasing
+		// (a timestamp) but the suffix the (random) hash.
+		// By reversing we move the hash to the front, making the comparison of
+		// session ids "random".
+		encoded, err = reverseSessionId(encoded)
+	}
+	return encoded, err
+}
+
+func (h *Hub) getDecodeCache(cache_key string) *LruCache {
+	hash := fnv.New32a()
+	hash.Write([]byte(cache_key)) // nolint
+	idx := hash.Sum32() % uint32(len(h.decodeCaches))
+	return h.decodeCaches[idx]
+}
+
+func (h *Hub) invalidateSessionId(id string, sessionType string) {
+	if len(id) == 0 {
+		return
+	}
+
+	cache_key := id + "|" + sessionType
+	cache := h.getDecodeCache(cache_key)
+	cache.Remove(cache_key)
+}
+
+func (h *Hub) setDecodedSessionId(id string, sessionType string, data *SessionIdData) {
+	if len(id) == 0 {
+		return
+	}
+
+	cache_key := id + "|" + sessionType
+	cache := h.getDecodeCache(cache_key)
+	cache.Set(cache_key, data)
+}
+
+func (h *Hub) decodeSessionId(id string, sessionType string) *SessionIdData {
+	if len(id) == 0 {
+		return nil
+	}
+
+	cache_key := id + "|" + sessionType
+	cache := h.getDecodeCache(cache_key)
+	if result := cache.Get(cache_key); result != nil {
+		return result.(*SessionIdData)
+	}
+
+	if sessionType == publicSessionName {
+		var err error
+		id, err = reverseSessionId(id)
+		if err != nil {
+			return nil
+		}
+	}
+
+	var data SessionIdData
+	if h.cookie.Decode(sessionType, id, &data) != nil {
+		return nil
+	}
+
+	cache.Set(cache_key, &data)
+	return &data
+}
+
+func (h *Hub) GetSessionByPublicId(sessionId string) Session {
+	data := h.decodeSessionId(sessionId, publicSessionName)
+	if data == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	session := h.sessions[data.Sid]
+	h.mu.Unlock()
+	return session
+}
+
+func (h *Hub) checkExpiredSessions(now time.Time) {
+	for s := range h.expiredSessions {
+		if s.IsExpired(now) {
+			h.mu.Unlock()
+			log.Printf("Closing expired session %s (private=%s)", s.PublicId(), s.PrivateId())
+			s.Close()
+			h.mu.Lock()
+			// Should already be deleted by the close code, but better be sure.
+			delete(h.expiredSessions, s)
+		}
+	}
+}
+
+func (h *Hub) checkExpireClients(now time.Time, clients map[*Client]time.Time, reason string) {
+	for client, timeout := range clients {
+		if now.After(timeout) {
+			// This will close the client connection.
+			h.mu.Unlock()
 			client.SendByeResponseWithReason(nil, reason)
-			if reason == "room_join_timeout" {
+			if reason == ByeCodeRoomJoinTimeout {
 				session := client.GetSession()
 				if session != nil {
 					session.Close()
@@ -600,11 +1388,11 @@ func (h *Hub) checkExpireClients(now time.Time, clients map[*Client]time.Time, r
 }
 
 func (h *Hub) checkAnonymousClients(now time.Time) {
-	h.checkExpireClients(now, h.anonymousClients, "room_join_timeout")
+	h.checkExpireClients(now, h.anonymousClients, ByeCodeRoomJoinTimeout)
 }
 
 func (h *Hub) checkInitialHello(now time.Time) {
-	h.checkExpireClients(now, h.expectHelloClients, "hello_timeout")
+	h.checkExpireClients(now, h.expectHelloClients, ByeCodeHelloTimeout)
 }
 
 func (h *Hub) performHousekeeping(now time.Time) {
@@ -613,10 +1401,14 @@ func (h *Hub) performHousekeeping(now time.Time) {
 	h.checkAnonymousClients(now)
 	h.checkInitialHello(now)
 	h.mu.Unlock()
+
+	h.checkEmptyRooms(now)
 }
 
-func (h *Hub) removeSession(session Session) (removed bool) {
-	session.LeaveRoom(true)
+// removeSession removes the session from the hub and its room, the reason is
+// one of the "LeaveReason*" values that is sent to the other sessions.
+func (h *Hub) removeSession(session Session, reason string) (removed bool) {
+	session.LeaveRoom(true, reason)
 	h.invalidateSessionId(session.PrivateId(), privateSessionName)
 	h.invalidateSessionId(session.PublicId(), publicSessionName)
 
@@ -625,6 +1417,8 @@ func (h *Hub) removeSession(session Session) (removed bool) {
 		delete(h.clients, data.Sid)
 		if _, found := h.sessions[data.Sid]; found {
 			delete(h.sessions, data.Sid)
+			h.removeBackendSessionLocked(session)
+			h.removeAddressSessionLocked(session)
 			statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), session.ClientType()).Dec()
 			removed = true
 		}
@@ -705,6 +1499,20 @@ func (h *Hub) processRegister(client *Client, message *ClientMessage, backend *B
 		return
 	}
 
+	// The user id is only known after the backend authenticated the client.
+	if h.isUserDenied(backend, auth.Auth.UserId) {
+		log.Printf("User %s@%s from %s is denied", auth.Auth.UserId, backend.Id(), client.RemoteAddr())
+		client.SendMessage(message.NewErrorServerMessage(UserForbidden))
+		return
+	}
+
+	// Clients may only connect as observer if the backend allows it.
+	if message.Hello.Observer && !auth.Auth.Observer {
+		log.Printf("User %s@%s from %s may not connect as observer", auth.Auth.UserId, backend.Id(), client.RemoteAddr())
+		client.SendMessage(message.NewErrorServerMessage(ObserverNotAllowed))
+		return
+	}
+
 	sid := atomic.AddUint64(&h.sid, 1)
 	for sid == 0 {
 		sid = atomic.AddUint64(&h.sid, 1)
@@ -729,6 +1537,9 @@ func (h *Hub) processRegister(client *Client, message *ClientMessage, backend *B
 	} else {
 		log.Printf("Register anonymous@%s from %s in %s (%s) %s (private=%s)", backend.Id(), client.RemoteAddr(), client.Country(), client.UserAgent(), publicSessionId, privateSessionId)
 	}
+	if info := message.Hello.Client; info != nil {
+		log.Printf("Session %s is using client %s", publicSessionId, info)
+	}
 
 	session, err := NewClientSession(h, privateSessionId, publicSessionId, sessionIdData, backend, message.Hello, auth.Auth)
 	if err != nil {
@@ -752,9 +1563,30 @@ func (h *Hub) processRegister(client *Client, message *ClientMessage, backend *B
 		return
 	}
 
+	limitAddress := session.ClientType() != HelloClientTypeInternal
+	if limitAddress {
+		if limit, exceeded := h.isSessionLimitPerAddressExceededLocked(getSessionLimitAddress(client), backend); exceeded {
+			h.mu.Unlock()
+
+			log.Printf("Too many sessions connected from %s, rejecting session %s of backend %s", client.RemoteAddr(), session.PublicId(), backend.Id())
+			statsHubSessionsAddressLimitExceededTotal.WithLabelValues(backend.Id()).Inc()
+			session.Close()
+			client.SendMessage(message.NewErrorServerMessage(NewTooManySessionsError("", limit)))
+			return
+		}
+	}
+
+	if isDebugSession(h.debugSessions, session) {
+		log.Printf("Logging message payloads of session %s", publicSessionId)
+		session.SetDebugPayloads(true)
+	}
 	session.SetClient(client)
 	h.sessions[sessionIdData.Sid] = session
 	h.clients[sessionIdData.Sid] = client
+	h.addBackendSessionLocked(session)
+	if limitAddress {
+		h.addAddressSessionLocked(session, getSessionLimitAddress(client))
+	}
 	delete(h.expectHelloClients, client)
 	if userId == "" && auth.Type != HelloClientTypeInternal {
 		h.startWaitAnonymousClientRoomLocked(client)
@@ -805,7 +1637,39 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 		return
 	}
 
+	if session := client.GetSession(); session != nil && session.DebugPayloads() {
+		log.Printf("Received from session %s: %s", session.PublicId(), formatDebugPayload(&message))
+	}
+
+	if getCustomMessageType(message.Type) != nil {
+		payload, err := getCustomMessagePayload(data, message.Type)
+		if err != nil {
+			log.Printf("Error decoding payload of %s message from %s: %v", message.Type, client.RemoteAddr(), err)
+			client.SendMessage(message.NewErrorServerMessage(InvalidFormat))
+			return
+		}
+		message.customPayload = payload
+	}
+
+	if session := client.GetSession(); session != nil {
+		message.fromInternal = session.ClientType() == HelloClientTypeInternal
+		if message.Message != nil {
+			message.Message.fromInternal = message.fromInternal
+		}
+	}
+
+	countClientMessage(&message)
 	if err := message.CheckValid(); err != nil {
+		if err == ErrInvalidMessageId {
+			// Don't copy the invalid id to the response.
+			message.Id = ""
+		}
+
+		if message.Dry {
+			h.processDryMsg(client, &message, err)
+			return
+		}
+
 		if session := client.GetSession(); session != nil {
 			log.Printf("Invalid message %+v from client %s: %v", message, session.PublicId(), err)
 			session.SendMessage(message.NewErrorServerMessage(InvalidFormat))
@@ -816,6 +1680,11 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 		return
 	}
 
+	if message.Dry {
+		h.processDryMsg(client, &message, nil)
+		return
+	}
+
 	session := client.GetSession()
 	if session == nil {
 		if message.Type != "hello" {
@@ -827,27 +1696,108 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 		return
 	}
 
-	switch message.Type {
-	case "room":
-		h.processRoom(client, &message)
-	case "message":
-		h.processMessageMsg(client, &message)
+	if message.Type != "bye" && !session.AllowMessage() {
+		log.Printf("Session %s exceeded message rate of %d messages per second", session.PublicId(), session.MessageRate())
+		session.SendMessage(message.NewErrorServerMessage(NewRateLimitedError(session.MessageRetryAfter())))
+		return
+	}
+
+	if h.isReadOnly() && !isAllowedWhenReadOnly(&message) {
+		log.Printf("Server is read-only, rejecting %s message from %s", message.Type, session.PublicId())
+		session.SendMessage(message.NewErrorServerMessage(ReadOnly))
+		return
+	}
+
+	switch message.Type {
+	case "room":
+		h.processRoom(client, &message)
+	case "message":
+		h.processMessageMsg(client, &message)
 	case "control":
 		h.processControlMsg(client, &message)
 	case "internal":
 		h.processInternalMsg(client, &message)
 	case "transient":
 		h.processTransientMsg(client, &message)
+	case "capabilities":
+		h.processCapabilitiesMsg(client, &message)
+	case "kick":
+		h.processKickMsg(client, &message)
+	case "move":
+		h.processMoveMsg(client, &message)
+	case "presence":
+		h.processPresenceMsg(client, &message)
+	case "echo":
+		h.processEchoMsg(client, &message)
+	case "participants":
+		h.processParticipantsMsg(client, &message)
 	case "bye":
 		h.processByeMsg(client, &message)
 	case "hello":
-		log.Printf("Ignore hello %+v for already authenticated connection %s", message.Hello, session.PublicId())
+		h.processDuplicateHello(session, &message)
 	default:
-		log.Printf("Ignore unknown message %+v from %s", message, session.PublicId())
+		if customType := getCustomMessageType(message.Type); customType != nil {
+			customType.handler(h, session, &message, message.customPayload)
+		} else {
+			log.Printf("Ignore unknown message %+v from %s", message, session.PublicId())
+		}
+	}
+}
+
+// processDryMsg replies with the result of validating a dry request. The
+// request is not processed further, in particular no session ids or rooms are
+// looked up, so the response only depends on the request itself.
+func (h *Hub) processDryMsg(client *Client, message *ClientMessage, validationError error) {
+	var response *ServerMessage
+	if validationError != nil {
+		response = message.NewErrorServerMessage(NewError(ErrorCodeInvalidFormat, validationError.Error()))
+	} else {
+		response = &ServerMessage{
+			Id:   message.Id,
+			Type: "validate",
+			Validate: &ValidateServerMessage{
+				Type: message.Type,
+			},
+		}
+	}
+
+	session := client.GetSession()
+	if session == nil {
+		if now := time.Now(); !client.dryLimiter.Allow(now) {
+			client.SendMessage(message.NewErrorServerMessage(NewRateLimitedError(client.dryLimiter.RetryAfter(now))))
+			return
+		}
+
+		client.SendMessage(response)
+		return
+	}
+
+	if !session.AllowMessage() {
+		session.SendMessage(message.NewErrorServerMessage(NewRateLimitedError(session.MessageRetryAfter())))
+		return
+	}
+
+	session.SendMessage(response)
+}
+
+// processDuplicateHello handles a hello on a connection that is already
+// authenticated. Only resuming the own session is allowed and answered with
+// the current hello response, the identity of the session is never changed.
+func (h *Hub) processDuplicateHello(session *ClientSession, message *ClientMessage) {
+	if resumeId := message.Hello.ResumeId; resumeId != "" && resumeId == session.PrivateId() {
+		h.sendHelloResponse(session, message)
+		return
 	}
+
+	log.Printf("Reject hello %+v for already authenticated connection %s", message.Hello, session.PublicId())
+	session.SendMessage(message.NewErrorServerMessage(AlreadyJoined))
 }
 
 func (h *Hub) sendHelloResponse(session *ClientSession, message *ClientMessage) bool {
+	return session.SendMessage(h.newHelloResponse(session, message))
+}
+
+func (h *Hub) newHelloResponse(session *ClientSession, message *ClientMessage) *ServerMessage {
 	response := &ServerMessage{
 		Id:   message.Id,
 		Type: "hello",
@@ -857,9 +1807,38 @@ func (h *Hub) sendHelloResponse(session *ClientSession, message *ClientMessage)
 			ResumeId:  session.PrivateId(),
 			UserId:    session.UserId(),
 			Server:    h.GetServerInfo(session),
+
+			MaxMessageRate: session.MessageRate(),
+			Features:       h.getSessionFeatures(session),
+			ServerTime:     h.timeSource.Now().UnixNano() / int64(time.Millisecond),
 		},
 	}
-	return session.SendMessage(response)
+	return response
+}
+
+// getSessionFeatures returns the features that are enabled for the session,
+// i.e. the features of the server that are allowed for the backend of the
+// session. Negotiated features are only returned if the client included them
+// in its "hello" request and they are not disabled.
+func (h *Hub) getSessionFeatures(session *ClientSession) []string {
+	info := h.GetServerInfo(session)
+	result := make([]string, 0, len(info.Features))
+	for _, f := range info.Features {
+		if isNegotiatedFeature(f) && !session.HasFeature(f) {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+func isNegotiatedFeature(feature string) bool {
+	for _, f := range NegotiatedFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *Hub) processHello(client *Client, message *ClientMessage) {
@@ -867,17 +1846,20 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 	if resumeId != "" {
 		data := h.decodeSessionId(resumeId, privateSessionName)
 		if data == nil {
+			// The id was not created by this server (or with a different hash key).
 			statsHubSessionResumeFailed.Inc()
-			client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
+			client.SendMessage(message.NewErrorServerMessage(ResumeUnknown))
 			return
 		}
 
 		h.mu.Lock()
 		session, found := h.sessions[data.Sid]
 		if !found || resumeId != session.PrivateId() {
+			// The id was created by this server, so the session existed but has
+			// expired or was closed (its internal id might have been reused).
 			h.mu.Unlock()
 			statsHubSessionResumeFailed.Inc()
-			client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
+			client.SendMessage(message.NewErrorServerMessage(ResumeExpired))
 			return
 		}
 
@@ -887,7 +1869,17 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 			h.mu.Unlock()
 			log.Printf("Client resumed non-client session %s (private=%s)", session.PublicId(), session.PrivateId())
 			statsHubSessionResumeFailed.Inc()
-			client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
+			client.SendMessage(message.NewErrorServerMessage(ResumeUnknown))
+			return
+		}
+
+		// The denylist might have been changed since the session connected.
+		if h.isUserDenied(clientSession.Backend(), clientSession.UserId()) {
+			h.mu.Unlock()
+			log.Printf("User %s@%s from %s is denied, not resuming session %s", clientSession.UserId(), clientSession.Backend().Id(), client.RemoteAddr(), session.PublicId())
+			statsHubSessionResumeFailed.Inc()
+			client.SendMessage(message.NewErrorServerMessage(UserForbidden))
+			session.Close()
 			return
 		}
 
@@ -899,7 +1891,7 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 
 		if prev := clientSession.SetClient(client); prev != nil {
 			log.Printf("Closing previous client from %s for session %s", prev.RemoteAddr(), session.PublicId())
-			prev.SendByeResponseWithReason(nil, "session_resumed")
+			prev.SendByeResponseWithReason(nil, ByeCodeSessionResumed)
 		}
 
 		clientSession.StopExpire()
@@ -910,7 +1902,12 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 		log.Printf("Resume session from %s in %s (%s) %s (private=%s)", client.RemoteAddr(), client.Country(), client.UserAgent(), session.PublicId(), session.PrivateId())
 
 		statsHubSessionsResumedTotal.WithLabelValues(clientSession.Backend().Id(), clientSession.ClientType()).Inc()
-		h.sendHelloResponse(clientSession, message)
+		response := h.newHelloResponse(clientSession, message)
+		if dropped := clientSession.takeDroppedPendingMessages(); dropped > 0 {
+			log.Printf("Session %s dropped %d messages while disconnected", session.PublicId(), dropped)
+			response.Hello.DroppedMessages = dropped
+		}
+		clientSession.SendMessage(response)
 		clientSession.NotifySessionResumed(client)
 		return
 	}
@@ -942,6 +1939,27 @@ func (h *Hub) processHelloClient(client *Client, message *ClientMessage) {
 		return
 	}
 
+	if !h.isAuthTypeAllowed(backend, HelloClientTypeClient) {
+		log.Printf("Client %s may not use auth type %s for backend %s", client.RemoteAddr(), HelloClientTypeClient, backend.Id())
+		client.SendMessage(message.NewErrorServerMessage(InvalidClientType))
+		return
+	}
+
+	if missing := h.getMissingRequiredFeatures(backend, message.Hello.Features); len(missing) > 0 {
+		log.Printf("Client %s does not support required features %s", client.RemoteAddr(), missing)
+		client.SendMessage(message.NewErrorServerMessage(NewMissingRequiredFeatureError(missing)))
+		return
+	}
+
+	// Check before authenticating to avoid unnecessary backend requests, the
+	// limit is checked again when the session is registered.
+	if limit, exceeded := h.isSessionLimitPerAddressExceeded(getSessionLimitAddress(client), backend); exceeded {
+		log.Printf("Too many sessions connected from %s for backend %s", client.RemoteAddr(), backend.Id())
+		statsHubSessionsAddressLimitExceededTotal.WithLabelValues(backend.Id()).Inc()
+		client.SendMessage(message.NewErrorServerMessage(NewTooManySessionsError("", limit)))
+		return
+	}
+
 	// Run in timeout context to prevent blocking too long.
 	ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
 	defer cancel()
@@ -975,12 +1993,20 @@ func (h *Hub) processHelloInternal(client *Client, message *ClientMessage) {
 		return
 	}
 
+	// Internal clients pass the backend they act for in their params, which
+	// is used to check the allowed auth types.
 	backend := h.backend.GetBackend(message.Hello.Auth.internalParams.parsedBackend)
 	if backend == nil {
 		client.SendMessage(message.NewErrorServerMessage(InvalidBackendUrl))
 		return
 	}
 
+	if !h.isAuthTypeAllowed(backend, HelloClientTypeInternal) {
+		log.Printf("Client %s may not use auth type %s for backend %s", client.RemoteAddr(), HelloClientTypeInternal, backend.Id())
+		client.SendMessage(message.NewErrorServerMessage(InvalidClientType))
+		return
+	}
+
 	auth := &BackendClientResponse{
 		Type: "auth",
 		Auth: &BackendClientAuthResponse{},
@@ -988,13 +2014,17 @@ func (h *Hub) processHelloInternal(client *Client, message *ClientMessage) {
 	h.processRegister(client, message, backend, auth)
 }
 
-func (h *Hub) disconnectByRoomSessionId(roomSessionId string) {
+// disconnectByRoomSessionId closes the session that is connected with the
+// given room session id. If the session is in the room that will be joined
+// by the new connection, no "leave" event is sent to the other participants.
+// Returns true if such a session existed.
+func (h *Hub) disconnectByRoomSessionId(roomSessionId string, roomId string, backend *Backend) bool {
 	sessionId, err := h.roomSessions.GetSessionId(roomSessionId)
 	if err == ErrNoSuchRoomSession {
-		return
+		return false
 	} else if err != nil {
 		log.Printf("Could not get session id for room session %s: %s", roomSessionId, err)
-		return
+		return false
 	}
 
 	session := h.GetSessionByPublicId(sessionId)
@@ -1003,24 +2033,115 @@ func (h *Hub) disconnectByRoomSessionId(roomSessionId string) {
 		msg := &ServerMessage{
 			Type: "bye",
 			Bye: &ByeServerMessage{
-				Reason: "room_session_reconnected",
+				Reason: ByeCodeRoomSessionReconnected,
 			},
 		}
 		if err := h.nats.PublishMessage("session."+sessionId, msg); err != nil {
 			log.Printf("Could not send reconnect bye to session %s: %s", sessionId, err)
 		}
-		return
+		return true
 	}
 
 	log.Printf("Closing session %s because same room session %s connected", session.PublicId(), roomSessionId)
-	session.LeaveRoom(false)
 	switch sess := session.(type) {
 	case *ClientSession:
+		if room := sess.GetRoom(); room != nil && roomId != "" && room.Id() == roomId && backend != nil && room.Backend().Id() == backend.Id() {
+			// The new connection will join as resumed session.
+			sess.LeaveRoomResumed()
+		} else {
+			sess.LeaveRoom(false, LeaveReasonDisconnected)
+		}
 		if client := sess.GetClient(); client != nil {
-			client.SendByeResponseWithReason(nil, "room_session_reconnected")
+			client.SendByeResponseWithReason(nil, ByeCodeRoomSessionReconnected)
 		}
+	default:
+		session.LeaveRoom(false, LeaveReasonDisconnected)
 	}
 	session.Close()
+	return true
+}
+
+// getRoomSessionOwner returns the user of a room session as confirmed by the
+// backend. This is the user id of the session or, for guests, the user id that
+// the backend returned in the session data of the room. An empty string is
+// returned if the backend didn't identify the guest.
+func getRoomSessionOwner(userId string, data *RoomSessionData) string {
+	if userId != "" {
+		return userId
+	} else if data != nil {
+		return data.UserId
+	}
+	return ""
+}
+
+// decodeRoomSessionData returns the session data from a backend room response
+// or nil if none (or invalid) data was returned.
+func decodeRoomSessionData(sessionData *json.RawMessage) *RoomSessionData {
+	if sessionData == nil || len(*sessionData) == 0 {
+		return nil
+	}
+
+	var data RoomSessionData
+	if err := json.Unmarshal(*sessionData, &data); err != nil {
+		return nil
+	}
+	return &data
+}
+
+// isRoomSessionAllowed checks if the given room session id may be used by the
+// session after the backend accepted it for the room. A room session that is
+// already connected may only be taken over by the same user of the same
+// backend, otherwise a client could disconnect other participants by sending
+// their room session id.
+func (h *Hub) isRoomSessionAllowed(session *ClientSession, roomSessionId string, room *BackendClientRoomResponse) bool {
+	sessionId, err := h.roomSessions.GetSessionId(roomSessionId)
+	if err != nil {
+		// Not connected (or unknown), the backend validated the room session.
+		return true
+	} else if sessionId == session.PublicId() {
+		return true
+	}
+
+	if other := h.GetSessionByPublicId(sessionId); other != nil {
+		if other.Backend().Id() != session.Backend().Id() {
+			return false
+		}
+
+		var otherData *RoomSessionData
+		if otherRoom := other.GetRoom(); otherRoom != nil {
+			otherData = otherRoom.GetRoomSessionData(other)
+		}
+		var data *RoomSessionData
+		if room != nil {
+			data = decodeRoomSessionData(room.Session)
+		}
+		owner := getRoomSessionOwner(session.UserId(), data)
+		otherOwner := getRoomSessionOwner(other.UserId(), otherData)
+		if owner != "" || otherOwner != "" {
+			return owner == otherOwner
+		}
+
+		// Neither session could be identified (e.g. guests without session data
+		// from the backend), only sessions whose client is no longer connected
+		// may be taken over when reconnecting.
+		if otherSession, ok := other.(*ClientSession); ok {
+			return otherSession.GetClient() == nil
+		}
+		return false
+	}
+
+	data := h.decodeSessionId(sessionId, publicSessionName)
+	if data == nil {
+		log.Printf("Room session %s belongs to invalid session %s, not allowed for %s", roomSessionId, sessionId, session.PublicId())
+		return false
+	} else if data.BackendId != session.Backend().Id() {
+		log.Printf("Room session %s belongs to session %s of backend %s, not allowed for %s", roomSessionId, sessionId, data.BackendId, session.PublicId())
+		return false
+	}
+
+	// The session is located on a different server, the backend confirmed the
+	// room session and the other server will close it.
+	return true
 }
 
 func (h *Hub) sendRoom(session *ClientSession, message *ClientMessage, room *Room) bool {
@@ -1035,9 +2156,11 @@ func (h *Hub) sendRoom(session *ClientSession, message *ClientMessage, room *Roo
 			RoomId: "",
 		}
 	} else {
+		properties, version := room.PropertiesSnapshot()
 		response.Room = &RoomServerMessage{
-			RoomId:     room.id,
-			Properties: room.properties,
+			RoomId:            room.id,
+			Properties:        properties,
+			PropertiesVersion: version,
 		}
 	}
 	return session.SendMessage(response)
@@ -1051,8 +2174,14 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 			return
 		}
 
+		if session.GetRoom() != nil && !session.AllowRoomSwitch() {
+			log.Printf("Session %s exceeded room switch rate of %d rooms per minute", session.PublicId(), session.RoomSwitchRate())
+			session.SendMessage(message.NewErrorServerMessage(NewRateLimitedError(session.RoomSwitchRetryAfter())))
+			return
+		}
+
 		// We can handle leaving a room directly.
-		if session.LeaveRoom(true) != nil {
+		if session.LeaveRoom(true, LeaveReasonLeft) != nil {
 			// User was in a room before, so need to notify about leaving it.
 			h.sendRoom(session, message, nil)
 		}
@@ -1064,12 +2193,21 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 
 	if session != nil {
 		if room := h.getRoomForBackend(roomId, session.Backend()); room != nil && room.HasSession(session) {
-			// Session already is in that room, no action needed.
+			// Session already is in that room, only send the current state so
+			// clients can recover from missed property updates.
+			h.sendRoom(session, message, room)
+			return
+		}
+
+		if !session.AllowRoomSwitch() {
+			log.Printf("Session %s exceeded room switch rate of %d rooms per minute", session.PublicId(), session.RoomSwitchRate())
+			session.SendMessage(message.NewErrorServerMessage(NewRateLimitedError(session.RoomSwitchRetryAfter())))
 			return
 		}
 	}
 
 	var room BackendClientResponse
+	var resumed bool
 	if session.ClientType() == HelloClientTypeInternal {
 		// Internal clients can join any room.
 		room = BackendClientResponse{
@@ -1083,6 +2221,14 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
 		defer cancel()
 
+		// The owner of sessions with a user id is known, so the room session can
+		// be checked before the backend is notified about the join.
+		if message.Room.SessionId != "" && session.UserId() != "" && !h.isRoomSessionAllowed(session, message.Room.SessionId, nil) {
+			log.Printf("Session %s of user %s may not use room session %s", session.PublicId(), session.UserId(), message.Room.SessionId)
+			session.SendMessage(message.NewErrorServerMessage(RoomSessionForbidden))
+			return
+		}
+
 		sessionId := message.Room.SessionId
 		if sessionId == "" {
 			// TODO(jojo): Better make the session id required in the request.
@@ -1097,14 +2243,27 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 
 		// TODO(jojo): Validate response
 
+		// Anonymous sessions are identified by the session data returned by the
+		// backend. No "leave" is sent to the backend if they are rejected, as
+		// this would remove the room session of the session that owns it.
+		if message.Room.SessionId != "" && session.UserId() == "" && room.Type == "room" && !h.isRoomSessionAllowed(session, message.Room.SessionId, room.Room) {
+			log.Printf("Anonymous session %s may not use room session %s", session.PublicId(), message.Room.SessionId)
+			session.SendMessage(message.NewErrorServerMessage(RoomSessionForbidden))
+			return
+		}
+
 		if message.Room.SessionId != "" {
 			// There can only be one connection per Nextcloud Talk session,
 			// disconnect any other connections without sending a "leave" event.
-			h.disconnectByRoomSessionId(message.Room.SessionId)
+			var joinRoomId string
+			if room.Type == "room" {
+				joinRoomId = roomId
+			}
+			resumed = h.disconnectByRoomSessionId(message.Room.SessionId, joinRoomId, session.Backend())
 		}
 	}
 
-	h.processJoinRoom(session, message, &room)
+	h.processJoinRoom(session, message, &room, resumed)
 }
 
 func (h *Hub) getRoomForBackend(id string, backend *Backend) *Room {
@@ -1115,6 +2274,18 @@ func (h *Hub) getRoomForBackend(id string, backend *Backend) *Room {
 	return h.rooms[internalRoomId]
 }
 
+// SendRoomError sends an error to all sessions of the room with the given id.
+// Returns false if the room doesn't exist on this server.
+func (h *Hub) SendRoomError(id string, backend *Backend, code string, message string) bool {
+	room := h.getRoomForBackend(id, backend)
+	if room == nil {
+		return false
+	}
+
+	room.PublishError(code, message)
+	return true
+}
+
 func (h *Hub) removeRoom(room *Room) {
 	internalRoomId := getRoomIdForBackend(room.Id(), room.Backend())
 	h.ru.Lock()
@@ -1125,6 +2296,45 @@ func (h *Hub) removeRoom(room *Room) {
 	h.ru.Unlock()
 }
 
+// markRoomEmpty starts the grace period after which the given room will be
+// removed if no session joins it.
+func (h *Hub) markRoomEmpty(room *Room, now time.Time) {
+	h.ru.Lock()
+	room.emptySince = now
+	h.ru.Unlock()
+}
+
+// markRoomUsed stops the grace period of the given room.
+func (h *Hub) markRoomUsed(room *Room) {
+	h.ru.Lock()
+	room.emptySince = time.Time{}
+	h.ru.Unlock()
+}
+
+func (h *Hub) checkEmptyRooms(now time.Time) {
+	if h.emptyRoomTimeout <= 0 {
+		return
+	}
+
+	var expired []*Room
+	h.ru.Lock()
+	for id, room := range h.rooms {
+		if room.emptySince.IsZero() || now.Sub(room.emptySince) < h.emptyRoomTimeout {
+			continue
+		}
+
+		log.Printf("Removing room %s which was empty since %s", room.Id(), room.emptySince)
+		delete(h.rooms, id)
+		statsHubRoomsCurrent.WithLabelValues(room.Backend().Id()).Dec()
+		expired = append(expired, room)
+	}
+	h.ru.Unlock()
+
+	for _, room := range expired {
+		room.expire()
+	}
+}
+
 func (h *Hub) createRoom(id string, properties *json.RawMessage, backend *Backend) (*Room, error) {
 	// Note the write lock must be held.
 	room, err := NewRoom(id, properties, h, h.nats, backend)
@@ -1138,7 +2348,22 @@ func (h *Hub) createRoom(id string, properties *json.RawMessage, backend *Backen
 	return room, nil
 }
 
-func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, room *BackendClientResponse) {
+// cancelRoomJoin notifies the backend that the session didn't join the room
+// it requested after the backend already confirmed the join.
+func (h *Hub) cancelRoomJoin(session *ClientSession, message *ClientMessage) {
+	if session.ClientType() == HelloClientTypeInternal {
+		// No backend request was performed for internal clients.
+		return
+	}
+
+	roomSessionId := message.Room.SessionId
+	if roomSessionId == "" {
+		roomSessionId = session.PublicId()
+	}
+	session.notifyRoomLeave(message.Room.RoomId, roomSessionId)
+}
+
+func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, room *BackendClientResponse, resumed bool) {
 	if room.Type == "error" {
 		session.SendMessage(message.NewErrorServerMessage(room.Error))
 		return
@@ -1147,11 +2372,25 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 		return
 	}
 
-	session.LeaveRoom(true)
-
 	roomId := room.Room.RoomId
+	// Check the capacity of an existing room before leaving the previous room,
+	// so the session stays in it if the room is full.
+	reserved := h.getRoomForBackend(roomId, session.Backend())
+	if reserved != nil && !reserved.ReserveSession(session) {
+		log.Printf("Room %s is full, session %s may not join", roomId, session.PublicId())
+		h.cancelRoomJoin(session, message)
+		session.SendMessage(message.NewErrorServerMessage(RoomFull))
+		return
+	}
+
+	session.LeaveRoom(true, LeaveReasonMoved)
+
 	internalRoomId := getRoomIdForBackend(roomId, session.Backend())
 	if err := session.SubscribeRoomNats(h.nats, roomId, message.Room.SessionId); err != nil {
+		if reserved != nil {
+			reserved.ReleaseSession(session)
+		}
+		h.cancelRoomJoin(session, message)
 		session.SendMessage(message.NewWrappedErrorServerMessage(err))
 		// The client (implicitly) left the room due to an error.
 		h.sendRoom(session, nil, nil)
@@ -1160,19 +2399,35 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 
 	h.ru.Lock()
 	r, found := h.rooms[internalRoomId]
-	if !found {
+	if found && !r.emptySince.IsZero() {
+		// Restart the grace period so the room is not removed while the
+		// session is joining.
+		r.emptySince = time.Now()
+	} else if !found {
 		var err error
 		if r, err = h.createRoom(roomId, room.Room.Properties, session.Backend()); err != nil {
 			h.ru.Unlock()
 			session.SendMessage(message.NewWrappedErrorServerMessage(err))
 			// The client (implicitly) left the room due to an error.
 			session.UnsubscribeRoomNats()
+			h.cancelRoomJoin(session, message)
 			h.sendRoom(session, nil, nil)
 			return
 		}
 	}
 	h.ru.Unlock()
 
+	if !r.ReserveSession(session) {
+		// The room was filled by other sessions while joining.
+		log.Printf("Room %s is full, session %s may not join", roomId, session.PublicId())
+		session.SendMessage(message.NewErrorServerMessage(RoomFull))
+		// The client (implicitly) left the room due to an error.
+		session.UnsubscribeRoomNats()
+		h.cancelRoomJoin(session, message)
+		h.sendRoom(session, nil, nil)
+		return
+	}
+
 	h.mu.Lock()
 	if client := session.GetClient(); client != nil {
 		// The client now joined a room, don't expire him if he is anonymous.
@@ -1184,18 +2439,50 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 		session.SetPermissions(*room.Room.Permissions)
 	}
 	h.sendRoom(session, message, r)
-	h.notifyUserJoinedRoom(r, session, room.Room.Session)
+	h.notifyUserJoinedRoom(r, session, room.Room.Session, resumed)
+}
+
+// splitEvent returns the messages to send for the given event message so
+// they don't exceed the configured maximum event size.
+func (h *Hub) splitEvent(message *ServerMessage) []*ServerMessage {
+	if message.Event == nil || h.maxEventSize <= 0 {
+		return []*ServerMessage{message}
+	}
+
+	events := message.Event.Split(h.maxEventSize)
+	if len(events) == 1 {
+		return []*ServerMessage{message}
+	}
+
+	result := make([]*ServerMessage, 0, len(events))
+	for _, event := range events {
+		msg := *message
+		msg.Event = event
+		result = append(result, &msg)
+	}
+	return result
 }
 
-func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionData *json.RawMessage) {
+func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionData *json.RawMessage, resumed bool) {
 	// Register session with the room
-	if sessions := room.AddSession(session, sessionData); len(sessions) > 0 {
+	var sessions []Session
+	if resumed {
+		sessions = room.AddResumedSession(session, sessionData)
+	} else {
+		sessions = room.AddSession(session, sessionData)
+	}
+	if len(sessions) > 0 {
 		events := make([]*EventServerMessageSessionEntry, 0, len(sessions))
 		for _, s := range sessions {
+			if isObserverSession(s) {
+				continue
+			}
+
 			entry := &EventServerMessageSessionEntry{
-				SessionId: s.PublicId(),
-				UserId:    s.UserId(),
-				User:      s.UserData(),
+				SessionId:   s.PublicId(),
+				UserId:      s.UserId(),
+				User:        s.UserData(),
+				DisplayName: s.DisplayName(),
 			}
 			if s, ok := s.(*ClientSession); ok {
 				entry.RoomSessionId = s.RoomSessionId()
@@ -1212,7 +2499,11 @@ func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionDa
 		}
 
 		// No need to send through NATS, the session is connected locally.
-		session.SendMessage(msg)
+		if msg = session.filterSubscribedEvent(msg); msg != nil {
+			for _, m := range h.splitEvent(msg) {
+				session.SendMessage(m)
+			}
+		}
 
 		// Notify about initial flags of virtual sessions.
 		for _, s := range sessions {
@@ -1263,13 +2554,22 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 		if data != nil {
 			if data.BackendId != session.Backend().Id() {
 				// Clients are only allowed to send to sessions from the same backend.
+				if msg.RequestReceipt {
+					sendMessageReceipt(session, message, ReceiptStatusNotFound)
+				}
 				return
 			}
 
-			if h.mcu != nil {
+			if h.isMcuEnabled(session) {
 				// Maybe this is a message to be processed by the MCU.
 				var data MessageClientMessageData
 				if err := json.Unmarshal(*msg.Data, &data); err == nil {
+					if err := data.CheckValid(); err != nil {
+						log.Printf("Invalid MCU message %+v from %s: %s", data, session.PublicId(), err)
+						session.SendMessage(message.NewErrorServerMessage(NewError(ErrorCodeInvalidFormat, err.Error())))
+						return
+					}
+
 					clientData = &data
 					switch data.Type {
 					case "requestoffer":
@@ -1286,8 +2586,27 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 					case "selectStream":
 						fallthrough
 					case "candidate":
+						if session.IsObserver() && msg.Recipient.SessionId == session.PublicId() {
+							// Observers may only subscribe streams of other sessions.
+							sendNotAllowed(session, message, "Observers may not publish media.")
+							return
+						}
+
 						h.processMcuMessage(session, session, message, msg, &data)
 						return
+					case "candidates":
+						if session.IsObserver() && msg.Recipient.SessionId == session.PublicId() {
+							// Observers may only subscribe streams of other sessions.
+							sendNotAllowed(session, message, "Observers may not publish media.")
+							return
+						}
+
+						// Already validated in "CheckValid".
+						candidates, _ := data.SplitCandidates()
+						for _, candidate := range candidates {
+							h.processMcuMessage(session, session, message, msg, candidate)
+						}
+						return
 					}
 				}
 			}
@@ -1300,9 +2619,11 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 			subject = "session." + msg.Recipient.SessionId
 			h.mu.RLock()
 			recipient = h.clients[data.Sid]
+			found := recipient != nil
 			if recipient == nil {
 				// Send to client connection for virtual sessions.
 				sess := h.sessions[data.Sid]
+				found = sess != nil
 				if sess != nil && sess.ClientType() == HelloClientTypeVirtual {
 					virtualSession := sess.(*VirtualSession)
 					clientSession := virtualSession.Session()
@@ -1316,6 +2637,12 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 				}
 			}
 			h.mu.RUnlock()
+
+			if !found && msg.RequestReceipt && !h.isClustered() {
+				// Without other servers, the session must be connected locally.
+				sendMessageReceipt(session, message, ReceiptStatusNotFound)
+				return
+			}
 		}
 	case RecipientTypeUser:
 		if msg.Recipient.UserId != "" {
@@ -1333,7 +2660,7 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 			if room := session.GetRoom(); room != nil {
 				subject = GetSubjectForRoomId(room.Id(), room.Backend())
 
-				if h.mcu != nil {
+				if h.isMcuEnabled(session) {
 					var data MessageClientMessageData
 					if err := json.Unmarshal(*msg.Data, &data); err == nil {
 						clientData = &data
@@ -1344,6 +2671,14 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 	}
 	if subject == "" {
 		log.Printf("Unknown recipient in message %+v from %s", msg, session.PublicId())
+		if msg.RequestReceipt {
+			sendMessageReceipt(session, message, ReceiptStatusNotFound)
+		}
+		return
+	}
+
+	if session.IsObserver() {
+		sendNotAllowed(session, message, "Observers may not send messages.")
 		return
 	}
 
@@ -1373,11 +2708,7 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 	response := &ServerMessage{
 		Type: "message",
 		Message: &MessageServerMessage{
-			Sender: &MessageServerMessageSender{
-				Type:      msg.Recipient.Type,
-				SessionId: session.PublicId(),
-				UserId:    session.UserId(),
-			},
+			Sender:    session.GetMessageSender(msg.Recipient.Type),
 			Recipient: serverRecipient,
 			Data:      msg.Data,
 		},
@@ -1403,30 +2734,54 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 			return
 		}
 		recipient.SendMessage(response)
+		if msg.RequestReceipt {
+			sendMessageReceipt(session, message, ReceiptStatusDelivered)
+		}
 	} else {
 		if clientData != nil && clientData.Type == "sendoffer" {
 			// TODO(jojo): Implement this.
 			log.Printf("Sending offers to remote clients is not supported yet (client %s)", session.PublicId())
 			return
 		}
-		if err := h.nats.PublishMessage(subject, response); err != nil {
+		natsMsg := &NatsMessage{
+			SendTime: time.Now(),
+			Type:     "message",
+			Message:  response,
+		}
+		if msg.Recipient.ExcludeSelf {
+			natsMsg.ExcludeSessionId = session.PublicId()
+		}
+		if err := h.nats.PublishNats(subject, natsMsg); err != nil {
 			log.Printf("Error publishing message to remote session: %s", err)
+			if msg.RequestReceipt {
+				session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			}
+		} else if msg.RequestReceipt {
+			sendMessageReceipt(session, message, ReceiptStatusForwarded)
 		}
 	}
 }
 
-func isAllowedToControl(session Session) bool {
-	if session.ClientType() == HelloClientTypeInternal {
-		// Internal clients are allowed to send any control message.
-		return true
-	}
+// isClustered returns true if other servers may be connected through NATS.
+func (h *Hub) isClustered() bool {
+	_, loopback := h.nats.(*LoopbackNatsClient)
+	return !loopback
+}
 
-	if session.HasPermission(PERMISSION_MAY_CONTROL) {
-		// Moderator clients are allowed to send any control message.
-		return true
+func sendMessageReceipt(session *ClientSession, message *ClientMessage, status string) {
+	response := &ServerMessage{
+		Id:   message.Id,
+		Type: "receipt",
+		Receipt: &ReceiptServerMessage{
+			Recipient: &message.Message.Recipient,
+			Status:    status,
+		},
 	}
+	session.SendMessage(response)
+}
 
-	return false
+func isAllowedToControl(session Session) bool {
+	return GetSessionRole(session) == SessionRoleModerator
 }
 
 func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
@@ -1435,9 +2790,12 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 	if session == nil {
 		// Client is not connected yet.
 		return
-	} else if !isAllowedToControl(session) {
+	} else if !msg.IsAllowedFrom(GetSessionRole(session)) {
 		log.Printf("Ignore control message %+v from %s", msg, session.PublicId())
 		return
+	} else if session.IsObserver() {
+		sendNotAllowed(session, message, "Observers may not send control messages.")
+		return
 	}
 
 	var recipient *Client
@@ -1455,9 +2813,11 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 			subject = "session." + msg.Recipient.SessionId
 			h.mu.RLock()
 			recipient = h.clients[data.Sid]
+			found := recipient != nil
 			if recipient == nil {
 				// Send to client connection for virtual sessions.
 				sess := h.sessions[data.Sid]
+				found = sess != nil
 				if sess != nil && sess.ClientType() == HelloClientTypeVirtual {
 					virtualSession := sess.(*VirtualSession)
 					clientSession := virtualSession.Session()
@@ -1471,6 +2831,12 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 				}
 			}
 			h.mu.RUnlock()
+
+			if !found && msg.RequestReceipt && !h.isClustered() {
+				// Without other servers, the session must be connected locally.
+				sendMessageReceipt(session, message, ReceiptStatusNotFound)
+				return
+			}
 		}
 	case RecipientTypeUser:
 		if msg.Recipient.UserId != "" {
@@ -1498,11 +2864,7 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 	response := &ServerMessage{
 		Type: "control",
 		Control: &ControlServerMessage{
-			Sender: &MessageServerMessageSender{
-				Type:      msg.Recipient.Type,
-				SessionId: session.PublicId(),
-				UserId:    session.UserId(),
-			},
+			Sender:    session.GetMessageSender(msg.Recipient.Type),
 			Recipient: serverRecipient,
 			Data:      msg.Data,
 		},
@@ -1522,157 +2884,588 @@ func (h *Hub) processInternalMsg(client *Client, message *ClientMessage) {
 	if session == nil {
 		// Client is not connected yet.
 		return
-	} else if session.ClientType() != HelloClientTypeInternal {
-		log.Printf("Ignore internal message %+v from %s", msg, session.PublicId())
+	} else if session.ClientType() != HelloClientTypeInternal {
+		log.Printf("Ignore internal message %+v from %s", msg, session.PublicId())
+		return
+	}
+
+	switch msg.Type {
+	case "addsession":
+		msg := msg.AddSession
+		room := h.getRoomForBackend(msg.RoomId, session.Backend())
+		if room == nil {
+			log.Printf("Ignore add session message %+v for invalid room %s from %s", *msg, msg.RoomId, session.PublicId())
+			return
+		}
+
+		sessionIdData := h.newSessionIdData(session.Backend())
+		privateSessionId, err := h.encodeSessionId(sessionIdData, privateSessionName)
+		if err != nil {
+			log.Printf("Could not encode private virtual session id: %s", err)
+			return
+		}
+		publicSessionId, err := h.encodeSessionId(sessionIdData, publicSessionName)
+		if err != nil {
+			log.Printf("Could not encode public virtual session id: %s", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+		defer cancel()
+
+		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
+
+		if msg.Options != nil {
+			request := NewBackendClientRoomRequest(room.Id(), msg.UserId, publicSessionId)
+			request.Room.ActorId = msg.Options.ActorId
+			request.Room.ActorType = msg.Options.ActorType
+			request.Room.InCall = FlagInCall | FlagWithPhone
+
+			var response BackendClientResponse
+			if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
+				log.Printf("Could not join virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
+				reply := message.NewErrorServerMessage(NewError(ErrorCodeAddFailed, "Could not join virtual session."))
+				session.SendMessage(reply)
+				return
+			}
+
+			if response.Type == "error" {
+				log.Printf("Could not join virtual session %s at backend %s: %+v", virtualSessionId, session.BackendUrl(), response.Error)
+				reply := message.NewErrorServerMessage(NewError(ErrorCodeAddFailed, response.Error.Error()))
+				session.SendMessage(reply)
+				return
+			}
+		} else {
+			request := NewBackendClientSessionRequest(room.Id(), "add", publicSessionId, msg)
+			var response BackendClientSessionResponse
+			if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
+				log.Printf("Could not add virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
+				reply := message.NewErrorServerMessage(NewErrorCode(ErrorCodeAddFailed))
+				session.SendMessage(reply)
+				return
+			}
+		}
+
+		sess := NewVirtualSession(session, privateSessionId, publicSessionId, sessionIdData, msg)
+		h.mu.Lock()
+		h.sessions[sessionIdData.Sid] = sess
+		h.virtualSessions[virtualSessionId] = sessionIdData.Sid
+		h.addBackendSessionLocked(sess)
+		h.mu.Unlock()
+		statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
+		statsHubSessionsTotal.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
+		log.Printf("Session %s added virtual session %s with initial flags %d", session.PublicId(), sess.PublicId(), sess.Flags())
+		session.AddVirtualSession(sess)
+		sess.SetRoom(room)
+		room.AddSession(sess, nil)
+	case "updatesession":
+		msg := msg.UpdateSession
+		room := h.getRoomForBackend(msg.RoomId, session.Backend())
+		if room == nil {
+			log.Printf("Ignore remove session message %+v for invalid room %s from %s", *msg, msg.RoomId, session.PublicId())
+			return
+		}
+
+		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
+		h.mu.Lock()
+		sid, found := h.virtualSessions[virtualSessionId]
+		if !found {
+			h.mu.Unlock()
+			return
+		}
+
+		sess := h.sessions[sid]
+		h.mu.Unlock()
+		if sess != nil {
+			update := false
+			if virtualSession, ok := sess.(*VirtualSession); ok {
+				if msg.User != nil {
+					previous := newSessionEntry(virtualSession)
+					if virtualSession.SetUserData(msg.User) {
+						room.PublishSessionChanged(virtualSession, previous)
+					}
+				}
+				if msg.Flags != nil {
+					if virtualSession.SetFlags(*msg.Flags) {
+						update = true
+					}
+				}
+			} else {
+				log.Printf("Ignore update request for non-virtual session %s", sess.PublicId())
+			}
+			if update {
+				room.NotifySessionChanged(sess)
+			}
+		}
+	case "removesession":
+		msg := msg.RemoveSession
+		room := h.getRoomForBackend(msg.RoomId, session.Backend())
+		if room == nil {
+			log.Printf("Ignore remove session message %+v for invalid room %s from %s", *msg, msg.RoomId, session.PublicId())
+			return
+		}
+
+		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
+		h.mu.Lock()
+		sid, found := h.virtualSessions[virtualSessionId]
+		if !found {
+			h.mu.Unlock()
+			return
+		}
+
+		delete(h.virtualSessions, virtualSessionId)
+		sess := h.sessions[sid]
+		h.mu.Unlock()
+		if sess != nil {
+			log.Printf("Session %s removed virtual session %s", session.PublicId(), sess.PublicId())
+			if vsess, ok := sess.(*VirtualSession); ok {
+				// We should always have a VirtualSession here.
+				vsess.closeWithReason(LeaveReasonLeft, session, message)
+			} else {
+				sess.Close()
+			}
+		}
+	case "broadcast":
+		h.processInternalBroadcast(session, message, msg.Broadcast)
+	default:
+		log.Printf("Ignore unsupported internal message %+v from %s", msg, session.PublicId())
+		return
+	}
+}
+
+func (h *Hub) processInternalBroadcast(session *ClientSession, message *ClientMessage, msg *BroadcastInternalClientMessage) {
+	var backend *Backend
+	if msg.Backend != "" {
+		if backend = h.lookupBackend(msg.Backend); backend == nil {
+			log.Printf("Ignore broadcast for invalid backend %s from %s", msg.Backend, session.PublicId())
+			session.SendMessage(message.NewErrorServerMessage(NewErrorCode(ErrorCodeInvalidBackend)))
+			return
+		}
+	}
+
+	// The limit is checked again by every server for its own sessions.
+	if _, err := h.getBroadcastSessions(backend, msg); err != nil {
+		log.Printf("Ignore broadcast %+v from %s: %s", *msg, session.PublicId(), err)
+		session.SendMessage(message.NewErrorServerMessage(NewError(ErrorCodeTooManyRecipients, err.Error())))
+		return
+	}
+
+	broadcast := &NatsMessage{
+		SendTime:  time.Now(),
+		Type:      "broadcast",
+		Broadcast: msg,
+	}
+	if err := h.nats.PublishNats(internalBroadcastSubject, broadcast); err != nil {
+		log.Printf("Could not publish broadcast %+v from %s: %s", *msg, session.PublicId(), err)
+		session.SendMessage(message.NewWrappedErrorServerMessage(err))
+		return
+	}
+
+	log.Printf("Session %s broadcasted to backend %s, room %s", session.PublicId(), msg.Backend, msg.RoomId)
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "internal",
+		Internal: &InternalServerMessage{
+			Type: "broadcast",
+		},
+	})
+}
+
+// subscribeBroadcasts subscribes the broadcasts of internal clients that are
+// connected to any server of the cluster.
+func (h *Hub) subscribeBroadcasts() error {
+	h.broadcastReceiver = make(chan *nats.Msg, 64)
+	subscription, err := h.nats.Subscribe(internalBroadcastSubject, h.broadcastReceiver)
+	if err != nil {
+		return err
+	}
+
+	h.broadcastSubscription = subscription
+	return nil
+}
+
+// processNatsBroadcast sends a broadcast received through NATS to the matching
+// sessions of this server.
+func (h *Hub) processNatsBroadcast(msg *nats.Msg) {
+	var message NatsMessage
+	if err := h.nats.Decode(msg, &message); err != nil {
+		log.Printf("Could not decode NATS broadcast %+v: %s", *msg, err)
+		return
+	} else if message.Type != "broadcast" || message.Broadcast == nil {
+		log.Printf("Ignore unsupported NATS broadcast %+v", message)
+		return
+	}
+
+	broadcast := message.Broadcast
+	var backend *Backend
+	if broadcast.Backend != "" {
+		if backend = h.lookupBackend(broadcast.Backend); backend == nil {
+			log.Printf("Ignore broadcast for unknown backend %s", broadcast.Backend)
+			return
+		}
+	}
+
+	sessions, err := h.getBroadcastSessions(backend, broadcast)
+	if err != nil {
+		log.Printf("Ignore broadcast %+v: %s", *broadcast, err)
+		return
+	}
+
+	log.Printf("Broadcasting to %d sessions (backend %s, room %s)", len(sessions), broadcast.Backend, broadcast.RoomId)
+	// Sending to many sessions could take some time, don't block the hub loop.
+	go broadcastMessage(sessions, &ServerMessage{
+		Type: "notify",
+		Notify: &NotifyServerMessage{
+			Type: NotifyTypeBroadcast,
+			Data: broadcast.Data,
+		},
+	})
+}
+
+// getBroadcastSessions returns the client sessions that match the filter of
+// the broadcast. An error is returned if more than MaxBroadcastSessions match.
+func (h *Hub) getBroadcastSessions(backend *Backend, msg *BroadcastInternalClientMessage) ([]*ClientSession, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var sessions []*ClientSession
+	check := func(session Session) error {
+		clientSession, ok := session.(*ClientSession)
+		if !ok || clientSession.ClientType() != HelloClientTypeClient {
+			return nil
+		}
+
+		var roomId string
+		if room := clientSession.GetRoom(); room != nil {
+			roomId = room.Id()
+		}
+		if !msg.MatchesRoom(roomId) {
+			return nil
+		}
+
+		if len(sessions) >= MaxBroadcastSessions {
+			return fmt.Errorf("broadcast would be sent to more than %d sessions", MaxBroadcastSessions)
+		}
+		sessions = append(sessions, clientSession)
+		return nil
+	}
+
+	if backend != nil {
+		for key, backendSessions := range h.backendSessions {
+			if key.backendId != backend.Id() || !msg.MatchesRoom(key.roomId) {
+				continue
+			}
+
+			for session := range backendSessions {
+				if err := check(session); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else {
+		for _, session := range h.sessions {
+			if err := check(session); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sessions, nil
+}
+
+func isAllowedToUpdateTransientData(session Session) bool {
+	if session.ClientType() == HelloClientTypeInternal {
+		// Internal clients are always allowed.
+		return true
+	}
+
+	if session.HasPermission(PERMISSION_TRANSIENT_DATA) {
+		return true
+	}
+
+	return false
+}
+
+func (h *Hub) processCapabilitiesMsg(client *Client, message *ClientMessage) {
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	// Only internal clients may request other backends, see "CheckValid".
+	var backends []string
+	if message.Capabilities != nil {
+		backends = message.Capabilities.Backends
+	}
+
+	capabilities := h.newCapabilities(h.GetServerInfo(session), session.Backend())
+	for _, id := range backends {
+		entry := &CapabilitiesBackendServerMessage{
+			Backend: id,
+		}
+		if backend := h.lookupBackend(id); backend == nil {
+			entry.Error = NewErrorCode(ErrorCodeInvalidBackend)
+		} else {
+			// Return the capabilities that clients of the backend would get.
+			entry.Capabilities = h.newCapabilities(h.getServerInfoForBackend(h.info, backend), backend)
+		}
+		capabilities.Backends = append(capabilities.Backends, entry)
+	}
+
+	response := &ServerMessage{
+		Id:           message.Id,
+		Type:         "capabilities",
+		Capabilities: capabilities,
+	}
+	session.SendMessage(response)
+}
+
+func (h *Hub) newCapabilities(info *HelloServerMessageServer, backend *Backend) *CapabilitiesServerMessage {
+	capabilities := &CapabilitiesServerMessage{
+		Version:        info.Version,
+		Features:       info.Features,
+		MaxMessageSize: maxMessageSize,
+		Codecs:         h.getCodecs(info),
+	}
+	if backend != nil {
+		capabilities.MaxStreamBitrate = backend.maxStreamBitrate
+		capabilities.MaxScreenBitrate = backend.maxScreenBitrate
+		capabilities.SessionLimit = backend.sessionLimit
+		capabilities.MaxParticipants = backend.MaxParticipants()
+	}
+	return capabilities
+}
+
+// lookupBackend returns the backend with the given id or url, or nil if no
+// such backend is configured.
+func (h *Hub) lookupBackend(idOrUrl string) *Backend {
+	for _, backend := range h.backend.GetBackends() {
+		if backend.Id() == idOrUrl {
+			return backend
+		}
+	}
+
+	if !strings.Contains(idOrUrl, "://") {
+		return nil
+	}
+
+	u, err := url.Parse(idOrUrl)
+	if err != nil {
+		return nil
+	}
+
+	return h.backend.GetBackend(u)
+}
+
+// getCodecs returns the codecs of the MCU if it is available with the given
+// server information. The lists are empty (but not nil) otherwise.
+func (h *Hub) getCodecs(info *HelloServerMessageServer) *CapabilitiesCodecs {
+	result := &CapabilitiesCodecs{
+		Audio: []string{},
+		Video: []string{},
+	}
+	if h.mcu == nil {
+		return result
+	}
+
+	for _, f := range info.Features {
+		if f == ServerFeatureMcu {
+			codecs := h.mcu.Codecs()
+			result.Audio = append(result.Audio, codecs.Audio...)
+			result.Video = append(result.Video, codecs.Video...)
+			break
+		}
+	}
+	return result
+}
+
+func (h *Hub) processEchoMsg(client *Client, message *ClientMessage) {
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	response := &ServerMessage{
+		Id:   message.Id,
+		Type: "echo",
+		Echo: &EchoServerMessage{
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		},
+	}
+	if message.Echo != nil {
+		response.Echo.Data = message.Echo.Data
+	}
+	session.SendMessage(response)
+}
+
+func (h *Hub) processKickMsg(client *Client, message *ClientMessage) {
+	msg := message.Kick
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeNotInRoom))
+		session.SendMessage(response)
+		return
+	}
+
+	if session.IsObserver() {
+		sendNotAllowed(session, message, "Observers may not kick sessions.")
+		return
+	} else if !isAllowedToControl(session) {
+		sendNotAllowed(session, message, "Not allowed to kick sessions.")
+		return
+	} else if msg.SessionId == session.PublicId() {
+		sendNotAllowed(session, message, "Not allowed to kick own session.")
 		return
 	}
 
-	switch msg.Type {
-	case "addsession":
-		msg := msg.AddSession
-		room := h.getRoomForBackend(msg.RoomId, session.Backend())
-		if room == nil {
-			log.Printf("Ignore add session message %+v for invalid room %s from %s", *msg, msg.RoomId, session.PublicId())
+	// Only sessions in the same room may be kicked.
+	target := h.GetSessionByPublicId(msg.SessionId)
+	if target == nil {
+		// The session might be connected to a different server which checks
+		// the room of the session.
+		data := h.decodeSessionId(msg.SessionId, publicSessionName)
+		if data == nil || data.BackendId != session.Backend().Id() {
+			session.SendMessage(message.NewErrorServerMessage(NoSuchKickSession))
 			return
 		}
 
-		sessionIdData := h.newSessionIdData(session.Backend())
-		privateSessionId, err := h.encodeSessionId(sessionIdData, privateSessionName)
-		if err != nil {
-			log.Printf("Could not encode private virtual session id: %s", err)
-			return
+		log.Printf("Session %s kicks remote session %s from room %s", session.PublicId(), msg.SessionId, room.Id())
+		kick := &NatsMessage{
+			SendTime: time.Now(),
+			Type:     "kick",
+			Kick: &NatsKickMessage{
+				RoomId: room.Id(),
+				Reason: msg.Reason,
+			},
 		}
-		publicSessionId, err := h.encodeSessionId(sessionIdData, publicSessionName)
-		if err != nil {
-			log.Printf("Could not encode public virtual session id: %s", err)
-			return
+		if err := h.nats.PublishNats("session."+msg.SessionId, kick); err != nil {
+			log.Printf("Could not send kick to remote session %s: %s", msg.SessionId, err)
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
 		}
+		return
+	} else if target.GetRoom() != room {
+		session.SendMessage(message.NewErrorServerMessage(NoSuchKickSession))
+		return
+	} else if target.ClientType() == HelloClientTypeInternal {
+		sendNotAllowed(session, message, "Not allowed to kick internal sessions.")
+		return
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
-		defer cancel()
-
-		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
-
-		if msg.Options != nil {
-			request := NewBackendClientRoomRequest(room.Id(), msg.UserId, publicSessionId)
-			request.Room.ActorId = msg.Options.ActorId
-			request.Room.ActorType = msg.Options.ActorType
-			request.Room.InCall = FlagInCall | FlagWithPhone
+	log.Printf("Session %s kicks session %s from room %s", session.PublicId(), msg.SessionId, room.Id())
+	if err := h.KickSession(msg.SessionId, msg.Reason); err != nil {
+		session.SendMessage(message.NewWrappedErrorServerMessage(err))
+	}
+}
 
-			var response BackendClientResponse
-			if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
-				log.Printf("Could not join virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
-				reply := message.NewErrorServerMessage(NewError("add_failed", "Could not join virtual session."))
-				session.SendMessage(reply)
-				return
-			}
+func (h *Hub) processMoveMsg(client *Client, message *ClientMessage) {
+	msg := message.Move
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
 
-			if response.Type == "error" {
-				log.Printf("Could not join virtual session %s at backend %s: %+v", virtualSessionId, session.BackendUrl(), response.Error)
-				reply := message.NewErrorServerMessage(NewError("add_failed", response.Error.Error()))
-				session.SendMessage(reply)
-				return
-			}
-		} else {
-			request := NewBackendClientSessionRequest(room.Id(), "add", publicSessionId, msg)
-			var response BackendClientSessionResponse
-			if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
-				log.Printf("Could not add virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
-				reply := message.NewErrorServerMessage(NewError("add_failed", "Could not add virtual session."))
-				session.SendMessage(reply)
-				return
-			}
-		}
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeNotInRoom))
+		session.SendMessage(response)
+		return
+	}
 
-		sess := NewVirtualSession(session, privateSessionId, publicSessionId, sessionIdData, msg)
-		h.mu.Lock()
-		h.sessions[sessionIdData.Sid] = sess
-		h.virtualSessions[virtualSessionId] = sessionIdData.Sid
-		h.mu.Unlock()
-		statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
-		statsHubSessionsTotal.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
-		log.Printf("Session %s added virtual session %s with initial flags %d", session.PublicId(), sess.PublicId(), sess.Flags())
-		session.AddVirtualSession(sess)
-		sess.SetRoom(room)
-		room.AddSession(sess, nil)
-	case "updatesession":
-		msg := msg.UpdateSession
-		room := h.getRoomForBackend(msg.RoomId, session.Backend())
-		if room == nil {
-			log.Printf("Ignore remove session message %+v for invalid room %s from %s", *msg, msg.RoomId, session.PublicId())
-			return
-		}
+	if !isAllowedToControl(session) {
+		sendNotAllowed(session, message, "Not allowed to move sessions.")
+		return
+	} else if msg.SessionId == session.PublicId() {
+		sendNotAllowed(session, message, "Not allowed to move own session.")
+		return
+	}
 
-		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
-		h.mu.Lock()
-		sid, found := h.virtualSessions[virtualSessionId]
-		if !found {
-			h.mu.Unlock()
-			return
-		}
+	// Only client sessions in the same room may be moved.
+	target, ok := h.GetSessionByPublicId(msg.SessionId).(*ClientSession)
+	if !ok || target.ClientType() != HelloClientTypeClient || target.GetRoom() != room {
+		session.SendMessage(message.NewErrorServerMessage(NoSuchMoveSession))
+		return
+	} else if msg.RoomId == room.Id() {
+		// Session already is in the requested room.
+		sendMoveResponse(session, message)
+		return
+	}
 
-		sess := h.sessions[sid]
-		h.mu.Unlock()
-		if sess != nil {
-			update := false
-			if virtualSession, ok := sess.(*VirtualSession); ok {
-				if msg.Flags != nil {
-					if virtualSession.SetFlags(*msg.Flags) {
-						update = true
-					}
-				}
-			} else {
-				log.Printf("Ignore update request for non-virtual session %s", sess.PublicId())
-			}
-			if update {
-				room.NotifySessionChanged(sess)
-			}
-		}
-	case "removesession":
-		msg := msg.RemoveSession
-		room := h.getRoomForBackend(msg.RoomId, session.Backend())
-		if room == nil {
-			log.Printf("Ignore remove session message %+v for invalid room %s from %s", *msg, msg.RoomId, session.PublicId())
-			return
-		}
+	// The moved session must join the room itself, so the backend knows about
+	// the room session in the new room and the session is subject to the same
+	// checks and limits as when switching rooms on its own.
+	log.Printf("Session %s moves session %s from room %s to %s", session.PublicId(), target.PublicId(), room.Id(), msg.RoomId)
+	target.SendMessage(&ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "switchto",
+			SwitchTo: &RoomSwitchToServerMessage{
+				RoomId: msg.RoomId,
+			},
+		},
+	})
 
-		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
-		h.mu.Lock()
-		sid, found := h.virtualSessions[virtualSessionId]
-		if !found {
-			h.mu.Unlock()
-			return
-		}
+	sendMoveResponse(session, message)
+}
 
-		delete(h.virtualSessions, virtualSessionId)
-		sess := h.sessions[sid]
-		h.mu.Unlock()
-		if sess != nil {
-			log.Printf("Session %s removed virtual session %s", session.PublicId(), sess.PublicId())
-			if vsess, ok := sess.(*VirtualSession); ok {
-				// We should always have a VirtualSession here.
-				vsess.CloseWithFeedback(session, message)
-			} else {
-				sess.Close()
-			}
-		}
-	default:
-		log.Printf("Ignore unsupported internal message %+v from %s", msg, session.PublicId())
-		return
-	}
+// sendMoveResponse confirms to the moderator that the session was instructed
+// to move.
+func sendMoveResponse(session *ClientSession, message *ClientMessage) {
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "move",
+		Move: &MoveServerMessage{
+			SessionId: message.Move.SessionId,
+			RoomId:    message.Move.RoomId,
+		},
+	})
 }
 
-func isAllowedToUpdateTransientData(session Session) bool {
-	if session.ClientType() == HelloClientTypeInternal {
-		// Internal clients are always allowed.
-		return true
+// KickSession disconnects the session with the given public id. Client
+// sessions receive a "bye" message with the given reason, virtual sessions are
+// removed from the backend. The room of the session is notified about the
+// kicked session.
+func (h *Hub) KickSession(sessionId string, reason string) error {
+	session := h.GetSessionByPublicId(sessionId)
+	if session == nil {
+		return NoSuchKickSession
 	}
 
-	if session.HasPermission(PERMISSION_TRANSIENT_DATA) {
-		return true
+	if room := session.GetRoom(); room != nil {
+		room.PublishSessionKicked(session, reason)
 	}
 
-	return false
+	log.Printf("Kicking session %s (%s)", session.PublicId(), reason)
+	switch s := session.(type) {
+	case *ClientSession:
+		s.LeaveRoom(true, LeaveReasonKicked)
+		if client := s.GetClient(); client != nil {
+			client.SendMessage(&ServerMessage{
+				Type: "bye",
+				Bye: &ByeServerMessage{
+					Reason:  ByeCodeKicked,
+					Message: reason,
+				},
+			})
+		}
+		s.Close()
+	case *VirtualSession:
+		// The backend must be notified about the removed virtual session, so
+		// it still needs its room when closing.
+		s.closeWithReason(LeaveReasonKicked, nil, nil)
+	default:
+		session.LeaveRoom(true, LeaveReasonKicked)
+		session.Close()
+	}
+	return nil
 }
 
 func (h *Hub) processTransientMsg(client *Client, message *ClientMessage) {
@@ -1685,11 +3478,16 @@ func (h *Hub) processTransientMsg(client *Client, message *ClientMessage) {
 
 	room := session.GetRoom()
 	if room == nil {
-		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeNotInRoom))
 		session.SendMessage(response)
 		return
 	}
 
+	if session.IsObserver() && (msg.Type == "set" || msg.Type == "remove") {
+		sendNotAllowed(session, message, "Observers may not update transient data.")
+		return
+	}
+
 	switch msg.Type {
 	case "set":
 		if !isAllowedToUpdateTransientData(session) {
@@ -1700,7 +3498,7 @@ func (h *Hub) processTransientMsg(client *Client, message *ClientMessage) {
 		if msg.Value == nil {
 			room.SetTransientData(msg.Key, nil)
 		} else {
-			room.SetTransientData(msg.Key, *msg.Value)
+			room.SetTransientDataTTL(msg.Key, *msg.Value, msg.GetTTL())
 		}
 	case "remove":
 		if !isAllowedToUpdateTransientData(session) {
@@ -1710,23 +3508,100 @@ func (h *Hub) processTransientMsg(client *Client, message *ClientMessage) {
 
 		room.RemoveTransientData(msg.Key)
 	default:
-		response := message.NewErrorServerMessage(NewError("ignored", "Unsupported message type."))
+		response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeIgnored))
+		session.SendMessage(response)
+	}
+}
+
+func (h *Hub) processPresenceMsg(client *Client, message *ClientMessage) {
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeNotInRoom))
+		session.SendMessage(response)
+		return
+	}
+
+	if session.IsObserver() {
+		sendNotAllowed(session, message, "Observers may not update their presence.")
+		return
+	}
+
+	// Presence updates are not persisted and not confirmed, repeated updates
+	// with the same state are dropped.
+	if !session.UpdatePresence(room, message.Presence.State, time.Now()) {
+		return
+	}
+
+	room.PublishPresence(session, message.Presence.State)
+}
+
+// processParticipantsMsg sends the sessions that are currently in the room of
+// the session as a "snapshot" event, e.g. so clients can recover their state
+// without rejoining the room.
+func (h *Hub) processParticipantsMsg(client *Client, message *ClientMessage) {
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil || room.Id() != message.Participants.RoomId {
+		response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeNotInRoom))
 		session.SendMessage(response)
+		return
+	}
+
+	msg := &ServerMessage{
+		Id:   message.Id,
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "snapshot",
+			Join:   room.GetSessionEntries(),
+		},
+	}
+	for _, m := range h.splitEvent(msg) {
+		session.SendMessage(m)
 	}
 }
 
 func sendNotAllowed(session *ClientSession, message *ClientMessage, reason string) {
-	response := message.NewErrorServerMessage(NewError("not_allowed", reason))
+	response := message.NewErrorServerMessage(NewError(ErrorCodeNotAllowed, reason))
 	session.SendMessage(response)
 }
 
 func sendMcuClientNotFound(session *ClientSession, message *ClientMessage) {
-	response := message.NewErrorServerMessage(NewError("client_not_found", "No MCU client found to send message to."))
+	response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeClientNotFound))
+	session.SendMessage(response)
+}
+
+func sendMcuUnavailable(session *ClientSession, message *ClientMessage) {
+	response := message.NewErrorServerMessage(NewRetryableError(ErrorCodeMcuUnavailable, ""))
+	session.SendMessage(response)
+}
+
+func sendMcuTimeout(session *ClientSession, message *ClientMessage) {
+	response := message.NewErrorServerMessage(NewRetryableError(ErrorCodeTimeout, ""))
 	session.SendMessage(response)
 }
 
+// isMcuUnavailableError returns true if the error is caused by the MCU not
+// being able to accept new clients (e.g. because it is not connected or has
+// no capacity left) instead of the request being invalid.
+func isMcuUnavailableError(err error) bool {
+	return errors.Is(err, ErrNotConnected) ||
+		errors.Is(err, ErrMcuUnavailable)
+}
+
 func sendMcuProcessingFailed(session *ClientSession, message *ClientMessage) {
-	response := message.NewErrorServerMessage(NewError("processing_failed", "Processing of the message failed, please check server logs."))
+	response := message.NewErrorServerMessage(NewErrorCode(ErrorCodeProcessingFailed))
 	session.SendMessage(response)
 }
 
@@ -1758,6 +3633,30 @@ func (h *Hub) isInSameCall(senderSession *ClientSession, recipientSessionId stri
 	return true
 }
 
+// notifyPublisherChanged asks the local sessions that subscribed the given
+// stream of a publisher to renegotiate.
+func (h *Hub) notifyPublisherChanged(publisherId string, streamType string) {
+	h.mu.RLock()
+	var sessions []*ClientSession
+	var subscribers []McuSubscriber
+	for _, session := range h.sessions {
+		clientSession, ok := session.(*ClientSession)
+		if !ok {
+			continue
+		}
+
+		if subscriber := clientSession.GetSubscriber(publisherId, streamType); subscriber != nil {
+			sessions = append(sessions, clientSession)
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	h.mu.RUnlock()
+
+	for idx, session := range sessions {
+		session.OnRenegotiate(subscribers[idx], RenegotiateReasonPublisherChanged)
+	}
+}
+
 func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSession, client_message *ClientMessage, message *MessageClientMessage, data *MessageClientMessageData) {
 	ctx, cancel := context.WithTimeout(context.Background(), h.mcuTimeout)
 	defer cancel()
@@ -1765,6 +3664,8 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 	var mc McuClient
 	var err error
 	var clientType string
+	// changed is set if an existing publisher sent a new offer.
+	var changed bool
 	switch data.Type {
 	case "requestoffer":
 		if session.PublicId() == message.Recipient.SessionId {
@@ -1788,6 +3689,7 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 		mc, err = session.GetOrCreateSubscriber(ctx, h.mcu, message.Recipient.SessionId, data.RoomType)
 	case "offer":
 		clientType = "publisher"
+		changed = session.GetPublisher(data.RoomType) != nil
 		mc, err = session.GetOrCreatePublisher(ctx, h.mcu, data.RoomType, data)
 		if err, ok := err.(*PermissionError); ok {
 			log.Printf("Session %s is not allowed to offer %s, ignoring (%s)", session.PublicId(), data.RoomType, err)
@@ -1824,7 +3726,13 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 	}
 	if err != nil {
 		log.Printf("Could not create MCU %s for session %s to send %+v to %s: %s", clientType, session.PublicId(), data, message.Recipient.SessionId, err)
-		sendMcuClientNotFound(senderSession, client_message)
+		if errors.Is(err, context.DeadlineExceeded) {
+			sendMcuTimeout(senderSession, client_message)
+		} else if isMcuUnavailableError(err) {
+			sendMcuUnavailable(senderSession, client_message)
+		} else {
+			sendMcuClientNotFound(senderSession, client_message)
+		}
 		return
 	} else if mc == nil {
 		log.Printf("No MCU %s found for session %s to send %+v to %s", clientType, session.PublicId(), data, message.Recipient.SessionId)
@@ -1832,59 +3740,75 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 		return
 	}
 
-	mc.SendMessage(context.TODO(), message, data, func(err error, response map[string]interface{}) {
+	// The message is processed asynchronously, so it needs its own context
+	// that is not cancelled when this function returns.
+	msgCtx, msgCancel := context.WithTimeout(context.Background(), h.mcuTimeout)
+	mc.SendMessage(msgCtx, message, data, func(err error, response map[string]interface{}) {
+		defer msgCancel()
 		if err != nil {
 			log.Printf("Could not send MCU message %+v for session %s to %s: %s", data, session.PublicId(), message.Recipient.SessionId, err)
-			sendMcuProcessingFailed(senderSession, client_message)
+			if errors.Is(err, context.DeadlineExceeded) {
+				sendMcuTimeout(senderSession, client_message)
+			} else {
+				sendMcuProcessingFailed(senderSession, client_message)
+			}
 			return
-		} else if response == nil {
+		}
+
+		if message.RequestReceipt {
+			sendMessageReceipt(senderSession, client_message, ReceiptStatusProcessed)
+		}
+		if changed {
+			h.notifyPublisherChanged(session.PublicId(), data.RoomType)
+		}
+		if response == nil {
 			// No response received
 			return
 		}
 
-		h.sendMcuMessageResponse(session, message, data, response)
+		if err := h.sendMcuMessageResponse(session, message, data, response); err != nil {
+			sendMcuProcessingFailed(senderSession, client_message)
+		}
 	})
 }
 
-func (h *Hub) sendMcuMessageResponse(session *ClientSession, message *MessageClientMessage, data *MessageClientMessageData, response map[string]interface{}) {
+func (h *Hub) sendMcuMessageResponse(session *ClientSession, message *MessageClientMessage, data *MessageClientMessageData, response map[string]interface{}) error {
 	var response_message *ServerMessage
 	switch response["type"] {
 	case "answer":
-		answer_message := &AnswerOfferMessage{
-			To:       session.PublicId(),
-			From:     session.PublicId(),
-			Type:     "answer",
-			RoomType: data.RoomType,
-			Payload:  response,
+		sdp, _ := response["sdp"].(string)
+		answer_message, err := NewAnswer(session.PublicId(), session.PublicId(), data.RoomType, sdp)
+		if err != nil {
+			log.Printf("Invalid answer %+v to %s: %s", response, session.PublicId(), err)
+			return err
 		}
+		// Forward the complete payload, the MCU might send additional fields.
+		answer_message.Payload = response
 		answer_data, err := json.Marshal(answer_message)
 		if err != nil {
 			log.Printf("Could not serialize answer %+v to %s: %s", answer_message, session.PublicId(), err)
-			return
+			return err
 		}
 		response_message = &ServerMessage{
 			Type: "message",
 			Message: &MessageServerMessage{
-				Sender: &MessageServerMessageSender{
-					Type:      "session",
-					SessionId: session.PublicId(),
-					UserId:    session.UserId(),
-				},
-				Data: (*json.RawMessage)(&answer_data),
+				Sender: session.GetMessageSender(RecipientTypeSession),
+				Data:   (*json.RawMessage)(&answer_data),
 			},
 		}
 	case "offer":
-		offer_message := &AnswerOfferMessage{
-			To:       session.PublicId(),
-			From:     message.Recipient.SessionId,
-			Type:     "offer",
-			RoomType: data.RoomType,
-			Payload:  response,
+		sdp, _ := response["sdp"].(string)
+		offer_message, err := NewOffer(session.PublicId(), message.Recipient.SessionId, data.RoomType, sdp)
+		if err != nil {
+			log.Printf("Invalid offer %+v to %s: %s", response, session.PublicId(), err)
+			return err
 		}
+		// Forward the complete payload, the MCU might send additional fields.
+		offer_message.Payload = response
 		offer_data, err := json.Marshal(offer_message)
 		if err != nil {
 			log.Printf("Could not serialize offer %+v to %s: %s", offer_message, session.PublicId(), err)
-			return
+			return err
 		}
 		response_message = &ServerMessage{
 			Type: "message",
@@ -1899,23 +3823,31 @@ func (h *Hub) sendMcuMessageResponse(session *ClientSession, message *MessageCli
 		}
 	default:
 		log.Printf("Unsupported response %+v received to send to %s", response, session.PublicId())
-		return
+		return nil
 	}
 
 	if response_message != nil {
 		session.SendMessage(response_message)
 	}
+	return nil
 }
 
 func (h *Hub) processByeMsg(client *Client, message *ClientMessage) {
 	client.SendByeResponse(message)
 	if session := h.processUnregister(client); session != nil {
-		session.Close()
+		session.CloseWithReason(LeaveReasonLeft)
 	}
 }
 
 func (h *Hub) processRoomUpdated(message *BackendServerRoomRequest) {
 	room := message.room
+	if message.Update.Properties == nil && message.Update.PropertiesPatch != nil {
+		if err := room.PatchProperties(message.Update.PropertiesPatch); err != nil {
+			log.Printf("Could not patch properties of room %s: %s", room.Id(), err)
+		}
+		return
+	}
+
 	room.UpdateProperties(message.Update.Properties)
 }
 
@@ -1924,7 +3856,7 @@ func (h *Hub) processRoomDeleted(message *BackendServerRoomRequest) {
 	sessions := room.Close()
 	for _, session := range sessions {
 		// The session is no longer in the room
-		session.LeaveRoom(true)
+		session.LeaveRoom(true, LeaveReasonLeft)
 		switch sess := session.(type) {
 		case *ClientSession:
 			if client := sess.GetClient(); client != nil {
@@ -1936,7 +3868,7 @@ func (h *Hub) processRoomDeleted(message *BackendServerRoomRequest) {
 
 func (h *Hub) processRoomInCallChanged(message *BackendServerRoomRequest) {
 	room := message.room
-	room.PublishUsersInCallChanged(message.InCall.Changed, message.InCall.Users)
+	room.PublishUsersInCallChangedWithState(message.InCall.InCall, message.InCall.Changed, message.InCall.Users)
 }
 
 func (h *Hub) processRoomParticipants(message *BackendServerRoomRequest) {
@@ -1960,22 +3892,10 @@ func (h *Hub) GetStats() map[string]interface{} {
 	return result
 }
 
-func getRealUserIP(r *http.Request) string {
-	// Note this function assumes it is running behind a trusted proxy, so
-	// the headers can be trusted.
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
-	}
-
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// Result could be a list "clientip, proxy1, proxy2", so only use first element.
-		if pos := strings.Index(ip, ","); pos >= 0 {
-			ip = strings.TrimSpace(ip[:pos])
-		}
-		return ip
-	}
-
-	return r.RemoteAddr
+// getRealUserIP returns the address of the client that sent the request,
+// forwarding headers are only used if they were set by a trusted proxy.
+func (h *Hub) getRealUserIP(r *http.Request) string {
+	return h.getTrustedProxies().GetClientIP(r)
 }
 
 func (h *Hub) lookupClientCountry(client *Client) string {
@@ -2007,7 +3927,7 @@ func (h *Hub) lookupClientCountry(client *Client) string {
 }
 
 func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
-	addr := getRealUserIP(r)
+	addr := h.getRealUserIP(r)
 	agent := r.Header.Get("User-Agent")
 
 	conn, err := h.upgrader.Upgrade(w, r, nil)
@@ -2021,6 +3941,7 @@ func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Could not create client for %s: %s", addr, err)
 		return
 	}
+	client.sharedProxy = h.getTrustedProxies().IsSharedProxy(r)
 
 	if h.geoip != nil {
 		client.OnLookupCountry = h.lookupClientCountry
@@ -56,12 +56,19 @@ var (
 		Name:      "sessions_resume_failed_total",
 		Help:      "The total number of failed session resume requests",
 	})
+	statsHubSessionsAddressLimitExceededTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "hub",
+		Name:      "sessions_address_limit_exceeded_total",
+		Help:      "The total number of sessions rejected because too many sessions were connected from the same address",
+	}, []string{"backend"})
 
 	hubStats = []prometheus.Collector{
 		statsHubRoomsCurrent,
 		statsHubSessionsCurrent,
 		statsHubSessionsTotal,
 		statsHubSessionResumeFailed,
+		statsHubSessionsAddressLimitExceededTotal,
 	}
 )
 
@@ -24,11 +24,14 @@ package signaling
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -38,6 +41,8 @@ import (
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const (
@@ -255,25 +260,101 @@ func processAuthRequest(t *testing.T, w http.ResponseWriter, r *http.Request, re
 	response := &BackendClientResponse{
 		Type: "auth",
 		Auth: &BackendClientAuthResponse{
-			Version: BackendVersion,
-			UserId:  params.UserId,
+			Version:  BackendVersion,
+			UserId:   params.UserId,
+			Observer: params.Observer,
 		},
 	}
+	if params.UserId != "" {
+		userdata := json.RawMessage(fmt.Sprintf("{\"displayname\":\"Name of %s\"}", params.UserId))
+		response.Auth.User = &userdata
+	}
 	return response
 }
 
+// takeoverRoomSessionLeaves counts the "leave" requests of the sessions in
+// testcase "TestClientTakeoverRoomSession".
+var takeoverRoomSessionLeaves int32
+
+// recordedRoomRequests contains the room requests of rooms starting with
+// "test-room-record" as "action:roomid:sessionid".
+var (
+	recordedRoomRequestsLock sync.Mutex
+	recordedRoomRequests     []string
+)
+
+func getRecordedRoomRequests(roomIdPrefix string) []string {
+	recordedRoomRequestsLock.Lock()
+	defer recordedRoomRequestsLock.Unlock()
+
+	var result []string
+	for _, request := range recordedRoomRequests {
+		if strings.HasPrefix(request, "join:"+roomIdPrefix) || strings.HasPrefix(request, "leave:"+roomIdPrefix) {
+			result = append(result, request)
+		}
+	}
+	return result
+}
+
+// waitForRecordedRoomRequests waits until all expected room requests were
+// recorded and fails if any of the unexpected requests was recorded.
+func waitForRecordedRoomRequests(ctx context.Context, t *testing.T, roomIdPrefix string, expected []string, unexpectedPrefix string) {
+	for {
+		requests := getRecordedRoomRequests(roomIdPrefix)
+		found := 0
+		for _, request := range requests {
+			if unexpectedPrefix != "" && strings.HasPrefix(request, unexpectedPrefix) {
+				t.Fatalf("Expected no request %s, got %+v", unexpectedPrefix, requests)
+			}
+			for _, e := range expected {
+				if request == e {
+					found++
+					break
+				}
+			}
+		}
+		if found >= len(expected) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Expected requests %+v, got %+v", expected, requests)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
 func processRoomRequest(t *testing.T, w http.ResponseWriter, r *http.Request, request *BackendClientRequest) *BackendClientResponse {
 	if request.Type != "room" || request.Room == nil {
 		t.Fatalf("Expected an room backend request, got %+v", request)
 	}
 
+	if strings.HasPrefix(request.Room.RoomId, "test-room-record") {
+		action := request.Room.Action
+		if action == "" {
+			action = "join"
+		}
+		recordedRoomRequestsLock.Lock()
+		recordedRoomRequests = append(recordedRoomRequests, action+":"+request.Room.RoomId+":"+request.Room.SessionId)
+		recordedRoomRequestsLock.Unlock()
+	}
+
 	switch request.Room.RoomId {
 	case "test-room-slow":
 		time.Sleep(100 * time.Millisecond)
 	case "test-room-takeover-room-session":
-		// Additional checks for testcase "TestClientTakeoverRoomSession"
+		// Additional checks for testcase "TestClientTakeoverRoomSession", only
+		// the session that took over the room session may leave.
 		if request.Room.Action == "leave" && request.Room.UserId == "test-userid1" {
-			t.Errorf("Should not receive \"leave\" event for first user, received %+v", request.Room)
+			if atomic.AddInt32(&takeoverRoomSessionLeaves, 1) > 1 {
+				t.Errorf("Should not receive \"leave\" event for first session, received %+v", request.Room)
+			}
+		}
+	case "test-room-unknown":
+		return &BackendClientResponse{
+			Type:  "error",
+			Error: NewErrorCode(ErrorCodeNoSuchRoom),
 		}
 	}
 
@@ -425,6 +506,48 @@ func performHousekeeping(hub *Hub, now time.Time) *sync.WaitGroup {
 	return &wg
 }
 
+func TestHubWithResolver(t *testing.T) {
+	r := mux.NewRouter()
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	nats, err := NewLoopbackNatsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nats.Close()
+
+	config, err := getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse("https://resolved.domain.invalid/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &testBackendResolver{
+		backend: &Backend{
+			id:        "dynamic",
+			url:       u.String(),
+			parsedUrl: u,
+			secret:    testBackendSecret,
+		},
+	}
+	hub, err := NewHubWithResolver(config, nats, r, "no-version", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.backend.Close()
+
+	if backend := hub.backend.GetBackend(u); backend != resolver.backend {
+		t.Errorf("Expected backend %+v, got %+v", resolver.backend, backend)
+	}
+	if configured, _ := url.Parse(server.URL); hub.backend.IsUrlAllowed(configured) {
+		t.Errorf("The configured url %s should not be allowed", configured)
+	}
+}
+
 func TestExpectClientHello(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -449,8 +572,8 @@ func TestExpectClientHello(t *testing.T) {
 	if message2 != nil {
 		t.Fatalf("Received multiple messages, already have %+v, also got %+v", message, message2)
 	}
-	if err := checkUnexpectedClose(err); err != nil {
-		t.Fatal(err)
+	if !websocket.IsCloseError(err, GetByeCloseCode(ByeCodeHelloTimeout)) {
+		t.Fatalf("Expected close code %d, got %+v", GetByeCloseCode(ByeCodeHelloTimeout), err)
 	}
 
 	if err := checkMessageType(message, "bye"); err != nil {
@@ -486,6 +609,78 @@ func TestClientHello(t *testing.T) {
 	}
 }
 
+type fixedTimeSource struct {
+	now time.Time
+}
+
+func (s *fixedTimeSource) Now() time.Time {
+	return s.now
+}
+
+func TestClientHelloServerTime(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	now := time.Date(2023, time.November, 14, 22, 13, 20, 123000000, time.UTC)
+	hub.timeSource = &fixedTimeSource{
+		now: now,
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if hello, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else if expected := int64(1700000000123); hello.Hello.ServerTime != expected {
+		t.Errorf("Expected server time %d, got %+v", expected, hello.Hello)
+	}
+}
+
+func TestClientMessageInvalidId(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &ClientMessage{
+		Id:   strings.Repeat("x", 16*1024),
+		Type: "bye",
+		Bye:  &ByeClientMessage{},
+	}
+	// Write directly, the test client would reject the invalid message.
+	if err := client.conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oversized id is not copied to the error.
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Error(err)
+	} else if message.Id != "" {
+		t.Errorf("Expected no id, got %d bytes", len(message.Id))
+	}
+}
+
 func TestClientHelloWithSpaces(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -548,23 +743,17 @@ func TestClientHelloAllowAll(t *testing.T) {
 	}
 }
 
-func TestClientHelloSessionLimit(t *testing.T) {
+func TestClientCapabilities(t *testing.T) {
 	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
-		config, err := getTestConfig(server)
+		config, err := getTestConfigWithMultipleBackends(server)
 		if err != nil {
 			return nil, err
 		}
 
-		config.RemoveOption("backend", "allowed")
-		config.RemoveOption("backend", "secret")
-		config.AddOption("backend", "backends", "backend1, backend2")
-
-		config.AddOption("backend1", "url", server.URL+"/one")
-		config.AddOption("backend1", "secret", string(testBackendSecret))
-		config.AddOption("backend1", "sessionlimit", "1")
-
-		config.AddOption("backend2", "url", server.URL+"/two")
-		config.AddOption("backend2", "secret", string(testBackendSecret))
+		config.AddOption("backend1", "maxstreambitrate", "1000000")
+		config.AddOption("backend1", "maxscreenbitrate", "2000000")
+		config.AddOption("backend1", "sessionlimit", "10")
+		config.AddOption("backend1", "maxparticipants", "20")
 		return config, nil
 	})
 	defer shutdown()
@@ -575,239 +764,437 @@ func TestClientHelloSessionLimit(t *testing.T) {
 	client := NewTestClient(t, server, hub)
 	defer client.CloseWithBye()
 
-	params1 := TestBackendClientAuthParams{
+	params := TestBackendClientAuthParams{
 		UserId: testDefaultUserId,
 	}
-	if err := client.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+	if err := client.SendHelloParams(server.URL+"/one", "client", params); err != nil {
 		t.Fatal(err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	if hello, err := client.RunUntilHello(ctx); err != nil {
-		t.Error(err)
-	} else {
-		if hello.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
-		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
-		}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
 	}
 
-	// The second client can't connect as it would exceed the session limit.
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-
-	params2 := TestBackendClientAuthParams{
-		UserId: testDefaultUserId + "2",
+	request := &ClientMessage{
+		Id:   "abcd",
+		Type: "capabilities",
 	}
-	if err := client2.SendHelloParams(server.URL+"/one", "client", params2); err != nil {
+	if err := client.WriteJSON(request); err != nil {
 		t.Fatal(err)
 	}
 
-	msg, err := client2.RunUntilMessage(ctx)
+	message, err := client.RunUntilMessage(ctx)
 	if err != nil {
-		t.Error(err)
-	} else {
-		if msg.Type != "error" || msg.Error == nil {
-			t.Errorf("Expected error message, got %+v", msg)
-		} else if msg.Error.Code != "session_limit_exceeded" {
-			t.Errorf("Expected error \"session_limit_exceeded\", got %+v", msg.Error.Code)
-		}
+		t.Fatal(err)
 	}
-
-	// The client can connect to a different backend.
-	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+	if err := checkMessageType(message, "capabilities"); err != nil {
 		t.Fatal(err)
 	}
 
-	if hello, err := client2.RunUntilHello(ctx); err != nil {
-		t.Error(err)
-	} else {
-		if hello.Hello.UserId != testDefaultUserId+"2" {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"2", hello.Hello)
-		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
+	if message.Id != request.Id {
+		t.Errorf("Expected id %s, got %+v", request.Id, message)
+	}
+	capabilities := message.Capabilities
+	if capabilities.Version != hub.info.Version {
+		t.Errorf("Expected version %s, got %+v", hub.info.Version, capabilities)
+	}
+	if !reflect.DeepEqual(capabilities.Features, DefaultFeatures) {
+		t.Errorf("Expected features %+v, got %+v", DefaultFeatures, capabilities.Features)
+	}
+	if capabilities.MaxStreamBitrate != 1000000 {
+		t.Errorf("Expected max stream bitrate 1000000, got %+v", capabilities)
+	}
+	if capabilities.MaxScreenBitrate != 2000000 {
+		t.Errorf("Expected max screen bitrate 2000000, got %+v", capabilities)
+	}
+	if capabilities.SessionLimit != 10 {
+		t.Errorf("Expected session limit 10, got %+v", capabilities)
+	}
+	if capabilities.MaxParticipants != 20 {
+		t.Errorf("Expected max participants 20, got %+v", capabilities)
+	}
+	if capabilities.MaxMessageSize != maxMessageSize {
+		t.Errorf("Expected max message size %d, got %+v", maxMessageSize, capabilities)
+	}
+	// No MCU is configured, so no codecs are available.
+	if codecs := capabilities.Codecs; codecs == nil || codecs.Audio == nil || codecs.Video == nil {
+		t.Errorf("Expected empty codecs, got %+v", codecs)
+	} else if len(codecs.Audio) != 0 || len(codecs.Video) != 0 {
+		t.Errorf("Expected empty codecs, got %+v", codecs)
+	}
+}
+
+func TestClientCapabilitiesBackends(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
 		}
+
+		config.AddOption("backend1", "sessionlimit", "10")
+		config.AddOption("backend2", "features", ServerFeatureCapabilities)
+		return config, nil
+	})
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	request := &ClientMessage{
+		Id:   "abcd",
+		Type: "capabilities",
+		Capabilities: &CapabilitiesClientMessage{
+			Backends: []string{
+				"backend1",
+				server.URL + "/two/",
+				"unknown-backend",
+			},
+		},
+		// Not serialized, the server checks the type of the sending client.
+		fromInternal: true,
 	}
 
-	// If the first client disconnects (and releases the session), a new one can connect.
-	client.CloseWithBye()
-	if err := client.WaitForClientRemoved(ctx); err != nil {
+	// Regular clients may not request capabilities of other backends.
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
 		t.Error(err)
 	}
 
-	client3 := NewTestClient(t, server, hub)
-	defer client3.CloseWithBye()
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloInternalWithBackend(server.URL + "/one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
 
-	params3 := TestBackendClientAuthParams{
-		UserId: testDefaultUserId + "3",
+	message, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := client3.SendHelloParams(server.URL+"/one", "client", params3); err != nil {
+	if err := checkMessageType(message, "capabilities"); err != nil {
 		t.Fatal(err)
 	}
 
-	if hello, err := client3.RunUntilHello(ctx); err != nil {
-		t.Error(err)
+	backends := message.Capabilities.Backends
+	if len(backends) != 3 {
+		t.Fatalf("Expected 3 backends, got %+v", backends)
+	}
+	if entry := backends[0]; entry.Backend != "backend1" || entry.Error != nil || entry.Capabilities == nil {
+		t.Errorf("Expected capabilities of backend1, got %+v", entry)
 	} else {
-		if hello.Hello.UserId != testDefaultUserId+"3" {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"3", hello.Hello)
+		if !reflect.DeepEqual(entry.Capabilities.Features, DefaultFeatures) {
+			t.Errorf("Expected features %+v, got %+v", DefaultFeatures, entry.Capabilities.Features)
 		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
+		if entry.Capabilities.SessionLimit != 10 {
+			t.Errorf("Expected session limit 10, got %+v", entry.Capabilities)
 		}
 	}
+	if entry := backends[1]; entry.Backend != server.URL+"/two/" || entry.Error != nil || entry.Capabilities == nil {
+		t.Errorf("Expected capabilities of backend2, got %+v", entry)
+	} else if expected := []string{ServerFeatureCapabilities}; !reflect.DeepEqual(entry.Capabilities.Features, expected) {
+		t.Errorf("Expected features %+v, got %+v", expected, entry.Capabilities.Features)
+	}
+	if entry := backends[2]; entry.Backend != "unknown-backend" || entry.Capabilities != nil {
+		t.Errorf("Expected error for unknown backend, got %+v", entry)
+	} else if entry.Error == nil || entry.Error.Code != ErrorCodeInvalidBackend {
+		t.Errorf("Expected error %s, got %+v", ErrorCodeInvalidBackend, entry.Error)
+	}
 }
 
-func TestSessionIdsUnordered(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientCapabilitiesBackendsMcuUnavailable(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "fallback", McuFallbackFeatures)
+		return config, nil
+	})
 	defer shutdown()
 
-	publicSessionIds := make([]string, 0)
-	for i := 0; i < 20; i++ {
-		client := NewTestClient(t, server, hub)
-		defer client.CloseWithBye()
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
 
-		if err := client.SendHello(testDefaultUserId); err != nil {
-			t.Fatal(err)
-		}
+	hub.SetMcu(mcu)
+	hub.onMcuDisconnected()
 
-		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-		defer cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
 
-		if hello, err := client.RunUntilHello(ctx); err != nil {
-			t.Error(err)
-		} else {
-			if hello.Hello.UserId != testDefaultUserId {
-				t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
-				break
-			}
-			if hello.Hello.SessionId == "" {
-				t.Errorf("Expected session id, got %+v", hello.Hello)
-				break
-			}
-
-			data := hub.decodeSessionId(hello.Hello.SessionId, publicSessionName)
-			if data == nil {
-				t.Errorf("Could not decode session id: %s", hello.Hello.SessionId)
-				break
-			}
-
-			hub.mu.RLock()
-			session := hub.sessions[data.Sid]
-			hub.mu.RUnlock()
-			if session == nil {
-				t.Errorf("Could not get session for id %+v", data)
-				break
-			}
-
-			publicSessionIds = append(publicSessionIds, session.PublicId())
-		}
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteJSON(&ClientMessage{
+		Id:   "abcd",
+		Type: "capabilities",
+		Capabilities: &CapabilitiesClientMessage{
+			Backends: []string{
+				server.URL,
+			},
+		},
+		// Not serialized, the server checks the type of the sending client.
+		fromInternal: true,
+	}); err != nil {
+		t.Fatal(err)
 	}
 
-	if len(publicSessionIds) == 0 {
-		t.Fatal("no session ids decoded")
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "capabilities"); err != nil {
+		t.Fatal(err)
 	}
 
-	larger := 0
-	smaller := 0
-	prevSid := ""
-	for i, sid := range publicSessionIds {
-		if i > 0 {
-			if sid > prevSid {
-				larger++
-			} else if sid < prevSid {
-				smaller--
-			} else {
-				t.Error("should not have received the same session id twice")
-			}
+	backends := message.Capabilities.Backends
+	if len(backends) != 1 || backends[0].Capabilities == nil {
+		t.Fatalf("Expected capabilities of one backend, got %+v", backends)
+	}
+	for _, f := range backends[0].Capabilities.Features {
+		if isMcuFeature(f) {
+			t.Errorf("should not advertise feature %s while the MCU is unavailable, got %+v", f, backends[0].Capabilities.Features)
 		}
-		prevSid = sid
 	}
-
-	// Public session ids should not be ordered.
-	if len(publicSessionIds) == larger {
-		t.Error("the session ids are all larger than the previous ones")
-	} else if len(publicSessionIds) == smaller {
-		t.Error("the session ids are all smaller than the previous ones")
+	if codecs := backends[0].Capabilities.Codecs; len(codecs.Audio) != 0 || len(codecs.Video) != 0 {
+		t.Errorf("Expected no codecs while the MCU is unavailable, got %+v", codecs)
 	}
 }
 
-func TestClientHelloResume(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientCapabilitiesCodecs(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend2", "features", ServerFeatureCapabilities)
+		return config, nil
+	})
 	defer shutdown()
 
-	client := NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
 
-	if err := client.SendHello(testDefaultUserId); err != nil {
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
 		t.Fatal(err)
 	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello, err := client.RunUntilHello(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if hello.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+	testcases := []struct {
+		url   string
+		audio []string
+		video []string
+	}{
+		{server.URL + "/one", defaultAudioCodecs, defaultVideoCodecs},
+		// The MCU is not available for the second backend.
+		{server.URL + "/two", []string{}, []string{}},
+	}
+	for _, tc := range testcases {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		params := TestBackendClientAuthParams{
+			UserId: testDefaultUserId,
 		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
+		if err := client.SendHelloParams(tc.url, "client", params); err != nil {
+			t.Fatal(err)
 		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
+
+		if _, err := client.RunUntilHello(ctx); err != nil {
+			t.Fatal(err)
 		}
-	}
 
-	client.Close()
-	if err := client.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
-	}
+		request := &ClientMessage{
+			Id:   "abcd",
+			Type: "capabilities",
+		}
+		if err := client.WriteJSON(request); err != nil {
+			t.Fatal(err)
+		}
 
-	client = NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkMessageType(message, "capabilities"); err != nil {
+			t.Fatal(err)
+		}
 
-	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
-		t.Fatal(err)
+		expected := &CapabilitiesCodecs{
+			Audio: tc.audio,
+			Video: tc.video,
+		}
+		if !reflect.DeepEqual(message.Capabilities.Codecs, expected) {
+			t.Errorf("Expected codecs %+v for %s, got %+v", expected, tc.url, message.Capabilities.Codecs)
+		}
 	}
-	hello2, err := client.RunUntilHello(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if hello2.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
+}
+
+func TestClientHelloRequiredFeatures(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
 		}
-		if hello2.Hello.SessionId != hello.Hello.SessionId {
-			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+
+		config.AddOption("clients", "required_features", "foo, bar")
+		// The second backend doesn't require any features.
+		config.AddOption("backend2", "required_features", "")
+		return config, nil
+	})
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	testcases := []struct {
+		url      string
+		features []string
+		missing  []string
+	}{
+		{server.URL + "/one", nil, []string{"foo", "bar"}},
+		{server.URL + "/one", []string{"bar", "baz"}, []string{"foo"}},
+		{server.URL + "/one", []string{"bar", "foo"}, nil},
+		{server.URL + "/two", nil, nil},
+	}
+	for idx, tc := range testcases {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		params, err := json.Marshal(TestBackendClientAuthParams{
+			UserId: testDefaultUserId,
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
-		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
-			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "1234",
+			Type: "hello",
+			Hello: &HelloClientMessage{
+				Version:  HelloVersion,
+				Features: tc.features,
+				Auth: HelloClientMessageAuth{
+					Url:    tc.url,
+					Params: (*json.RawMessage)(&params),
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tc.missing) == 0 {
+			if err := checkMessageType(message, "hello"); err != nil {
+				t.Errorf("Expected hello for %d: %s", idx, err)
+			}
+			continue
+		}
+
+		if err := checkMessageError(message, ErrorCodeMissingRequiredFeature); err != nil {
+			t.Errorf("Expected error for %d: %s", idx, err)
+			continue
+		}
+		var details struct {
+			Features []string `json:"features"`
+		}
+		if data, err := json.Marshal(message.Error.Details); err != nil {
+			t.Error(err)
+		} else if err := json.Unmarshal(data, &details); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(details.Features, tc.missing) {
+			t.Errorf("Expected missing features %+v for %d, got %+v", tc.missing, idx, details.Features)
 		}
 	}
 }
 
-func TestClientHelloResumeExpired(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientHelloSessionLimit(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RemoveOption("backend", "allowed")
+		config.RemoveOption("backend", "secret")
+		config.AddOption("backend", "backends", "backend1, backend2")
+
+		config.AddOption("backend1", "url", server.URL+"/one")
+		config.AddOption("backend1", "secret", string(testBackendSecret))
+		config.AddOption("backend1", "sessionlimit", "1")
+
+		config.AddOption("backend2", "url", server.URL+"/two")
+		config.AddOption("backend2", "secret", string(testBackendSecret))
+		return config, nil
+	})
 	defer shutdown()
 
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
 	client := NewTestClient(t, server, hub)
 	defer client.CloseWithBye()
 
-	if err := client.SendHello(testDefaultUserId); err != nil {
+	params1 := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	if err := client.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
 		t.Fatal(err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello, err := client.RunUntilHello(ctx)
-	if err != nil {
+	if hello, err := client.RunUntilHello(ctx); err != nil {
 		t.Error(err)
 	} else {
 		if hello.Hello.UserId != testDefaultUserId {
@@ -816,278 +1203,312 @@ func TestClientHelloResumeExpired(t *testing.T) {
 		if hello.Hello.SessionId == "" {
 			t.Errorf("Expected session id, got %+v", hello.Hello)
 		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
-		}
-	}
-
-	client.Close()
-	if err := client.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
 	}
 
-	// Perform housekeeping in the future, this will cause the session to be
-	// cleaned up after it is expired.
-	performHousekeeping(hub, time.Now().Add(sessionExpireDuration+time.Second)).Wait()
-
-	client = NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+	// The second client can't connect as it would exceed the session limit.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
 
-	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+	params2 := TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "2",
+	}
+	if err := client2.SendHelloParams(server.URL+"/one", "client", params2); err != nil {
 		t.Fatal(err)
 	}
-	msg, err := client.RunUntilMessage(ctx)
+
+	msg, err := client2.RunUntilMessage(ctx)
 	if err != nil {
 		t.Error(err)
 	} else {
 		if msg.Type != "error" || msg.Error == nil {
 			t.Errorf("Expected error message, got %+v", msg)
-		} else if msg.Error.Code != "no_such_session" {
-			t.Errorf("Expected error \"no_such_session\", got %+v", msg.Error.Code)
+		} else if msg.Error.Code != "session_limit_exceeded" {
+			t.Errorf("Expected error \"session_limit_exceeded\", got %+v", msg.Error.Code)
 		}
 	}
-}
-
-func TestClientHelloResumeTakeover(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
-	defer shutdown()
-
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
 
-	if err := client1.SendHello(testDefaultUserId); err != nil {
+	// The client can connect to a different backend.
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
 		t.Fatal(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
-
-	hello, err := client1.RunUntilHello(ctx)
-	if err != nil {
+	if hello, err := client2.RunUntilHello(ctx); err != nil {
 		t.Error(err)
 	} else {
-		if hello.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		if hello.Hello.UserId != testDefaultUserId+"2" {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"2", hello.Hello)
 		}
 		if hello.Hello.SessionId == "" {
 			t.Errorf("Expected session id, got %+v", hello.Hello)
 		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
-		}
 	}
 
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
+	// If the first client disconnects (and releases the session), a new one can connect.
+	client.CloseWithBye()
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
 
-	if err := client2.SendHelloResume(hello.Hello.ResumeId); err != nil {
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+
+	params3 := TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "3",
+	}
+	if err := client3.SendHelloParams(server.URL+"/one", "client", params3); err != nil {
 		t.Fatal(err)
 	}
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
+
+	if hello, err := client3.RunUntilHello(ctx); err != nil {
 		t.Error(err)
 	} else {
-		if hello2.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
-		}
-		if hello2.Hello.SessionId != hello.Hello.SessionId {
-			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+		if hello.Hello.UserId != testDefaultUserId+"3" {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"3", hello.Hello)
 		}
-		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
-			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
 		}
 	}
+}
 
-	// The first client got disconnected with a reason in a "Bye" message.
-	msg, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if msg.Type != "bye" || msg.Bye == nil {
-			t.Errorf("Expected bye message, got %+v", msg)
-		} else if msg.Bye.Reason != "session_resumed" {
-			t.Errorf("Expected reason \"session_resumed\", got %+v", msg.Bye.Reason)
+func TestClientHelloSessionLimitPerAddress(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	if msg, err := client1.RunUntilMessage(ctx); err == nil {
-		t.Errorf("Expected error but received %+v", msg)
-	} else if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
-		t.Errorf("Expected close error but received %+v", err)
-	}
-}
 
-func TestClientHelloResumeOtherHub(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+		config.AddOption("app", "trustedproxies", "127.0.0.1")
+		config.AddOption("clients", "sessionlimitperaddress", "3")
+		config.AddOption("backend2", "sessionlimitperaddress", "1")
+		return config, nil
+	})
 	defer shutdown()
 
-	client := NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
-
-	if err := client.SendHello(testDefaultUserId); err != nil {
-		t.Fatal(err)
+	header := http.Header{
+		http.CanonicalHeaderKey("x-real-ip"): []string{"1.2.3.4"},
 	}
 
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello, err := client.RunUntilHello(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if hello.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+	// The expected limit is 0 if the session should be able to connect.
+	connect := func(client *TestClient, url string, userId string, expectedLimit int) {
+		t.Helper()
+		params := TestBackendClientAuthParams{
+			UserId: userId,
 		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
+		if err := client.SendHelloParams(url, "client", params); err != nil {
+			t.Fatal(err)
 		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
+
+		var details TooManySessionsErrorDetails
+		if expectedLimit == 0 {
+			if _, err := client.RunUntilHello(ctx); err != nil {
+				t.Error(err)
+			}
+		} else if msg, err := client.RunUntilMessage(ctx); err != nil {
+			t.Error(err)
+		} else if err := checkMessageError(msg, ErrorCodeTooManySessions); err != nil {
+			t.Error(err)
+		} else if err := msg.Error.DecodeDetails(&details); err != nil {
+			t.Error(err)
+		} else if details.Limit != expectedLimit {
+			t.Errorf("Expected limit %d, got %+v", expectedLimit, details)
 		}
 	}
 
-	client.Close()
-	if err := client.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
-	}
+	// All test clients connect from the same address.
+	client1 := NewTestClientWithHeader(t, server, hub, header)
+	defer client1.CloseWithBye()
+	connect(client1, server.URL+"/two", testDefaultUserId+"1", 0)
 
-	// Simulate a restart of the hub.
-	atomic.StoreUint64(&hub.sid, 0)
-	sessions := make([]Session, 0)
-	hub.mu.Lock()
-	for _, session := range hub.sessions {
-		sessions = append(sessions, session)
-	}
-	hub.mu.Unlock()
-	for _, session := range sessions {
-		session.Close()
-	}
-	hub.mu.Lock()
-	count := len(hub.sessions)
-	hub.mu.Unlock()
-	if count > 0 {
-		t.Errorf("Should have removed all sessions (still has %d)", count)
-	}
+	// The second backend only allows one session per address.
+	client2 := NewTestClientWithHeader(t, server, hub, header)
+	defer client2.CloseWithBye()
+	connect(client2, server.URL+"/two", testDefaultUserId+"2", 1)
+	connect(client2, server.URL+"/one", testDefaultUserId+"2", 0)
 
-	// The new client will get the same (internal) sid for his session.
-	newClient := NewTestClient(t, server, hub)
-	defer newClient.CloseWithBye()
+	client3 := NewTestClientWithHeader(t, server, hub, header)
+	defer client3.CloseWithBye()
+	connect(client3, server.URL+"/one", testDefaultUserId+"3", 0)
 
-	if err := newClient.SendHello(testDefaultUserId); err != nil {
+	// The global limit applies to all backends.
+	client4 := NewTestClientWithHeader(t, server, hub, header)
+	defer client4.CloseWithBye()
+	connect(client4, server.URL+"/one", testDefaultUserId+"4", 3)
+
+	// Internal clients are not limited.
+	internal := NewTestClientWithHeader(t, server, hub, header)
+	defer internal.CloseWithBye()
+	if err := internal.SendHelloInternalWithBackend(server.URL + "/one"); err != nil {
 		t.Fatal(err)
 	}
-
-	if hello, err := newClient.RunUntilHello(ctx); err != nil {
+	if _, err := internal.RunUntilHello(ctx); err != nil {
 		t.Error(err)
-	} else {
-		if hello.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
-		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
-		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
-		}
 	}
 
-	// The previous session (which had the same internal sid) can't be resumed.
-	client = NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
-	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
-		t.Fatal(err)
-	}
-	msg, err := client.RunUntilMessage(ctx)
-	if err != nil {
+	// Sessions are released when they disconnect.
+	client1.CloseWithBye()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
 		t.Error(err)
-	} else {
-		if msg.Type != "error" || msg.Error == nil {
-			t.Errorf("Expected error message, got %+v", msg)
-		} else if msg.Error.Code != "no_such_session" {
-			t.Errorf("Expected error \"no_such_session\", got %+v", msg.Error.Code)
-		}
 	}
 
-	// Expire old sessions
-	hub.performHousekeeping(time.Now().Add(2 * sessionExpireDuration))
+	connect(client4, server.URL+"/one", testDefaultUserId+"4", 0)
+
+	// Clients from other addresses are not affected.
+	client5 := NewTestClient(t, server, hub)
+	defer client5.CloseWithBye()
+	connect(client5, server.URL+"/two", testDefaultUserId+"5", 0)
 }
 
-func TestClientHelloResumePublicId(t *testing.T) {
-	// Test that a client can't resume a "public" session of another user.
+func TestClientHelloSessionLimitPerAddressProxy(t *testing.T) {
+	// Use the default configuration where no proxy is trusted.
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
-		t.Fatal(err)
-	}
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
-		t.Fatal(err)
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
+	if hub.sessionLimitPerAddress != defaultSessionLimitPerAddress {
+		t.Fatalf("Expected default limit %d, got %d", defaultSessionLimitPerAddress, hub.sessionLimitPerAddress)
+	}
+
+	headers := []http.Header{
+		// Connections from the local proxy without forwarding headers.
+		nil,
+		// Connections from an untrusted proxy.
+		{http.CanonicalHeaderKey("x-forwarded-for"): []string{"1.2.3.4"}},
+	}
+	var clients []*TestClient
+	defer func() {
+		// Close in parallel, closing waits for the close message to be processed.
+		var wg sync.WaitGroup
+		for _, client := range clients {
+			wg.Add(1)
+			go func(client *TestClient) {
+				defer wg.Done()
+				client.CloseWithBye()
+			}(client)
+		}
+		wg.Wait()
+	}()
+	for _, header := range headers {
+		for i := 0; i <= defaultSessionLimitPerAddress; i++ {
+			client := NewTestClientWithHeader(t, server, hub, header)
+			clients = append(clients, client)
+			if err := client.SendHello(testDefaultUserId + strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.RunUntilHello(ctx); err != nil {
+				t.Fatalf("Session %d with %+v could not connect: %s", i, header, err)
+			}
+		}
 	}
+}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+func TestGetSessionLimitAddress(t *testing.T) {
+	testcases := []struct {
+		addr        string
+		sharedProxy bool
+		expected    string
+	}{
+		{"1.2.3.4", false, "1.2.3.4"},
+		{"1.2.3.4", true, ""},
+		{"127.0.0.1", false, ""},
+		{"::1", false, ""},
+		{"unknown remote address", false, ""},
+	}
+
+	for _, tc := range testcases {
+		client := &Client{
+			addr:        tc.addr,
+			sharedProxy: tc.sharedProxy,
+		}
+		if addr := getSessionLimitAddress(client); addr != tc.expected {
+			t.Errorf("Expected %q for %+v, got %q", tc.expected, tc, addr)
+		}
 	}
+}
 
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
-	}
+func TestSessionIdsUnordered(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
 
-	data := "from-1-to-2"
-	client1.SendMessage(recipient2, data) // nolint
+	publicSessionIds := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
 
-	var payload string
-	var sender *MessageServerMessageSender
-	if err := checkReceiveClientMessageWithSender(ctx, client2, "session", hello1.Hello, &payload, &sender); err != nil {
-		t.Error(err)
-	} else if payload != data {
-		t.Errorf("Expected payload %s, got %s", data, payload)
-	}
+		if err := client.SendHello(testDefaultUserId); err != nil {
+			t.Fatal(err)
+		}
 
-	client1.Close()
-	if err := client1.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
 
-	client1 = NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
+		if hello, err := client.RunUntilHello(ctx); err != nil {
+			t.Error(err)
+		} else {
+			if hello.Hello.UserId != testDefaultUserId {
+				t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+				break
+			}
+			if hello.Hello.SessionId == "" {
+				t.Errorf("Expected session id, got %+v", hello.Hello)
+				break
+			}
 
-	// Can't resume a session with the id received from messages of a client.
-	if err := client1.SendHelloResume(sender.SessionId); err != nil {
-		t.Fatal(err)
+			data := hub.decodeSessionId(hello.Hello.SessionId, publicSessionName)
+			if data == nil {
+				t.Errorf("Could not decode session id: %s", hello.Hello.SessionId)
+				break
+			}
+
+			hub.mu.RLock()
+			session := hub.sessions[data.Sid]
+			hub.mu.RUnlock()
+			if session == nil {
+				t.Errorf("Could not get session for id %+v", data)
+				break
+			}
+
+			publicSessionIds = append(publicSessionIds, session.PublicId())
+		}
 	}
-	msg, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if msg.Type != "error" || msg.Error == nil {
-			t.Errorf("Expected error message, got %+v", msg)
-		} else if msg.Error.Code != "no_such_session" {
-			t.Errorf("Expected error \"no_such_session\", got %+v", msg.Error.Code)
+
+	if len(publicSessionIds) == 0 {
+		t.Fatal("no session ids decoded")
+	}
+
+	larger := 0
+	smaller := 0
+	prevSid := ""
+	for i, sid := range publicSessionIds {
+		if i > 0 {
+			if sid > prevSid {
+				larger++
+			} else if sid < prevSid {
+				smaller--
+			} else {
+				t.Error("should not have received the same session id twice")
+			}
 		}
+		prevSid = sid
 	}
 
-	// Expire old sessions
-	hub.performHousekeeping(time.Now().Add(2 * sessionExpireDuration))
+	// Public session ids should not be ordered.
+	if len(publicSessionIds) == larger {
+		t.Error("the session ids are all larger than the previous ones")
+	} else if len(publicSessionIds) == smaller {
+		t.Error("the session ids are all smaller than the previous ones")
+	}
 }
 
-func TestClientHelloByeResume(t *testing.T) {
+func TestClientHelloResume(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
@@ -1116,21 +1537,7 @@ func TestClientHelloByeResume(t *testing.T) {
 		}
 	}
 
-	if err := client.SendBye(); err != nil {
-		t.Fatal(err)
-	}
-	if message, err := client.RunUntilMessage(ctx); err != nil {
-		t.Error(err)
-	} else {
-		if err := checkMessageType(message, "bye"); err != nil {
-			t.Error(err)
-		}
-	}
-
 	client.Close()
-	if err := client.WaitForSessionRemoved(ctx, hello.Hello.SessionId); err != nil {
-		t.Error(err)
-	}
 	if err := client.WaitForClientRemoved(ctx); err != nil {
 		t.Error(err)
 	}
@@ -1141,19 +1548,165 @@ func TestClientHelloByeResume(t *testing.T) {
 	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
 		t.Fatal(err)
 	}
-	msg, err := client.RunUntilMessage(ctx)
+	hello2, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Error(err)
 	} else {
-		if msg.Type != "error" || msg.Error == nil {
-			t.Errorf("Expected \"error\", got %+v", *msg)
-		} else if msg.Error.Code != "no_such_session" {
-			t.Errorf("Expected error \"no_such_session\", got %+v", *msg)
+		if hello2.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
+		}
+		if hello2.Hello.SessionId != hello.Hello.SessionId {
+			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+		}
+		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
+			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
 		}
 	}
 }
 
-func TestClientHelloResumeAndJoin(t *testing.T) {
+func newResumeGracePeriodTest(ctx context.Context, t *testing.T) (*Hub, *httptest.Server, func(), *TestClient, *ServerMessage, *TestClient, *ServerMessage) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "resume_grace_period", "5")
+		return config, nil
+	})
+
+	client1 := NewTestClient(t, server, hub)
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	client1.Close()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return hub, server, shutdown, client1, hello1, client2, hello2
+}
+
+func TestClientResumeWithinGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hub, server, shutdown, _, hello1, client2, _ := newResumeGracePeriodTest(ctx, t)
+	defer shutdown()
+	defer client2.CloseWithBye()
+
+	// The session is still suspended within the grace period.
+	performHousekeeping(hub, time.Now().Add(4*time.Second)).Wait()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if hello, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.SessionId != hello1.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello1.Hello.SessionId, hello.Hello)
+	}
+
+	// Other participants didn't notice the disconnect.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client2.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+
+	if room := hub.getRoom("test-room"); room == nil {
+		t.Error("Expected room to exist")
+	} else if !room.HasSession(hub.GetSessionByPublicId(hello1.Hello.SessionId)) {
+		t.Errorf("Expected session %s to still be in the room", hello1.Hello.SessionId)
+	}
+}
+
+func TestClientResumeAfterGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hub, server, shutdown, _, hello1, client2, _ := newResumeGracePeriodTest(ctx, t)
+	defer shutdown()
+	defer client2.CloseWithBye()
+
+	// The configured grace period is shorter than the default.
+	performHousekeeping(hub, time.Now().Add(6*time.Second)).Wait()
+
+	if err := client2.RunUntilLeft(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkResumeFailed(message, ResumeFailedReasonExpired); err != nil {
+		t.Error(err)
+	}
+
+	// The client has to create a new session and join again.
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if hello3.Hello.SessionId == hello1.Hello.SessionId {
+		t.Errorf("Expected new session, got %+v", hello3.Hello)
+	}
+
+	if room, err := client1.JoinRoom(ctx, "test-room"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "test-room" {
+		t.Fatalf("Expected room test-room, got %s", room.Room.RoomId)
+	}
+
+	if err := client2.RunUntilJoined(ctx, hello3.Hello); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientHelloResumeExpired(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
@@ -1187,51 +1740,44 @@ func TestClientHelloResumeAndJoin(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Perform housekeeping in the future, this will cause the session to be
+	// cleaned up after it is expired.
+	performHousekeeping(hub, time.Now().Add(defaultResumeGracePeriod+time.Second)).Wait()
+
 	client = NewTestClient(t, server, hub)
 	defer client.CloseWithBye()
 
 	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
 		t.Fatal(err)
 	}
-	hello2, err := client.RunUntilHello(ctx)
+	msg, err := client.RunUntilMessage(ctx)
 	if err != nil {
 		t.Error(err)
 	} else {
-		if hello2.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
-		}
-		if hello2.Hello.SessionId != hello.Hello.SessionId {
-			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
-		}
-		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
-			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		if msg.Type != "error" || msg.Error == nil {
+			t.Errorf("Expected error message, got %+v", msg)
+		} else if err := checkResumeFailed(msg, ResumeFailedReasonExpired); err != nil {
+			t.Error(err)
 		}
 	}
-
-	// Join room by id.
-	roomId := "test-room"
-	if room, err := client.JoinRoom(ctx, roomId); err != nil {
-		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
-	}
 }
 
-func TestClientHelloClient(t *testing.T) {
+func TestClientHelloResumeTakeover(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
-	client := NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
 
-	if err := client.SendHelloClient(testDefaultUserId); err != nil {
+	if err := client1.SendHello(testDefaultUserId); err != nil {
 		t.Fatal(err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	if hello, err := client.RunUntilHello(ctx); err != nil {
+	hello, err := client1.RunUntilHello(ctx)
+	if err != nil {
 		t.Error(err)
 	} else {
 		if hello.Hello.UserId != testDefaultUserId {
@@ -1244,61 +1790,67 @@ func TestClientHelloClient(t *testing.T) {
 			t.Errorf("Expected resume id, got %+v", hello.Hello)
 		}
 	}
-}
-
-func TestClientHelloClient_V3Api(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
-	defer shutdown()
 
-	client := NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
 
-	params := TestBackendClientAuthParams{
-		UserId: testDefaultUserId,
-	}
-	// The "/api/v1/signaling/" URL will be changed to use "v3" as the "signaling-v3"
-	// feature is returned by the capabilities endpoint.
-	if err := client.SendHelloParams(server.URL+"/ocs/v2.php/apps/spreed/api/v1/signaling/backend", "client", params); err != nil {
+	if err := client2.SendHelloResume(hello.Hello.ResumeId); err != nil {
 		t.Fatal(err)
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
-
-	if hello, err := client.RunUntilHello(ctx); err != nil {
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
 		t.Error(err)
 	} else {
-		if hello.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		if hello2.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
 		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
+		if hello2.Hello.SessionId != hello.Hello.SessionId {
+			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
 		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
+			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		}
+	}
+
+	// The first client got disconnected with a reason in a "Bye" message.
+	msg, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if msg.Type != "bye" || msg.Bye == nil {
+			t.Errorf("Expected bye message, got %+v", msg)
+		} else if msg.Bye.Reason != "session_resumed" {
+			t.Errorf("Expected reason \"session_resumed\", got %+v", msg.Bye.Reason)
 		}
 	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err == nil {
+		t.Errorf("Expected error but received %+v", msg)
+	} else if !websocket.IsCloseError(err, GetByeCloseCode(ByeCodeSessionResumed)) {
+		t.Errorf("Expected close error but received %+v", err)
+	}
 }
 
-func TestClientHelloInternal(t *testing.T) {
+func TestClientHelloResumeOtherHub(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
 	client := NewTestClient(t, server, hub)
 	defer client.CloseWithBye()
 
-	if err := client.SendHelloInternal(); err != nil {
+	if err := client.SendHello(testDefaultUserId); err != nil {
 		t.Fatal(err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	if hello, err := client.RunUntilHello(ctx); err != nil {
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
 		t.Error(err)
 	} else {
-		if hello.Hello.UserId != "" {
-			t.Errorf("Expected empty user id, got %+v", hello.Hello)
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
 		}
 		if hello.Hello.SessionId == "" {
 			t.Errorf("Expected session id, got %+v", hello.Hello)
@@ -1307,15 +1859,4885 @@ func TestClientHelloInternal(t *testing.T) {
 			t.Errorf("Expected resume id, got %+v", hello.Hello)
 		}
 	}
-}
 
-func TestClientMessageToSessionId(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
-	defer shutdown()
+	client.Close()
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	// Simulate a restart of the hub.
+	atomic.StoreUint64(&hub.sid, 0)
+	sessions := make([]Session, 0)
+	hub.mu.Lock()
+	for _, session := range hub.sessions {
+		sessions = append(sessions, session)
+	}
+	hub.mu.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+	hub.mu.Lock()
+	count := len(hub.sessions)
+	hub.mu.Unlock()
+	if count > 0 {
+		t.Errorf("Should have removed all sessions (still has %d)", count)
+	}
+
+	// The new client will get the same (internal) sid for his session.
+	newClient := NewTestClient(t, server, hub)
+	defer newClient.CloseWithBye()
+
+	if err := newClient.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	if hello, err := newClient.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+
+	// The previous session (which had the same internal sid) can't be resumed.
+	client = NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if msg.Type != "error" || msg.Error == nil {
+			t.Errorf("Expected error message, got %+v", msg)
+		} else if err := checkResumeFailed(msg, ResumeFailedReasonExpired); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Expire old sessions
+	hub.performHousekeeping(time.Now().Add(2 * defaultResumeGracePeriod))
+}
+
+func TestClientHelloResumePublicId(t *testing.T) {
+	// Test that a client can't resume a "public" session of another user.
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	}
+
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	data := "from-1-to-2"
+	client1.SendMessage(recipient2, data) // nolint
+
+	var payload string
+	var sender *MessageServerMessageSender
+	if err := checkReceiveClientMessageWithSender(ctx, client2, "session", hello1.Hello, &payload, &sender); err != nil {
+		t.Error(err)
+	} else if payload != data {
+		t.Errorf("Expected payload %s, got %s", data, payload)
+	}
+
+	client1.Close()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	client1 = NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	// Can't resume a session with the id received from messages of a client.
+	if err := client1.SendHelloResume(sender.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if msg.Type != "error" || msg.Error == nil {
+			t.Errorf("Expected error message, got %+v", msg)
+		} else if err := checkResumeFailed(msg, ResumeFailedReasonUnknown); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Expire old sessions
+	hub.performHousekeeping(time.Now().Add(2 * defaultResumeGracePeriod))
+}
+
+func TestClientHelloByeResume(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+
+	if err := client.SendBye(); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else {
+		if err := checkMessageType(message, "bye"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	client.Close()
+	if err := client.WaitForSessionRemoved(ctx, hello.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	client = NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if msg.Type != "error" || msg.Error == nil {
+			t.Errorf("Expected \"error\", got %+v", *msg)
+		} else if err := checkResumeFailed(msg, ResumeFailedReasonExpired); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientHelloResumeAndJoin(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+
+	client.Close()
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	client = NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello2.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
+		}
+		if hello2.Hello.SessionId != hello.Hello.SessionId {
+			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+		}
+		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
+			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		}
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+}
+
+func TestClientHelloClient(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHelloClient(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if hello, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+}
+
+func TestClientHelloClient_V3Api(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	// The "/api/v1/signaling/" URL will be changed to use "v3" as the "signaling-v3"
+	// feature is returned by the capabilities endpoint.
+	if err := client.SendHelloParams(server.URL+"/ocs/v2.php/apps/spreed/api/v1/signaling/backend", "client", params); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if hello, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+}
+
+func TestClientEcho(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data := json.RawMessage(`{"foo":"bar"}`)
+	request := &ClientMessage{
+		Id:   "abcd",
+		Type: "echo",
+		Echo: &EchoClientMessage{
+			Data: &data,
+		},
+		// Not serialized, the server checks the type of the sending client.
+		fromInternal: true,
+	}
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := client.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageType(message, "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != request.Id {
+		t.Errorf("Expected id %s, got %+v", request.Id, message)
+	}
+	if message.Echo.Data == nil || string(*message.Echo.Data) != string(data) {
+		t.Errorf("Expected data %s, got %+v", string(data), message.Echo)
+	}
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+	if message.Echo.Timestamp < before || message.Echo.Timestamp > after {
+		t.Errorf("Expected timestamp between %d and %d, got %d", before, after, message.Echo.Timestamp)
+	}
+
+	// The data is too large.
+	tooLarge := json.RawMessage(`"` + strings.Repeat("x", MaxEchoDataSize) + `"`)
+	request.Echo.Data = &tooLarge
+	if err := client.conn.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientEchoNotAllowed(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data := json.RawMessage(`"the-data"`)
+	request := &ClientMessage{
+		Id:   "abcd",
+		Type: "echo",
+		Echo: &EchoClientMessage{
+			Data: &data,
+		},
+		// Not serialized, the server checks the type of the sending client.
+		fromInternal: true,
+	}
+	if err := client.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != request.Id {
+		t.Errorf("Expected id %s, got %+v", request.Id, message)
+	}
+	if message.Echo != nil {
+		t.Errorf("Expected no echo data, got %+v", message.Echo)
+	}
+}
+
+func TestClientHelloDeniedUsers(t *testing.T) {
+	var config *goconf.ConfigFile
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		var err error
+		config, err = getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("clients", "denied_users", "blocked-*")
+		config.AddOption("backend2", "denied_users", "user2")
+		return config, nil
+	})
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	connect := func(url string, userId string, expectedError string) {
+		t.Helper()
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		params := TestBackendClientAuthParams{
+			UserId: userId,
+		}
+		if err := client.SendHelloParams(url, "client", params); err != nil {
+			t.Fatal(err)
+		}
+
+		if expectedError == "" {
+			if _, err := client.RunUntilHello(ctx); err != nil {
+				t.Errorf("%s@%s: %s", userId, url, err)
+			}
+		} else if msg, err := client.RunUntilMessage(ctx); err != nil {
+			t.Errorf("%s@%s: %s", userId, url, err)
+		} else if err := checkMessageError(msg, expectedError); err != nil {
+			t.Errorf("%s@%s: %s", userId, url, err)
+		}
+	}
+
+	connect(server.URL+"/one", "blocked-user", "forbidden")
+	connect(server.URL+"/two", "blocked-user", "forbidden")
+	connect(server.URL+"/one", "user2", "")
+	connect(server.URL+"/two", "user2", "forbidden")
+	connect(server.URL+"/two", "user3", "")
+
+	// The global denylist can be changed by reloading the configuration.
+	config.RemoveOption("clients", "denied_users")
+	config.AddOption("clients", "denied_users", "user3")
+	hub.Reload(config)
+
+	connect(server.URL+"/one", "blocked-user", "")
+	connect(server.URL+"/two", "user3", "forbidden")
+}
+
+func TestClientHelloResumeDeniedUser(t *testing.T) {
+	var config *goconf.ConfigFile
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		var err error
+		config, err = getTestConfig(server)
+		return config, err
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// Users that were denied while disconnected may not resume their session.
+	config.AddOption("clients", "denied_users", testDefaultUserId)
+	hub.Reload(config)
+
+	client = NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "forbidden"); err != nil {
+		t.Error(err)
+	}
+
+	if session := hub.GetSessionByPublicId(hello.Hello.SessionId); session != nil {
+		t.Errorf("Expected session %s to be closed", hello.Hello.SessionId)
+	}
+}
+
+func TestClientHelloAllowedAuthTypes(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("clients", "allowed_auth_types", "client")
+		config.AddOption("backend2", "allowed_auth_types", "client, internal")
+		return config, nil
+	})
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// Internal clients are checked against the backend from their params.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloInternalWithBackend(server.URL + "/one"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(msg, "invalid_client_type"); err != nil {
+		t.Error(err)
+	}
+
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+	if err := client3.SendHelloInternalWithBackend(server.URL + "/two"); err != nil {
+		t.Fatal(err)
+	}
+	if hello, err := client3.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else if hello.Hello.SessionId == "" {
+		t.Errorf("Expected session id, got %+v", hello.Hello)
+	}
+}
+
+func TestClientHelloInternal(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if hello, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != "" {
+			t.Errorf("Expected empty user id, got %+v", hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+}
+
+func TestClientMessageToSessionId(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient2, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient1, data2) // nolint
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "session", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data2 {
+		t.Errorf("Expected payload %s, got %s", data2, payload)
+	}
+	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func TestClientRenegotiate(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, ok := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+	}
+
+	publisher := &TestMCUPublisher{
+		TestMCUClient: TestMCUClient{
+			id:         "the-publisher",
+			streamType: streamTypeVideo,
+		},
+	}
+	session.OnRenegotiate(publisher, RenegotiateReasonMcuDisconnected)
+
+	// Invalid requests are not sent to the client.
+	session.OnRenegotiate(publisher, "unknown-reason")
+
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "renegotiate"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &RenegotiateServerMessage{
+		From:     hello.Hello.SessionId,
+		RoomType: streamTypeVideo,
+		Reason:   RenegotiateReasonMcuDisconnected,
+	}
+	if !reflect.DeepEqual(message.Renegotiate, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, message.Renegotiate)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no further message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+}
+
+func TestClientRenegotiatePublisherChanged(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// The test MCU doesn't create subscribers, so add one manually.
+	session2, ok := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello2.Hello.SessionId)
+	}
+	session2.mu.Lock()
+	session2.subscribers = map[string]McuSubscriber{
+		hello1.Hello.SessionId + "|" + streamTypeVideo: &TestMCUSubscriber{
+			TestMCUClient: TestMCUClient{
+				id:         "the-subscriber",
+				streamType: streamTypeVideo,
+			},
+			publisher: hello1.Hello.SessionId,
+		},
+	}
+	session2.mu.Unlock()
+
+	sendOffer := func() {
+		if err := client1.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello1.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "offer",
+			Sid:      "54321",
+			RoomType: streamTypeVideo,
+			Payload: map[string]interface{}{
+				"sdp": MockSdpOfferAudioOnly,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Room events are ignored.
+		for {
+			message, err := client1.RunUntilMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			} else if message.Type == "event" {
+				continue
+			} else if err := checkMessageType(message, "message"); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// Subscribers don't need to renegotiate when the stream is published.
+	sendOffer()
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client2.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	// A new offer of the publisher changes the stream.
+	sendOffer()
+
+	message, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "renegotiate"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &RenegotiateServerMessage{
+		From:     hello1.Hello.SessionId,
+		RoomType: streamTypeVideo,
+		Reason:   RenegotiateReasonPublisherChanged,
+	}
+	if !reflect.DeepEqual(message.Renegotiate, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, message.Renegotiate)
+	}
+}
+
+func TestClientMessageReceipt(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	data := "from-internal"
+	if err := client2.SendMessageWithReceipt(recipient1, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "session", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data {
+		t.Errorf("Expected payload %s, got %s", data, payload)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageReceipt(message, recipient1.SessionId, ReceiptStatusDelivered); err != nil {
+		t.Error(err)
+	}
+
+	unknown := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: "unknown-session-id",
+	}
+	if err := client2.SendMessageWithReceipt(unknown, data); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageReceipt(message, unknown.SessionId, ReceiptStatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// Sessions that no longer exist are not found.
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client3.CloseWithBye()
+	if err := client3.WaitForSessionRemoved(ctx, hello3.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+
+	recipient3 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello3.Hello.SessionId,
+	}
+	if err := client2.SendMessageWithReceipt(recipient3, data); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageReceipt(message, recipient3.SessionId, ReceiptStatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// Only internal clients may request receipts.
+	if err := client1.SendMessageWithReceipt(recipient2, data); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientMessageReceiptMcu(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello.Hello.SessionId,
+	}
+	if err := client.SendMessageWithReceipt(recipient, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages processed by the MCU get a receipt before the response, room
+	// events are ignored.
+	var receipt *ServerMessage
+	for {
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type == "event" {
+			continue
+		} else if receipt == nil {
+			if err := checkMessageReceipt(message, recipient.SessionId, ReceiptStatusProcessed); err != nil {
+				t.Fatal(err)
+			}
+			receipt = message
+		} else if err := checkMessageType(message, "message"); err != nil {
+			t.Fatal(err)
+		} else {
+			break
+		}
+	}
+}
+
+func TestClientMessageMcuBackendFeatures(t *testing.T) {
+	hub, _, r, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend2", "features", "transient-data")
+		return config, nil
+	})
+	defer shutdown()
+	registerBackendHandlerUrl(t, r, "/one")
+	registerBackendHandlerUrl(t, r, "/two")
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHelloParams(server.URL+"/two", "client", TestBackendClientAuthParams{UserId: testDefaultUserId}); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello.Hello.SessionId,
+	}
+	if err := client.SendMessage(recipient, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The MCU is not enabled for the backend, so the message is not processed.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+	if publishers := mcu.GetPublishers(); len(publishers) > 0 {
+		t.Errorf("Expected no publishers, got %+v", publishers)
+	}
+}
+
+func TestClientMessageToUserId(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	} else if hello1.Hello.UserId == hello2.Hello.UserId {
+		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:   "user",
+		UserId: hello1.Hello.UserId,
+	}
+	recipient2 := MessageClientMessageRecipient{
+		Type:   "user",
+		UserId: hello2.Hello.UserId,
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient2, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient1, data2) // nolint
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "user", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data2 {
+		t.Errorf("Expected payload %s, got %s", data2, payload)
+	}
+
+	if err := checkReceiveClientMessage(ctx, client2, "user", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func TestClientMessageToUserIdMultipleSessions(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2a := NewTestClient(t, server, hub)
+	defer client2a.CloseWithBye()
+	if err := client2a.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	client2b := NewTestClient(t, server, hub)
+	defer client2b.CloseWithBye()
+	if err := client2b.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2a, err := client2a.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2b, err := client2b.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2a.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	} else if hello1.Hello.SessionId == hello2b.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	} else if hello2a.Hello.SessionId == hello2b.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello2a.Hello.SessionId)
+	}
+	if hello1.Hello.UserId == hello2a.Hello.UserId {
+		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	} else if hello1.Hello.UserId == hello2b.Hello.UserId {
+		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	} else if hello2a.Hello.UserId != hello2b.Hello.UserId {
+		t.Fatalf("Expected the same user ids, got %s and %s", hello2a.Hello.UserId, hello2b.Hello.UserId)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type:   "user",
+		UserId: hello2a.Hello.UserId,
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient, data1) // nolint
+
+	// Both clients will receive the message as it was sent to the user.
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client2a, "user", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+	if err := checkReceiveClientMessage(ctx, client2b, "user", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func WaitForUsersJoined(ctx context.Context, t *testing.T, client1 *TestClient, hello1 *ServerMessage, client2 *TestClient, hello2 *ServerMessage) {
+	// We will receive "joined" events for all clients. The ordering is not
+	// defined as messages are processed and sent by asynchronous NATS handlers.
+	msg1_1, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	msg1_2, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	msg2_1, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	msg2_2, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := client1.checkMessageJoined(msg1_1, hello1.Hello); err != nil {
+		// Ordering is "joined" from client 2, then from client 1
+		if err := client1.checkMessageJoined(msg1_1, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+		if err := client1.checkMessageJoined(msg1_2, hello1.Hello); err != nil {
+			t.Error(err)
+		}
+	} else {
+		// Ordering is "joined" from client 1, then from client 2
+		if err := client1.checkMessageJoined(msg1_2, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := client2.checkMessageJoined(msg2_1, hello1.Hello); err != nil {
+		// Ordering is "joined" from client 2, then from client 1
+		if err := client2.checkMessageJoined(msg2_1, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+		if err := client2.checkMessageJoined(msg2_2, hello1.Hello); err != nil {
+			t.Error(err)
+		}
+	} else {
+		// Ordering is "joined" from client 1, then from client 2
+		if err := client2.checkMessageJoined(msg2_2, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientMessageToRoom(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	} else if hello1.Hello.UserId == hello2.Hello.UserId {
+		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient, data2) // nolint
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "room", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data2 {
+		t.Errorf("Expected payload %s, got %s", data2, payload)
+	}
+
+	if err := checkReceiveClientMessage(ctx, client2, "room", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func TestClientMessageToRoomExcludeSelf(t *testing.T) {
+	hub, natsClient, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	room := session1.GetRoom()
+	if room == nil {
+		t.Fatalf("Expected room for session %s", session1.PublicId())
+	}
+
+	subject := GetSubjectForRoomId(room.Id(), room.Backend())
+	ch := make(chan *nats.Msg, 1)
+	sub, err := natsClient.Subscribe(subject, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe() // nolint
+
+	recipient := MessageClientMessageRecipient{
+		Type:        "room",
+		ExcludeSelf: true,
+	}
+
+	data1 := "from-1-to-all-others"
+	client1.SendMessage(recipient, data1) // nolint
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client2, "room", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+
+	select {
+	case msg := <-ch:
+		var natsMsg NatsMessage
+		if err := natsClient.Decode(msg, &natsMsg); err != nil {
+			t.Fatal(err)
+		} else if natsMsg.ExcludeSessionId != hello1.Hello.SessionId {
+			t.Errorf("Expected excluded session %s, got %+v", hello1.Hello.SessionId, natsMsg)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	// The excluded session is skipped even if it is not the sender.
+	data := json.RawMessage(`"from-other"`)
+	if err := natsClient.PublishNats(subject, &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "message",
+		Message: &ServerMessage{
+			Type: "message",
+			Message: &MessageServerMessage{
+				Sender: &MessageServerMessageSender{
+					Type:      "room",
+					SessionId: "other-session",
+				},
+				Data: &data,
+			},
+		},
+		ExcludeSessionId: hello2.Hello.SessionId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "message"); err != nil {
+		t.Fatal(err)
+	} else if msg.Message.Sender.SessionId != "other-session" {
+		t.Errorf("Expected message from other session, got %+v", msg.Message)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client1.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel3()
+
+	if message, err := client2.RunUntilMessage(ctx3); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+}
+
+func TestJoinRoom(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Leave room.
+	if room, err := client.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+}
+
+func TestExpectAnonymousJoinRoom(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(authAnonymousUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != "" {
+			t.Errorf("Expected an anonymous user, got %+v", hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+		if hello.Hello.ResumeId == "" {
+			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		}
+	}
+
+	// Perform housekeeping in the future, this will cause the connection to
+	// be terminated because the anonymous client didn't join a room.
+	performHousekeeping(hub, time.Now().Add(anonmyousJoinRoomTimeout+time.Second))
+
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := checkMessageType(message, "bye"); err != nil {
+		t.Error(err)
+	} else if message.Bye.Reason != "room_join_timeout" {
+		t.Errorf("Expected \"room_join_timeout\" reason, got %+v", message.Bye)
+	}
+
+	// Both the client and the session get removed from the hub.
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := client.WaitForSessionRemoved(ctx, hello.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJoinRoomChange(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Change room.
+	roomId = "other-test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Leave room.
+	if room, err := client.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+}
+
+func TestJoinMultiple(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	}
+
+	// Join room by id (first client).
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Join room by id (second client).
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event for the first and the second client.
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	// The first client will also receive a "joined" event from the second client.
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Leave room.
+	if room, err := client1.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+
+	// The second client will now receive a "left" event
+	if err := client2.RunUntilLeft(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+}
+
+func TestJoinRoomSwitchClient(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room-slow"
+	msg := &ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:    roomId,
+			SessionId: roomId + "-" + hello.Hello.SessionId,
+		},
+	}
+	if err := client.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	// Wait a bit to make sure request is sent before closing client.
+	time.Sleep(1 * time.Millisecond)
+	client.Close()
+	if err := client.WaitForClientRemoved(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client needs some time to reconnect.
+	time.Sleep(200 * time.Millisecond)
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello2.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
+		}
+		if hello2.Hello.SessionId != hello.Hello.SessionId {
+			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+		}
+		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
+			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		}
+	}
+
+	room, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkUnexpectedClose(err); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageType(room, "room"); err != nil {
+		t.Fatal(err)
+	}
+	if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client2.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Leave room.
+	if room, err := client2.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+}
+
+func TestGetRealUserIP(t *testing.T) {
+	REMOTE_ATTR := "192.168.1.2"
+
+	trusted, err := ParseTrustedProxies(REMOTE_ATTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &http.Request{
+		RemoteAddr: REMOTE_ATTR,
+	}
+	if ip := trusted.GetClientIP(request); ip != REMOTE_ATTR {
+		t.Errorf("Expected %s but got %s", REMOTE_ATTR, ip)
+	}
+
+	X_REAL_IP := "192.168.10.11"
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-real-ip"): []string{X_REAL_IP},
+	}
+	if ip := trusted.GetClientIP(request); ip != X_REAL_IP {
+		t.Errorf("Expected %s but got %s", X_REAL_IP, ip)
+	}
+
+	// "X-Real-IP" has preference before "X-Forwarded-For"
+	X_FORWARDED_FOR_IP := "192.168.20.21"
+	X_FORWARDED_FOR := X_FORWARDED_FOR_IP + ", 192.168.30.32"
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-real-ip"):       []string{X_REAL_IP},
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
+	}
+	if ip := trusted.GetClientIP(request); ip != X_REAL_IP {
+		t.Errorf("Expected %s but got %s", X_REAL_IP, ip)
+	}
+
+	// Only the last untrusted entry of "X-Forwarded-For" is used.
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
+	}
+	if ip := trusted.GetClientIP(request); ip != "192.168.30.32" {
+		t.Errorf("Expected %s but got %s", "192.168.30.32", ip)
+	}
+
+	// Headers are ignored if no proxies are trusted.
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-real-ip"):       []string{X_REAL_IP},
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
+	}
+	if ip := (*TrustedProxies)(nil).GetClientIP(request); ip != REMOTE_ATTR {
+		t.Errorf("Expected %s but got %s", REMOTE_ATTR, ip)
+	}
+}
+
+func TestClientRemoteAddrTrustedProxies(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	header := http.Header{
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{"1.2.3.4"},
+	}
+
+	// By default no proxies are trusted and the header is ignored.
+	client1 := NewTestClientWithHeader(t, server, hub, header)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session := hub.GetSessionByPublicId(hello1.Hello.SessionId); session == nil {
+		t.Fatalf("Could not find session %s", hello1.Hello.SessionId)
+	} else if addr := session.RemoteAddr(); addr != "127.0.0.1" {
+		t.Errorf("Expected remote address 127.0.0.1, got %s", addr)
+	}
+
+	config, err := getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddOption("app", "trustedproxies", "127.0.0.1")
+	hub.Reload(config)
+
+	client2 := NewTestClientWithHeader(t, server, hub, header)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session := hub.GetSessionByPublicId(hello2.Hello.SessionId); session == nil {
+		t.Fatalf("Could not find session %s", hello2.Hello.SessionId)
+	} else if addr := session.RemoteAddr(); addr != "1.2.3.4" {
+		t.Errorf("Expected remote address 1.2.3.4, got %s", addr)
+	}
+}
+
+func TestClientDebugPayloads(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session1, ok := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello1.Hello.SessionId)
+	}
+	session2, ok := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello2.Hello.SessionId)
+	}
+	if session1.DebugPayloads() || session2.DebugPayloads() {
+		t.Errorf("Payload logging should be disabled by default")
+	}
+
+	config, err := getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sessions connecting later can only be matched by their user.
+	config.AddOption("app", "debugsessions", hello1.Hello.SessionId+", "+session1.Backend().Id()+":"+testDefaultUserId+"3")
+	hub.Reload(config)
+
+	if !session1.DebugPayloads() {
+		t.Errorf("Payload logging should be enabled for %s", session1.PublicId())
+	}
+	if session2.DebugPayloads() {
+		t.Errorf("Payload logging should not be enabled for %s", session2.PublicId())
+	}
+
+	// Sessions connecting after the reload are also checked.
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session3, ok := hub.GetSessionByPublicId(hello3.Hello.SessionId).(*ClientSession); !ok {
+		t.Errorf("Could not find session %s", hello3.Hello.SessionId)
+	} else if !session3.DebugPayloads() {
+		t.Errorf("Payload logging should be enabled for %s", session3.PublicId())
+	}
+
+	client4 := NewTestClient(t, server, hub)
+	defer client4.CloseWithBye()
+	if err := client4.SendHello(testDefaultUserId + "4"); err != nil {
+		t.Fatal(err)
+	}
+	hello4, err := client4.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session4, ok := hub.GetSessionByPublicId(hello4.Hello.SessionId).(*ClientSession); !ok {
+		t.Errorf("Could not find session %s", hello4.Hello.SessionId)
+	} else if session4.DebugPayloads() {
+		t.Errorf("Payload logging should not be enabled for %s", session4.PublicId())
+	}
+
+	config, err = getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Reload(config)
+
+	if session1.DebugPayloads() {
+		t.Errorf("Payload logging should be disabled for %s", session1.PublicId())
+	}
+}
+
+func TestClientBackendUrlChanged(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, getTestConfigWithMultipleBackends)
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := getTestConfigWithMultipleBackends(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RemoveOption("backend1", "url")
+	config.AddOption("backend1", "url", server.URL+"/three")
+	hub.Reload(config)
+
+	// Sessions of the changed backend are disconnected.
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(msg, "bye"); err != nil {
+		t.Error(err)
+	} else if msg.Bye.Reason != ByeCodeBackendChanged {
+		t.Errorf("Expected reason %s, got %+v", ByeCodeBackendChanged, msg.Bye)
+	}
+
+	if session := hub.GetSessionByPublicId(hello2.Hello.SessionId); session == nil {
+		t.Errorf("Session %s should still be connected", hello2.Hello.SessionId)
+	}
+}
+
+func TestClientJoinDisplayName(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	expected := "Name of " + testDefaultUserId + "1"
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := client1.checkMessageJoinedSession(message, hello1.Hello.SessionId, testDefaultUserId+"1"); err != nil {
+		t.Fatal(err)
+	} else if name := message.Event.Join[0].DisplayName; name != expected {
+		t.Errorf("Expected display name %s, got %+v", expected, message.Event.Join[0])
+	}
+
+	// Anonymous sessions don't have a display name.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(authAnonymousUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := client1.checkMessageJoinedSession(message, hello2.Hello.SessionId, ""); err != nil {
+		t.Fatal(err)
+	} else if name := message.Event.Join[0].DisplayName; name != "" {
+		t.Errorf("Expected no display name, got %+v", message.Event.Join[0])
+	}
+}
+
+func TestClientMessageToSessionIdWhileDisconnected(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	}
+
+	client2.Close()
+	if err := client2.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	// The two chat messages should get combined into one when receiving pending messages.
+	chat_refresh := "{\"type\":\"chat\",\"chat\":{\"refresh\":true}}"
+	var data1 map[string]interface{}
+	if err := json.Unmarshal([]byte(chat_refresh), &data1); err != nil {
+		t.Fatal(err)
+	}
+	client1.SendMessage(recipient2, data1) // nolint
+	client1.SendMessage(recipient2, data1) // nolint
+
+	// Simulate some time until client resumes the session.
+	time.Sleep(10 * time.Millisecond)
+
+	client2 = NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello3.Hello.UserId != testDefaultUserId+"2" {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"2", hello3.Hello)
+		}
+		if hello3.Hello.SessionId != hello2.Hello.SessionId {
+			t.Errorf("Expected session id %s, got %+v", hello2.Hello.SessionId, hello3.Hello)
+		}
+		if hello3.Hello.ResumeId != hello2.Hello.ResumeId {
+			t.Errorf("Expected resume id %s, got %+v", hello2.Hello.ResumeId, hello3.Hello)
+		}
+	}
+
+	var payload map[string]interface{}
+	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(payload, data1) {
+		t.Errorf("Expected payload %+v, got %+v", data1, payload)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if err := checkReceiveClientMessage(ctx2, client2, "session", hello1.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+}
+
+func TestClientMessageToSessionIdWhileDisconnectedDropped(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "resume_buffer_size", "2")
+		return config, nil
+	})
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if size := session2.Backend().ResumeBufferSize(); size != 2 {
+		t.Errorf("Expected resume buffer size 2, got %d", size)
+	}
+
+	client2.Close()
+	if err := client2.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := client1.SendMessage(recipient2, fmt.Sprintf("message-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait until all messages have been processed by the session.
+	for {
+		session2.mu.Lock()
+		dropped := session2.droppedPendingMessages
+		session2.mu.Unlock()
+		if dropped > 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	client2 = NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if hello3, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello3.Hello.DroppedMessages != 1 {
+		t.Errorf("Expected one dropped message, got %+v", hello3.Hello)
+	}
+
+	// The oldest message was dropped.
+	for i := 2; i <= 3; i++ {
+		var payload string
+		if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+			t.Error(err)
+		} else if expected := fmt.Sprintf("message-%d", i); payload != expected {
+			t.Errorf("Expected payload %s, got %s", expected, payload)
+		}
+	}
+}
+
+func TestRoomParticipantsListUpdateWhileDisconnected(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	// Simulate request from the backend that somebody joined the call.
+	users := []map[string]interface{}{
+		{
+			"sessionId": "the-session-id",
+			"inCall":    1,
+		},
+	}
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	room.PublishUsersInCallChanged(users, users)
+	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	client2.Close()
+	if err := client2.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	room.PublishUsersInCallChanged(users, users)
+
+	// Give NATS message some time to be processed.
+	time.Sleep(100 * time.Millisecond)
+
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	chat_refresh := "{\"type\":\"chat\",\"chat\":{\"refresh\":true}}"
+	var data1 map[string]interface{}
+	if err := json.Unmarshal([]byte(chat_refresh), &data1); err != nil {
+		t.Fatal(err)
+	}
+	client1.SendMessage(recipient2, data1) // nolint
+
+	client2 = NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if hello3.Hello.UserId != testDefaultUserId+"2" {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"2", hello3.Hello)
+		}
+		if hello3.Hello.SessionId != hello2.Hello.SessionId {
+			t.Errorf("Expected session id %s, got %+v", hello2.Hello.SessionId, hello3.Hello)
+		}
+		if hello3.Hello.ResumeId != hello2.Hello.ResumeId {
+			t.Errorf("Expected resume id %s, got %+v", hello2.Hello.ResumeId, hello3.Hello)
+		}
+	}
+
+	// The participants list update event is triggered again after the session resume.
+	// TODO(jojo): Check contents of message and try with multiple users.
+	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	var payload map[string]interface{}
+	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(payload, data1) {
+		t.Errorf("Expected payload %+v, got %+v", data1, payload)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if err := checkReceiveClientMessage(ctx2, client2, "session", hello1.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+}
+
+func TestClientMoveSession(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room-record-move"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+
+	breakoutRoomId := roomId + "-breakout"
+	testcases := []struct {
+		client    *TestClient
+		sessionId string
+		roomId    string
+		error     string
+	}{
+		// Only moderators may move sessions.
+		{client2, hello1.Hello.SessionId, breakoutRoomId, "not_allowed"},
+		// The own session can't be moved.
+		{client1, hello1.Hello.SessionId, breakoutRoomId, "not_allowed"},
+		// Unknown sessions can't be moved.
+		{client1, "unknown-session-id", breakoutRoomId, "no_such_session"},
+	}
+	for idx, tc := range testcases {
+		if err := tc.client.WriteJSON(&ClientMessage{
+			Id:   strconv.Itoa(idx),
+			Type: "move",
+			Move: &MoveClientMessage{
+				SessionId: tc.sessionId,
+				RoomId:    tc.roomId,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if message, err := tc.client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, tc.error); err != nil {
+			t.Errorf("testcase %d: %s", idx, err)
+		}
+	}
+
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "move",
+		Type: "move",
+		Move: &MoveClientMessage{
+			SessionId: hello2.Hello.SessionId,
+			RoomId:    breakoutRoomId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The moved session is instructed to join the new room.
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Target != "room" || message.Event.Type != "switchto" {
+		t.Errorf("Expected switchto event, got %+v", message.Event)
+	} else if message.Event.SwitchTo == nil || message.Event.SwitchTo.RoomId != breakoutRoomId {
+		t.Errorf("Expected switch to room %s, got %+v", breakoutRoomId, message.Event.SwitchTo)
+	}
+
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "move"); err != nil {
+		t.Fatal(err)
+	} else if message.Id != "move" {
+		t.Errorf("Expected request id move, got %+v", message)
+	} else if message.Move.SessionId != hello2.Hello.SessionId || message.Move.RoomId != breakoutRoomId {
+		t.Errorf("Expected confirmation for session %s and room %s, got %+v", hello2.Hello.SessionId, breakoutRoomId, message.Move)
+	}
+
+	// The session is only moved once its client joined the new room.
+	if room := session2.GetRoom(); room == nil || room.Id() != roomId {
+		t.Errorf("Expected session to be in room %s, got %+v", roomId, room)
+	}
+
+	oldRoomSessionId := session2.RoomSessionId()
+	newRoomSessionId := breakoutRoomId + "-" + hello2.Hello.SessionId
+	if room, err := client2.JoinRoomWithRoomSession(ctx, breakoutRoomId, newRoomSessionId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != breakoutRoomId {
+		t.Fatalf("Expected room %s, got %s", breakoutRoomId, room.Room.RoomId)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := client1.checkMessageRoomLeave(message, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// The backend was notified about the new room session and that the old
+	// room session left.
+	waitForRecordedRoomRequests(ctx, t, roomId, []string{
+		"join:" + breakoutRoomId + ":" + newRoomSessionId,
+		"leave:" + roomId + ":" + oldRoomSessionId,
+	}, "leave:"+breakoutRoomId+":")
+
+	// Sessions in other rooms can't be moved.
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "move-again",
+		Type: "move",
+		Move: &MoveClientMessage{
+			SessionId: hello2.Hello.SessionId,
+			RoomId:    roomId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "no_such_session"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientKickSession(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloWithFeatures(testDefaultUserId+"1", []string{ServerFeatureLeaveReasons}); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+
+	// Only moderators may kick sessions.
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "kick",
+		Kick: &KickClientMessage{
+			SessionId: hello1.Hello.SessionId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown sessions can't be kicked.
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "2345",
+		Type: "kick",
+		Kick: &KickClientMessage{
+			SessionId: "unknown-session-id",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "no_such_session"); err != nil {
+		t.Fatal(err)
+	}
+
+	reason := "Please behave."
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "3456",
+		Type: "kick",
+		Kick: &KickClientMessage{
+			SessionId: hello2.Hello.SessionId,
+			Reason:    reason,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kicked session receives a "bye" with the reason. It might receive
+	// the "kicked" event before.
+	for {
+		message, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if message.Type == "event" && message.Event.Type == "kicked" {
+			continue
+		}
+
+		if err := checkMessageType(message, "bye"); err != nil {
+			t.Fatal(err)
+		} else if message.Bye.Reason != ByeCodeKicked {
+			t.Errorf("Expected reason %s, got %+v", ByeCodeKicked, message.Bye)
+		} else if message.Bye.Message != reason {
+			t.Errorf("Expected message %s, got %+v", reason, message.Bye)
+		}
+		break
+	}
+
+	// The connection is closed with the close code of the reason.
+	if _, err := client2.RunUntilMessage(ctx); err == nil {
+		t.Error("Expected connection to be closed")
+	} else if !websocket.IsCloseError(err, GetByeCloseCode(ByeCodeKicked)) {
+		t.Errorf("Expected close code %d, got %s", GetByeCloseCode(ByeCodeKicked), err)
+	}
+
+	// The room is notified about the kicked session.
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Target != "room" || message.Event.Type != "kicked" || message.Event.Kicked == nil {
+		t.Errorf("Expected kicked event, got %+v", message.Event)
+	} else if message.Event.Kicked.SessionId != hello2.Hello.SessionId || message.Event.Kicked.Reason != reason {
+		t.Errorf("Expected kicked session %s with reason %s, got %+v", hello2.Hello.SessionId, reason, message.Event.Kicked)
+	}
+	if err := client1.RunUntilLeftWithReason(ctx, hello2.Hello, LeaveReasonKicked); err != nil {
+		t.Error(err)
+	}
+
+	if session := hub.GetSessionByPublicId(hello2.Hello.SessionId); session != nil {
+		t.Errorf("Session %s should have been closed", hello2.Hello.SessionId)
+	}
+}
+
+func TestClientByeOnShutdown(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Stop()
+
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "bye"); err != nil {
+		t.Fatal(err)
+	} else if message.Bye.Reason != ByeCodeShutdown {
+		t.Errorf("Expected reason %s, got %+v", ByeCodeShutdown, message.Bye)
+	}
+	if _, err := client.RunUntilMessage(ctx); err == nil {
+		t.Error("Expected connection to be closed")
+	} else if !websocket.IsCloseError(err, GetByeCloseCode(ByeCodeShutdown)) {
+		t.Errorf("Expected close code %d, got %s", GetByeCloseCode(ByeCodeShutdown), err)
+	}
+
+	// Housekeeping is no longer running to expire the session.
+	if session := hub.GetSessionByPublicId(hello.Hello.SessionId); session != nil {
+		session.Close()
+	}
+}
+
+func TestClientKickSessionInternalAndRemote(t *testing.T) {
+	hub, natsClient, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	internal := NewTestClient(t, server, hub)
+	defer internal.CloseWithBye()
+	if err := internal.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	helloInternal, err := internal.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := internal.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+
+	kick := func(id string, sessionId string) {
+		t.Helper()
+		if err := client1.WriteJSON(&ClientMessage{
+			Id:   id,
+			Type: "kick",
+			Kick: &KickClientMessage{
+				SessionId: sessionId,
+				Reason:    "the-reason",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkKickError := func(code string) {
+		t.Helper()
+		for {
+			message, err := client1.RunUntilMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			} else if message.Type == "event" {
+				// Ignore join events.
+				continue
+			} else if err := checkMessageError(message, code); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// Internal sessions can't be kicked.
+	kick("1234", helloInternal.Hello.SessionId)
+	checkKickError("not_allowed")
+
+	// Sessions of other backends can't be kicked.
+	otherId, err := hub.encodeSessionId(&SessionIdData{
+		Sid:       1,
+		Created:   time.Now(),
+		BackendId: "other-backend",
+	}, publicSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kick("2345", otherId)
+	checkKickError("no_such_session")
+
+	// Sessions on other servers are kicked through NATS.
+	remoteId, err := hub.encodeSessionId(hub.newSessionIdData(session1.Backend()), publicSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *nats.Msg, 1)
+	sub, err := natsClient.Subscribe("session."+remoteId, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe() // nolint
+
+	kick("3456", remoteId)
+	select {
+	case msg := <-ch:
+		var message NatsMessage
+		if err := natsClient.Decode(msg, &message); err != nil {
+			t.Fatal(err)
+		} else if message.Type != "kick" || message.Kick == nil {
+			t.Errorf("Expected kick, got %+v", message)
+		} else if message.Kick.RoomId != roomId || message.Kick.Reason != "the-reason" {
+			t.Errorf("Expected kick from room %s, got %+v", roomId, message.Kick)
+		}
+	case <-ctx.Done():
+		t.Error(ctx.Err())
+	}
+
+	// Internal sessions ignore kicks received through NATS.
+	if err := natsClient.PublishNats("session."+helloInternal.Hello.SessionId, &NatsMessage{
+		Type: "kick",
+		Kick: &NatsKickMessage{
+			RoomId: roomId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if session := hub.GetSessionByPublicId(helloInternal.Hello.SessionId); session == nil {
+		t.Error("Internal session should not have been kicked")
+	}
+}
+
+func TestClientKickSessionFromOtherServer(t *testing.T) {
+	hub, natsClient, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Kicks from other rooms are ignored.
+	if err := natsClient.PublishNats("session."+hello.Hello.SessionId, &NatsMessage{
+		Type: "kick",
+		Kick: &NatsKickMessage{
+			RoomId: "other-room",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	reason := "Please behave."
+	if err := natsClient.PublishNats("session."+hello.Hello.SessionId, &NatsMessage{
+		Type: "kick",
+		Kick: &NatsKickMessage{
+			RoomId: roomId,
+			Reason: reason,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if message.Type == "event" && message.Event.Type == "kicked" {
+			continue
+		}
+
+		if err := checkMessageType(message, "bye"); err != nil {
+			t.Fatal(err)
+		} else if message.Bye.Reason != ByeCodeKicked || message.Bye.Message != reason {
+			t.Errorf("Expected kicked bye with message %s, got %+v", reason, message.Bye)
+		}
+		break
+	}
+}
+
+func TestClientLeaveReasons(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloWithFeatures(testDefaultUserId+"1", []string{ServerFeatureLeaveReasons}); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if _, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	joinAndWait := func() {
+		if _, err := client2.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		}
+		if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+			t.Fatal(err)
+		}
+		if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leaving the room.
+	joinAndWait()
+	if _, err := client2.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilLeftWithReason(ctx, hello2.Hello, LeaveReasonLeft); err != nil {
+		t.Error(err)
+	}
+
+	// Joining a different room.
+	joinAndWait()
+	if _, err := client2.JoinRoom(ctx, roomId+"-other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilLeftWithReason(ctx, hello2.Hello, LeaveReasonMoved); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the session with a "bye" is an explicit leave.
+	joinAndWait()
+	if err := client2.SendBye(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilLeftWithReason(ctx, hello2.Hello, LeaveReasonLeft); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientLeaveReasonsNotNegotiated(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if _, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	if _, err := client2.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients that didn't include the feature don't receive leave reasons.
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := client1.checkMessageRoomLeaveSession(message, hello2.Hello.SessionId); err != nil {
+		t.Error(err)
+	} else if message.Event.LeaveReasons != nil {
+		t.Errorf("Expected no leave reasons, got %+v", message.Event.LeaveReasons)
+	}
+}
+
+func TestClientTakeoverRoomSession(t *testing.T) {
+	atomic.StoreInt32(&takeoverRoomSessionLeaves, 0)
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room-takeover-room-session"
+	roomSessionid := "room-session-id"
+	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, roomSessionid); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if hubRoom := hub.getRoom(roomId); hubRoom == nil {
+		t.Fatalf("Room %s does not exist", roomId)
+	}
+
+	if session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId); session1 == nil {
+		t.Fatalf("There should be a session %s", hello1.Hello.SessionId)
+	}
+
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client3.JoinRoomWithRoomSession(ctx, roomId, roomSessionid+"other"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Wait until both users have joined.
+	WaitForUsersJoined(ctx, t, client1, hello1, client3, hello3)
+
+	// The same user connects again with the same room session.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	if err := client2.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoomWithRoomSession(ctx, roomId, roomSessionid); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// The first client got disconnected with a reason in a "Bye" message.
+	msg, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if msg.Type != "bye" || msg.Bye == nil {
+			t.Errorf("Expected bye message, got %+v", msg)
+		} else if msg.Bye.Reason != "room_session_reconnected" {
+			t.Errorf("Expected reason \"room_session_reconnected\", got %+v", msg.Bye.Reason)
+		}
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err == nil {
+		t.Errorf("Expected error but received %+v", msg)
+	} else if !websocket.IsCloseError(err, GetByeCloseCode(ByeCodeRoomSessionReconnected)) {
+		t.Errorf("Expected close error but received %+v", err)
+	}
+
+	// The first session has been closed
+	if session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId); session1 != nil {
+		t.Errorf("The session %s should have been removed", hello1.Hello.SessionId)
+	}
+
+	// The new client will receive "joined" events for the existing client3 and
+	// himself.
+	if err := client2.RunUntilJoined(ctx, hello3.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// No message about the closing is sent to the new connection.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client2.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+
+	// The permanently connected client will receive no "left" event from the
+	// overridden session but a "joined" for the new session that is marked as
+	// resumed as it replaces the previous connection.
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(msg, "event"); err != nil {
+		t.Error(err)
+	} else if msg.Event.Type != "join" || len(msg.Event.Join) != 1 || msg.Event.Join[0].SessionId != hello2.Hello.SessionId {
+		t.Errorf("Expected join of %s, got %+v", hello2.Hello.SessionId, msg.Event)
+	} else if !msg.Event.Join[0].Resumed {
+		t.Errorf("Expected resumed join, got %+v", msg.Event.Join[0])
+	}
+
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel3()
+
+	if message, err := client3.RunUntilMessage(ctx3); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+
+	time.Sleep(time.Second)
+}
+
+func TestClientTakeoverRoomSessionOtherUser(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room-record-takeover-other-user"
+	roomSessionid := "room-session-id"
+	if _, err := client1.JoinRoomWithRoomSession(ctx, roomId, roomSessionid); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A different user may not move the room session of another user.
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:    roomId,
+			SessionId: roomSessionid,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, ErrorCodeForbidden); err != nil {
+		t.Fatal(err)
+	}
+
+	// The room session was checked before the backend was notified, so the
+	// backend still only knows about the first session.
+	if requests := getRecordedRoomRequests(roomId); len(requests) != 1 {
+		t.Errorf("Expected only the join request of the first session, got %+v", requests)
+	}
+
+	// The first session is still connected and in the room.
+	if session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId); session1 == nil {
+		t.Fatalf("The session %s should still exist", hello1.Hello.SessionId)
+	} else if room := session1.GetRoom(); room == nil || room.Id() != roomId {
+		t.Errorf("The session %s should still be in room %s, got %+v", hello1.Hello.SessionId, roomId, room)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client1.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
+}
+
+func TestHubIsRoomSessionAllowed(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	connect := func(userId string) (*TestClient, *ClientSession) {
+		client := NewTestClient(t, server, hub)
+		if err := client.SendHello(userId); err != nil {
+			t.Fatal(err)
+		}
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, ok := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+		if !ok {
+			t.Fatalf("Expected client session for %s", hello.Hello.SessionId)
+		}
+		return client, session
+	}
+	roomResponse := func(userId string) *BackendClientRoomResponse {
+		data := json.RawMessage(`{"userid":"` + userId + `"}`)
+		return &BackendClientRoomResponse{
+			Session: &data,
+		}
+	}
+
+	client, session := connect(testDefaultUserId)
+	defer client.CloseWithBye()
+
+	if !hub.isRoomSessionAllowed(session, "unknown-room-session", nil) {
+		t.Error("Unknown room sessions should be allowed")
+	}
+
+	if err := hub.roomSessions.SetRoomSession(session, "own-room-session"); err != nil {
+		t.Fatal(err)
+	}
+	if !hub.isRoomSessionAllowed(session, "own-room-session", nil) {
+		t.Error("Own room session should be allowed")
+	}
+
+	// Sessions on other servers are closed over NATS if they belong to the
+	// same backend.
+	remoteId, err := hub.encodeSessionId(hub.newSessionIdData(session.Backend()), publicSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBackendId, err := hub.encodeSessionId(hub.newSessionIdData(&Backend{id: "other-backend"}), publicSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for roomSessionId, tc := range map[string]struct {
+		sessionId string
+		allowed   bool
+	}{
+		"invalid-room-session":       {"not-a-valid-session-id", false},
+		"remote-room-session":        {remoteId, true},
+		"other-backend-room-session": {otherBackendId, false},
+	} {
+		if err := hub.roomSessions.SetRoomSession(&DummySession{
+			publicId: tc.sessionId,
+		}, roomSessionId); err != nil {
+			t.Fatal(err)
+		}
+		if allowed := hub.isRoomSessionAllowed(session, roomSessionId, nil); allowed != tc.allowed {
+			t.Errorf("Expected %t for room session %s of %s, got %t", tc.allowed, roomSessionId, tc.sessionId, allowed)
+		}
+	}
+
+	guestClient1, guest1 := connect(authAnonymousUserId)
+	defer guestClient1.CloseWithBye()
+	guestClient2, guest2 := connect(authAnonymousUserId)
+	defer guestClient2.CloseWithBye()
+
+	// Guests can't be identified by their (empty) user id.
+	if err := hub.roomSessions.SetRoomSession(guest1, "guest-room-session"); err != nil {
+		t.Fatal(err)
+	}
+	if hub.isRoomSessionAllowed(guest2, "guest-room-session", nil) {
+		t.Error("Guest should not take over room session of connected guest")
+	}
+	if hub.isRoomSessionAllowed(guest2, "guest-room-session", roomResponse("guest-user")) {
+		t.Error("Identified guest should not take over room session of unidentified guest")
+	}
+	if hub.isRoomSessionAllowed(session, "guest-room-session", nil) {
+		t.Error("User should not take over room session of guest")
+	}
+
+	// The backend can identify guests in the session data of the room.
+	roomId := "test-room-with-sessiondata"
+	if room, err := guestClient1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	roomSessionId := roomId + "-" + guest1.PublicId()
+	if !hub.isRoomSessionAllowed(guest2, roomSessionId, roomResponse("userid-from-sessiondata")) {
+		t.Error("Guest should take over room session of same guest")
+	}
+	if hub.isRoomSessionAllowed(guest2, roomSessionId, roomResponse("other-guest")) {
+		t.Error("Guest should not take over room session of other guest")
+	}
+	if hub.isRoomSessionAllowed(guest2, roomSessionId, nil) {
+		t.Error("Unidentified guest should not take over room session of identified guest")
+	}
+
+	// Unidentified guests may take over sessions that are no longer connected.
+	guestClient3, guest3 := connect(authAnonymousUserId)
+	defer guestClient3.CloseWithBye()
+	if err := hub.roomSessions.SetRoomSession(guest3, "disconnected-room-session"); err != nil {
+		t.Fatal(err)
+	}
+	guest3.ClearClient(nil)
+	defer guest3.Close()
+	if !hub.isRoomSessionAllowed(guest2, "disconnected-room-session", nil) {
+		t.Error("Guest should take over room session of disconnected guest")
+	}
+}
+
+func TestClientTakeoverRoomSessionOtherServer(t *testing.T) {
+	hub, natsClient, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId)
+	if session == nil {
+		t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+	}
+
+	// Simulate a previous connection of the room session on a different server.
+	roomSessionId := "room-session-other-server"
+	remoteId, err := hub.encodeSessionId(hub.newSessionIdData(session.Backend()), publicSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &DummySession{
+		publicId: remoteId,
+	}
+	if err := hub.roomSessions.SetRoomSession(remote, roomSessionId); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.roomSessions.DeleteRoomSession(remote)
+
+	ch := make(chan *nats.Msg, 1)
+	sub, err := natsClient.Subscribe("session."+remoteId, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe() // nolint
+
+	roomId := "test-room"
+	if room, err := client.JoinRoomWithRoomSession(ctx, roomId, roomSessionId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// The other server is notified to close the previous connection.
+	select {
+	case msg := <-ch:
+		var message NatsMessage
+		if err := natsClient.Decode(msg, &message); err != nil {
+			t.Fatal(err)
+		} else if message.Type != "message" || message.Message == nil {
+			t.Errorf("Expected message, got %+v", message)
+		} else if bye := message.Message; bye.Type != "bye" || bye.Bye == nil || bye.Bye.Reason != ByeCodeRoomSessionReconnected {
+			t.Errorf("Expected reconnect bye, got %+v", bye)
+		}
+	case <-ctx.Done():
+		t.Error(ctx.Err())
+	}
+}
+
+func TestClientSendOfferPermissions(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if session2 == nil {
+		t.Fatalf("Session %s does not exist", hello2.Hello.SessionId)
+	}
+
+	// Client 1 is the moderator
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_SCREEN})
+	// Client 2 is a guest participant.
+	session2.SetPermissions([]Permission{})
+
+	// Client 2 may not send an offer (he doesn't have the necessary permissions).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "sendoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Client 1 may send an offer.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "sendoffer",
+		Sid:      "54321",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test MCU doesn't support clients yet, so an error will be returned
+	// to the client trying to send the offer.
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "client_not_found"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if msg, err := client2.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", msg)
+	}
+}
+
+func TestClientSendOfferPermissionsAudioOnly(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+
+	// Client is allowed to send audio only.
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO})
+
+	// Client may not send an offer with audio and video.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Client may send an offer (audio only).
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioOnly); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSendOfferMcuUnavailable(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	mcu.SetMaxPublishers(0)
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "mcu_unavailable"); err != nil {
+		t.Fatal(err)
+	} else if !msg.Error.Retryable {
+		t.Errorf("Expected retryable error, got %+v", msg.Error)
+	}
+
+	// The offer succeeds once the MCU has capacity again.
+	mcu.SetMaxPublishers(-1)
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioOnly); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSendOfferMcuResponse(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Additional fields of the MCU payload are forwarded.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      testSidAnswerExtraFields,
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "message"); err != nil {
+		t.Fatal(err)
+	} else {
+		var data AnswerOfferMessage
+		if err := json.Unmarshal(*msg.Message.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Type != "answer" {
+			t.Errorf("Expected answer, got %+v", data)
+		}
+		if sdp, ok := data.Payload["sdp"].(string); !ok || sdp != MockSdpAnswerAudioOnly {
+			t.Errorf("Expected sdp %s, got %+v", MockSdpAnswerAudioOnly, data.Payload)
+		}
+		if extra, ok := data.Payload["extra"].(string); !ok || extra != "value" {
+			t.Errorf("Expected extra field in payload, got %+v", data.Payload)
+		}
+	}
+
+	// Invalid answers from the MCU are reported to the client.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      testSidAnswerInvalidSdp,
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "processing_failed"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSendOfferMcuTimeout(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+	hub.mcuTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      testSidAnswerTimeout,
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioOnly,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "timeout"); err != nil {
+		t.Fatal(err)
+	} else if !msg.Error.Retryable {
+		t.Errorf("Expected retryable error, got %+v", msg.Error)
+	}
+}
+
+func TestClientSendOfferPermissionsAudioVideo(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+
+	// Client is allowed to send audio and video.
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+
+	// Client may send an offer (audio and video).
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client is no longer allowed to send video, this will stop the publisher.
+	msg := &BackendServerRoomRequest{
+		Type: "participants",
+		Participants: &BackendRoomParticipantsRequest{
+			Changed: []map[string]interface{}{
+				{
+					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
+					"permissions": []Permission{PERMISSION_MAY_PUBLISH_AUDIO},
+				},
+			},
+			Users: []map[string]interface{}{
+				{
+					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
+					"permissions": []Permission{PERMISSION_MAY_PUBLISH_AUDIO},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+
+	pubs := mcu.GetPublishers()
+	if len(pubs) != 1 {
+		t.Fatalf("expected one publisher, got %+v", pubs)
+	}
+
+loop:
+	for {
+		if err := ctx2.Err(); err != nil {
+			t.Errorf("publisher was not closed: %s", err)
+		}
+
+		for _, pub := range pubs {
+			if pub.isClosed() {
+				break loop
+			}
+		}
+
+		// Give some time to async processing.
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientSendOfferPermissionsAudioVideoMedia(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+
+	// Client is allowed to send audio and video.
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+
+	// Client may send an offer (audio and video).
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client is no longer allowed to send video, this will stop the publisher.
+	msg := &BackendServerRoomRequest{
+		Type: "participants",
+		Participants: &BackendRoomParticipantsRequest{
+			Changed: []map[string]interface{}{
+				{
+					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
+					"permissions": []Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_CONTROL},
+				},
+			},
+			Users: []map[string]interface{}{
+				{
+					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
+					"permissions": []Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_CONTROL},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel2()
+
+	pubs := mcu.GetPublishers()
+	if len(pubs) != 1 {
+		t.Fatalf("expected one publisher, got %+v", pubs)
+	}
+
+loop:
+	for {
+		if err := ctx2.Err(); err != nil {
+			if err != context.DeadlineExceeded {
+				t.Errorf("error while waiting for publisher: %s", err)
+			}
+			break
+		}
+
+		for _, pub := range pubs {
+			if pub.isClosed() {
+				t.Errorf("publisher was closed")
+				break loop
+			}
+		}
+
+		// Give some time to async processing.
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientRequestOfferNotInRoom(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, "roomsession1"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may not request an offer (he is not in the room yet).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may not request an offer (he is not in the call yet).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate request from the backend that somebody joined the call.
+	users1 := []map[string]interface{}{
+		{
+			"sessionId": hello2.Hello.SessionId,
+			"inCall":    1,
+		},
+	}
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	room.PublishUsersInCallChanged(users1, users1)
+	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may not request an offer (recipient is not in the call yet).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate request from the backend that somebody joined the call.
+	users2 := []map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+			"inCall":    1,
+		},
+	}
+	room.PublishUsersInCallChanged(users2, users2)
+	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may request an offer now (both are in the same room and call).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		// We check for "client_not_found" as the testing MCU doesn't support publishing/subscribing.
+		if err := checkMessageError(msg, "client_not_found"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+func TestNoSendBetweenSessionsOnDifferentBackends(t *testing.T) {
+	// Clients can't send messages to sessions connected from other backends.
+	hub, _, _, server, shutdown := CreateHubWithMultipleBackendsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	params1 := TestBackendClientAuthParams{
+		UserId: "user1",
+	}
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	params2 := TestBackendClientAuthParams{
+		UserId: "user2",
+	}
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient2, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient1, data2) // nolint
+
+	var payload string
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel3()
+	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+}
+
+func TestNoSameRoomOnDifferentBackends(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubWithMultipleBackendsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	params1 := TestBackendClientAuthParams{
+		UserId: "user1",
+	}
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	params2 := TestBackendClientAuthParams{
+		UserId: "user2",
+	}
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	msg1, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := client1.checkMessageJoined(msg1, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	msg2, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := client2.checkMessageJoined(msg2, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	hub.ru.RLock()
+	var rooms []*Room
+	for _, room := range hub.rooms {
+		defer room.Close()
+		rooms = append(rooms, room)
+	}
+	hub.ru.RUnlock()
+
+	if len(rooms) != 2 {
+		t.Errorf("Expected 2 rooms, got %+v", rooms)
+	}
+
+	if rooms[0].IsEqual(rooms[1]) {
+		t.Errorf("Rooms should be different: %+v", rooms)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient, data2) // nolint
+
+	var payload string
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel3()
+	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+}
+
+func TestClientHelloBackendFeatures(t *testing.T) {
+	hub, _, r, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend2", "features", "transient-data")
+		return config, nil
+	})
+	defer shutdown()
+	registerBackendHandlerUrl(t, r, "/one")
+	registerBackendHandlerUrl(t, r, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloParams(server.URL+"/one", "client", TestBackendClientAuthParams{UserId: "user1"}); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hello1.Hello.Server.Features, hub.info.Features) {
+		t.Errorf("Expected all features %+v, got %+v", hub.info.Features, hello1.Hello.Server.Features)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloParams(server.URL+"/two", "client", TestBackendClientAuthParams{UserId: "user2"}); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test hub doesn't have a MCU, so "mcu" is not advertised.
+	expected := []string{ServerFeatureTransientData}
+	if !reflect.DeepEqual(hello2.Hello.Server.Features, expected) {
+		t.Errorf("Expected features %+v, got %+v", expected, hello2.Hello.Server.Features)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClientHelloNegotiatedFeatures(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("clients", "disabled_features", ServerFeatureChangePrevious)
+		config.AddOption("backend2", "features", ServerFeatureMcu+", "+ServerFeatureChangePrevious)
+		config.AddOption("backend2", "disabled_features", "")
+		return config, nil
+	})
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	allFeatures := []string{
+		ServerFeatureRoomPropertiesPatch,
+		ServerFeatureChangePrevious,
+		ServerFeatureLeaveReasons,
+		ServerFeatureCandidates,
+		"foo",
+	}
+	testcases := []struct {
+		url         string
+		features    []string
+		expected    []string
+		notExpected []string
+	}{
+		// The globally disabled and unknown features are not enabled.
+		{
+			server.URL + "/one",
+			allFeatures,
+			[]string{ServerFeatureMcu, ServerFeatureRoomPropertiesPatch, ServerFeatureCandidates, ServerFeatureLeaveReasons},
+			[]string{ServerFeatureChangePrevious, "foo"},
+		},
+		// Negotiated features must be included by the client.
+		{
+			server.URL + "/one",
+			nil,
+			[]string{ServerFeatureMcu},
+			NegotiatedFeatures,
+		},
+		// The backend only allows some features.
+		{
+			server.URL + "/two",
+			allFeatures,
+			[]string{ServerFeatureMcu, ServerFeatureChangePrevious},
+			[]string{ServerFeatureRoomPropertiesPatch, ServerFeatureCandidates, ServerFeatureLeaveReasons, "foo"},
+		},
+	}
+	for idx, tc := range testcases {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		params, err := json.Marshal(TestBackendClientAuthParams{
+			UserId: testDefaultUserId,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "1234",
+			Type: "hello",
+			Hello: &HelloClientMessage{
+				Version:  HelloVersion,
+				Features: tc.features,
+				Auth: HelloClientMessageAuth{
+					Url:    tc.url,
+					Params: (*json.RawMessage)(&params),
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+		for _, f := range tc.expected {
+			if !containsString(hello.Hello.Features, f) {
+				t.Errorf("Expected feature %s in testcase %d, got %+v", f, idx, hello.Hello.Features)
+			}
+		}
+		for _, f := range tc.notExpected {
+			if containsString(hello.Hello.Features, f) {
+				t.Errorf("Expected no feature %s in testcase %d, got %+v", f, idx, hello.Hello.Features)
+			}
+			if isNegotiatedFeature(f) && session.HasFeature(f) {
+				t.Errorf("Feature %s should not be enabled for the session in testcase %d", f, idx)
+			}
+		}
+		for _, f := range hello.Hello.Features {
+			if !containsString(hello.Hello.Server.Features, f) {
+				t.Errorf("Feature %s in testcase %d is not advertised by the server %+v", f, idx, hello.Hello.Server.Features)
+			}
+		}
+	}
+}
+
+func TestHubFilterDisabledFeatures(t *testing.T) {
+	h := &Hub{
+		disabledFeatures: []string{"foo", "bar"},
+	}
+	features := []string{"foo", "baz", "bar", "lala"}
+	expected := []string{"baz", "lala"}
+	if filtered := h.filterDisabledFeatures("session", nil, features); !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, filtered)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1, backend2, backend3")
+	config.AddOption("backend1", "url", "https://domain1.invalid")
+	config.AddOption("backend1", "secret", string(testBackendSecret))
+	config.AddOption("backend2", "url", "https://domain2.invalid")
+	config.AddOption("backend2", "secret", string(testBackendSecret))
+	config.AddOption("backend2", "disabled_features", "lala")
+	config.AddOption("backend3", "url", "https://domain3.invalid")
+	config.AddOption("backend3", "secret", string(testBackendSecret))
+	config.AddOption("backend3", "disabled_features", "")
+	cfg, err := NewBackendConfiguration(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.Close()
+
+	testcases := []struct {
+		url      string
+		expected []string
+	}{
+		// Uses the global configuration.
+		{"https://domain1.invalid", []string{"baz", "lala"}},
+		// Overrides the global configuration.
+		{"https://domain2.invalid", []string{"foo", "baz", "bar"}},
+		// Enables all features.
+		{"https://domain3.invalid", features},
+	}
+	for _, test := range testcases {
+		u, _ := url.ParseRequestURI(test.url)
+		backend := cfg.GetBackend(u)
+		if backend == nil {
+			t.Fatalf("Expected backend for %s", test.url)
+		}
+		if filtered := h.filterDisabledFeatures("session", backend, features); !reflect.DeepEqual(filtered, test.expected) {
+			t.Errorf("Expected %+v for %s, got %+v", test.expected, test.url, filtered)
+		}
+	}
+}
+
+func checkMessageRoomCounts(message *ServerMessage, joined int, left int, sessions int) error {
+	if err := checkMessageType(message, "event"); err != nil {
+		return err
+	} else if message.Event.Target != "room" || message.Event.Type != "counts" {
+		return fmt.Errorf("Expected room counts event, got %+v", message.Event)
+	} else if counts := message.Event.Counts; counts == nil {
+		return fmt.Errorf("Expected counts in %+v", message.Event)
+	} else if counts.Joined != joined || counts.Left != left || counts.Sessions != sessions {
+		return fmt.Errorf("Expected %d joined, %d left and %d sessions, got %+v", joined, left, sessions, counts)
+	}
+	return nil
+}
+
+func TestClientSubscriptionCounts(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:      HelloVersion,
+			Subscription: SubscriptionLevelCounts,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
 		t.Fatal(err)
 	}
 	client2 := NewTestClient(t, server, hub)
@@ -1336,38 +6758,53 @@ func TestClientMessageToSessionId(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	if session := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession); session.SubscriptionLevel() != SubscriptionLevelCounts {
+		t.Errorf("Expected subscription %s, got %s", SubscriptionLevelCounts, session.SubscriptionLevel())
+	}
+	if session := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession); session.SubscriptionLevel() != SubscriptionLevelAll {
+		t.Errorf("Expected subscription %s, got %s", SubscriptionLevelAll, session.SubscriptionLevel())
 	}
 
-	recipient1 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomCounts(message, 1, 0, 1); err != nil {
+		t.Error(err)
 	}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient2, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient1, data2) // nolint
-
-	var payload string
-	if err := checkReceiveClientMessage(ctx, client1, "session", hello2.Hello, &payload); err != nil {
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	// Sessions with the default subscription receive the full events.
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
 		t.Error(err)
-	} else if payload != data2 {
-		t.Errorf("Expected payload %s, got %s", data2, payload)
 	}
-	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomCounts(message, 1, 0, 2); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomCounts(message, 0, 1, 1); err != nil {
 		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
 	}
 }
 
-func TestClientMessageToUserId(t *testing.T) {
+func TestClientSubscriptionCountsResume(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
@@ -1378,7 +6815,24 @@ func TestClientMessageToUserId(t *testing.T) {
 	}
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:      HelloVersion,
+			Subscription: SubscriptionLevelCounts,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1394,240 +6848,456 @@ func TestClientMessageToUserId(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	} else if hello1.Hello.UserId == hello2.Hello.UserId {
-		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	roomId := "test-room"
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomCounts(message, 1, 0, 1); err != nil {
+		t.Error(err)
 	}
 
-	recipient1 := MessageClientMessageRecipient{
-		Type:   "user",
-		UserId: hello1.Hello.UserId,
+	users := []map[string]interface{}{
+		{
+			"sessionId": "the-session-id",
+			"inCall":    1,
+		},
 	}
-	recipient2 := MessageClientMessageRecipient{
-		Type:   "user",
-		UserId: hello2.Hello.UserId,
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
 	}
+	room.PublishUsersInCallChanged(users, users)
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient2, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient1, data2) // nolint
-
-	var payload string
-	if err := checkReceiveClientMessage(ctx, client1, "user", hello2.Hello, &payload); err != nil {
+	client2.Close()
+	if err := client2.WaitForClientRemoved(ctx); err != nil {
 		t.Error(err)
-	} else if payload != data2 {
-		t.Errorf("Expected payload %s, got %s", data2, payload)
 	}
 
-	if err := checkReceiveClientMessage(ctx, client2, "user", hello1.Hello, &payload); err != nil {
+	client2 = NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if hello, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.SessionId != hello2.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello2.Hello.SessionId, hello.Hello)
+	}
+
+	// No participants update is sent to sessions that only subscribed counts,
+	// so the next message is the one from the other client.
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+	data := map[string]interface{}{
+		"foo": "bar",
+	}
+	if err := client1.SendMessage(recipient2, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload map[string]interface{}
+	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
 		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
+	} else if !reflect.DeepEqual(payload, data) {
+		t.Errorf("Expected payload %+v, got %+v", data, payload)
 	}
 }
 
-func TestClientMessageToUserIdMultipleSessions(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientJoinRoomMaxParticipants(t *testing.T) {
+	maxParticipants := 3
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "maxparticipants", strconv.Itoa(maxParticipants))
+		return config, nil
+	})
 	defer shutdown()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	var clients []*TestClient
+	for i := 0; i < maxParticipants+1; i++ {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+		if err := client.SendHello(testDefaultUserId + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.RunUntilHello(ctx); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+
+	// The first session creates the room, the others join concurrently.
+	roomId := "test-room"
+	if room, err := clients[0].JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-	client2a := NewTestClient(t, server, hub)
-	defer client2a.CloseWithBye()
-	if err := client2a.SendHello(testDefaultUserId + "2"); err != nil {
+
+	var wg sync.WaitGroup
+	for _, client := range clients[1:] {
+		wg.Add(1)
+		go func(client *TestClient) {
+			defer wg.Done()
+			if err := client.WriteJSON(&ClientMessage{
+				Id:   "ABCD",
+				Type: "room",
+				Room: &RoomClientMessage{
+					RoomId: roomId,
+				},
+			}); err != nil {
+				t.Error(err)
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	var rejected *TestClient
+	joined := []*TestClient{clients[0]}
+	for _, client := range clients[1:] {
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type == "error" {
+			if err := checkMessageError(message, "room_full"); err != nil {
+				t.Error(err)
+			} else if rejected != nil {
+				t.Error("Expected only one session to be rejected")
+			}
+			rejected = client
+		} else if err := checkMessageRoomId(message, roomId); err != nil {
+			t.Error(err)
+		} else {
+			joined = append(joined, client)
+		}
+	}
+	if rejected == nil {
+		t.Fatal("Expected one session to be rejected")
+	} else if len(joined) != maxParticipants {
+		t.Fatalf("Expected %d joined sessions, got %d", maxParticipants, len(joined))
+	}
+
+	// Participants leaving the room free their slot.
+	if err := joined[0].WriteJSON(&ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId: "",
+		},
+	}); err != nil {
 		t.Fatal(err)
 	}
-	client2b := NewTestClient(t, server, hub)
-	defer client2b.CloseWithBye()
-	if err := client2b.SendHello(testDefaultUserId + "2"); err != nil {
+	for {
+		// Skip events of the other sessions joining.
+		message, err := joined[0].RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if message.Type != "room" {
+			continue
+		} else if err := checkMessageRoomId(message, ""); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	if room, err := rejected.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
+}
+
+func TestClientJoinRoomMaxParticipantsKeepsRoom(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "maxparticipants", "1")
+		return config, nil
+	})
+	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
-	hello2a, err := client2a.RunUntilHello(ctx)
-	if err != nil {
+	if _, err := client1.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
 	}
-	hello2b, err := client2b.RunUntilHello(ctx)
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2a.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	} else if hello1.Hello.SessionId == hello2b.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	} else if hello2a.Hello.SessionId == hello2b.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello2a.Hello.SessionId)
+	fullRoomId := "test-room-record-full"
+	if room, err := client1.JoinRoom(ctx, fullRoomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != fullRoomId {
+		t.Fatalf("Expected room %s, got %s", fullRoomId, room.Room.RoomId)
 	}
-	if hello1.Hello.UserId == hello2a.Hello.UserId {
-		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
-	} else if hello1.Hello.UserId == hello2b.Hello.UserId {
-		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
-	} else if hello2a.Hello.UserId != hello2b.Hello.UserId {
-		t.Fatalf("Expected the same user ids, got %s and %s", hello2a.Hello.UserId, hello2b.Hello.UserId)
+
+	roomId := "test-room-record-other"
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
 	}
 
-	recipient := MessageClientMessageRecipient{
-		Type:   "user",
-		UserId: hello2a.Hello.UserId,
+	roomSessionId := fullRoomId + "-" + hello2.Hello.SessionId
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:    fullRoomId,
+			SessionId: roomSessionId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "room_full"); err != nil {
+		t.Error(err)
 	}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient, data1) // nolint
+	// The session stays in its previous room and the backend is notified that
+	// it didn't join the full room.
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if room := session2.GetRoom(); room == nil || room.Id() != roomId {
+		t.Errorf("Expected session to stay in room %s, got %+v", roomId, room)
+	}
+	waitForRecordedRoomRequests(ctx, t, fullRoomId, []string{
+		"join:" + fullRoomId + ":" + roomSessionId,
+		"leave:" + fullRoomId + ":" + roomSessionId,
+	}, "")
+	if requests := getRecordedRoomRequests(roomId); len(requests) != 1 {
+		t.Errorf("Expected only the join request for room %s, got %+v", roomId, requests)
+	}
+}
+
+func TestClientMessageRate(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "messagerate", "2")
+		config.AddOption("backend2", "messagerate", "0")
+		return config, nil
+	})
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
 
-	// Both clients will receive the message as it was sent to the user.
-	var payload string
-	if err := checkReceiveClientMessage(ctx, client2a, "user", hello1.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
-	}
-	if err := checkReceiveClientMessage(ctx, client2b, "user", hello1.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
 	}
-}
-
-func WaitForUsersJoined(ctx context.Context, t *testing.T, client1 *TestClient, hello1 *ServerMessage, client2 *TestClient, hello2 *ServerMessage) {
-	// We will receive "joined" events for all clients. The ordering is not
-	// defined as messages are processed and sent by asynchronous NATS handlers.
-	msg1_1, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params); err != nil {
+		t.Fatal(err)
 	}
-	msg1_2, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params); err != nil {
+		t.Fatal(err)
 	}
-	msg2_1, err := client2.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+
+	// The enforced rate is advertised in the hello response.
+	if hello, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.MaxMessageRate != 2 {
+		t.Errorf("Expected message rate 2, got %+v", hello.Hello)
 	}
-	msg2_2, err := client2.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+	if hello, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.MaxMessageRate != 0 {
+		t.Errorf("Expected unlimited message rate, got %+v", hello.Hello)
 	}
 
-	if err := client1.checkMessageJoined(msg1_1, hello1.Hello); err != nil {
-		// Ordering is "joined" from client 2, then from client 1
-		if err := client1.checkMessageJoined(msg1_1, hello2.Hello); err != nil {
-			t.Error(err)
-		}
-		if err := client1.checkMessageJoined(msg1_2, hello1.Hello); err != nil {
-			t.Error(err)
-		}
-	} else {
-		// Ordering is "joined" from client 1, then from client 2
-		if err := client1.checkMessageJoined(msg1_2, hello2.Hello); err != nil {
-			t.Error(err)
+	for i := 0; i < 3; i++ {
+		for _, client := range []*TestClient{client1, client2} {
+			if err := client.WriteJSON(&ClientMessage{
+				Id:   strconv.Itoa(i),
+				Type: "capabilities",
+			}); err != nil {
+				t.Fatal(err)
+			}
 		}
 	}
-	if err := client2.checkMessageJoined(msg2_1, hello1.Hello); err != nil {
-		// Ordering is "joined" from client 2, then from client 1
-		if err := client2.checkMessageJoined(msg2_1, hello2.Hello); err != nil {
-			t.Error(err)
-		}
-		if err := client2.checkMessageJoined(msg2_2, hello1.Hello); err != nil {
+
+	for i := 0; i < 3; i++ {
+		if message, err := client1.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if i < 2 {
+			if err := checkMessageType(message, "capabilities"); err != nil {
+				t.Error(err)
+			}
+		} else if err := checkMessageError(message, "rate_limited"); err != nil {
 			t.Error(err)
+		} else {
+			var details RateLimitedErrorDetails
+			if !message.Error.Retryable {
+				t.Errorf("Expected retryable error, got %+v", message.Error)
+			} else if err := message.Error.DecodeDetails(&details); err != nil {
+				t.Error(err)
+			} else if details.RetryAfter < 1 {
+				t.Errorf("Expected retry delay, got %+v", details)
+			}
 		}
-	} else {
-		// Ordering is "joined" from client 1, then from client 2
-		if err := client2.checkMessageJoined(msg2_2, hello2.Hello); err != nil {
+
+		if message, err := client2.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(message, "capabilities"); err != nil {
 			t.Error(err)
 		}
 	}
 }
 
-func TestClientMessageToRoom(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientRoomSwitchRate(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfigWithMultipleBackends(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "roomswitchrate", "4")
+		config.AddOption("backend2", "roomswitchrate", "0")
+		return config, nil
+	})
 	defer shutdown()
 
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params); err != nil {
 		t.Fatal(err)
 	}
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
+	if _, err := client1.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
 	}
-
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params); err != nil {
 		t.Fatal(err)
 	}
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
+	if _, err := client2.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	} else if hello1.Hello.UserId == hello2.Hello.UserId {
-		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
-	}
+	switchRoom := func(client *TestClient, id int, roomId string) *ServerMessage {
+		t.Helper()
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   strconv.Itoa(id),
+			Type: "room",
+			Room: &RoomClientMessage{
+				RoomId:    roomId,
+				SessionId: roomId + "-" + client.publicId,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
 
-	// Join room by id.
-	roomId := "test-room"
-	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
-		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		// Skip any join / leave events until the response is received.
+		for {
+			message, err := client.RunUntilMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.Id == strconv.Itoa(id) {
+				return message
+			}
+		}
 	}
 
-	// Give message processing some time.
-	time.Sleep(10 * time.Millisecond)
+	// Rapidly switching rooms is throttled, leaving a room also counts.
+	rooms := []string{"test-room-1", "test-room-2", "", "test-room-1", "test-room-2", ""}
+	for i, roomId := range rooms {
+		if message := switchRoom(client1, i, roomId); i < 4 {
+			if err := checkMessageType(message, "room"); err != nil {
+				t.Errorf("%d: %s", i, err)
+			} else if message.Room.RoomId != roomId {
+				t.Errorf("%d: expected room %s, got %+v", i, roomId, message.Room)
+			}
+		} else if err := checkMessageError(message, "rate_limited"); err != nil {
+			t.Errorf("%d: %s", i, err)
+		}
 
-	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
-		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		if message := switchRoom(client2, i, roomId); message.Type != "room" || message.Room.RoomId != roomId {
+			t.Errorf("%d: expected room %s, got %+v", i, roomId, message)
+		}
 	}
 
-	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
-
-	recipient := MessageClientMessageRecipient{
-		Type: "room",
+	// Joining the room the session is already in is not a room switch.
+	if message := switchRoom(client1, len(rooms), "test-room-1"); checkMessageType(message, "room") != nil || message.Room.RoomId != "test-room-1" {
+		t.Errorf("Expected room test-room-1, got %+v", message)
 	}
+}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient, data2) // nolint
-
-	var payload string
-	if err := checkReceiveClientMessage(ctx, client1, "room", hello2.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data2 {
-		t.Errorf("Expected payload %s, got %s", data2, payload)
-	}
+func getRoomForTest(hub *Hub, roomId string) *Room {
+	hub.ru.RLock()
+	defer hub.ru.RUnlock()
 
-	if err := checkReceiveClientMessage(ctx, client2, "room", hello1.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
+	for _, room := range hub.rooms {
+		if room.Id() == roomId {
+			return room
+		}
 	}
+	return nil
 }
 
-func TestJoinRoom(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestEmptyRoomTimeout(t *testing.T) {
+	emptyRoomTimeout := 30 * time.Second
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("clients", "emptyroomtimeout", strconv.Itoa(int(emptyRoomTimeout.Seconds())))
+		return config, nil
+	})
 	defer shutdown()
 
 	client := NewTestClient(t, server, hub)
@@ -1645,450 +7315,729 @@ func TestJoinRoom(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
 	roomId := "test-room"
 	if room, err := client.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
 
-	// We will receive a "joined" event.
+	room := getRoomForTest(hub, roomId)
+	if room == nil {
+		t.Fatalf("Room %s not found", roomId)
+	}
+	room.SetTransientData("foo", "bar")
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "transient"); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+
+	// The room is kept during the grace period.
+	performHousekeeping(hub, time.Now().Add(emptyRoomTimeout-time.Second)).Wait()
+	if r := getRoomForTest(hub, roomId); r != room {
+		t.Fatalf("Expected room %+v, got %+v", room, r)
+	}
+
+	// Rejoining preserves the room and its transient data.
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "transient"); err != nil {
+		t.Error(err)
+	} else if message.TransientData.Type != "initial" || message.TransientData.Data["foo"] != "bar" {
+		t.Errorf("Expected initial transient data, got %+v", message.TransientData)
+	}
 	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
 		t.Error(err)
 	}
+	if r := getRoomForTest(hub, roomId); r != room {
+		t.Fatalf("Expected room %+v, got %+v", room, r)
+	}
+	if data := room.transientData.GetData(); data["foo"] != "bar" {
+		t.Errorf("Expected transient data to be preserved, got %+v", data)
+	}
 
-	// Leave room.
 	if room, err := client.JoinRoom(ctx, ""); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != "" {
 		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
 	}
+
+	// The room is removed after the grace period.
+	performHousekeeping(hub, time.Now().Add(emptyRoomTimeout+time.Second)).Wait()
+	if r := getRoomForTest(hub, roomId); r != nil {
+		t.Errorf("Expected room to be removed, got %+v", r)
+	}
+
+	// Removing the room doesn't send any events.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	}
 }
 
-func TestExpectAnonymousJoinRoom(t *testing.T) {
+func checkMessagePresence(message *ServerMessage, sessionId string, state string) error {
+	if err := checkMessageType(message, "presence"); err != nil {
+		return err
+	} else if message.Presence.SessionId != sessionId {
+		return fmt.Errorf("Expected presence of %s, got %+v", sessionId, message.Presence)
+	} else if message.Presence.State != state {
+		return fmt.Errorf("Expected state %s, got %+v", state, message.Presence)
+	}
+	return nil
+}
+
+func TestClientPresence(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
-	client := NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
 
-	if err := client.SendHello(authAnonymousUserId); err != nil {
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
-
-	hello, err := client.RunUntilHello(ctx)
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
 	if err != nil {
-		t.Error(err)
-	} else {
-		if hello.Hello.UserId != "" {
-			t.Errorf("Expected an anonymous user, got %+v", hello.Hello)
-		}
-		if hello.Hello.SessionId == "" {
-			t.Errorf("Expected session id, got %+v", hello.Hello)
-		}
-		if hello.Hello.ResumeId == "" {
-			t.Errorf("Expected resume id, got %+v", hello.Hello)
+		t.Fatal(err)
+	}
+
+	presence := func(client *TestClient, state string) {
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "presence",
+			Type: "presence",
+			Presence: &PresenceClientMessage{
+				State: state,
+			},
+		}); err != nil {
+			t.Fatal(err)
 		}
 	}
 
-	// Perform housekeeping in the future, this will cause the connection to
-	// be terminated because the anonymous client didn't join a room.
-	performHousekeeping(hub, time.Now().Add(anonmyousJoinRoomTimeout+time.Second))
+	// Presence updates require a room.
+	presence(client1, PresenceStateTyping)
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_in_room"); err != nil {
+		t.Error(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
 
-	message, err := client.RunUntilMessage(ctx)
-	if err != nil {
+	presence(client1, PresenceStateTyping)
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessagePresence(message, hello1.Hello.SessionId, PresenceStateTyping); err != nil {
 		t.Error(err)
 	}
 
-	if err := checkMessageType(message, "bye"); err != nil {
+	// Repeated updates with the same state are coalesced.
+	presence(client1, PresenceStateTyping)
+	presence(client1, PresenceStateAway)
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessagePresence(message, hello1.Hello.SessionId, PresenceStateAway); err != nil {
 		t.Error(err)
-	} else if message.Bye.Reason != "room_join_timeout" {
-		t.Errorf("Expected \"room_join_timeout\" reason, got %+v", message.Bye)
 	}
 
-	// Both the client and the session get removed from the hub.
-	if err := client.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
-	}
-	if err := client.WaitForSessionRemoved(ctx, hello.Hello.SessionId); err != nil {
+	// The sender doesn't receive its own presence.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client1.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
 		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
 	}
 }
 
-func TestJoinRoomChange(t *testing.T) {
+func TestClientParticipantsSnapshot(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
-	client := NewTestClient(t, server, hub)
-	defer client.CloseWithBye()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
 
-	if err := client.SendHello(testDefaultUserId); err != nil {
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
-
-	hello, err := client.RunUntilHello(ctx)
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
+	requestParticipants := func(client *TestClient, roomId string) *ServerMessage {
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "participants",
+			Type: "participants",
+			Participants: &ParticipantsClientMessage{
+				RoomId: roomId,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+
 	roomId := "test-room"
-	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+	// The session must be in the requested room.
+	if message := requestParticipants(client1, roomId); checkMessageError(message, "not_in_room") != nil {
+		t.Errorf("Expected not_in_room error, got %+v", message)
+	}
+
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
 
-	// We will receive a "joined" event.
-	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
-		t.Error(err)
-	}
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
 
-	// Change room.
-	roomId = "other-test-room"
-	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
 
-	// We will receive a "joined" event.
-	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
-		t.Error(err)
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	if message := requestParticipants(client1, roomId+"-other"); checkMessageError(message, "not_in_room") != nil {
+		t.Errorf("Expected not_in_room error, got %+v", message)
 	}
 
-	// Leave room.
-	if room, err := client.JoinRoom(ctx, ""); err != nil {
+	message := requestParticipants(client1, roomId)
+	if err := checkMessageType(message, "event"); err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != "" {
-		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	} else if message.Id != "participants" || message.Event.Target != "room" || message.Event.Type != "snapshot" {
+		t.Fatalf("Expected snapshot event, got %+v", message.Event)
+	}
+
+	expected := map[string]string{
+		hello1.Hello.SessionId: testDefaultUserId + "1",
+		hello2.Hello.SessionId: testDefaultUserId + "2",
+	}
+	if len(message.Event.Join) != len(expected) {
+		t.Fatalf("Expected %d sessions, got %+v", len(expected), message.Event.Join)
+	}
+	for _, entry := range message.Event.Join {
+		if userId, found := expected[entry.SessionId]; !found {
+			t.Errorf("Unexpected session %+v", entry)
+		} else if entry.UserId != userId {
+			t.Errorf("Expected user %s for %s, got %+v", userId, entry.SessionId, entry)
+		} else if entry.RoomSessionId != roomId+"-"+entry.SessionId {
+			t.Errorf("Expected room session id for %s, got %+v", entry.SessionId, entry)
+		}
 	}
 }
 
-func TestJoinMultiple(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientObserver(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		// Observers are not counting to the maximum participants.
+		config.AddOption("backend", "maxparticipants", "1")
+		return config, nil
+	})
 	defer shutdown()
 
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
 	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
-
-	hello1, err := client1.RunUntilHello(ctx)
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId:   testDefaultUserId + "2",
+		Observer: true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			Observer: true,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
 	hello2, err := client2.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	if session := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession); !session.IsObserver() {
+		t.Errorf("Expected session %s to be an observer", session.PublicId())
 	}
 
-	// Join room by id (first client).
 	roomId := "test-room"
 	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-
-	// We will receive a "joined" event.
 	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
 		t.Error(err)
 	}
 
-	// Join room by id (second client).
 	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
+	// The observer receives the sessions in the room but not itself.
+	if err := client2.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
 
-	// We will receive a "joined" event for the first and the second client.
-	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+	// Observers may not send messages.
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+	client2.SendMessage(recipient, "from-observer") // nolint
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
 		t.Error(err)
 	}
-	// The first client will also receive a "joined" event from the second client.
-	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+	controlData, err := json.Marshal("from-observer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "control",
+		Type: "control",
+		Control: &ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: recipient,
+				Data:      (*json.RawMessage)(&controlData),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
 		t.Error(err)
 	}
 
-	// Leave room.
-	if room, err := client1.JoinRoom(ctx, ""); err != nil {
+	transientValue := json.RawMessage(`"value"`)
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "transient",
+		Type: "transient",
+		TransientData: &TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &transientValue,
+		},
+	}); err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != "" {
-		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
+		t.Error(err)
+	} else if !strings.HasPrefix(message.Error.Message, "Observers") {
+		t.Errorf("Expected observer error, got %+v", message.Error)
+	}
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "kick",
+		Type: "kick",
+		Kick: &KickClientMessage{
+			SessionId: hello1.Hello.SessionId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
+		t.Error(err)
+	} else if !strings.HasPrefix(message.Error.Message, "Observers") {
+		t.Errorf("Expected observer error, got %+v", message.Error)
 	}
 
-	// The second client will now receive a "left" event
-	if err := client2.RunUntilLeft(ctx, hello1.Hello); err != nil {
+	// Observers still receive messages.
+	data := "from-1-to-room"
+	client1.SendMessage(recipient, data) // nolint
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client2, "room", hello1.Hello, &payload); err != nil {
 		t.Error(err)
+	} else if payload != data {
+		t.Errorf("Expected payload %s, got %s", data, payload)
 	}
 
+	// Other sessions don't see the observer joining or leaving.
 	if room, err := client2.JoinRoom(ctx, ""); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != "" {
 		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
 	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client1.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
+	}
 }
 
-func TestJoinRoomSwitchClient(t *testing.T) {
+func TestClientObserverNotAllowed(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
 	client := NewTestClient(t, server, hub)
 	defer client.CloseWithBye()
-
-	if err := client.SendHello(testDefaultUserId); err != nil {
+	// The backend doesn't allow the user to connect as observer.
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			Observer: true,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
 		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Error(err)
 	}
+}
+
+func TestClientMessageStats(t *testing.T) {
+	collectAndLint(t, messageStats...)
+
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello, err := client.RunUntilHello(ctx)
-	if err != nil {
+	helloCount := testutil.ToFloat64(statsClientMessagesTotal.WithLabelValues("hello"))
+	otherCount := testutil.ToFloat64(statsClientMessagesTotal.WithLabelValues(statsLabelOther))
+	invalidFormatCount := testutil.ToFloat64(statsClientErrorsTotal.WithLabelValues("invalid_format"))
+	byeCount := testutil.ToFloat64(statsClientByesTotal.WithLabelValues(statsLabelNone))
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
 		t.Fatal(err)
 	}
-
-	// Join room by id.
-	roomId := "test-room-slow"
-	msg := &ClientMessage{
-		Id:   "ABCD",
-		Type: "room",
-		Room: &RoomClientMessage{
-			RoomId:    roomId,
-			SessionId: roomId + "-" + hello.Hello.SessionId,
-		},
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
 	}
-	if err := client.WriteJSON(msg); err != nil {
+
+	checkStatsValue(t, statsClientMessagesTotal.WithLabelValues("hello"), helloCount+1)
+
+	// Unknown message types are counted as "other" and rejected. Send without
+	// validating the message locally.
+	if err := client.conn.WriteJSON(&ClientMessage{
+		Id:   "foo",
+		Type: "some-unknown-type",
+	}); err != nil {
 		t.Fatal(err)
 	}
-	// Wait a bit to make sure request is sent before closing client.
-	time.Sleep(1 * time.Millisecond)
-	client.Close()
-	if err := client.WaitForClientRemoved(ctx); err != nil {
+	// Parsing errors are reported to the client.
+	if err := client.WriteJSON("not-a-message"); err != nil {
 		t.Fatal(err)
 	}
+	for i := 0; i < 2; i++ {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, "invalid_format"); err != nil {
+			t.Error(err)
+		}
+	}
 
-	// The client needs some time to reconnect.
-	time.Sleep(200 * time.Millisecond)
+	checkStatsValue(t, statsClientMessagesTotal.WithLabelValues(statsLabelOther), otherCount+1)
+	checkStatsValue(t, statsClientErrorsTotal.WithLabelValues("invalid_format"), invalidFormatCount+2)
 
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHelloResume(hello.Hello.ResumeId); err != nil {
+	if err := client.SendBye(); err != nil {
 		t.Fatal(err)
 	}
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "bye"); err != nil {
 		t.Error(err)
-	} else {
-		if hello2.Hello.UserId != testDefaultUserId {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello2.Hello)
+	}
+
+	checkStatsValue(t, statsClientByesTotal.WithLabelValues(statsLabelNone), byeCount+1)
+}
+
+func TestSessionsForBackend(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubWithMultipleBackendsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	var clients []*TestClient
+	var hellos []*ServerMessage
+	for _, u := range []string{"/one", "/two", "/two"} {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		params := TestBackendClientAuthParams{
+			UserId: testDefaultUserId + strconv.Itoa(len(clients)),
 		}
-		if hello2.Hello.SessionId != hello.Hello.SessionId {
-			t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+		if err := client.SendHelloParams(server.URL+u, "client", params); err != nil {
+			t.Fatal(err)
 		}
-		if hello2.Hello.ResumeId != hello.Hello.ResumeId {
-			t.Errorf("Expected resume id %s, got %+v", hello.Hello.ResumeId, hello2.Hello)
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
 		}
+		clients = append(clients, client)
+		hellos = append(hellos, hello)
 	}
 
-	room, err := client2.RunUntilMessage(ctx)
-	if err != nil {
-		t.Fatal(err)
+	if sessions := hub.SessionsForBackend("backend1"); len(sessions) != 1 {
+		t.Errorf("Expected one session for backend1, got %+v", sessions)
+	} else if sessions[0].PublicId() != hellos[0].Hello.SessionId {
+		t.Errorf("Expected session %s, got %s", hellos[0].Hello.SessionId, sessions[0].PublicId())
+	}
+	if sessions := hub.SessionsForBackend("backend2"); len(sessions) != 2 {
+		t.Errorf("Expected two sessions for backend2, got %+v", sessions)
 	}
-	if err := checkUnexpectedClose(err); err != nil {
-		t.Fatal(err)
+	if sessions := hub.SessionsForBackend("unknown"); len(sessions) != 0 {
+		t.Errorf("Expected no sessions for unknown backend, got %+v", sessions)
 	}
-	if err := checkMessageType(room, "room"); err != nil {
+
+	// Sessions are also listed by the room they joined.
+	roomId := "test-room"
+	if room, err := clients[1].JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
-	}
-	if room.Room.RoomId != roomId {
+	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-
-	// We will receive a "joined" event.
-	if err := client2.RunUntilJoined(ctx, hello.Hello); err != nil {
+	if err := clients[1].RunUntilJoined(ctx, hellos[1].Hello); err != nil {
 		t.Error(err)
 	}
+	if sessions := hub.SessionsForBackendRoom("backend2", roomId); len(sessions) != 1 {
+		t.Errorf("Expected one session in room of backend2, got %+v", sessions)
+	} else if sessions[0].PublicId() != hellos[1].Hello.SessionId {
+		t.Errorf("Expected session %s, got %s", hellos[1].Hello.SessionId, sessions[0].PublicId())
+	}
+	if sessions := hub.SessionsForBackendRoom("backend2", ""); len(sessions) != 1 {
+		t.Errorf("Expected one session without room for backend2, got %+v", sessions)
+	} else if sessions[0].PublicId() != hellos[2].Hello.SessionId {
+		t.Errorf("Expected session %s, got %s", hellos[2].Hello.SessionId, sessions[0].PublicId())
+	}
+	if sessions := hub.SessionsForBackendRoom("backend1", roomId); len(sessions) != 0 {
+		t.Errorf("Expected no sessions in room of backend1, got %+v", sessions)
+	}
+	if sessions := hub.SessionsForBackend("backend2"); len(sessions) != 2 {
+		t.Errorf("Expected two sessions for backend2, got %+v", sessions)
+	}
 
-	// Leave room.
-	if room, err := client2.JoinRoom(ctx, ""); err != nil {
+	if room, err := clients[1].JoinRoom(ctx, ""); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != "" {
 		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
 	}
-}
-
-func TestGetRealUserIP(t *testing.T) {
-	REMOTE_ATTR := "192.168.1.2"
-
-	request := &http.Request{
-		RemoteAddr: REMOTE_ATTR,
+	if sessions := hub.SessionsForBackendRoom("backend2", roomId); len(sessions) != 0 {
+		t.Errorf("Expected no sessions in room of backend2, got %+v", sessions)
 	}
-	if ip := getRealUserIP(request); ip != REMOTE_ATTR {
-		t.Errorf("Expected %s but got %s", REMOTE_ATTR, ip)
+	if sessions := hub.SessionsForBackendRoom("backend2", ""); len(sessions) != 2 {
+		t.Errorf("Expected two sessions without room for backend2, got %+v", sessions)
 	}
 
-	X_REAL_IP := "192.168.10.11"
-	request.Header = http.Header{
-		http.CanonicalHeaderKey("x-real-ip"): []string{X_REAL_IP},
+	// Sessions are removed from the index when they disconnect.
+	if err := clients[2].SendBye(); err != nil {
+		t.Fatal(err)
 	}
-	if ip := getRealUserIP(request); ip != X_REAL_IP {
-		t.Errorf("Expected %s but got %s", X_REAL_IP, ip)
+	if message, err := clients[2].RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "bye"); err != nil {
+		t.Error(err)
 	}
-
-	// "X-Real-IP" has preference before "X-Forwarded-For"
-	X_FORWARDED_FOR_IP := "192.168.20.21"
-	X_FORWARDED_FOR := X_FORWARDED_FOR_IP + ", 192.168.30.32"
-	request.Header = http.Header{
-		http.CanonicalHeaderKey("x-real-ip"):       []string{X_REAL_IP},
-		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
+	if err := clients[2].WaitForSessionRemoved(ctx, hellos[2].Hello.SessionId); err != nil {
+		t.Error(err)
 	}
-	if ip := getRealUserIP(request); ip != X_REAL_IP {
-		t.Errorf("Expected %s but got %s", X_REAL_IP, ip)
+	if sessions := hub.SessionsForBackend("backend2"); len(sessions) != 1 {
+		t.Errorf("Expected one session for backend2, got %+v", sessions)
 	}
 
-	request.Header = http.Header{
-		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
+	// Sessions of removed backends are no longer listed.
+	config, err := getTestConfigWithMultipleBackends(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddOption("backend", "backends", "backend1")
+	config.RemoveSection("backend2")
+	hub.Reload(config)
+
+	if sessions := hub.SessionsForBackend("backend1"); len(sessions) != 1 {
+		t.Errorf("Expected one session for backend1, got %+v", sessions)
 	}
-	if ip := getRealUserIP(request); ip != X_FORWARDED_FOR_IP {
-		t.Errorf("Expected %s but got %s", X_FORWARDED_FOR_IP, ip)
+	if sessions := hub.SessionsForBackend("backend2"); len(sessions) != 0 {
+		t.Errorf("Expected no sessions for removed backend2, got %+v", sessions)
 	}
 }
 
-func TestClientMessageToSessionIdWhileDisconnected(t *testing.T) {
+func TestClientHelloTooManyFeatures(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
-		t.Fatal(err)
-	}
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
-		t.Fatal(err)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
 
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-	hello2, err := client2.RunUntilHello(ctx)
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	}
-
-	client2.Close()
-	if err := client2.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
-	}
-
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
-	}
-
-	// The two chat messages should get combined into one when receiving pending messages.
-	chat_refresh := "{\"type\":\"chat\",\"chat\":{\"refresh\":true}}"
-	var data1 map[string]interface{}
-	if err := json.Unmarshal([]byte(chat_refresh), &data1); err != nil {
+	features := make([]string, 0, maxHelloFeatures+1)
+	for i := 0; i <= maxHelloFeatures; i++ {
+		features = append(features, "feature-"+strconv.Itoa(i))
+	}
+	// Send without validating the message locally.
+	if err := client.conn.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			Features: features,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
 		t.Fatal(err)
 	}
-	client1.SendMessage(recipient2, data1) // nolint
-	client1.SendMessage(recipient2, data1) // nolint
 
-	// Simulate some time until client resumes the session.
-	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
 
-	client2 = NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+	if message, err := client.RunUntilMessage(ctx); err != nil {
 		t.Fatal(err)
-	}
-	hello3, err := client2.RunUntilHello(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if hello3.Hello.UserId != testDefaultUserId+"2" {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"2", hello3.Hello)
-		}
-		if hello3.Hello.SessionId != hello2.Hello.SessionId {
-			t.Errorf("Expected session id %s, got %+v", hello2.Hello.SessionId, hello3.Hello)
-		}
-		if hello3.Hello.ResumeId != hello2.Hello.ResumeId {
-			t.Errorf("Expected resume id %s, got %+v", hello2.Hello.ResumeId, hello3.Hello)
-		}
-	}
-
-	var payload map[string]interface{}
-	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
 		t.Error(err)
-	} else if !reflect.DeepEqual(payload, data1) {
-		t.Errorf("Expected payload %+v, got %+v", data1, payload)
-	}
-
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel2()
-
-	if err := checkReceiveClientMessage(ctx2, client2, "session", hello1.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
 	}
 }
 
-func TestRoomParticipantsListUpdateWhileDisconnected(t *testing.T) {
+func TestRoomErrorBroadcast(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
 	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
-	defer cancel()
-
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
 	hello2, err := client2.RunUntilHello(ctx)
@@ -2096,11 +8045,6 @@ func TestRoomParticipantsListUpdateWhileDisconnected(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	}
-
-	// Join room by id.
 	roomId := "test-room"
 	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
@@ -2119,239 +8063,400 @@ func TestRoomParticipantsListUpdateWhileDisconnected(t *testing.T) {
 
 	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
 
-	// Simulate request from the backend that somebody joined the call.
-	users := []map[string]interface{}{
-		{
-			"sessionId": "the-session-id",
-			"inCall":    1,
-		},
+	backend := hub.GetSessionByPublicId(hello1.Hello.SessionId).Backend()
+	if hub.SendRoomError("unknown-room", backend, "mcu_unavailable", "The MCU is not available.") {
+		t.Error("Should not be able to send errors to unknown rooms")
 	}
-	room := hub.getRoom(roomId)
-	if room == nil {
-		t.Fatalf("Could not find room %s", roomId)
+	if !hub.SendRoomError(roomId, backend, "mcu_unavailable", "The MCU is not available.") {
+		t.Fatalf("Could not send error to room %s", roomId)
 	}
-	room.PublishUsersInCallChanged(users, users)
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
-		t.Error(err)
+
+	for _, client := range []*TestClient{client1, client2} {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, "mcu_unavailable"); err != nil {
+			t.Error(err)
+		} else if message.Id != "" || message.Error.Target != ErrorTargetRoom {
+			t.Errorf("Expected room error, got %+v", message)
+		}
+
+		// The sessions are still connected after the error.
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "abcd",
+			Type: "capabilities",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(message, "capabilities"); err != nil {
+			t.Error(err)
+		}
 	}
+}
 
-	client2.Close()
-	if err := client2.WaitForClientRemoved(ctx); err != nil {
-		t.Error(err)
+func TestClientDryMessages(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	checkValidated := func(client *TestClient, messageType string) {
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(message, "validate"); err != nil {
+			t.Fatal(err)
+		} else if message.Validate.Type != messageType {
+			t.Errorf("Expected validated type %s, got %+v", messageType, message.Validate)
+		}
 	}
 
-	room.PublishUsersInCallChanged(users, users)
+	// Dry requests are validated before the hello was sent but don't
+	// authenticate the connection.
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "dry-hello",
+		Type: "hello",
+		Dry:  true,
+		Hello: &HelloClientMessage{
+			Version: HelloVersion,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkValidated(client1, "hello")
 
-	// Give NATS message some time to be processed.
-	time.Sleep(100 * time.Millisecond)
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "dry-room",
+		Type: "room",
+		Dry:  true,
+		Room: &RoomClientMessage{
+			RoomId:    "test-room",
+			SessionId: "the-session",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkValidated(client1, "room")
 
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
+	// Send without validating the message locally.
+	if err := client1.conn.WriteJSON(&ClientMessage{
+		Id:   "dry-invalid",
+		Type: "room",
+		Dry:  true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Error(err)
+	} else if message.Error.Message != "room missing" {
+		t.Errorf("Expected validation error, got %+v", message.Error)
 	}
 
-	chat_refresh := "{\"type\":\"chat\",\"chat\":{\"refresh\":true}}"
-	var data1 map[string]interface{}
-	if err := json.Unmarshal([]byte(chat_refresh), &data1); err != nil {
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "room",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:    "test-room",
+			SessionId: "the-session",
+		},
+	}); err != nil {
 		t.Fatal(err)
 	}
-	client1.SendMessage(recipient2, data1) // nolint
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "hello_expected"); err != nil {
+		t.Error(err)
+	}
 
-	client2 = NewTestClient(t, server, hub)
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
-	hello3, err := client2.RunUntilHello(ctx)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if hello3.Hello.UserId != testDefaultUserId+"2" {
-			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId+"2", hello3.Hello)
-		}
-		if hello3.Hello.SessionId != hello2.Hello.SessionId {
-			t.Errorf("Expected session id %s, got %+v", hello2.Hello.SessionId, hello3.Hello)
-		}
-		if hello3.Hello.ResumeId != hello2.Hello.ResumeId {
-			t.Errorf("Expected resume id %s, got %+v", hello2.Hello.ResumeId, hello3.Hello)
-		}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// The participants list update event is triggered again after the session resume.
-	// TODO(jojo): Check contents of message and try with multiple users.
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
-		t.Error(err)
+	// The response doesn't depend on the recipient being a valid session.
+	data := json.RawMessage(`{"foo":"bar"}`)
+	for _, sessionId := range []string{hello2.Hello.SessionId, "unknown-session-id"} {
+		if err := client1.WriteJSON(&ClientMessage{
+			Id:   "dry-message",
+			Type: "message",
+			Dry:  true,
+			Message: &MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: sessionId,
+				},
+				Data: &data,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		checkValidated(client1, "message")
 	}
 
-	var payload map[string]interface{}
-	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+	if message, err := client2.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
 		t.Error(err)
-	} else if !reflect.DeepEqual(payload, data1) {
-		t.Errorf("Expected payload %+v, got %+v", data1, payload)
+	} else if message != nil {
+		t.Errorf("Expected no message, got %+v", message)
 	}
+}
 
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel2()
+func TestClientDryMessagesRateLimitedBeforeHello(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
 
-	if err := checkReceiveClientMessage(ctx2, client2, "session", hello1.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	for i := 0; i <= maxDryMessageRate; i++ {
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "dry-" + strconv.Itoa(i),
+			Type: "room",
+			Dry:  true,
+			Room: &RoomClientMessage{
+				RoomId: "test-room",
+			},
+		}); err != nil {
+			t.Fatal(err)
 		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
 	}
-}
 
-func TestClientTakeoverRoomSession(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
-	defer shutdown()
+	for i := 0; i < maxDryMessageRate; i++ {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(message, "validate"); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "rate_limited"); err != nil {
+		t.Fatal(err)
+	}
 
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	// The hello is not affected by the limit of dry requests.
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
 	}
+}
+
+func TestHubSwapBackends(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubWithMultipleBackendsForTest(t)
+	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello1, err := client1.RunUntilHello(ctx)
+	for _, u := range []string{"/one", "/two"} {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		if err := client.SendHelloParams(server.URL+u, "client", TestBackendClientAuthParams{
+			UserId: testDefaultUserId,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.RunUntilHello(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u1, _ := url.Parse(server.URL + "/one")
+	backend1 := hub.backend.GetBackend(u1)
+	if backend1 == nil {
+		t.Fatal("Expected backend1")
+	}
+
+	config, err := getTestConfigWithMultipleBackends(server)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Join room by id.
-	roomId := "test-room-takeover-room-session"
-	roomSessionid := "room-session-id"
-	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, roomSessionid); err != nil {
+	config.RemoveOption("backend", "backends")
+	config.AddOption("backend", "backends", "backend1")
+	backends, err := NewBackendConfiguration(config)
+	if err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
+	defer backends.Close()
 
-	if hubRoom := hub.getRoom(roomId); hubRoom == nil {
-		t.Fatalf("Room %s does not exist", roomId)
+	if err := hub.SwapBackends(backends); err != nil {
+		t.Fatal(err)
 	}
 
-	if session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId); session1 == nil {
-		t.Fatalf("There should be a session %s", hello1.Hello.SessionId)
+	if b := hub.backend.GetBackend(u1); b != backend1 {
+		t.Errorf("Expected backend1 to be preserved, got %+v", b)
+	}
+	u2, _ := url.Parse(server.URL + "/two/")
+	if b := hub.backend.GetBackend(u2); b != nil {
+		t.Errorf("Expected backend2 to be removed, got %+v", b)
+	}
+	if sessions := hub.SessionsForBackend("backend1"); len(sessions) != 1 {
+		t.Errorf("Expected one session for backend1, got %+v", sessions)
+	}
+	if sessions := hub.SessionsForBackend("backend2"); len(sessions) != 0 {
+		t.Errorf("Expected no sessions for removed backend2, got %+v", sessions)
 	}
+}
 
-	client3 := NewTestClient(t, server, hub)
-	defer client3.CloseWithBye()
+func TestHubSwapBackendsUrlChanged(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, getTestConfigWithMultipleBackends)
+	defer shutdown()
 
-	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
-		t.Fatal(err)
-	}
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
 
-	hello3, err := client3.RunUntilHello(ctx)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params); err != nil {
 		t.Fatal(err)
 	}
-
-	if room, err := client3.JoinRoomWithRoomSession(ctx, roomId, roomSessionid+"other"); err != nil {
+	if _, err := client1.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
 
-	// Wait until both users have joined.
-	WaitForUsersJoined(ctx, t, client1, hello1, client3, hello3)
-
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params); err != nil {
 		t.Fatal(err)
 	}
-
 	hello2, err := client2.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if room, err := client2.JoinRoomWithRoomSession(ctx, roomId, roomSessionid); err != nil {
+	// backend1 keeps its id but uses a different url.
+	config, err := getTestConfigWithMultipleBackends(server)
+	if err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-
-	// The first client got disconnected with a reason in a "Bye" message.
-	msg, err := client1.RunUntilMessage(ctx)
+	config.RemoveOption("backend1", "url")
+	config.AddOption("backend1", "url", server.URL+"/three")
+	backends, err := NewBackendConfiguration(config)
 	if err != nil {
-		t.Error(err)
-	} else {
-		if msg.Type != "bye" || msg.Bye == nil {
-			t.Errorf("Expected bye message, got %+v", msg)
-		} else if msg.Bye.Reason != "room_session_reconnected" {
-			t.Errorf("Expected reason \"room_session_reconnected\", got %+v", msg.Bye.Reason)
-		}
-	}
-
-	if msg, err := client1.RunUntilMessage(ctx); err == nil {
-		t.Errorf("Expected error but received %+v", msg)
-	} else if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
-		t.Errorf("Expected close error but received %+v", err)
+		t.Fatal(err)
 	}
+	defer backends.Close()
 
-	// The first session has been closed
-	if session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId); session1 != nil {
-		t.Errorf("The session %s should have been removed", hello1.Hello.SessionId)
+	if err := hub.SwapBackends(backends); err != nil {
+		t.Fatal(err)
 	}
 
-	// The new client will receive "joined" events for the existing client3 and
-	// himself.
-	if err := client2.RunUntilJoined(ctx, hello3.Hello, hello2.Hello); err != nil {
+	// Sessions of the changed backend are disconnected.
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
 		t.Error(err)
-	}
-
-	// No message about the closing is sent to the new connection.
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
-	defer cancel2()
-
-	if message, err := client2.RunUntilMessage(ctx2); err != nil && err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+	} else if err := checkMessageType(msg, "bye"); err != nil {
 		t.Error(err)
-	} else if message != nil {
-		t.Errorf("Expected no message, got %+v", message)
+	} else if msg.Bye.Reason != ByeCodeBackendChanged {
+		t.Errorf("Expected reason %s, got %+v", ByeCodeBackendChanged, msg.Bye)
 	}
 
-	// The permanently connected client will receive a "left" event from the
-	// overridden session and a "joined" for the new session.
-	if err := client3.RunUntilLeft(ctx, hello1.Hello); err != nil {
-		t.Error(err)
-	}
-	if err := client3.RunUntilJoined(ctx, hello2.Hello); err != nil {
-		t.Error(err)
+	if session := hub.GetSessionByPublicId(hello2.Hello.SessionId); session == nil {
+		t.Errorf("Session %s should still be connected", hello2.Hello.SessionId)
 	}
-
-	time.Sleep(time.Second)
 }
 
-func TestClientSendOfferPermissions(t *testing.T) {
+func TestClientHelloAfterHello(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
-	mcu, err := NewTestMCU()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
-	} else if err := mcu.Start(); err != nil {
+	}
+
+	// A second hello for a different user is rejected.
+	if err := client.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
-	defer mcu.Stop()
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "already_joined"); err != nil {
+		t.Error(err)
+	}
 
-	hub.SetMcu(mcu)
+	// Resuming the own session returns the current hello response.
+	if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if message.Hello.SessionId != hello.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %s", hello.Hello.SessionId, message.Hello.SessionId)
+	} else if message.Hello.UserId != testDefaultUserId {
+		t.Errorf("Expected user id %s, got %s", testDefaultUserId, message.Hello.UserId)
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId)
+	if session == nil {
+		t.Fatal("Session should still exist")
+	} else if session.UserId() != testDefaultUserId {
+		t.Errorf("Expected user id %s, got %s", testDefaultUserId, session.UserId())
+	}
+}
+
+func TestClientSlowDisconnected(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-
 	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
-
 	hello1, err := client1.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
@@ -2359,17 +8464,14 @@ func TestClientSendOfferPermissions(t *testing.T) {
 
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-
 	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
-
 	hello2, err := client2.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
 	roomId := "test-room"
 	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
@@ -2388,75 +8490,169 @@ func TestClientSendOfferPermissions(t *testing.T) {
 
 	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
 
-	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
-	if session1 == nil {
-		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	session2, ok := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Expected client session for %s", hello2.Hello.SessionId)
 	}
-	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
-	if session2 == nil {
-		t.Fatalf("Session %s does not exist", hello2.Hello.SessionId)
+	if backend := session2.Backend(); backend.WriteTimeout() != writeWait {
+		t.Errorf("Expected default write timeout, got %s", backend.WriteTimeout())
 	}
+	// Simulate a client that doesn't read its messages, writing to it will
+	// exceed the deadline.
+	session2.GetClient().SetWriteTimeout(time.Nanosecond)
 
-	// Client 1 is the moderator
-	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_SCREEN})
-	// Client 2 is a guest participant.
-	session2.SetPermissions([]Permission{})
-
-	// Client 2 may not send an offer (he doesn't have the necessary permissions).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
+	if err := client1.SendMessage(MessageClientMessageRecipient{
 		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "sendoffer",
-		Sid:      "12345",
-		RoomType: "screen",
+		SessionId: hello2.Hello.SessionId,
+	}, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilLeft(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client1.WaitForSessionRemoved(ctx, hello2.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientCustomMessageType(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	const messageType = "x-test-echo"
+	if err := RegisterCustomMessageType(messageType, func(payload *json.RawMessage) error {
+		if payload == nil {
+			return fmt.Errorf("payload missing")
+		}
+		return nil
+	}, func(hub *Hub, session *ClientSession, message *ClientMessage, payload *json.RawMessage) {
+		session.SendMessage(&ServerMessage{
+			Id:   message.Id,
+			Type: "message",
+			Message: &MessageServerMessage{
+				Sender: &MessageServerMessageSender{
+					Type:      RecipientTypeSession,
+					SessionId: session.PublicId(),
+				},
+				Data: payload,
+			},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterCustomMessageType(messageType)
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.conn.WriteJSON(map[string]interface{}{
+		"id":        "echo",
+		"type":      messageType,
+		messageType: map[string]string{"foo": "bar"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "message"); err != nil {
+		t.Error(err)
+	} else if message.Id != "echo" || string(*message.Message.Data) != `{"foo":"bar"}` {
+		t.Errorf("Unexpected response %+v", message)
+	}
+
+	// The payload is checked by the validator.
+	if err := client.conn.WriteJSON(map[string]interface{}{
+		"id":   "echo",
+		"type": messageType,
 	}); err != nil {
 		t.Fatal(err)
 	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Error(err)
+	}
+}
 
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+func TestClientTrafficAccounting(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
-			t.Fatal(err)
-		}
 	}
 
-	// Client 1 may send an offer.
-	if err := client1.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "sendoffer",
-		Sid:      "54321",
-		RoomType: "screen",
+	session, ok := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Expected client session for %s", hello.Hello.SessionId)
+	}
+	backend := session.Backend()
+	// The hello response has already been sent to the session.
+	sent := session.BytesSent()
+	if sent == 0 {
+		t.Error("Expected bytes sent for the hello response")
+	}
+	received := session.BytesReceived()
+
+	// Presence updates without a room are answered with an error.
+	if err := client.WriteJSON(&ClientMessage{
+		Id:   "presence",
+		Type: "presence",
+		Presence: &PresenceClientMessage{
+			State: PresenceStateActive,
+		},
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	// The test MCU doesn't support clients yet, so an error will be returned
-	// to the client trying to send the offer.
-	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+	if message, err := client.RunUntilMessage(ctx); err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "client_not_found"); err != nil {
-			t.Fatal(err)
-		}
+	} else if err := checkMessageError(message, "not_in_room"); err != nil {
+		t.Error(err)
 	}
 
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel2()
+	if value := session.BytesReceived(); value <= received {
+		t.Errorf("Expected more than %d bytes received, got %d", received, value)
+	}
+	if value := session.BytesSent(); value <= sent {
+		t.Errorf("Expected more than %d bytes sent, got %d", sent, value)
+	}
+	if value := backend.BytesReceived(); value < session.BytesReceived() {
+		t.Errorf("Expected at least %d bytes received by backend, got %d", session.BytesReceived(), value)
+	}
+	if value := backend.BytesSent(); value < session.BytesSent() {
+		t.Errorf("Expected at least %d bytes sent by backend, got %d", session.BytesSent(), value)
+	}
 
-	if msg, err := client2.RunUntilMessage(ctx2); err != nil {
-		if err != context.DeadlineExceeded {
-			t.Fatal(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", msg)
+	backendSent := backend.BytesSent()
+	session.Close()
+	if session.BytesSent() != 0 || session.BytesReceived() != 0 {
+		t.Errorf("Expected counters to be reset, got %d / %d", session.BytesSent(), session.BytesReceived())
+	}
+	if value := backend.BytesSent(); value < backendSent {
+		t.Errorf("Expected backend to keep %d bytes sent, got %d", backendSent, value)
 	}
 }
 
-func TestClientSendOfferPermissionsAudioOnly(t *testing.T) {
+func TestClientMcuMessageInvalidSid(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
@@ -2473,45 +8669,21 @@ func TestClientSendOfferPermissionsAudioOnly(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
 		t.Fatal(err)
 	}
-
-	hello1, err := client1.RunUntilHello(ctx)
+	hello, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
-	roomId := "test-room"
-	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
-		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
-	}
-
-	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
-		t.Error(err)
-	}
-
-	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
-	if session1 == nil {
-		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
-	}
-
-	// Client is allowed to send audio only.
-	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO})
-
-	// Client may not send an offer with audio and video.
-	if err := client1.SendMessage(MessageClientMessageRecipient{
+	if err := client.SendMessage(MessageClientMessageRecipient{
 		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
+		SessionId: hello.Hello.SessionId,
 	}, MessageClientMessageData{
 		Type:     "offer",
-		Sid:      "54321",
 		RoomType: "video",
 		Payload: map[string]interface{}{
 			"sdp": MockSdpOfferAudioAndVideo,
@@ -2520,35 +8692,197 @@ func TestClientSendOfferPermissionsAudioOnly(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+	if message, err := client.RunUntilMessage(ctx); err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
-			t.Fatal(err)
-		}
+	} else if err := checkMessageError(message, "invalid_format"); err != nil {
+		t.Error(err)
+	} else if message.Error.Message != "sid missing" {
+		t.Errorf("Expected sid error, got %+v", message.Error)
 	}
+}
 
-	// Client may send an offer (audio only).
-	if err := client1.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "offer",
-		Sid:      "54321",
-		RoomType: "video",
-		Payload: map[string]interface{}{
-			"sdp": MockSdpOfferAudioOnly,
-		},
-	}); err != nil {
-		t.Fatal(err)
-	}
+func TestClientCandidatesBatch(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch_%v", batch), func(t *testing.T) {
+			hub, _, _, server, shutdown := CreateHubForTest(t)
+			defer shutdown()
 
-	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioOnly); err != nil {
-		t.Fatal(err)
+			mcu, err := NewTestMCU()
+			if err != nil {
+				t.Fatal(err)
+			} else if err := mcu.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer mcu.Stop()
+
+			hub.SetMcu(mcu)
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+
+			client := NewTestClient(t, server, hub)
+			defer client.CloseWithBye()
+
+			var features []string
+			if batch {
+				features = append(features, ServerFeatureCandidates)
+			}
+			params, err := json.Marshal(TestBackendClientAuthParams{
+				UserId: testDefaultUserId,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WriteJSON(&ClientMessage{
+				Id:   "1234",
+				Type: "hello",
+				Hello: &HelloClientMessage{
+					Version:  HelloVersion,
+					Features: features,
+					Auth: HelloClientMessageAuth{
+						Url:    server.URL,
+						Params: (*json.RawMessage)(&params),
+					},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			hello, err := client.RunUntilHello(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			roomId := "test-room"
+			if _, err := client.JoinRoom(ctx, roomId); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+				t.Error(err)
+			}
+
+			session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+			session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+
+			recipient := MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: hello.Hello.SessionId,
+			}
+			if err := client.SendMessage(recipient, MessageClientMessageData{
+				Type:     "offer",
+				Sid:      "54321",
+				RoomType: "video",
+				Payload: map[string]interface{}{
+					"sdp": MockSdpOfferAudioOnly,
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioOnly); err != nil {
+				t.Fatal(err)
+			}
+
+			publishers := mcu.GetPublishers()
+			if len(publishers) != 1 {
+				t.Fatalf("Expected one publisher, got %+v", publishers)
+			}
+			var publisher *TestMCUPublisher
+			for _, pub := range publishers {
+				publisher = pub
+			}
+
+			candidates := []interface{}{
+				"candidate:0 1 UDP 2122194687 192.0.2.1 12345 typ host",
+				"candidate:1 1 UDP 2122194687 192.0.2.2 12345 typ host",
+				"candidate:2 1 UDP 1685987071 198.51.100.1 23456 typ srflx",
+			}
+
+			// Candidates sent by the client in a single message are passed
+			// individually to the MCU.
+			if err := client.SendMessage(recipient, MessageClientMessageData{
+				Type:     "candidates",
+				Sid:      "54321",
+				RoomType: "video",
+				Payload: map[string]interface{}{
+					"candidates": candidates,
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			for len(publisher.GetCandidates()) < len(candidates) {
+				select {
+				case <-ctx.Done():
+					t.Fatalf("Expected candidates %+v, got %+v", candidates, publisher.GetCandidates())
+				case <-time.After(time.Millisecond):
+				}
+			}
+			// The test MCU processes messages asynchronously, so the order of
+			// the candidates is not preserved.
+			received := publisher.GetCandidates()
+			sort.Slice(received, func(i, j int) bool {
+				return received[i].(string) < received[j].(string)
+			})
+			if !reflect.DeepEqual(received, candidates) {
+				t.Errorf("Expected candidates %+v, got %+v", candidates, received)
+			}
+
+			if err := client.SendMessage(recipient, MessageClientMessageData{
+				Type:     "candidates",
+				Sid:      "54321",
+				RoomType: "video",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if message, err := client.RunUntilMessage(ctx); err != nil {
+				t.Fatal(err)
+			} else if err := checkMessageError(message, "invalid_format"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Candidates from the MCU are sent as one message to clients that
+			// support it.
+			for _, candidate := range candidates {
+				publisher.listener.OnIceCandidate(publisher, candidate)
+			}
+
+			received = nil
+			for len(received) < len(candidates) {
+				message, err := client.RunUntilMessage(ctx)
+				if err != nil {
+					t.Fatal(err)
+				} else if err := checkMessageType(message, "message"); err != nil {
+					t.Fatal(err)
+				}
+
+				var data AnswerOfferMessage
+				if err := json.Unmarshal(*message.Message.Data, &data); err != nil {
+					t.Fatal(err)
+				}
+				if batch {
+					if data.Type != "candidates" {
+						t.Fatalf("Expected candidates, got %+v", data)
+					}
+					received = append(received, data.Payload["candidates"].([]interface{})...)
+					if len(received) != len(candidates) {
+						t.Errorf("Expected all candidates in one message, got %+v", data)
+					}
+				} else {
+					if data.Type != "candidate" {
+						t.Fatalf("Expected candidate, got %+v", data)
+					}
+					received = append(received, data.Payload["candidate"])
+				}
+			}
+			if !reflect.DeepEqual(received, candidates) {
+				t.Errorf("Expected candidates %+v, got %+v", candidates, received)
+			}
+		})
 	}
 }
 
-func TestClientSendOfferPermissionsAudioVideo(t *testing.T) {
+func TestClientCandidatesBatchLeaveCall(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
@@ -2565,120 +8899,104 @@ func TestClientSendOfferPermissionsAudioVideo(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
 
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			Features: []string{ServerFeatureCandidates},
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
 		t.Fatal(err)
 	}
 
-	hello1, err := client1.RunUntilHello(ctx)
+	hello, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
 	roomId := "test-room"
-	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+	if _, err := client.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-
-	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
 		t.Error(err)
 	}
 
-	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
-	if session1 == nil {
-		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
-	}
-
-	// Client is allowed to send audio and video.
-	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
 
-	// Client may send an offer (audio and video).
-	if err := client1.SendMessage(MessageClientMessageRecipient{
+	if err := client.SendMessage(MessageClientMessageRecipient{
 		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
+		SessionId: hello.Hello.SessionId,
 	}, MessageClientMessageData{
 		Type:     "offer",
 		Sid:      "54321",
 		RoomType: "video",
 		Payload: map[string]interface{}{
-			"sdp": MockSdpOfferAudioAndVideo,
+			"sdp": MockSdpOfferAudioOnly,
 		},
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+	if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioOnly); err != nil {
 		t.Fatal(err)
 	}
 
-	// Client is no longer allowed to send video, this will stop the publisher.
-	msg := &BackendServerRoomRequest{
-		Type: "participants",
-		Participants: &BackendRoomParticipantsRequest{
-			Changed: []map[string]interface{}{
-				{
-					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
-					"permissions": []Permission{PERMISSION_MAY_PUBLISH_AUDIO},
-				},
-			},
-			Users: []map[string]interface{}{
-				{
-					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
-					"permissions": []Permission{PERMISSION_MAY_PUBLISH_AUDIO},
-				},
-			},
-		},
-	}
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		t.Fatal(err)
+	publishers := mcu.GetPublishers()
+	if len(publishers) != 1 {
+		t.Fatalf("Expected one publisher, got %+v", publishers)
 	}
-	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Error(err)
-	}
-	if res.StatusCode != 200 {
-		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	var publisher *TestMCUPublisher
+	for _, pub := range publishers {
+		publisher = pub
 	}
 
-	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
-	defer cancel2()
+	// Candidates that are still batched when leaving the call are dropped.
+	publisher.listener.OnIceCandidate(publisher, "candidate:0 1 UDP 2122194687 192.0.2.1 12345 typ host")
+	session.LeaveCall()
 
-	pubs := mcu.GetPublishers()
-	if len(pubs) != 1 {
-		t.Fatalf("expected one publisher, got %+v", pubs)
+	session.mu.Lock()
+	pending := len(session.pendingCandidates)
+	session.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected no pending candidates, got %d", pending)
 	}
 
-loop:
-	for {
-		if err := ctx2.Err(); err != nil {
-			t.Errorf("publisher was not closed: %s", err)
-		}
-
-		for _, pub := range pubs {
-			if pub.isClosed() {
-				break loop
-			}
-		}
+	ctx2, cancel2 := context.WithTimeout(ctx, 5*candidatesBatchDelay)
+	defer cancel2()
 
-		// Give some time to async processing.
-		time.Sleep(time.Millisecond)
+	if message, err := client.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
 	}
 }
 
-func TestClientSendOfferPermissionsAudioVideoMedia(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientMcuFallback(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "fallback", McuFallbackNotify)
+		return config, nil
+	})
 	defer shutdown()
 
 	mcu, err := NewTestMCU()
@@ -2696,122 +9014,74 @@ func TestClientSendOfferPermissionsAudioVideoMedia(t *testing.T) {
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-
 	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
-
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Join room by id.
-	roomId := "test-room"
-	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+	if hello, err := client1.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	} else if !containsString(hello.Hello.Server.Features, ServerFeatureMcu) {
+		t.Errorf("expected feature %s, got %+v", ServerFeatureMcu, hello.Hello.Server.Features)
 	}
 
-	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
-		t.Error(err)
-	}
+	hub.onMcuDisconnected()
 
-	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
-	if session1 == nil {
-		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "notify"); err != nil {
+		t.Fatal(err)
+	} else if message.Notify.Type != NotifyTypeMcuUnavailable {
+		t.Errorf("expected notify type %s, got %+v", NotifyTypeMcuUnavailable, message.Notify)
 	}
 
-	// Client is allowed to send audio and video.
-	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
-
-	// Client may send an offer (audio and video).
-	if err := client1.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "offer",
-		Sid:      "54321",
-		RoomType: "video",
-		Payload: map[string]interface{}{
-			"sdp": MockSdpOfferAudioAndVideo,
-		},
-	}); err != nil {
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
-
-	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+	if hello, err := client2.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
+	} else {
+		for _, f := range hello.Hello.Server.Features {
+			if isMcuFeature(f) {
+				t.Errorf("should not advertise feature %s while the MCU is unavailable, got %+v", f, hello.Hello.Server.Features)
+			}
+		}
 	}
 
-	// Client is no longer allowed to send video, this will stop the publisher.
-	msg := &BackendServerRoomRequest{
-		Type: "participants",
-		Participants: &BackendRoomParticipantsRequest{
-			Changed: []map[string]interface{}{
-				{
-					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
-					"permissions": []Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_CONTROL},
-				},
-			},
-			Users: []map[string]interface{}{
-				{
-					"sessionId":   roomId + "-" + hello1.Hello.SessionId,
-					"permissions": []Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_CONTROL},
-				},
-			},
-		},
+	hub.onMcuConnected()
+
+	for _, client := range []*TestClient{client1, client2} {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(message, "notify"); err != nil {
+			t.Fatal(err)
+		} else if message.Notify.Type != NotifyTypeMcuAvailable {
+			t.Errorf("expected notify type %s, got %+v", NotifyTypeMcuAvailable, message.Notify)
+		}
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
 		t.Fatal(err)
 	}
-	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
-	if err != nil {
+	if hello, err := client3.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
+	} else if !containsString(hello.Hello.Server.Features, ServerFeatureMcu) {
+		t.Errorf("expected feature %s, got %+v", ServerFeatureMcu, hello.Hello.Server.Features)
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Error(err)
-	}
-	if res.StatusCode != 200 {
-		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
-	}
-
-	ctx2, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
-	defer cancel2()
-
-	pubs := mcu.GetPublishers()
-	if len(pubs) != 1 {
-		t.Fatalf("expected one publisher, got %+v", pubs)
-	}
-
-loop:
-	for {
-		if err := ctx2.Err(); err != nil {
-			if err != context.DeadlineExceeded {
-				t.Errorf("error while waiting for publisher: %s", err)
-			}
-			break
-		}
+}
 
-		for _, pub := range pubs {
-			if pub.isClosed() {
-				t.Errorf("publisher was closed")
-				break loop
-			}
+func TestClientMcuFallbackRoomError(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
 		}
 
-		// Give some time to async processing.
-		time.Sleep(time.Millisecond)
-	}
-}
-
-func TestClientRequestOfferNotInRoom(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+		config.AddOption("mcu", "fallback", McuFallbackNotify)
+		return config, nil
+	})
 	defer shutdown()
 
 	mcu, err := NewTestMCU()
@@ -2829,11 +9099,9 @@ func TestClientRequestOfferNotInRoom(t *testing.T) {
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-
 	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
-
 	hello1, err := client1.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
@@ -2841,234 +9109,412 @@ func TestClientRequestOfferNotInRoom(t *testing.T) {
 
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-
 	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
-
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
+	if _, err := client2.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
 	roomId := "test-room"
-	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, "roomsession1"); err != nil {
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-
-	// We will receive a "joined" event.
 	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	// Client 2 may not request an offer (he is not in the room yet).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
-	}); err != nil {
+	if room, err := client2.JoinRoom(ctx, roomId+"-other"); err != nil {
 		t.Fatal(err)
+	} else if room.Room.RoomId != roomId+"-other" {
+		t.Fatalf("Expected room %s, got %s", roomId+"-other", room.Room.RoomId)
 	}
-
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+	if err := client2.DrainMessages(ctx); err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
-			t.Fatal(err)
-		}
 	}
 
-	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Room %s does not exist", roomId)
+	}
+	users := []map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+			"inCall":    7,
+		},
+	}
+	room.PublishUsersInCallChanged(users, users)
+	if _, err := client1.RunUntilMessage(ctx); err != nil {
 		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
 
-	// We will receive a "joined" event.
-	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
-		t.Error(err)
+	hub.onMcuDisconnected()
+
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "notify"); err != nil {
+		t.Fatal(err)
 	}
-	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, ErrorCodeMcuUnavailable); err != nil {
 		t.Error(err)
+	} else if message.Error.Target != ErrorTargetRoom {
+		t.Errorf("Expected room error, got %+v", message.Error)
 	}
 
-	// Client 2 may not request an offer (he is not in the call yet).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
-	}); err != nil {
+	// Rooms without sessions in the call only get the notification.
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "notify"); err != nil {
 		t.Fatal(err)
 	}
 
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client2.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+}
+
+func TestClientMcuFallbackDisabled(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
-			t.Fatal(err)
-		}
 	}
+	defer mcu.Stop()
 
-	// Simulate request from the backend that somebody joined the call.
-	users1 := []map[string]interface{}{
-		{
-			"sessionId": hello2.Hello.SessionId,
-			"inCall":    1,
-		},
+	hub.SetMcu(mcu)
+	hub.onMcuDisconnected()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
 	}
-	room := hub.getRoom(roomId)
-	if room == nil {
-		t.Fatalf("Could not find room %s", roomId)
+	if hello, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if !containsString(hello.Hello.Server.Features, ServerFeatureMcu) {
+		t.Errorf("expected feature %s, got %+v", ServerFeatureMcu, hello.Hello.Server.Features)
 	}
-	room.PublishUsersInCallChanged(users1, users1)
-	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
-		t.Error(err)
+}
+
+func TestClientInternalBroadcast(t *testing.T) {
+	hub, natsClient, router, server, shutdown := CreateHubForTestWithConfig(t, getTestConfigWithMultipleBackends)
+	defer shutdown()
+
+	registerBackendHandlerUrl(t, router, "/one")
+	registerBackendHandlerUrl(t, router, "/two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
 	}
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
-		t.Error(err)
+	testcases := []struct {
+		url    string
+		roomId string
+	}{
+		{server.URL + "/one", "room-a"},
+		{server.URL + "/one", "other-room"},
+		{server.URL + "/two", "room-b"},
+	}
+	var clients []*TestClient
+	for _, tc := range testcases {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+		if err := client.SendHelloParams(tc.url, "client", params); err != nil {
+			t.Fatal(err)
+		}
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room, err := client.JoinRoom(ctx, tc.roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != tc.roomId {
+			t.Fatalf("Expected room %s, got %s", tc.roomId, room.Room.RoomId)
+		}
+		if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
 	}
 
-	// Client 2 may not request an offer (recipient is not in the call yet).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
-	}); err != nil {
+	internal := NewTestClient(t, server, hub)
+	defer internal.CloseWithBye()
+	if err := internal.SendHelloInternalWithBackend(server.URL + "/one"); err != nil {
 		t.Fatal(err)
 	}
-
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+	if _, err := internal.RunUntilHello(ctx); err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
+	}
+
+	broadcast := func(backend string, roomId string, data string) {
+		raw := json.RawMessage(data)
+		if err := internal.WriteJSON(&ClientMessage{
+			Id:   "broadcast-" + data,
+			Type: "internal",
+			Internal: &InternalClientMessage{
+				Type: "broadcast",
+				Broadcast: &BroadcastInternalClientMessage{
+					Backend: backend,
+					RoomId:  roomId,
+					Data:    &raw,
+				},
+			},
+		}); err != nil {
 			t.Fatal(err)
 		}
 	}
-
-	// Simulate request from the backend that somebody joined the call.
-	users2 := []map[string]interface{}{
-		{
-			"sessionId": hello1.Hello.SessionId,
-			"inCall":    1,
-		},
+	checkAck := func(data string) {
+		if message, err := internal.RunUntilMessage(ctx); err != nil {
+			t.Error(err)
+		} else if err := checkMessageType(message, "internal"); err != nil {
+			t.Error(err)
+		} else if message.Id != "broadcast-"+data || message.Internal.Type != "broadcast" {
+			t.Errorf("Expected broadcast ack for %s, got %+v", data, message)
+		}
 	}
-	room.PublishUsersInCallChanged(users2, users2)
-	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
-		t.Error(err)
+	checkBroadcast := func(client *TestClient, data string) {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Error(err)
+		} else if err := checkMessageType(message, "notify"); err != nil {
+			t.Error(err)
+		} else if message.Notify.Type != NotifyTypeBroadcast {
+			t.Errorf("Expected notify type %s, got %+v", NotifyTypeBroadcast, message.Notify)
+		} else if message.Notify.Data == nil || string(*message.Notify.Data) != data {
+			t.Errorf("Expected data %s, got %+v", data, message.Notify)
+		}
 	}
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+
+	// Sessions in matching rooms of all backends receive the broadcast.
+	broadcast("", "room-*", `{"step":1}`)
+	checkAck(`{"step":1}`)
+	checkBroadcast(clients[0], `{"step":1}`)
+	checkBroadcast(clients[2], `{"step":1}`)
+
+	// Backends can be filtered by id or url.
+	broadcast("backend1", "", `{"step":2}`)
+	checkAck(`{"step":2}`)
+	checkBroadcast(clients[0], `{"step":2}`)
+	// The first broadcast was not received by the session in the other room.
+	checkBroadcast(clients[1], `{"step":2}`)
+
+	broadcast(server.URL+"/two/", "room-*", `{"step":3}`)
+	checkAck(`{"step":3}`)
+	checkBroadcast(clients[2], `{"step":3}`)
+
+	broadcast("unknown-backend", "", `{"step":4}`)
+	if message, err := internal.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(message, "invalid_backend"); err != nil {
 		t.Error(err)
 	}
 
-	// Client 2 may request an offer now (both are in the same room and call).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
+	// Broadcasts from other servers are sent to the matching local sessions.
+	raw := json.RawMessage(`{"step":5}`)
+	if err := natsClient.PublishNats(internalBroadcastSubject, &NatsMessage{
+		Type: "broadcast",
+		Broadcast: &BroadcastInternalClientMessage{
+			Backend: "backend2",
+			Data:    &raw,
+		},
 	}); err != nil {
 		t.Fatal(err)
 	}
+	checkBroadcast(clients[2], `{"step":5}`)
 
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
-		t.Fatal(err)
-	} else {
-		// We check for "client_not_found" as the testing MCU doesn't support publishing/subscribing.
-		if err := checkMessageError(msg, "client_not_found"); err != nil {
-			t.Fatal(err)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	for _, client := range clients {
+		if message, err := client.RunUntilMessage(ctx2); err == nil {
+			t.Errorf("Expected no message, got %+v", message)
+		} else if err != context.DeadlineExceeded {
+			t.Error(err)
 		}
 	}
+}
 
+func TestGetConfiguredBufferSize(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("app", "small", "1024")
+	config.AddOption("app", "invalid", "-1")
+	config.AddOption("app", "large", strconv.Itoa(maxWebsocketBufferSize+1))
+
+	testcases := []struct {
+		option   string
+		expected int
+	}{
+		{"missing", defaultWebsocketReadBufferSize},
+		{"small", 1024},
+		{"invalid", defaultWebsocketReadBufferSize},
+		{"large", maxWebsocketBufferSize},
+	}
+	for _, tc := range testcases {
+		if size := getConfiguredBufferSize(config, tc.option, defaultWebsocketReadBufferSize); size != tc.expected {
+			t.Errorf("Expected size %d for %s, got %d", tc.expected, tc.option, size)
+		}
+	}
 }
 
-func TestNoSendBetweenSessionsOnDifferentBackends(t *testing.T) {
-	// Clients can't send messages to sessions connected from other backends.
-	hub, _, _, server, shutdown := CreateHubWithMultipleBackendsForTest(t)
+func TestGetConfiguredMcuFallback(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected string
+	}{
+		{"", McuFallbackNone},
+		{"none", McuFallbackNone},
+		{" none ", McuFallbackNone},
+		{"features", McuFallbackFeatures},
+		{"notify", McuFallbackNotify},
+		{"invalid", McuFallbackNone},
+	}
+	for _, tc := range testcases {
+		config := goconf.NewConfigFile()
+		config.AddOption("mcu", "fallback", tc.value)
+		if fallback := getConfiguredMcuFallback(config); fallback != tc.expected {
+			t.Errorf("Expected fallback %q for %q, got %q", tc.expected, tc.value, fallback)
+		}
+	}
+}
+
+func TestClientReadOnly(t *testing.T) {
+	var config *goconf.ConfigFile
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		var err error
+		if config, err = getTestConfig(server); err != nil {
+			return nil, err
+		}
+
+		config.AddOption("app", "readonly", "true")
+		return config, nil
+	})
 	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-
-	params1 := TestBackendClientAuthParams{
-		UserId: "user1",
-	}
-	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+	// Clients may still connect in read-only mode.
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
 		t.Fatal(err)
 	}
-	hello1, err := client1.RunUntilHello(ctx)
+	hello, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-
-	params2 := TestBackendClientAuthParams{
-		UserId: "user2",
-	}
-	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
-		t.Fatal(err)
+	roomId := "test-room"
+	data := json.RawMessage(`"hello"`)
+	rejected := []*ClientMessage{
+		{
+			Id:   "join",
+			Type: "room",
+			Room: &RoomClientMessage{
+				RoomId: roomId,
+			},
+		},
+		{
+			Id:   "message",
+			Type: "message",
+			Message: &MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: hello.Hello.SessionId,
+				},
+				Data: &data,
+			},
+		},
+		{
+			Id:   "control",
+			Type: "control",
+			Control: &ControlClientMessage{
+				MessageClientMessage: MessageClientMessage{
+					Recipient: MessageClientMessageRecipient{
+						Type:      "session",
+						SessionId: hello.Hello.SessionId,
+					},
+					Data: &data,
+				},
+			},
+		},
 	}
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
+	for _, msg := range rejected {
+		if err := client.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, ErrorCodeReadOnly); err != nil {
+			t.Errorf("%s: %s", msg.Id, err)
+		} else if message.Id != msg.Id {
+			t.Errorf("Expected id %s, got %+v", msg.Id, message)
+		}
 	}
 
-	recipient1 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
+	// Requests that don't change the state are still processed.
+	if err := client.WriteJSON(&ClientMessage{
+		Id:   "capabilities",
+		Type: "capabilities",
+	}); err != nil {
+		t.Fatal(err)
 	}
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "capabilities"); err != nil {
+		t.Error(err)
 	}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient2, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient1, data2) // nolint
+	// The read-only mode can be disabled by reloading the configuration.
+	config.RemoveOption("app", "readonly")
+	hub.Reload(config)
 
-	var payload string
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel2()
-	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
+}
 
-	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel3()
-	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+func checkReceiveQualityChanged(ctx context.Context, client *TestClient, sessionId string, quality string) error {
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		return err
+	} else if err := checkMessageType(message, "event"); err != nil {
+		return err
+	} else if message.Event.Target != "participants" || message.Event.Type != "quality" || message.Event.Quality == nil {
+		return fmt.Errorf("Expected quality event, got %+v", message.Event)
+	} else if sessions := message.Event.Quality.Sessions; len(sessions) != 1 {
+		return fmt.Errorf("Expected one session, got %+v", message.Event.Quality)
+	} else if sessions[0].SessionId != sessionId || sessions[0].Quality != quality {
+		return fmt.Errorf("Expected quality %s of %s, got %+v", quality, sessionId, sessions[0])
 	}
+	return nil
 }
 
-func TestNoSameRoomOnDifferentBackends(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubWithMultipleBackendsForTest(t)
+func TestClientSessionQualityChanged(t *testing.T) {
+	resetTimeout := connectionQualityResetTimeout
+	connectionQualityResetTimeout = 100 * time.Millisecond
+	defer func() {
+		connectionQualityResetTimeout = resetTimeout
+	}()
+
+	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
@@ -3076,11 +9522,7 @@ func TestNoSameRoomOnDifferentBackends(t *testing.T) {
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-
-	params1 := TestBackendClientAuthParams{
-		UserId: "user1",
-	}
-	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
 	hello1, err := client1.RunUntilHello(ctx)
@@ -3090,11 +9532,7 @@ func TestNoSameRoomOnDifferentBackends(t *testing.T) {
 
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-
-	params2 := TestBackendClientAuthParams{
-		UserId: "user2",
-	}
-	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
 	hello2, err := client2.RunUntilHello(ctx)
@@ -3102,77 +9540,111 @@ func TestNoSameRoomOnDifferentBackends(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
 	roomId := "test-room"
 	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-	msg1, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
-	}
-	if err := client1.checkMessageJoined(msg1, hello1.Hello); err != nil {
-		t.Error(err)
-	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
 
 	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-	msg2, err := client2.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1, ok := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello1.Hello.SessionId)
 	}
-	if err := client2.checkMessageJoined(msg2, hello2.Hello); err != nil {
-		t.Error(err)
+
+	// The initial quality is "good", so no event is sent.
+	session1.OnQualityChanged(nil, ConnectionQualityGood)
+	session1.OnQualityChanged(nil, ConnectionQualityPoor)
+	// Unchanged qualities are not sent again.
+	session1.OnQualityChanged(nil, ConnectionQualityPoor)
+
+	for _, client := range []*TestClient{client1, client2} {
+		if err := checkReceiveQualityChanged(ctx, client, hello1.Hello.SessionId, ConnectionQualityPoor); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	hub.ru.RLock()
-	var rooms []*Room
-	for _, room := range hub.rooms {
-		defer room.Close()
-		rooms = append(rooms, room)
+	// The quality is reset if no further slow links are reported.
+	for _, client := range []*TestClient{client1, client2} {
+		if err := checkReceiveQualityChanged(ctx, client, hello1.Hello.SessionId, ConnectionQualityGood); err != nil {
+			t.Fatal(err)
+		}
 	}
-	hub.ru.RUnlock()
 
-	if len(rooms) != 2 {
-		t.Errorf("Expected 2 rooms, got %+v", rooms)
+	ctx2, cancel2 := context.WithTimeout(ctx, 2*connectionQualityResetTimeout)
+	defer cancel2()
+
+	if message, err := client2.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
 	}
+}
 
-	if rooms[0].IsEqual(rooms[1]) {
-		t.Errorf("Rooms should be different: %+v", rooms)
+func TestClientSessionQualityResetAfterClose(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	recipient := MessageClientMessageRecipient{
-		Type: "room",
+	roomId := "test-room"
+	if _, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Fatal(err)
 	}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient, data2) // nolint
+	session, ok := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+	}
 
-	var payload string
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel2()
-	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+	session.OnQualityChanged(nil, ConnectionQualityPoor)
+	session.mu.Lock()
+	timer := session.qualityTimer
+	session.mu.Unlock()
+	if timer == nil {
+		t.Fatal("Expected quality reset timer")
 	}
 
-	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel3()
-	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+	// A timer that is no longer the current one doesn't reset the quality.
+	var stale *time.Timer
+	session.resetQuality(nil, &stale)
+	session.mu.Lock()
+	if session.quality != ConnectionQualityPoor || session.qualityTimer != timer {
+		t.Errorf("Expected quality %s with unchanged timer, got %s", ConnectionQualityPoor, session.quality)
+	}
+	session.mu.Unlock()
+
+	// Simulate the timer firing while the session is closed.
+	session.Close()
+	session.resetQuality(nil, &timer)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.quality != "" || session.qualityTimer != nil {
+		t.Errorf("Expected no quality and timer after close, got %s (%v)", session.quality, session.qualityTimer)
 	}
 }
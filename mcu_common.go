@@ -24,6 +24,8 @@ package signaling
 import (
 	"context"
 	"fmt"
+	"log"
+	"strings"
 
 	"github.com/dlintw/goconf"
 )
@@ -37,8 +39,68 @@ const (
 
 var (
 	ErrNotConnected = fmt.Errorf("not connected")
+	// ErrMcuUnavailable is returned if no MCU connection can accept a new
+	// publisher or subscriber.
+	ErrMcuUnavailable = fmt.Errorf("no MCU connection available")
 )
 
+var (
+	// Codecs supported by the Janus videoroom plugin.
+	knownAudioCodecs = map[string]bool{
+		"opus":      true,
+		"multiopus": true,
+		"g722":      true,
+		"pcmu":      true,
+		"pcma":      true,
+		"isac32":    true,
+		"isac16":    true,
+	}
+	knownVideoCodecs = map[string]bool{
+		"vp8":  true,
+		"vp9":  true,
+		"h264": true,
+		"av1":  true,
+		"h265": true,
+	}
+
+	// Defaults of the Janus videoroom plugin.
+	defaultAudioCodecs = []string{"opus"}
+	defaultVideoCodecs = []string{"vp8"}
+)
+
+// McuCodecs contains the ids of the audio and video codecs supported by the
+// MCU in the order of preference.
+type McuCodecs struct {
+	Audio []string
+	Video []string
+}
+
+func getConfiguredCodecsFromOption(config *goconf.ConfigFile, option string, known map[string]bool, defaults []string) []string {
+	value, _ := config.GetString("mcu", option)
+	var codecs []string
+	for _, codec := range getConfiguredValues(strings.ToLower(value)) {
+		if !known[codec] {
+			log.Printf("WARNING: Unsupported codec \"%s\" in \"%s\" of section \"mcu\", skipping", codec, option)
+			continue
+		}
+
+		codecs = append(codecs, codec)
+	}
+	if len(codecs) == 0 {
+		codecs = defaults
+	}
+	return codecs
+}
+
+// getConfiguredCodecs returns the codecs configured in section "mcu", unknown
+// codecs are skipped.
+func getConfiguredCodecs(config *goconf.ConfigFile) McuCodecs {
+	return McuCodecs{
+		Audio: getConfiguredCodecsFromOption(config, "audiocodecs", knownAudioCodecs, defaultAudioCodecs),
+		Video: getConfiguredCodecsFromOption(config, "videocodecs", knownVideoCodecs, defaultVideoCodecs),
+	}
+}
+
 type MediaType int
 
 const (
@@ -59,6 +121,30 @@ type McuListener interface {
 	SubscriberClosed(subscriber McuSubscriber)
 }
 
+// McuRenegotiateListener can be implemented by a McuListener that should be
+// notified if the remote side of a client needs to renegotiate.
+type McuRenegotiateListener interface {
+	OnRenegotiate(client McuClient, reason string)
+}
+
+func notifyRenegotiate(listener McuListener, client McuClient, reason string) {
+	if l, ok := listener.(McuRenegotiateListener); ok {
+		l.OnRenegotiate(client, reason)
+	}
+}
+
+// McuQualityListener can be implemented by a McuListener that should be
+// notified if the connection quality of a client changed.
+type McuQualityListener interface {
+	OnQualityChanged(client McuClient, quality string)
+}
+
+func notifyQualityChanged(listener McuListener, client McuClient, quality string) {
+	if l, ok := listener.(McuQualityListener); ok {
+		l.OnQualityChanged(client, quality)
+	}
+}
+
 type McuInitiator interface {
 	Country() string
 }
@@ -73,6 +159,9 @@ type Mcu interface {
 
 	GetStats() interface{}
 
+	// Codecs returns the codecs that can be used by publishers.
+	Codecs() McuCodecs
+
 	NewPublisher(ctx context.Context, listener McuListener, id string, streamType string, bitrate int, mediaTypes MediaType, initiator McuInitiator) (McuPublisher, error)
 	NewSubscriber(ctx context.Context, listener McuListener, publisher string, streamType string) (McuSubscriber, error)
 }
@@ -22,9 +22,38 @@
 package signaling
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/dlintw/goconf"
 )
 
 func TestCommonMcuStats(t *testing.T) {
 	collectAndLint(t, commonMcuStats...)
 }
+
+func TestMcuConfiguredCodecs(t *testing.T) {
+	testcases := []struct {
+		audio    string
+		video    string
+		expected McuCodecs
+	}{
+		{"", "", McuCodecs{defaultAudioCodecs, defaultVideoCodecs}},
+		{"opus, g722", "VP9,vp8", McuCodecs{[]string{"opus", "g722"}, []string{"vp9", "vp8"}}},
+		{"unknown", "h264, unknown", McuCodecs{defaultAudioCodecs, []string{"h264"}}},
+		// Audio codecs can't be used as video codecs and vice versa.
+		{"vp8", "opus", McuCodecs{defaultAudioCodecs, defaultVideoCodecs}},
+	}
+	for _, tc := range testcases {
+		config := goconf.NewConfigFile()
+		if tc.audio != "" {
+			config.AddOption("mcu", "audiocodecs", tc.audio)
+		}
+		if tc.video != "" {
+			config.AddOption("mcu", "videocodecs", tc.video)
+		}
+		if codecs := getConfiguredCodecs(config); !reflect.DeepEqual(codecs, tc.expected) {
+			t.Errorf("Expected %+v for %s / %s, got %+v", tc.expected, tc.audio, tc.video, codecs)
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"log"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -50,6 +51,10 @@ const (
 	defaultMaxStreamBitrate = 1024 * 1024
 	defaultMaxScreenBitrate = 2048 * 1024
 
+	// Number of lost packets reported in a "slowlink" event from which the
+	// connection quality is considered poor.
+	slowLinkPoorLostPackets = 100
+
 	streamTypeVideo  = "video"
 	streamTypeScreen = "screen"
 )
@@ -140,6 +145,7 @@ type mcuJanus struct {
 	maxStreamBitrate int
 	maxScreenBitrate int
 	mcuTimeout       time.Duration
+	codecs           McuCodecs
 
 	gw      *JanusGateway
 	session *JanusSession
@@ -185,6 +191,7 @@ func NewMcuJanus(url string, config *goconf.ConfigFile) (Mcu, error) {
 		maxStreamBitrate: maxStreamBitrate,
 		maxScreenBitrate: maxScreenBitrate,
 		mcuTimeout:       mcuTimeout,
+		codecs:           getConfiguredCodecs(config),
 		closeChan:        make(chan bool, 1),
 		clients:          make(map[clientInterface]bool),
 
@@ -398,6 +405,10 @@ type mcuJanusConnectionStats struct {
 	Uptime     *time.Time `json:"uptime,omitempty"`
 }
 
+func (m *mcuJanus) Codecs() McuCodecs {
+	return m.codecs
+}
+
 func (m *mcuJanus) GetStats() interface{} {
 	result := mcuJanusConnectionStats{
 		Url: m.url,
@@ -732,6 +743,8 @@ func (m *mcuJanus) getOrCreatePublisherHandle(ctx context.Context, id string, st
 		// Do not use the video-orientation RTP extension as it breaks video
 		// orientation changes in Firefox.
 		"videoorient_ext": false,
+		"audiocodec":      strings.Join(m.codecs.Audio, ","),
+		"videocodec":      strings.Join(m.codecs.Video, ","),
 	}
 	var maxBitrate int
 	if streamType == streamTypeScreen {
@@ -861,12 +874,23 @@ func (p *mcuJanusPublisher) handleConnected(event *janus.WebRTCUpMsg) {
 	p.mcu.publisherConnected.Notify(p.id + "|" + p.streamType)
 }
 
+// getSlowLinkQuality returns the connection quality for a "slowlink" event
+// with the given number of lost packets.
+func getSlowLinkQuality(lost int64) string {
+	if lost >= slowLinkPoorLostPackets {
+		return ConnectionQualityPoor
+	}
+
+	return ConnectionQualityMedium
+}
+
 func (p *mcuJanusPublisher) handleSlowLink(event *janus.SlowLinkMsg) {
 	if event.Uplink {
 		log.Printf("Publisher %s (%d) is reporting %d lost packets on the uplink (Janus -> client)", p.listener.PublicId(), p.handleId, event.Lost)
 	} else {
 		log.Printf("Publisher %s (%d) is reporting %d lost packets on the downlink (client -> Janus)", p.listener.PublicId(), p.handleId, event.Lost)
 	}
+	notifyQualityChanged(p.listener, p, getSlowLinkQuality(event.Lost))
 }
 
 func (p *mcuJanusPublisher) handleMedia(event *janus.MediaMsg) {
@@ -1099,6 +1123,7 @@ func (p *mcuJanusSubscriber) handleSlowLink(event *janus.SlowLinkMsg) {
 	} else {
 		log.Printf("Subscriber %s (%d) is reporting %d lost packets on the downlink (client -> Janus)", p.listener.PublicId(), p.handleId, event.Lost)
 	}
+	notifyQualityChanged(p.listener, p, getSlowLinkQuality(event.Lost))
 }
 
 func (p *mcuJanusSubscriber) handleMedia(event *janus.MediaMsg) {
@@ -1120,6 +1145,7 @@ func (p *mcuJanusSubscriber) NotifyReconnected() {
 	p.handleId = handle.Id
 	p.roomId = pub.roomId
 	log.Printf("Subscriber %d for publisher %s reconnected on handle %d", p.id, p.publisher, p.handleId)
+	notifyRenegotiate(p.listener, p, RenegotiateReasonMcuReconnected)
 }
 
 func (p *mcuJanusSubscriber) Close(ctx context.Context) {
@@ -109,3 +109,22 @@ func TestPublisherStatsCounter(t *testing.T) {
 
 	collectAndLint(t, commonMcuStats...)
 }
+
+func TestSlowLinkQuality(t *testing.T) {
+	testcases := []struct {
+		lost     int64
+		expected string
+	}{
+		{0, ConnectionQualityMedium},
+		{1, ConnectionQualityMedium},
+		{slowLinkPoorLostPackets - 1, ConnectionQualityMedium},
+		{slowLinkPoorLostPackets, ConnectionQualityPoor},
+		{slowLinkPoorLostPackets + 1, ConnectionQualityPoor},
+	}
+
+	for _, tc := range testcases {
+		if quality := getSlowLinkQuality(tc.lost); quality != tc.expected {
+			t.Errorf("Expected quality %s for %d lost packets, got %s", tc.expected, tc.lost, quality)
+		}
+	}
+}
@@ -657,12 +657,16 @@ func (c *mcuProxyConnection) removeSubscriber(subscriber *mcuProxySubscriber) {
 	}
 }
 
-func (c *mcuProxyConnection) clearSubscribers() {
+// clearSubscribers closes all subscribers and asks their listeners to
+// renegotiate with the given reason. The listeners are notified before the
+// subscribers are closed, so they still know about the affected stream.
+func (c *mcuProxyConnection) clearSubscribers(reason string) {
 	c.subscribersLock.Lock()
 	defer c.subscribersLock.Unlock()
 
 	go func(subscribers map[string]*mcuProxySubscriber) {
 		for _, subscriber := range subscribers {
+			notifyRenegotiate(subscriber.listener, subscriber, reason)
 			subscriber.NotifyClosed()
 		}
 	}(c.subscribers)
@@ -696,10 +700,10 @@ func (c *mcuProxyConnection) processMessage(msg *ProxyServerMessage) {
 		c.helloMsgId = ""
 		switch msg.Type {
 		case "error":
-			if msg.Error.Code == "no_such_session" {
+			if msg.Error.Code == ErrorCodeNoSuchSession {
 				log.Printf("Session %s could not be resumed on %s, registering new", c.sessionId, c.url)
 				c.clearPublishers()
-				c.clearSubscribers()
+				c.clearSubscribers(RenegotiateReasonMcuReconnected)
 				c.clearCallbacks()
 				c.sessionId = ""
 				if err := c.sendHello(); err != nil {
@@ -787,7 +791,7 @@ func (c *mcuProxyConnection) processEvent(msg *ProxyServerMessage) {
 	case "backend-disconnected":
 		log.Printf("Upstream backend at %s got disconnected, reset MCU objects", c.url)
 		c.clearPublishers()
-		c.clearSubscribers()
+		c.clearSubscribers(RenegotiateReasonMcuDisconnected)
 		c.clearCallbacks()
 		// TODO: Should we also reconnect?
 		return
@@ -1012,6 +1016,7 @@ type mcuProxy struct {
 
 	maxStreamBitrate int
 	maxScreenBitrate int
+	codecs           McuCodecs
 
 	mu         sync.RWMutex
 	publishers map[string]*mcuProxyConnection
@@ -1071,6 +1076,8 @@ func NewMcuProxy(config *goconf.ConfigFile) (Mcu, error) {
 
 		maxStreamBitrate: maxStreamBitrate,
 		maxScreenBitrate: maxScreenBitrate,
+		// The proxies must be configured with the same codecs.
+		codecs: getConfiguredCodecs(config),
 
 		publishers: make(map[string]*mcuProxyConnection),
 
@@ -1522,6 +1529,10 @@ type mcuProxyStats struct {
 	Details    map[string]*mcuProxyConnectionStats `json:"details"`
 }
 
+func (m *mcuProxy) Codecs() McuCodecs {
+	return m.codecs
+}
+
 func (m *mcuProxy) GetStats() interface{} {
 	details := make(map[string]*mcuProxyConnectionStats)
 	result := &mcuProxyStats{
@@ -1723,7 +1734,7 @@ func (m *mcuProxy) NewPublisher(ctx context.Context, listener McuListener, id st
 	}
 
 	statsProxyNobackendAvailableTotal.WithLabelValues(streamType).Inc()
-	return nil, fmt.Errorf("No MCU connection available")
+	return nil, ErrMcuUnavailable
 }
 
 func (m *mcuProxy) getPublisherConnection(ctx context.Context, publisher string, streamType string) *mcuProxyConnection {
@@ -22,6 +22,9 @@
 package signaling
 
 import (
+	"context"
+	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -166,3 +169,71 @@ func Test_sortConnectionsForCountryWithOverride(t *testing.T) {
 		})
 	}
 }
+
+type testRenegotiateListener struct {
+	mu     sync.Mutex
+	events []string
+	done   chan struct{}
+}
+
+func (l *testRenegotiateListener) record(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *testRenegotiateListener) PublicId() string {
+	return "the-session-id"
+}
+
+func (l *testRenegotiateListener) OnUpdateOffer(client McuClient, offer map[string]interface{}) {
+}
+
+func (l *testRenegotiateListener) OnIceCandidate(client McuClient, candidate interface{}) {
+}
+
+func (l *testRenegotiateListener) OnIceCompleted(client McuClient) {
+}
+
+func (l *testRenegotiateListener) PublisherClosed(publisher McuPublisher) {
+}
+
+func (l *testRenegotiateListener) SubscriberClosed(subscriber McuSubscriber) {
+	l.record("closed")
+	close(l.done)
+}
+
+func (l *testRenegotiateListener) OnRenegotiate(client McuClient, reason string) {
+	l.record("renegotiate " + reason)
+}
+
+func TestMcuProxyClearSubscribers(t *testing.T) {
+	conn := &mcuProxyConnection{
+		subscribers: make(map[string]*mcuProxySubscriber),
+	}
+	listener := &testRenegotiateListener{
+		done: make(chan struct{}),
+	}
+	subscriber := newMcuProxySubscriber("the-publisher-id", "video", "the-proxy-id", conn, listener)
+	conn.subscribers[subscriber.proxyId] = subscriber
+
+	conn.clearSubscribers(RenegotiateReasonMcuDisconnected)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	select {
+	case <-listener.done:
+	case <-ctx.Done():
+		t.Fatal("Subscriber was not closed")
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	expected := []string{
+		"renegotiate " + RenegotiateReasonMcuDisconnected,
+		"closed",
+	}
+	if !reflect.DeepEqual(listener.events, expected) {
+		t.Errorf("Expected events %+v, got %+v", expected, listener.events)
+	}
+}
@@ -37,13 +37,15 @@ const (
 )
 
 type TestMCU struct {
-	mu         sync.Mutex
-	publishers map[string]*TestMCUPublisher
+	mu            sync.Mutex
+	publishers    map[string]*TestMCUPublisher
+	maxPublishers int
 }
 
 func NewTestMCU() (*TestMCU, error) {
 	return &TestMCU{
-		publishers: make(map[string]*TestMCUPublisher),
+		publishers:    make(map[string]*TestMCUPublisher),
+		maxPublishers: -1,
 	}, nil
 }
 
@@ -67,7 +69,29 @@ func (m *TestMCU) GetStats() interface{} {
 	return nil
 }
 
+func (m *TestMCU) Codecs() McuCodecs {
+	return McuCodecs{
+		Audio: defaultAudioCodecs,
+		Video: defaultVideoCodecs,
+	}
+}
+
+// SetMaxPublishers limits the number of publishers that can be created, a
+// negative value disables the limit.
+func (m *TestMCU) SetMaxPublishers(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxPublishers = count
+}
+
 func (m *TestMCU) NewPublisher(ctx context.Context, listener McuListener, id string, streamType string, bitrate int, mediaTypes MediaType, initiator McuInitiator) (McuPublisher, error) {
+	m.mu.Lock()
+	if m.maxPublishers >= 0 && len(m.publishers) >= m.maxPublishers {
+		m.mu.Unlock()
+		return nil, ErrMcuUnavailable
+	}
+	m.mu.Unlock()
+
 	var maxBitrate int
 	if streamType == streamTypeScreen {
 		maxBitrate = TestMaxBitrateScreen
@@ -85,6 +109,7 @@ func (m *TestMCU) NewPublisher(ctx context.Context, listener McuListener, id str
 			streamType: streamType,
 		},
 
+		listener:   listener,
 		mediaTypes: mediaTypes,
 		bitrate:    bitrate,
 	}
@@ -118,6 +143,22 @@ func (m *TestMCU) NewSubscriber(ctx context.Context, listener McuListener, publi
 	return nil, fmt.Errorf("Not implemented")
 }
 
+// TestMCUSubscriber can be used by tests that need existing subscribers, the
+// test MCU doesn't create subscribers itself.
+type TestMCUSubscriber struct {
+	TestMCUClient
+
+	publisher string
+}
+
+func (s *TestMCUSubscriber) Publisher() string {
+	return s.publisher
+}
+
+func (s *TestMCUSubscriber) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
+	go callback(fmt.Errorf("Message type %s is not implemented", data.Type), nil)
+}
+
 type TestMCUClient struct {
 	closed int32
 
@@ -142,11 +183,30 @@ func (c *TestMCUClient) isClosed() bool {
 	return atomic.LoadInt32(&c.closed) != 0
 }
 
+const (
+	// Offers with these sids will be answered with special payloads.
+	testSidAnswerExtraFields = "answer-extra-fields"
+	testSidAnswerInvalidSdp  = "answer-invalid-sdp"
+	// Offers with this sid will not be answered until the context expires.
+	testSidAnswerTimeout = "answer-timeout"
+)
+
 type TestMCUPublisher struct {
 	TestMCUClient
 
+	listener   McuListener
 	mediaTypes MediaType
 	bitrate    int
+
+	mu         sync.Mutex
+	candidates []interface{}
+}
+
+func (p *TestMCUPublisher) GetCandidates() []interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]interface{}{}, p.candidates...)
 }
 
 func (p *TestMCUPublisher) HasMedia(mt MediaType) bool {
@@ -162,6 +222,26 @@ func (p *TestMCUPublisher) SendMessage(ctx context.Context, message *MessageClie
 
 		switch data.Type {
 		case "offer":
+			switch data.Sid {
+			case testSidAnswerExtraFields:
+				callback(nil, map[string]interface{}{
+					"type":  "answer",
+					"sdp":   MockSdpAnswerAudioOnly,
+					"extra": "value",
+				})
+				return
+			case testSidAnswerInvalidSdp:
+				callback(nil, map[string]interface{}{
+					"type": "answer",
+					"sdp":  1234,
+				})
+				return
+			case testSidAnswerTimeout:
+				<-ctx.Done()
+				callback(ctx.Err(), nil)
+				return
+			}
+
 			sdp := data.Payload["sdp"]
 			if sdp, ok := sdp.(string); ok {
 				if sdp == MockSdpOfferAudioOnly {
@@ -179,6 +259,11 @@ func (p *TestMCUPublisher) SendMessage(ctx context.Context, message *MessageClie
 				}
 			}
 			callback(fmt.Errorf("Offer payload %+v is not implemented", data.Payload), nil)
+		case "candidate":
+			p.mu.Lock()
+			p.candidates = append(p.candidates, data.Payload["candidate"])
+			p.mu.Unlock()
+			callback(nil, nil)
 		default:
 			callback(fmt.Errorf("Message type %s is not implemented", data.Type), nil)
 		}
@@ -0,0 +1,101 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsClientMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "client",
+		Name:      "messages_total",
+		Help:      "The total number of messages received from clients by type",
+	}, []string{"type"})
+	statsClientErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "client",
+		Name:      "errors_total",
+		Help:      "The total number of errors sent to clients by code",
+	}, []string{"code"})
+	statsClientByesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "client",
+		Name:      "byes_total",
+		Help:      "The total number of byes sent to clients by reason",
+	}, []string{"reason"})
+
+	messageStats = []prometheus.Collector{
+		statsClientMessagesTotal,
+		statsClientErrorsTotal,
+		statsClientByesTotal,
+	}
+
+	// Only known values are used as labels to keep the cardinality bounded.
+	statsKnownClientMessageTypes = getClientMessageTypes()
+)
+
+const (
+	statsLabelOther = "other"
+	statsLabelNone  = "none"
+)
+
+// RegisterMessageStats registers the metrics about messages exchanged with
+// clients with the given registerer.
+func RegisterMessageStats(registerer prometheus.Registerer) {
+	registerAllWith(registerer, messageStats...)
+}
+
+func getStatsLabel(value string, known map[string]bool) string {
+	if known[value] {
+		return value
+	}
+
+	return statsLabelOther
+}
+
+func countClientMessage(message *ClientMessage) {
+	statsClientMessagesTotal.WithLabelValues(getStatsLabel(message.Type, statsKnownClientMessageTypes)).Inc()
+}
+
+func countServerMessage(message *ServerMessage) {
+	switch message.Type {
+	case "error":
+		if message.Error != nil {
+			code := message.Error.Code
+			if !IsKnownErrorCode(code) {
+				code = statsLabelOther
+			}
+			statsClientErrorsTotal.WithLabelValues(code).Inc()
+		}
+	case "bye":
+		reason := statsLabelNone
+		if message.Bye != nil && message.Bye.Reason != "" {
+			reason = message.Bye.Reason
+			if _, found := ByeCloseCodes[reason]; !found {
+				reason = statsLabelOther
+			}
+		}
+		statsClientByesTotal.WithLabelValues(reason).Inc()
+	}
+}
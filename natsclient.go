@@ -48,9 +48,23 @@ type NatsMessage struct {
 
 	Permissions []Permission `json:"permissions,omitempty"`
 
+	Kick *NatsKickMessage `json:"kick,omitempty"`
+
+	Broadcast *BroadcastInternalClientMessage `json:"broadcast,omitempty"`
+
+	// ExcludeSessionId is the session that must not receive the message.
+	ExcludeSessionId string `json:"excludesessionid,omitempty"`
+
 	Id string `json:"id"`
 }
 
+// NatsKickMessage is sent to the server of a session that should be kicked
+// from the given room.
+type NatsKickMessage struct {
+	RoomId string `json:"roomid"`
+	Reason string `json:"reason,omitempty"`
+}
+
 type NatsSubscription interface {
 	Unsubscribe() error
 }
@@ -0,0 +1,102 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const (
+	// Number of virtual nodes per node on the hash ring.
+	nodeRingReplicas = 128
+)
+
+type nodeRingEntry struct {
+	hash uint64
+	node string
+}
+
+// NodeRing maps rooms to nodes using consistent hashing, so only a small
+// fraction of rooms is assigned to a different node if nodes are added or
+// removed. The mapping only depends on the node names and not on their order,
+// so all nodes with the same list get the same result.
+type NodeRing struct {
+	entries []nodeRingEntry
+}
+
+func getNodeRingHash(value string) uint64 {
+	hash := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+func NewNodeRing(nodes []string) *NodeRing {
+	ring := &NodeRing{}
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if node == "" || seen[node] {
+			continue
+		}
+
+		seen[node] = true
+		for i := 0; i < nodeRingReplicas; i++ {
+			ring.entries = append(ring.entries, nodeRingEntry{
+				hash: getNodeRingHash(node + "#" + strconv.Itoa(i)),
+				node: node,
+			})
+		}
+	}
+	sort.Slice(ring.entries, func(i, j int) bool {
+		a, b := ring.entries[i], ring.entries[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		// Make the order deterministic for (unlikely) collisions.
+		return a.node < b.node
+	})
+	return ring
+}
+
+// Get returns the node that owns the given room, or an empty string if the
+// ring doesn't contain any nodes.
+func (r *NodeRing) Get(roomId string) string {
+	if len(r.entries) == 0 {
+		return ""
+	}
+
+	hash := getNodeRingHash(roomId)
+	idx := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].hash >= hash
+	})
+	if idx == len(r.entries) {
+		idx = 0
+	}
+	return r.entries[idx].node
+}
+
+// RoomNode returns the node of the list that owns the given room. Callers that
+// look up many rooms for the same nodes should use a NodeRing instead.
+func RoomNode(roomId string, nodes []string) string {
+	return NewNodeRing(nodes).Get(roomId)
+}
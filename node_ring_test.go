@@ -0,0 +1,118 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"testing"
+)
+
+func getTestNodes(count int) []string {
+	nodes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		nodes = append(nodes, fmt.Sprintf("node%d.domain.invalid", i))
+	}
+	return nodes
+}
+
+func TestRoomNodeEmpty(t *testing.T) {
+	if node := RoomNode("the-room", nil); node != "" {
+		t.Errorf("Expected no node, got %s", node)
+	}
+	if node := RoomNode("the-room", []string{""}); node != "" {
+		t.Errorf("Expected no node, got %s", node)
+	}
+	if node := RoomNode("the-room", []string{"node1"}); node != "node1" {
+		t.Errorf("Expected node1, got %s", node)
+	}
+}
+
+func TestRoomNodeDeterministic(t *testing.T) {
+	nodes := getTestNodes(5)
+	reversed := make([]string, 0, len(nodes)+1)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		reversed = append(reversed, nodes[i])
+	}
+	// Duplicate entries are ignored.
+	reversed = append(reversed, nodes[0])
+
+	ring1 := NewNodeRing(nodes)
+	ring2 := NewNodeRing(reversed)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		roomId := fmt.Sprintf("room-%d", i)
+		node := ring1.Get(roomId)
+		if node2 := ring2.Get(roomId); node != node2 {
+			t.Errorf("Expected same node for room %s, got %s and %s", roomId, node, node2)
+		}
+		if node3 := RoomNode(roomId, nodes); node != node3 {
+			t.Errorf("Expected node %s for room %s, got %s", node, roomId, node3)
+		}
+		counts[node]++
+	}
+
+	// All nodes should own some of the rooms.
+	for _, node := range nodes {
+		if counts[node] < 100 {
+			t.Errorf("Expected at least 100 rooms for %s, got %d (%+v)", node, counts[node], counts)
+		}
+	}
+}
+
+func TestRoomNodeRemap(t *testing.T) {
+	const rooms = 10000
+	nodes := getTestNodes(10)
+	ring := NewNodeRing(nodes)
+	added := NewNodeRing(append(nodes, "new-node.domain.invalid"))
+	removed := NewNodeRing(nodes[1:])
+
+	movedAdded := 0
+	movedRemoved := 0
+	for i := 0; i < rooms; i++ {
+		roomId := fmt.Sprintf("room-%d", i)
+		node := ring.Get(roomId)
+		if newNode := added.Get(roomId); newNode != node {
+			// Rooms may only move to the new node.
+			if newNode != "new-node.domain.invalid" {
+				t.Errorf("Room %s moved from %s to %s", roomId, node, newNode)
+			}
+			movedAdded++
+		}
+		if newNode := removed.Get(roomId); newNode != node {
+			// Only rooms of the removed node may move.
+			if node != nodes[0] {
+				t.Errorf("Room %s moved from %s to %s", roomId, node, newNode)
+			}
+			movedRemoved++
+		}
+	}
+
+	// Ideally 1/11 of the rooms move to the new node, allow some variance.
+	if limit := rooms * 3 / 2 / 11; movedAdded > limit {
+		t.Errorf("Expected at most %d rooms to move, got %d", limit, movedAdded)
+	} else if movedAdded == 0 {
+		t.Error("Expected rooms to move to the new node")
+	}
+	if limit := rooms * 3 / 2 / 10; movedRemoved > limit {
+		t.Errorf("Expected at most %d rooms to move, got %d", limit, movedRemoved)
+	}
+}
@@ -0,0 +1,155 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// PreparedMessage is a ServerMessage that is serialized only once and can be
+// sent to many clients, e.g. when broadcasting an event to all sessions of a
+// room. The websocket frames are also prepared once for each combination of
+// connection settings (including compression).
+type PreparedMessage struct {
+	message  *ServerMessage
+	data     []byte
+	prepared *websocket.PreparedMessage
+}
+
+func NewPreparedMessage(message *ServerMessage) (*PreparedMessage, error) {
+	data, err := message.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PreparedMessage{
+		message:  message,
+		data:     data,
+		prepared: prepared,
+	}, nil
+}
+
+// Message returns the original message. It must not be modified.
+func (m *PreparedMessage) Message() *ServerMessage {
+	return m.message
+}
+
+func (m *PreparedMessage) MarshalJSON() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *PreparedMessage) CloseAfterSend(session MessageSession) bool {
+	return m.message.CloseAfterSend(session)
+}
+
+func (m *PreparedMessage) String() string {
+	return string(m.data)
+}
+
+// broadcastMessage sends the same message to all given sessions while
+// serializing it only once.
+func broadcastMessage(sessions []*ClientSession, message *ServerMessage) {
+	switch len(sessions) {
+	case 0:
+		return
+	case 1:
+		// No need to prepare a message for a single recipient.
+		sessions[0].SendMessage(message)
+		return
+	}
+
+	prepared, err := NewPreparedMessage(message)
+	if err != nil {
+		log.Printf("Could not prepare message %+v, sending individually: %s", message, err)
+		for _, session := range sessions {
+			session.SendMessage(message)
+		}
+		return
+	}
+
+	for _, session := range sessions {
+		session.SendPreparedMessage(prepared)
+	}
+}
+
+const (
+	// Number of prepared messages of room events that are kept.
+	preparedMessageCacheSize = 16
+)
+
+// preparedMessageCache keeps the prepared messages of the most recent room
+// events received through NATS. The sessions of a room each receive the same
+// serialized event, so it can be looked up by the received data and is only
+// serialized once for all sessions that don't need a filtered version.
+type preparedMessageCache struct {
+	mu      sync.Mutex
+	entries map[string]*PreparedMessage
+	keys    []string
+	next    int
+}
+
+func newPreparedMessageCache(size int) *preparedMessageCache {
+	return &preparedMessageCache{
+		entries: make(map[string]*PreparedMessage, size),
+		keys:    make([]string, size),
+	}
+}
+
+// Get returns the prepared message for the received data, the given message
+// that was decoded from the data is prepared if no entry exists yet.
+func (c *preparedMessageCache) Get(data []byte, message *ServerMessage) (*PreparedMessage, error) {
+	c.mu.Lock()
+	prepared, found := c.entries[string(data)]
+	c.mu.Unlock()
+	if found {
+		return prepared, nil
+	}
+
+	// Prepare without holding the lock so other events are not blocked.
+	prepared, err := NewPreparedMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, found := c.entries[string(data)]; found {
+		return existing, nil
+	}
+
+	key := string(data)
+	if old := c.keys[c.next]; old != "" {
+		delete(c.entries, old)
+	}
+	c.keys[c.next] = key
+	c.next = (c.next + 1) % len(c.keys)
+	c.entries[key] = prepared
+	return prepared, nil
+}
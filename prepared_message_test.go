@@ -0,0 +1,317 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+func newTestBroadcastMessage() *ServerMessage {
+	properties := json.RawMessage(`{"name":"` + strings.Repeat("x", 1024) + `"}`)
+	return &ServerMessage{
+		Type: "room",
+		Room: &RoomServerMessage{
+			RoomId:            "test-room",
+			Properties:        &properties,
+			PropertiesVersion: 1,
+		},
+	}
+}
+
+// newTestBroadcastClients creates "count" clients with websocket connections
+// to peers that read and discard all received messages. The returned function
+// must be called to close the connections.
+func newTestBroadcastClients(tb testing.TB, count int) ([]*Client, func()) {
+	upgrader := websocket.Upgrader{}
+	conns := make(chan *websocket.Conn, count)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	var closers []func() error
+	closeAll := func() {
+		for _, f := range closers {
+			f() // nolint
+		}
+		server.Close()
+	}
+
+	url := strings.Replace(server.URL, "http://", "ws://", 1)
+	clients := make([]*Client, 0, count)
+	for i := 0; i < count; i++ {
+		peer, _, err := websocket.DefaultDialer.Dial(url, nil) // nolint
+		if err != nil {
+			closeAll()
+			tb.Fatal(err)
+		}
+		closers = append(closers, peer.Close)
+		go func() {
+			for {
+				if _, _, err := peer.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		conn := <-conns
+		closers = append(closers, conn.Close)
+		client, err := NewClient(conn, fmt.Sprintf("client-%d", i), "")
+		if err != nil {
+			closeAll()
+			tb.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	return clients, closeAll
+}
+
+func TestPreparedMessage(t *testing.T) {
+	message := newTestBroadcastMessage()
+	prepared, err := NewPreparedMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prepared.Message() != message {
+		t.Errorf("expected message %+v, got %+v", message, prepared.Message())
+	}
+
+	expected, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := json.Marshal(prepared); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(expected, data) {
+		t.Errorf("expected %s, got %s", string(expected), string(data))
+	}
+
+	if prepared.CloseAfterSend(nil) {
+		t.Error("should not close after sending")
+	}
+	bye, err := NewPreparedMessage(&ServerMessage{
+		Type: "bye",
+		Bye:  &ByeServerMessage{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bye.CloseAfterSend(nil) {
+		t.Error("should close after sending")
+	}
+}
+
+func TestPreparedMessageSend(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		client, err := NewClient(conn, r.RemoteAddr, "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		prepared, err := NewPreparedMessage(newTestBroadcastMessage())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < 2; i++ {
+			if !client.SendMessage(prepared) {
+				t.Error("could not send prepared message")
+			}
+		}
+		conn.ReadMessage() // nolint
+	}))
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http://", "ws://", 1)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil) // nolint
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected, err := json.Marshal(newTestBroadcastMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.TextMessage {
+			t.Errorf("expected text message, got %d", messageType)
+		}
+		if !bytes.Equal(expected, data) {
+			t.Errorf("expected %s, got %s", string(expected), string(data))
+		}
+	}
+}
+
+func BenchmarkBroadcastServerMessage(b *testing.B) {
+	clients, closeClients := newTestBroadcastClients(b, 300)
+	defer closeClients()
+	message := newTestBroadcastMessage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, client := range clients {
+			client.SendMessage(message)
+		}
+	}
+}
+
+func BenchmarkBroadcastPreparedMessage(b *testing.B) {
+	clients, closeClients := newTestBroadcastClients(b, 300)
+	defer closeClients()
+	message := newTestBroadcastMessage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		prepared, err := NewPreparedMessage(message)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, client := range clients {
+			client.SendMessage(prepared)
+		}
+	}
+}
+
+func TestPreparedMessageCache(t *testing.T) {
+	cache := newPreparedMessageCache(2)
+	message := newTestBroadcastMessage()
+
+	first, err := cache.Get([]byte("first"), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared, err := cache.Get([]byte("first"), newTestBroadcastMessage()); err != nil {
+		t.Fatal(err)
+	} else if prepared != first {
+		t.Errorf("expected cached message %+v, got %+v", first, prepared)
+	}
+
+	// The oldest entry is removed if the cache is full.
+	if _, err := cache.Get([]byte("second"), message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get([]byte("third"), message); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(cache.entries))
+	}
+	if prepared, err := cache.Get([]byte("first"), message); err != nil {
+		t.Fatal(err)
+	} else if prepared == first {
+		t.Error("expected new prepared message after eviction")
+	}
+}
+
+// newTestRoomSessions creates "count" sessions that receive room events
+// through NATS like the sessions of a room, together with the message that
+// would be received for a published room event.
+func newTestRoomSessions(b *testing.B, count int, prepared bool) ([]*ClientSession, *nats.Msg, func()) {
+	client, err := NewLoopbackNatsClient()
+	if err != nil {
+		b.Fatal(err)
+	}
+	hub := &Hub{
+		nats: client,
+	}
+	if prepared {
+		hub.preparedMessages = newPreparedMessageCache(preparedMessageCacheSize)
+	}
+
+	clients, closeClients := newTestBroadcastClients(b, count)
+	sessions := make([]*ClientSession, 0, count)
+	for i, c := range clients {
+		sessions = append(sessions, &ClientSession{
+			hub:          hub,
+			publicId:     fmt.Sprintf("session-%d", i),
+			subscription: SubscriptionLevelAll,
+			client:       c,
+		})
+	}
+
+	data, err := json.Marshal(&NatsMessage{
+		SendTime: time.Now(),
+		Type:     "message",
+		Message:  newTestBroadcastMessage(),
+	})
+	if err != nil {
+		closeClients()
+		b.Fatal(err)
+	}
+	msg := &nats.Msg{
+		Subject: GetSubjectForRoomId("test-room", nil),
+		Data:    data,
+	}
+	return sessions, msg, func() {
+		closeClients()
+		client.Close()
+	}
+}
+
+func benchmarkRoomDelivery(b *testing.B, prepared bool) {
+	sessions, msg, closeSessions := newTestRoomSessions(b, 300, prepared)
+	defer closeSessions()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if prepared {
+			// Each iteration is a different event.
+			sessions[0].hub.preparedMessages = newPreparedMessageCache(preparedMessageCacheSize)
+		}
+		for _, session := range sessions {
+			session.processClientMessage(msg)
+		}
+	}
+}
+
+func BenchmarkRoomDeliveryServerMessage(b *testing.B) {
+	benchmarkRoomDelivery(b, false)
+}
+
+func BenchmarkRoomDeliveryPreparedMessage(b *testing.B) {
+	benchmarkRoomDelivery(b, true)
+}
@@ -27,7 +27,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -69,15 +68,15 @@ type ContextKey string
 var (
 	ContextKeySession = ContextKey("session")
 
-	TimeoutCreatingPublisher  = signaling.NewError("timeout", "Timeout creating publisher.")
-	TimeoutCreatingSubscriber = signaling.NewError("timeout", "Timeout creating subscriber.")
-	TokenAuthFailed           = signaling.NewError("auth_failed", "The token could not be authenticated.")
-	TokenExpired              = signaling.NewError("token_expired", "The token is expired.")
-	UnknownClient             = signaling.NewError("unknown_client", "Unknown client id given.")
-	UnsupportedCommand        = signaling.NewError("bad_request", "Unsupported command received.")
-	UnsupportedMessage        = signaling.NewError("bad_request", "Unsupported message received.")
-	UnsupportedPayload        = signaling.NewError("unsupported_payload", "Unsupported payload type.")
-	ShutdownScheduled         = signaling.NewError("shutdown_scheduled", "The server is scheduled to shutdown.")
+	TimeoutCreatingPublisher  = signaling.NewError(signaling.ErrorCodeTimeout, "Timeout creating publisher.")
+	TimeoutCreatingSubscriber = signaling.NewError(signaling.ErrorCodeTimeout, "Timeout creating subscriber.")
+	TokenAuthFailed           = signaling.NewError(signaling.ErrorCodeAuthFailed, "The token could not be authenticated.")
+	TokenExpired              = signaling.NewErrorCode(signaling.ErrorCodeTokenExpired)
+	UnknownClient             = signaling.NewErrorCode(signaling.ErrorCodeUnknownClient)
+	UnsupportedCommand        = signaling.NewError(signaling.ErrorCodeBadRequest, "Unsupported command received.")
+	UnsupportedMessage        = signaling.NewError(signaling.ErrorCodeBadRequest, "Unsupported message received.")
+	UnsupportedPayload        = signaling.NewErrorCode(signaling.ErrorCodeUnsupportedPayload)
+	ShutdownScheduled         = signaling.NewErrorCode(signaling.ErrorCodeShutdownScheduled)
 )
 
 type ProxyServer struct {
@@ -98,6 +97,7 @@ type ProxyServer struct {
 
 	tokens          ProxyTokens
 	statsAllowedIps map[string]bool
+	trustedProxies  atomic.Value
 
 	sid          uint64
 	cookie       *securecookie.SecureCookie
@@ -157,6 +157,11 @@ func NewProxyServer(r *mux.Router, version string, config *goconf.ConfigFile) (*
 		}
 	}
 
+	trustedProxies, err := getConfiguredTrustedProxies(config)
+	if err != nil {
+		return nil, err
+	}
+
 	country, _ := config.GetString("app", "country")
 	country = strings.ToUpper(country)
 	if signaling.IsValidCountry(country) {
@@ -188,6 +193,7 @@ func NewProxyServer(r *mux.Router, version string, config *goconf.ConfigFile) (*
 		clientIds: make(map[string]string),
 	}
 
+	result.trustedProxies.Store(trustedProxies)
 	result.upgrader.CheckOrigin = result.checkOrigin
 
 	if debug, _ := config.GetBool("app", "debug"); debug {
@@ -388,6 +394,11 @@ func (s *ProxyServer) ScheduleShutdown() {
 }
 
 func (s *ProxyServer) Reload(config *goconf.ConfigFile) {
+	if trustedProxies, err := getConfiguredTrustedProxies(config); err != nil {
+		log.Printf("Could not parse trusted proxies, keeping current list: %s", err)
+	} else {
+		s.trustedProxies.Store(trustedProxies)
+	}
 	s.tokens.Reload(config)
 }
 
@@ -398,26 +409,34 @@ func (s *ProxyServer) setCommonHeaders(f func(http.ResponseWriter, *http.Request
 	}
 }
 
-func getRealUserIP(r *http.Request) string {
-	// Note this function assumes it is running behind a trusted proxy, so
-	// the headers can be trusted.
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+func getConfiguredTrustedProxies(config *goconf.ConfigFile) (*signaling.TrustedProxies, error) {
+	value, _ := config.GetString("app", "trustedproxies")
+	trustedProxies, err := signaling.ParseTrustedProxies(value)
+	if err != nil {
+		return nil, err
 	}
 
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// Result could be a list "clientip, proxy1, proxy2", so only use first element.
-		if pos := strings.Index(ip, ","); pos >= 0 {
-			ip = strings.TrimSpace(ip[:pos])
-		}
-		return ip
+	if trustedProxies.Empty() {
+		log.Printf("No trusted proxies configured, forwarding headers will be ignored")
+	} else {
+		log.Printf("Trusting forwarding headers from proxies %s", trustedProxies)
 	}
+	return trustedProxies, nil
+}
+
+func (s *ProxyServer) getTrustedProxies() *signaling.TrustedProxies {
+	trustedProxies, _ := s.trustedProxies.Load().(*signaling.TrustedProxies)
+	return trustedProxies
+}
 
-	return r.RemoteAddr
+// getRealUserIP returns the address of the client that sent the request,
+// forwarding headers are only used from trusted proxies.
+func (s *ProxyServer) getRealUserIP(r *http.Request) string {
+	return s.getTrustedProxies().GetClientIP(r)
 }
 
 func (s *ProxyServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	addr := getRealUserIP(r)
+	addr := s.getRealUserIP(r)
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Could not upgrade request from %s: %s", addr, err)
@@ -1000,12 +1019,14 @@ func (s *ProxyServer) getStats() map[string]interface{} {
 
 func (s *ProxyServer) validateStatsRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addr := getRealUserIP(r)
-		if strings.Contains(addr, ":") {
-			if host, _, err := net.SplitHostPort(addr); err == nil {
-				addr = host
-			}
+		if s.getTrustedProxies().IsUntrustedForward(r) {
+			// The request was forwarded by a proxy that is not trusted, so the
+			// address of the client that sent it is unknown.
+			http.Error(w, "Authentication check failed", http.StatusForbidden)
+			return
 		}
+
+		addr := s.getRealUserIP(r)
 		if !s.statsAllowedIps[addr] {
 			http.Error(w, "Authentication check failed", http.StatusForbidden)
 			return
@@ -0,0 +1,95 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+// messageRateLimiter allows a number of messages per interval (one second by
+// default) with bursts of up to the same number of messages.
+type messageRateLimiter struct {
+	mu sync.Mutex
+
+	rate     int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newMessageRateLimiter(rate int) *messageRateLimiter {
+	return newRateLimiter(rate, time.Second)
+}
+
+// newRateLimiter returns a limiter that allows "rate" events per "interval".
+func newRateLimiter(rate int, interval time.Duration) *messageRateLimiter {
+	return &messageRateLimiter{
+		rate:     rate,
+		interval: interval,
+		tokens:   float64(rate),
+		last:     time.Now(),
+	}
+}
+
+// Rate returns the number of messages that are allowed per interval.
+func (l *messageRateLimiter) Rate() int {
+	return l.rate
+}
+
+// Allow checks if another message may be processed at the given time.
+func (l *messageRateLimiter) Allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refillLocked(now)
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// RetryAfter returns the duration after which another message may be
+// processed if it is not allowed at the given time.
+func (l *messageRateLimiter) RetryAfter(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refillLocked(now)
+	if l.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) * float64(l.interval) / float64(l.rate))
+}
+
+func (l *messageRateLimiter) refillLocked(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += float64(elapsed) / float64(l.interval) * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+		l.last = now
+	}
+}
@@ -0,0 +1,125 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageRateLimiter(t *testing.T) {
+	limiter := newMessageRateLimiter(5)
+	if rate := limiter.Rate(); rate != 5 {
+		t.Errorf("Expected rate 5, got %d", rate)
+	}
+
+	now := limiter.last
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(now) {
+			t.Fatalf("Message %d should be allowed", i)
+		}
+	}
+	if limiter.Allow(now) {
+		t.Error("Burst should be limited")
+	}
+
+	// A new message is allowed every 200ms.
+	now = now.Add(100 * time.Millisecond)
+	if limiter.Allow(now) {
+		t.Error("Message should not be allowed after 100ms")
+	}
+	now = now.Add(100 * time.Millisecond)
+	if !limiter.Allow(now) {
+		t.Error("Message should be allowed after 200ms")
+	}
+	if limiter.Allow(now) {
+		t.Error("Only one message should be allowed after 200ms")
+	}
+
+	// Tokens don't accumulate above the rate.
+	now = now.Add(time.Minute)
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(now) {
+			t.Fatalf("Message %d should be allowed", i)
+		}
+	}
+	if limiter.Allow(now) {
+		t.Error("Burst should be limited")
+	}
+}
+
+func TestRateLimiterInterval(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+	if rate := limiter.Rate(); rate != 2 {
+		t.Errorf("Expected rate 2, got %d", rate)
+	}
+
+	now := limiter.last
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow(now) {
+			t.Fatalf("Event %d should be allowed", i)
+		}
+	}
+	if limiter.Allow(now) {
+		t.Error("Burst should be limited")
+	}
+
+	// A new event is allowed every 30 seconds.
+	now = now.Add(time.Second)
+	if limiter.Allow(now) {
+		t.Error("Event should not be allowed after one second")
+	}
+	now = now.Add(29 * time.Second)
+	if !limiter.Allow(now) {
+		t.Error("Event should be allowed after 30 seconds")
+	}
+	if limiter.Allow(now) {
+		t.Error("Only one event should be allowed after 30 seconds")
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+	now := limiter.last
+	if retry := limiter.RetryAfter(now); retry != 0 {
+		t.Errorf("Expected no retry delay, got %s", retry)
+	}
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow(now) {
+			t.Fatalf("Event %d should be allowed", i)
+		}
+	}
+	if retry := limiter.RetryAfter(now); retry != 30*time.Second {
+		t.Errorf("Expected retry after 30 seconds, got %s", retry)
+	}
+
+	now = now.Add(20 * time.Second)
+	if retry := limiter.RetryAfter(now); retry != 10*time.Second {
+		t.Errorf("Expected retry after 10 seconds, got %s", retry)
+	}
+
+	now = now.Add(10 * time.Second)
+	if retry := limiter.RetryAfter(now); retry != 0 {
+		t.Errorf("Expected no retry delay, got %s", retry)
+	}
+}
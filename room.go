@@ -28,6 +28,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -59,6 +60,8 @@ type Room struct {
 	backend *Backend
 
 	properties *json.RawMessage
+	// propertiesVersion is increased whenever the properties change.
+	propertiesVersion uint64
 
 	closeChan chan bool
 	mu        *sync.RWMutex
@@ -68,6 +71,10 @@ type Room struct {
 	virtualSessions  map[*VirtualSession]bool
 	inCallSessions   map[Session]bool
 	roomSessionData  map[string]*RoomSessionData
+	observerSessions map[Session]bool
+
+	// Sessions that are allowed to join but were not added yet.
+	reservedSessions map[string]bool
 
 	statsRoomSessionsCurrent *prometheus.GaugeVec
 
@@ -81,6 +88,9 @@ type Room struct {
 	lastNatsRoomRequests map[string]int64
 
 	transientData *TransientData
+
+	// Time since when the room is empty, protected by the lock of the hub.
+	emptySince time.Time
 }
 
 func GetSubjectForRoomId(roomId string, backend *Backend) string {
@@ -121,7 +131,8 @@ func NewRoom(roomId string, properties *json.RawMessage, hub *Hub, n NatsClient,
 		nats:    n,
 		backend: backend,
 
-		properties: properties,
+		properties:        properties,
+		propertiesVersion: 1,
 
 		closeChan: make(chan bool, 1),
 		mu:        &sync.RWMutex{},
@@ -131,6 +142,9 @@ func NewRoom(roomId string, properties *json.RawMessage, hub *Hub, n NatsClient,
 		virtualSessions:  make(map[*VirtualSession]bool),
 		inCallSessions:   make(map[Session]bool),
 		roomSessionData:  make(map[string]*RoomSessionData),
+		observerSessions: make(map[Session]bool),
+
+		reservedSessions: make(map[string]bool),
 
 		statsRoomSessionsCurrent: statsRoomSessionsCurrent.MustCurryWith(prometheus.Labels{
 			"backend": backend.Id(),
@@ -159,6 +173,13 @@ func (r *Room) Properties() *json.RawMessage {
 	return r.properties
 }
 
+// PropertiesSnapshot returns the current properties and their version.
+func (r *Room) PropertiesSnapshot() (*json.RawMessage, uint64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.properties, r.propertiesVersion
+}
+
 func (r *Room) Backend() *Backend {
 	return r.backend
 }
@@ -187,6 +208,15 @@ func (r *Room) IsEqual(other *Room) bool {
 
 func (r *Room) run() {
 	ticker := time.NewTicker(updateActiveSessionsInterval)
+	defer ticker.Stop()
+
+	// Stats are only published if enabled.
+	var statsTimer <-chan time.Time
+	if interval := r.hub.roomStatsInterval; interval > 0 {
+		statsTicker := time.NewTicker(interval)
+		defer statsTicker.Stop()
+		statsTimer = statsTicker.C
+	}
 loop:
 	for {
 		select {
@@ -198,6 +228,8 @@ loop:
 			}
 		case <-ticker.C:
 			r.publishActiveSessions()
+		case <-statsTimer:
+			r.PublishStats()
 		}
 	}
 }
@@ -225,6 +257,7 @@ func (r *Room) unsubscribeBackend() {
 func (r *Room) Close() []Session {
 	r.hub.removeRoom(r)
 	r.doClose()
+	r.transientData.Close()
 	r.mu.Lock()
 	r.unsubscribeBackend()
 	result := make([]Session, 0, len(r.sessions))
@@ -236,6 +269,9 @@ func (r *Room) Close() []Session {
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeInternal})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeVirtual})
 	r.mu.Unlock()
+	for _, s := range result {
+		r.hub.updateBackendSessionRoom(s, r.id, "")
+	}
 	return result
 }
 
@@ -285,6 +321,16 @@ func (r *Room) processBackendRoomRequest(message *BackendServerRoomRequest) {
 }
 
 func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Session {
+	return r.addSession(session, sessionData, false)
+}
+
+// AddResumedSession adds a session that replaces a previous connection of the
+// same room session, other participants will see the join as resumed.
+func (r *Room) AddResumedSession(session Session, sessionData *json.RawMessage) []Session {
+	return r.addSession(session, sessionData, true)
+}
+
+func (r *Room) addSession(session Session, sessionData *json.RawMessage, resumed bool) []Session {
 	var roomSessionData *RoomSessionData
 	if sessionData != nil && len(*sessionData) > 0 {
 		roomSessionData = &RoomSessionData{}
@@ -296,6 +342,7 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 
 	sid := session.PublicId()
 	r.mu.Lock()
+	delete(r.reservedSessions, sid)
 	_, found := r.sessions[sid]
 	// Return list of sessions already in the room.
 	result := make([]Session, 0, len(r.sessions))
@@ -304,6 +351,9 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 			result = append(result, s)
 		}
 	}
+	if len(r.sessions) == 0 && r.hub.emptyRoomTimeout > 0 {
+		r.hub.markRoomUsed(r)
+	}
 	r.sessions[sid] = session
 	if !found {
 		r.statsRoomSessionsCurrent.With(prometheus.Labels{"clienttype": session.ClientType()}).Inc()
@@ -321,6 +371,10 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 		}
 		r.virtualSessions[virtualSession] = true
 		publishUsersChanged = true
+	default:
+		if isObserverSession(session) {
+			r.observerSessions[session] = true
+		}
 	}
 	if roomSessionData != nil {
 		r.roomSessionData[sid] = roomSessionData
@@ -328,7 +382,16 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 	}
 	r.mu.Unlock()
 	if !found {
-		r.PublishSessionJoined(session, roomSessionData)
+		r.hub.updateBackendSessionRoom(session, "", r.id)
+	}
+	if roomSessionData != nil {
+		if clientSession, ok := session.(*ClientSession); ok {
+			// The user id of guests is taken from the room session data.
+			clientSession.clearMessageSenders()
+		}
+	}
+	if !found {
+		r.PublishSessionJoined(session, roomSessionData, resumed)
 		if publishUsersChanged {
 			r.publishUsersChangedWithInternal()
 			if session, ok := session.(*VirtualSession); ok && session.Flags() != 0 {
@@ -349,6 +412,69 @@ func (r *Room) HasSession(session Session) bool {
 	return result
 }
 
+func isObserverSession(session Session) bool {
+	clientSession, ok := session.(*ClientSession)
+	return ok && clientSession.IsObserver()
+}
+
+func (r *Room) numParticipantsLocked() int {
+	return len(r.sessions) - len(r.internalSessions) - len(r.virtualSessions) - len(r.observerSessions)
+}
+
+// ReserveSession checks if the session may join the room without exceeding
+// the maximum number of participants of the backend. If allowed, a slot is
+// reserved for the session until it is added to the room.
+func (r *Room) ReserveSession(session Session) bool {
+	maxParticipants := r.backend.MaxParticipants()
+	if maxParticipants <= 0 {
+		return true
+	}
+
+	switch session.ClientType() {
+	case HelloClientTypeInternal:
+		fallthrough
+	case HelloClientTypeVirtual:
+		// Internal and virtual sessions are not counting to the limit.
+		return true
+	}
+	if isObserverSession(session) {
+		// Observers are not counting to the limit.
+		return true
+	}
+
+	sid := session.PublicId()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.sessions[sid]; found || r.reservedSessions[sid] {
+		return true
+	}
+
+	if r.numParticipantsLocked()+len(r.reservedSessions) >= maxParticipants {
+		return false
+	}
+
+	r.reservedSessions[sid] = true
+	return true
+}
+
+// ReleaseSession releases the slot that was reserved for the session if it
+// could not be added to the room.
+func (r *Room) ReleaseSession(session Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.reservedSessions, session.PublicId())
+}
+
+// NumSessions returns the number of sessions in the room that are visible to
+// other sessions, i.e. without observers.
+func (r *Room) NumSessions() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.sessions) - len(r.observerSessions)
+}
+
 func (r *Room) IsSessionInCall(session Session) bool {
 	r.mu.RLock()
 	_, result := r.inCallSessions[session]
@@ -356,8 +482,22 @@ func (r *Room) IsSessionInCall(session Session) bool {
 	return result
 }
 
-// Returns "true" if there are still clients in the room.
-func (r *Room) RemoveSession(session Session) bool {
+// RemoveSession removes the session from the room and publishes that it left
+// with the given reason. Returns "true" if there are still clients in the room.
+func (r *Room) RemoveSession(session Session, reason string) bool {
+	return r.removeSession(session, reason, true)
+}
+
+// RemoveResumedSession removes a session that is replaced by a new connection
+// of the same room session, the other participants don't receive a "leave"
+// event for it.
+func (r *Room) RemoveResumedSession(session Session) bool {
+	return r.removeSession(session, LeaveReasonDisconnected, false)
+}
+
+func (r *Room) removeSession(session Session, reason string, notify bool) bool {
+	r.hub.updateBackendSessionRoom(session, r.id, "")
+
 	r.mu.Lock()
 	if _, found := r.sessions[session.PublicId()]; !found {
 		r.mu.Unlock()
@@ -368,6 +508,7 @@ func (r *Room) RemoveSession(session Session) bool {
 	r.statsRoomSessionsCurrent.With(prometheus.Labels{"clienttype": session.ClientType()}).Dec()
 	delete(r.sessions, sid)
 	delete(r.internalSessions, session)
+	delete(r.observerSessions, session)
 	if virtualSession, ok := session.(*VirtualSession); ok {
 		delete(r.virtualSessions, virtualSession)
 	}
@@ -378,10 +519,20 @@ func (r *Room) RemoveSession(session Session) bool {
 	delete(r.roomSessionData, sid)
 	if len(r.sessions) > 0 {
 		r.mu.Unlock()
-		r.PublishSessionLeft(session)
+		if notify {
+			r.PublishSessionLeft(session, reason)
+		}
 		return true
 	}
 
+	if r.hub.emptyRoomTimeout > 0 {
+		// Keep the room and its transient data for a while in case a session
+		// joins again, it will be removed by the hub afterwards.
+		r.hub.markRoomEmpty(r, time.Now())
+		r.mu.Unlock()
+		return false
+	}
+
 	r.hub.removeRoom(r)
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeClient})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeInternal})
@@ -392,8 +543,27 @@ func (r *Room) RemoveSession(session Session) bool {
 	return false
 }
 
+// expire closes a room that was empty for too long and has already been
+// removed from the hub. No events are sent as there are no participants.
+func (r *Room) expire() {
+	r.doClose()
+	r.transientData.Close()
+	r.mu.Lock()
+	r.unsubscribeBackend()
+	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeClient})
+	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeInternal})
+	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeVirtual})
+	r.mu.Unlock()
+}
+
 func (r *Room) publish(message *ServerMessage) error {
-	return r.nats.PublishMessage(GetSubjectForRoomId(r.id, r.backend), message)
+	subject := GetSubjectForRoomId(r.id, r.backend)
+	for _, msg := range r.hub.splitEvent(message) {
+		if err := r.nats.PublishMessage(subject, msg); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *Room) UpdateProperties(properties *json.RawMessage) {
@@ -406,11 +576,94 @@ func (r *Room) UpdateProperties(properties *json.RawMessage) {
 	}
 
 	r.properties = properties
+	r.propertiesVersion++
+	r.publishPropertiesLocked(nil)
+}
+
+func isJSONNull(value json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+}
+
+// parsePropertiesPatch parses a patch of room properties, it must be a JSON
+// object.
+func parsePropertiesPatch(patch *json.RawMessage) (map[string]json.RawMessage, error) {
+	if patch == nil || len(*patch) == 0 {
+		return nil, fmt.Errorf("properties patch missing")
+	}
+
+	var changes map[string]json.RawMessage
+	if err := json.Unmarshal(*patch, &changes); err != nil {
+		return nil, fmt.Errorf("properties patch must be an object: %w", err)
+	} else if changes == nil {
+		return nil, fmt.Errorf("properties patch must be an object")
+	}
+	return changes, nil
+}
+
+// PatchProperties applies a patch to the top-level properties of the room.
+// Properties of the patch replace the current values, a value of "null"
+// removes the property. Sessions are only notified about the properties that
+// actually changed.
+func (r *Room) PatchProperties(patch *json.RawMessage) error {
+	changes, err := parsePropertiesPatch(patch)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := make(map[string]json.RawMessage)
+	if r.properties != nil && len(*r.properties) > 0 && !isJSONNull(*r.properties) {
+		if err := json.Unmarshal(*r.properties, &current); err != nil {
+			return fmt.Errorf("properties of room %s are not an object: %w", r.id, err)
+		}
+	}
+
+	applied := make(map[string]json.RawMessage)
+	for key, value := range changes {
+		prev, found := current[key]
+		if isJSONNull(value) {
+			if !found {
+				continue
+			}
+
+			delete(current, key)
+		} else if found && bytes.Equal(prev, value) {
+			continue
+		} else {
+			current[key] = value
+		}
+		applied[key] = value
+	}
+	if len(applied) == 0 {
+		// Don't notify if properties didn't change.
+		return nil
+	}
+
+	properties, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	appliedPatch, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+
+	r.properties = (*json.RawMessage)(&properties)
+	r.propertiesVersion++
+	r.publishPropertiesLocked((*json.RawMessage)(&appliedPatch))
+	return nil
+}
+
+func (r *Room) publishPropertiesLocked(patch *json.RawMessage) {
 	message := &ServerMessage{
 		Type: "room",
 		Room: &RoomServerMessage{
-			RoomId:     r.id,
-			Properties: r.properties,
+			RoomId:            r.id,
+			Properties:        r.properties,
+			PropertiesPatch:   patch,
+			PropertiesVersion: r.propertiesVersion,
 		},
 	}
 	if err := r.publish(message); err != nil {
@@ -424,9 +677,10 @@ func (r *Room) GetRoomSessionData(session Session) *RoomSessionData {
 	return r.roomSessionData[session.PublicId()]
 }
 
-func (r *Room) PublishSessionJoined(session Session, sessionData *RoomSessionData) {
+func (r *Room) PublishSessionJoined(session Session, sessionData *RoomSessionData, resumed bool) {
 	sessionId := session.PublicId()
-	if sessionId == "" {
+	if sessionId == "" || isObserverSession(session) {
+		// Observers are not visible to other sessions.
 		return
 	}
 
@@ -442,9 +696,11 @@ func (r *Room) PublishSessionJoined(session Session, sessionData *RoomSessionDat
 			Type:   "join",
 			Join: []*EventServerMessageSessionEntry{
 				{
-					SessionId: sessionId,
-					UserId:    userid,
-					User:      session.UserData(),
+					SessionId:   sessionId,
+					UserId:      userid,
+					User:        session.UserData(),
+					DisplayName: session.DisplayName(),
+					Resumed:     resumed,
 				},
 			},
 		},
@@ -461,9 +717,79 @@ func (r *Room) PublishSessionJoined(session Session, sessionData *RoomSessionDat
 	}
 }
 
-func (r *Room) PublishSessionLeft(session Session) {
+// newSessionEntry returns the current state of the session for room events.
+func newSessionEntry(session Session) *EventServerMessageSessionEntry {
+	entry := &EventServerMessageSessionEntry{
+		SessionId:   session.PublicId(),
+		UserId:      session.UserId(),
+		User:        session.UserData(),
+		DisplayName: session.DisplayName(),
+	}
+	if session, ok := session.(*ClientSession); ok {
+		entry.RoomSessionId = session.RoomSessionId()
+	}
+	return entry
+}
+
+// GetSessionEntries returns the current state of all sessions in the room that
+// are visible to other sessions, sorted by their session id.
+func (r *Room) GetSessionEntries() []*EventServerMessageSessionEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := make([]*EventServerMessageSessionEntry, 0, len(r.sessions))
+	for sid, session := range r.sessions {
+		if isObserverSession(session) {
+			continue
+		}
+
+		entry := newSessionEntry(session)
+		if entry.UserId == "" {
+			// The user id of guests is taken from the room session data.
+			if data := r.roomSessionData[sid]; data != nil {
+				entry.UserId = data.UserId
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SessionId < entries[j].SessionId
+	})
+	return entries
+}
+
+// PublishSessionChanged notifies the room that the state of the session has
+// changed, previous is the state that was published before.
+func (r *Room) PublishSessionChanged(session Session, previous *EventServerMessageSessionEntry) {
+	if session.PublicId() == "" || isObserverSession(session) {
+		return
+	}
+
+	entry := newSessionEntry(session)
+	entry.Previous = newEventServerMessageSessionPrevious(previous, entry)
+	if entry.Previous == nil {
+		// Nothing changed.
+		return
+	}
+
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "change",
+			Change: []*EventServerMessageSessionEntry{
+				entry,
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish session changed message in room %s: %s", r.Id(), err)
+	}
+}
+
+func (r *Room) PublishSessionLeft(session Session, reason string) {
 	sessionId := session.PublicId()
-	if sessionId == "" {
+	if sessionId == "" || isObserverSession(session) {
 		return
 	}
 
@@ -477,6 +803,11 @@ func (r *Room) PublishSessionLeft(session Session) {
 			},
 		},
 	}
+	if reason != "" {
+		message.Event.LeaveReasons = map[string]string{
+			sessionId: reason,
+		}
+	}
 	if err := r.publish(message); err != nil {
 		log.Printf("Could not publish session left message in room %s: %s", r.Id(), err)
 	}
@@ -486,6 +817,104 @@ func (r *Room) PublishSessionLeft(session Session) {
 	}
 }
 
+// PublishPresence sends the presence state of the given session to all other
+// sessions in the room.
+func (r *Room) PublishPresence(session Session, state string) {
+	message := &ServerMessage{
+		Type: "presence",
+		Presence: &PresenceServerMessage{
+			SessionId: session.PublicId(),
+			UserId:    session.UserId(),
+			State:     state,
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish presence of session %s in room %s: %s", session.PublicId(), r.Id(), err)
+	}
+}
+
+// PublishError sends an error to all sessions in the room, the sessions are
+// not disconnected.
+func (r *Room) PublishError(code string, message string) {
+	if err := r.publish(NewRoomErrorServerMessage(code, message)); err != nil {
+		log.Printf("Could not publish error %s in room %s: %s", code, r.Id(), err)
+	}
+}
+
+// PublishSessionKicked notifies all sessions in the room that the given
+// session was kicked.
+func (r *Room) PublishSessionKicked(session Session, reason string) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "kicked",
+			Kicked: &RoomKickedServerMessage{
+				SessionId: session.PublicId(),
+				Reason:    reason,
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish session kicked message in room %s: %s", r.Id(), err)
+	}
+}
+
+// GetStats returns the current metrics of the room.
+func (r *Room) GetStats() *RoomStatsServerMessage {
+	r.mu.RLock()
+	stats := &RoomStatsServerMessage{
+		RoomId:   r.id,
+		Sessions: len(r.sessions),
+		InCall:   len(r.inCallSessions),
+	}
+	if r.backend != nil {
+		stats.MaxStreamBitrate = r.backend.maxStreamBitrate
+		stats.MaxScreenBitrate = r.backend.maxScreenBitrate
+	}
+	sessions := make([]*ClientSession, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		if clientSession, ok := session.(*ClientSession); ok {
+			sessions = append(sessions, clientSession)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, session := range sessions {
+		if session.HasPublishers() {
+			stats.Mcu = true
+			break
+		}
+	}
+	return stats
+}
+
+// PublishStats notifies all sessions in the room about the current metrics of
+// the room.
+func (r *Room) PublishStats() {
+	stats := r.GetStats()
+	if stats.Sessions == 0 {
+		return
+	}
+
+	if err := stats.CheckValid(); err != nil {
+		log.Printf("Not publishing invalid stats %+v in room %s: %s", stats, r.Id(), err)
+		return
+	}
+
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "stats",
+			Stats:  stats,
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish stats message in room %s: %s", r.Id(), err)
+	}
+}
+
 func (r *Room) addInternalSessions(users []map[string]interface{}) []map[string]interface{} {
 	now := time.Now().Unix()
 	r.mu.Lock()
@@ -548,7 +977,28 @@ func IsInCall(value interface{}) (bool, bool) {
 	}
 }
 
+// ParseInCall returns if the raw "incall" value, either a boolean or the
+// in-call flags, marks a call as active.
+func ParseInCall(raw json.RawMessage) (bool, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return false, err
+	}
+
+	inCall, ok := IsInCall(value)
+	if !ok {
+		return false, fmt.Errorf("unsupported incall value %s", string(raw))
+	}
+	return inCall, nil
+}
+
 func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users []map[string]interface{}) {
+	r.PublishUsersInCallChangedWithState(nil, changed, users)
+}
+
+// PublishUsersInCallChangedWithState is like PublishUsersInCallChanged but
+// also includes the raw "incall" value of the backend request in the event.
+func (r *Room) PublishUsersInCallChangedWithState(inCall json.RawMessage, changed []map[string]interface{}, users []map[string]interface{}) {
 	r.users = users
 	for _, user := range changed {
 		inCallInterface, found := user["inCall"]
@@ -610,6 +1060,11 @@ func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users
 			},
 		},
 	}
+	if len(inCall) > 0 {
+		if err := message.Event.Update.SetInCall(inCall); err != nil {
+			log.Printf("Ignore invalid incall value in room %s: %s", r.Id(), err)
+		}
+	}
 	if err := r.publish(message); err != nil {
 		log.Printf("Could not publish incall message in room %s: %s", r.Id(), err)
 	}
@@ -659,7 +1114,15 @@ func (r *Room) NotifySessionResumed(session *ClientSession) {
 		return
 	}
 
-	session.SendMessage(message)
+	// The update is sent directly, so apply the subscription of the session
+	// like for events received through NATS.
+	if message = session.filterSubscribedEvent(message); message == nil {
+		return
+	}
+
+	for _, msg := range r.hub.splitEvent(message) {
+		session.SendMessage(msg)
+	}
 }
 
 func (r *Room) NotifySessionChanged(session Session) {
@@ -701,6 +1164,32 @@ func (r *Room) publishSessionFlagsChanged(session *VirtualSession) {
 	}
 }
 
+// PublishSessionsQualityChanged notifies all sessions in the room about
+// changed connection qualities of the given sessions.
+func (r *Room) PublishSessionsQualityChanged(sessions []*RoomQualityServerMessageEntry) error {
+	quality := &RoomQualityServerMessage{
+		RoomId:   r.id,
+		Sessions: sessions,
+	}
+	if err := quality.CheckValid(); err != nil {
+		return err
+	}
+
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target:  "participants",
+			Type:    "quality",
+			Quality: quality,
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish quality changed message in room %s: %s", r.Id(), err)
+		return err
+	}
+	return nil
+}
+
 func (r *Room) publishActiveSessions() (int, *sync.WaitGroup) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -798,15 +1287,21 @@ func (r *Room) notifyInternalRoomDeleted() {
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	sessions := make([]*ClientSession, 0, len(r.internalSessions))
 	for s := range r.internalSessions {
-		s.(*ClientSession).SendMessage(msg)
+		sessions = append(sessions, s.(*ClientSession))
 	}
+	broadcastMessage(sessions, msg)
 }
 
 func (r *Room) SetTransientData(key string, value interface{}) {
 	r.transientData.Set(key, value)
 }
 
+func (r *Room) SetTransientDataTTL(key string, value interface{}, ttl time.Duration) {
+	r.transientData.SetTTL(key, value, ttl)
+}
+
 func (r *Room) RemoveTransientData(key string) {
 	r.transientData.Remove(key)
 }
@@ -27,9 +27,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/dlintw/goconf"
 	"github.com/gorilla/websocket"
 )
 
@@ -71,6 +75,53 @@ func TestRoom_InCall(t *testing.T) {
 	}
 }
 
+func TestRoom_ParseInCall(t *testing.T) {
+	type Testcase struct {
+		Value  string
+		InCall bool
+		Valid  bool
+	}
+	tests := []Testcase{
+		// Bare boolean of older versions of Nextcloud Talk.
+		{"true", true, true},
+		{"false", false, true},
+		// In-call flags.
+		{"0", false, true},
+		{"1", true, true},
+		{"2", false, true},
+		{"3", true, true},
+		{"7", true, true},
+		{"8", false, true},
+		// Invalid values.
+		{"", false, false},
+		{"null", false, false},
+		{"\"foo\"", false, false},
+		{"{}", false, false},
+	}
+	for _, test := range tests {
+		inCall, err := ParseInCall(json.RawMessage(test.Value))
+		if valid := err == nil; valid != test.Valid {
+			t.Errorf("%s should be valid %v, got %s", test.Value, test.Valid, err)
+		}
+		if inCall != test.InCall {
+			t.Errorf("%s should convert to %v, got %v", test.Value, test.InCall, inCall)
+		}
+
+		var event RoomEventServerMessage
+		if err := event.SetInCall(json.RawMessage(test.Value)); err != nil {
+			if test.Valid {
+				t.Errorf("Could not set %s: %s", test.Value, err)
+			} else if event.InCall != nil || event.InCallState != nil {
+				t.Errorf("Invalid value %s should not be set, got %+v", test.Value, event)
+			}
+		} else if event.InCall == nil || string(*event.InCall) != test.Value {
+			t.Errorf("Expected raw value %s, got %+v", test.Value, event.InCall)
+		} else if event.InCallState == nil || *event.InCallState != test.InCall {
+			t.Errorf("Expected state %v for %s, got %+v", test.InCall, test.Value, event.InCallState)
+		}
+	}
+}
+
 func TestRoom_Update(t *testing.T) {
 	hub, _, router, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -209,6 +260,174 @@ loop:
 	}
 }
 
+func TestRoom_PatchProperties(t *testing.T) {
+	hub, _, router, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	config, err := getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBackendServer(config, hub, "no-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(router); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// The first client supports patches, the second one doesn't.
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			Features: []string{ServerFeatureRoomPropertiesPatch},
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if _, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+	if _, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	updateRoom := func(update *BackendRoomUpdateRequest) int {
+		data, err := json.Marshal(&BackendServerRoomRequest{
+			Type:   "update",
+			Update: update,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if _, err := ioutil.ReadAll(res.Body); err != nil {
+			t.Error(err)
+		}
+		return res.StatusCode
+	}
+
+	checkRoom := func(client *TestClient, properties string, patch string, version uint64) {
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageRoomId(message, roomId); err != nil {
+			t.Fatal(err)
+		}
+
+		if properties == "" {
+			if message.Room.Properties != nil {
+				t.Errorf("Expected no properties, got %s", string(*message.Room.Properties))
+			}
+		} else if message.Room.Properties == nil || string(*message.Room.Properties) != properties {
+			t.Errorf("Expected properties %s, got %+v", properties, message.Room)
+		}
+		if patch == "" {
+			if message.Room.PropertiesPatch != nil {
+				t.Errorf("Expected no patch, got %s", string(*message.Room.PropertiesPatch))
+			}
+		} else if message.Room.PropertiesPatch == nil || string(*message.Room.PropertiesPatch) != patch {
+			t.Errorf("Expected patch %s, got %+v", patch, message.Room)
+		}
+		if message.Room.PropertiesVersion != version {
+			t.Errorf("Expected version %d, got %d", version, message.Room.PropertiesVersion)
+		}
+	}
+
+	// Full updates are sent to all clients.
+	properties := json.RawMessage(`{"foo":"bar","baz":1}`)
+	if status := updateRoom(&BackendRoomUpdateRequest{
+		Properties: &properties,
+	}); status != http.StatusOK {
+		t.Fatalf("Expected successful request, got %d", status)
+	}
+	checkRoom(client1, string(properties), "", 2)
+	checkRoom(client2, string(properties), "", 2)
+
+	// Patches change, add and remove properties.
+	patch := json.RawMessage(`{"foo":"qux","baz":null,"new":true,"missing":null}`)
+	if status := updateRoom(&BackendRoomUpdateRequest{
+		PropertiesPatch: &patch,
+	}); status != http.StatusOK {
+		t.Fatalf("Expected successful request, got %d", status)
+	}
+	checkRoom(client1, "", `{"baz":null,"foo":"qux","new":true}`, 3)
+	checkRoom(client2, `{"foo":"qux","new":true}`, "", 3)
+
+	// Patches without changes are not sent.
+	patch = json.RawMessage(`{"foo":"qux"}`)
+	if status := updateRoom(&BackendRoomUpdateRequest{
+		PropertiesPatch: &patch,
+	}); status != http.StatusOK {
+		t.Fatalf("Expected successful request, got %d", status)
+	}
+
+	// Invalid patches are rejected.
+	patch = json.RawMessage(`["foo"]`)
+	if status := updateRoom(&BackendRoomUpdateRequest{
+		PropertiesPatch: &patch,
+	}); status != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %d", status)
+	}
+
+	// Joining the same room again returns a snapshot of the properties.
+	if message, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if message.Room.Properties == nil || string(*message.Room.Properties) != `{"foo":"qux","new":true}` {
+		t.Errorf("Expected full properties, got %+v", message.Room)
+	} else if message.Room.PropertiesPatch != nil {
+		t.Errorf("Expected no patch, got %s", string(*message.Room.PropertiesPatch))
+	} else if message.Room.PropertiesVersion != 3 {
+		t.Errorf("Expected version 3, got %d", message.Room.PropertiesVersion)
+	}
+}
+
 func TestRoom_Delete(t *testing.T) {
 	hub, _, router, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -421,3 +640,106 @@ func TestRoom_RoomSessionData(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestRoom_Stats(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("clients", "roomstatsinterval", "1")
+		return config, nil
+	})
+	defer shutdown()
+
+	if hub.roomStatsInterval != time.Second {
+		t.Errorf("Expected room stats interval of one second, got %s", hub.roomStatsInterval)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Room %s does not exist", roomId)
+	}
+
+	expected := &RoomStatsServerMessage{
+		RoomId:   roomId,
+		Sessions: 1,
+	}
+	if stats := room.GetStats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+
+	// Stats are published periodically.
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Target != "room" || message.Event.Type != "stats" {
+		t.Fatalf("Expected room stats event, got %+v", message.Event)
+	} else if !reflect.DeepEqual(message.Event.Stats, expected) {
+		t.Errorf("Expected stats %+v, got %+v", expected, message.Event.Stats)
+	}
+
+	// The MCU is only reported when sessions are publishing.
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+	hub.SetMcu(mcu)
+
+	if stats := room.GetStats(); stats.Mcu {
+		t.Errorf("Expected no MCU without publishers, got %+v", stats)
+	}
+
+	if err := client.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := room.GetStats(); !stats.Mcu {
+		t.Errorf("Expected MCU with publishers, got %+v", stats)
+	}
+}
@@ -29,6 +29,9 @@ import (
 )
 
 type DummySession struct {
+	trafficCounter
+	sessionMetadata
+
 	publicId string
 }
 
@@ -44,6 +47,10 @@ func (s *DummySession) ClientType() string {
 	return ""
 }
 
+func (s *DummySession) ClientInfo() *HelloClientInfo {
+	return nil
+}
+
 func (s *DummySession) Data() *SessionIdData {
 	return nil
 }
@@ -75,7 +82,11 @@ func (s *DummySession) GetRoom() *Room {
 	return nil
 }
 
-func (s *DummySession) LeaveRoom(notify bool) *Room {
+func (s *DummySession) CurrentRoom() MessageRoom {
+	return nil
+}
+
+func (s *DummySession) LeaveRoom(notify bool, reason string) *Room {
 	return nil
 }
 
@@ -90,6 +101,14 @@ func (s *DummySession) HasPermission(permission Permission) bool {
 	return false
 }
 
+func (s *DummySession) DisplayName() string {
+	return ""
+}
+
+func (s *DummySession) RemoteAddr() string {
+	return ""
+}
+
 func checkSession(t *testing.T, sessions RoomSessions, sessionId string, roomSessionId string) Session {
 	session := &DummySession{
 		publicId: sessionId,
@@ -22,6 +22,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -40,6 +41,7 @@ import (
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 
 	signaling "github.com/strukturag/nextcloud-spreed-signaling"
 )
@@ -64,16 +66,19 @@ const (
 	maxMcuRetry     = time.Second * 16
 )
 
-func createListener(addr string) (net.Listener, error) {
+func createListener(addr string, keepAlive time.Duration) (net.Listener, error) {
 	if addr[0] == '/' {
 		os.Remove(addr)
 		return net.Listen("unix", addr)
 	}
 
-	return net.Listen("tcp", addr)
+	config := net.ListenConfig{
+		KeepAlive: keepAlive,
+	}
+	return config.Listen(context.Background(), "tcp", addr)
 }
 
-func createTLSListener(addr string, certFile, keyFile string) (net.Listener, error) {
+func createTLSListener(addr string, keepAlive time.Duration, certFile, keyFile string) (net.Listener, error) {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return nil, err
@@ -81,12 +86,27 @@ func createTLSListener(addr string, certFile, keyFile string) (net.Listener, err
 	config := tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
-	if addr[0] == '/' {
-		os.Remove(addr)
-		return tls.Listen("unix", addr, &config)
+	listener, err := createListener(addr, keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, &config), nil
+}
+
+// getKeepAlive returns the TCP keepalive period configured in the given
+// section. Zero uses the default of the operating system / Go runtime,
+// negative values disable keepalives.
+func getKeepAlive(config *goconf.ConfigFile, section string) time.Duration {
+	keepAlive, _ := config.GetInt(section, "keepalive")
+	if keepAlive < 0 {
+		log.Printf("TCP keepalive disabled for %s listeners", section)
+		return -1
+	} else if keepAlive == 0 {
+		return 0
 	}
 
-	return tls.Listen("tcp", addr, &config)
+	log.Printf("Using TCP keepalive period of %d seconds for %s listeners", keepAlive, section)
+	return time.Duration(keepAlive) * time.Second
 }
 
 func main() {
@@ -132,7 +152,7 @@ func main() {
 
 	log.Printf("Starting up version %s/%s as pid %d", version, runtime.Version(), os.Getpid())
 
-	config, err := goconf.ReadConfigFile(*configFlag)
+	config, err := signaling.ReadConfigFile(*configFlag)
 	if err != nil {
 		log.Fatal("Could not read configuration: ", err)
 	}
@@ -142,6 +162,7 @@ func main() {
 	log.Printf("Using a maximum of %d CPUs", cpus)
 
 	signaling.RegisterStats()
+	signaling.RegisterMessageStats(prometheus.DefaultRegisterer)
 
 	natsUrl, _ := config.GetString("nats", "url")
 	if natsUrl == "" {
@@ -206,7 +227,7 @@ func main() {
 					log.Fatalf("Cancelled")
 				case syscall.SIGHUP:
 					log.Printf("Received SIGHUP, reloading %s", *configFlag)
-					if config, err = goconf.ReadConfigFile(*configFlag); err != nil {
+					if config, err = signaling.ReadConfigFile(*configFlag); err != nil {
 						log.Printf("Could not read configuration from %s: %s", *configFlag, err)
 					} else {
 						mcuUrl, _ = config.GetString("mcu", "url")
@@ -276,10 +297,11 @@ func main() {
 		if writeTimeout <= 0 {
 			writeTimeout = defaultWriteTimeout
 		}
+		keepAlive := getKeepAlive(config, "https")
 		for _, address := range strings.Split(saddr, " ") {
 			go func(address string) {
 				log.Println("Listening on", address)
-				listener, err := createTLSListener(address, cert, key)
+				listener, err := createTLSListener(address, keepAlive, cert, key)
 				if err != nil {
 					log.Fatal("Could not start listening: ", err)
 				}
@@ -305,11 +327,12 @@ func main() {
 		if writeTimeout <= 0 {
 			writeTimeout = defaultWriteTimeout
 		}
+		keepAlive := getKeepAlive(config, "http")
 
 		for _, address := range strings.Split(addr, " ") {
 			go func(address string) {
 				log.Println("Listening on", address)
-				listener, err := createListener(address)
+				listener, err := createListener(address, keepAlive)
 				if err != nil {
 					log.Fatal("Could not start listening: ", err)
 				}
@@ -335,7 +358,7 @@ loop:
 			break loop
 		case syscall.SIGHUP:
 			log.Printf("Received SIGHUP, reloading %s", *configFlag)
-			if config, err := goconf.ReadConfigFile(*configFlag); err != nil {
+			if config, err := signaling.ReadConfigFile(*configFlag); err != nil {
 				log.Printf("Could not read configuration from %s: %s", *configFlag, err)
 			} else {
 				hub.Reload(config)
@@ -24,6 +24,7 @@ package signaling
 import (
 	"encoding/json"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -38,6 +39,48 @@ var (
 	PERMISSION_TRANSIENT_DATA     Permission = "transient-data"
 )
 
+type SessionRole string
+
+const (
+	// Moderators may control other sessions in their room.
+	SessionRoleModerator SessionRole = "moderator"
+	// Participants may only send regular messages.
+	SessionRoleParticipant SessionRole = "participant"
+)
+
+// GetSessionRole returns the role of the session, based on the permissions
+// the session has in its current room.
+func GetSessionRole(session Session) SessionRole {
+	if session.ClientType() == HelloClientTypeInternal {
+		// Internal clients act on behalf of the backend.
+		return SessionRoleModerator
+	}
+
+	if session.HasPermission(PERMISSION_MAY_CONTROL) {
+		return SessionRoleModerator
+	}
+
+	return SessionRoleParticipant
+}
+
+// getUserDisplayName returns the display name from the user data provided by
+// the backend. Anonymous sessions (i.e. without a user id) never have a
+// display name, as guests can choose their name freely.
+func getUserDisplayName(userId string, userData *json.RawMessage) string {
+	if userId == "" || userData == nil || len(*userData) == 0 {
+		return ""
+	}
+
+	var data struct {
+		DisplayName string `json:"displayname"`
+	}
+	if err := json.Unmarshal(*userData, &data); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(data.DisplayName)
+}
+
 type SessionIdData struct {
 	Sid       uint64
 	Created   time.Time
@@ -48,10 +91,17 @@ type Session interface {
 	PrivateId() string
 	PublicId() string
 	ClientType() string
+	ClientInfo() *HelloClientInfo
 	Data() *SessionIdData
 
 	UserId() string
 	UserData() *json.RawMessage
+	// DisplayName returns the display name from the user data or an empty
+	// string for anonymous sessions.
+	DisplayName() string
+
+	SetData(key string, value interface{}) error
+	GetData(key string) interface{}
 
 	Backend() *Backend
 	BackendUrl() string
@@ -59,10 +109,24 @@ type Session interface {
 
 	SetRoom(room *Room)
 	GetRoom() *Room
-	LeaveRoom(notify bool) *Room
+	// MessageSession provides the room from "GetRoom" to protocol messages.
+	MessageSession
+	// LeaveRoom removes the session from its room, the reason is one of the
+	// "LeaveReason*" values that is sent to the other sessions.
+	LeaveRoom(notify bool, reason string) *Room
 
 	IsExpired(now time.Time) bool
 	Close()
 
 	HasPermission(permission Permission) bool
+
+	// BytesSent returns the number of bytes sent to the client of the session.
+	BytesSent() uint64
+	// BytesReceived returns the number of bytes received from the client of
+	// the session.
+	BytesReceived() uint64
+
+	// RemoteAddr returns the address of the client of the session as resolved
+	// from the trusted proxies.
+	RemoteAddr() string
 }
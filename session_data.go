@@ -0,0 +1,106 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Maximum total size of the custom data (keys and JSON encoded values)
+	// that can be attached to a session.
+	maxSessionDataSize = 4 * 1024
+)
+
+var (
+	ErrSessionDataTooLarge = fmt.Errorf("session data too large")
+)
+
+// sessionMetadata stores custom data attached to a session. It is embedded in
+// the session types and is cleared when a session is closed.
+type sessionMetadata struct {
+	dataMu    sync.Mutex
+	dataSizes map[string]int
+	dataSize  int
+	values    map[string]interface{}
+}
+
+// SetData attaches the given value to the session, a nil value removes the
+// key. Returns an error if the total size of the data would exceed the limit.
+func (m *sessionMetadata) SetData(key string, value interface{}) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+
+	if value == nil {
+		m.removeDataLocked(key)
+		return nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	size := len(key) + len(encoded)
+	if m.dataSize-m.dataSizes[key]+size > maxSessionDataSize {
+		return ErrSessionDataTooLarge
+	}
+
+	if m.values == nil {
+		m.values = make(map[string]interface{})
+		m.dataSizes = make(map[string]int)
+	}
+	m.dataSize += size - m.dataSizes[key]
+	m.dataSizes[key] = size
+	m.values[key] = value
+	return nil
+}
+
+func (m *sessionMetadata) removeDataLocked(key string) {
+	if _, found := m.values[key]; !found {
+		return
+	}
+
+	m.dataSize -= m.dataSizes[key]
+	delete(m.dataSizes, key)
+	delete(m.values, key)
+}
+
+// GetData returns the value attached to the session for the given key or nil
+// if no such value exists.
+func (m *sessionMetadata) GetData(key string) interface{} {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+
+	return m.values[key]
+}
+
+func (m *sessionMetadata) clearData() {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+
+	m.values = nil
+	m.dataSizes = nil
+	m.dataSize = 0
+}
@@ -0,0 +1,85 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionMetadata(t *testing.T) {
+	var data sessionMetadata
+	if value := data.GetData("foo"); value != nil {
+		t.Errorf("Expected no value, got %+v", value)
+	}
+
+	if err := data.SetData("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if value := data.GetData("foo"); value != "bar" {
+		t.Errorf("Expected bar, got %+v", value)
+	}
+	if err := data.SetData("tenant", map[string]interface{}{"id": 123}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.SetData("foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if value := data.GetData("foo"); value != nil {
+		t.Errorf("Expected no value after removing, got %+v", value)
+	}
+	if value := data.GetData("tenant"); value == nil {
+		t.Error("Expected other value to be kept")
+	}
+
+	data.clearData()
+	if value := data.GetData("tenant"); value != nil {
+		t.Errorf("Expected no value after clearing, got %+v", value)
+	}
+}
+
+func TestSessionMetadataSizeLimit(t *testing.T) {
+	var data sessionMetadata
+	// The JSON encoded string includes the surrounding quotes.
+	large := strings.Repeat("x", maxSessionDataSize-len("key")-2)
+	if err := data.SetData("key", large+"x"); err != ErrSessionDataTooLarge {
+		t.Errorf("Expected error %s, got %v", ErrSessionDataTooLarge, err)
+	}
+	if err := data.SetData("key", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetData("other", 1); err != ErrSessionDataTooLarge {
+		t.Errorf("Expected error %s, got %v", ErrSessionDataTooLarge, err)
+	}
+
+	// Replacing a value only counts the new size.
+	if err := data.SetData("key", "small"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetData("other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if value := data.GetData("key"); value != "small" {
+		t.Errorf("Expected small, got %+v", value)
+	}
+}
@@ -22,6 +22,8 @@
 package signaling
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 )
 
@@ -36,3 +38,77 @@ func assertSessionHasNotPermission(t *testing.T, session Session, permission Per
 		t.Errorf("Session %s has permission %s but shouldn't", session.PublicId(), permission)
 	}
 }
+
+func TestGetSessionRole(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if role := GetSessionRole(session1); role != SessionRoleParticipant {
+		t.Errorf("Expected role %s, got %s", SessionRoleParticipant, role)
+	}
+
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_CONTROL})
+	if role := GetSessionRole(session1); role != SessionRoleModerator {
+		t.Errorf("Expected role %s, got %s", SessionRoleModerator, role)
+	}
+
+	// Internal clients are always moderators.
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId)
+	if role := GetSessionRole(session2); role != SessionRoleModerator {
+		t.Errorf("Expected role %s for internal session, got %s", SessionRoleModerator, role)
+	}
+}
+
+func TestGetUserDisplayName(t *testing.T) {
+	testcases := []struct {
+		userId   string
+		userData string
+		expected string
+	}{
+		{"user", `{"displayname":"Test User"}`, "Test User"},
+		{"user", `{"displayname":"  Test User "}`, "Test User"},
+		{"user", `{"displayname":"Test User","other":"value"}`, "Test User"},
+		{"user", `{"other":"value"}`, ""},
+		{"user", `{"displayname":123}`, ""},
+		{"user", `"invalid"`, ""},
+		{"user", "", ""},
+		// Anonymous sessions never have a display name.
+		{"", `{"displayname":"Test User"}`, ""},
+	}
+
+	for _, tc := range testcases {
+		var userData *json.RawMessage
+		if tc.userData != "" {
+			data := json.RawMessage(tc.userData)
+			userData = &data
+		}
+		if name := getUserDisplayName(tc.userId, userData); name != tc.expected {
+			t.Errorf("Expected display name \"%s\" for %s / %s, got \"%s\"", tc.expected, tc.userId, tc.userData, name)
+		}
+	}
+}
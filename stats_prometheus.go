@@ -39,8 +39,12 @@ var (
 )
 
 func registerAll(cs ...prometheus.Collector) {
+	registerAllWith(prometheus.DefaultRegisterer, cs...)
+}
+
+func registerAllWith(registerer prometheus.Registerer, cs ...prometheus.Collector) {
 	for _, c := range cs {
-		if err := prometheus.DefaultRegisterer.Register(c); err != nil {
+		if err := registerer.Register(c); err != nil {
 			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
 				panic(err)
 			}
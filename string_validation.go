@@ -0,0 +1,71 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Control characters that are allowed in texts for users.
+	allowedTextControlCharacters = "\t\n"
+)
+
+func validateStringAllowing(name string, value string, allowed string) error {
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s is not valid UTF-8", name)
+	}
+
+	for _, ch := range value {
+		if unicode.IsControl(ch) && !strings.ContainsRune(allowed, ch) {
+			return fmt.Errorf("%s contains control character %q", name, ch)
+		}
+	}
+	return nil
+}
+
+// validateString checks that a string field of a message is valid UTF-8 and
+// doesn't contain any control characters. All "CheckValid" methods use this
+// for ids, types and other strings so they can't be used to inject data into
+// logs or messages of other clients.
+func validateString(name string, value string) error {
+	return validateStringAllowing(name, value, "")
+}
+
+// validateText is like "validateString" but allows tabs and newlines, e.g. for
+// reasons that are displayed to users.
+func validateText(name string, value string) error {
+	return validateStringAllowing(name, value, allowedTextControlCharacters)
+}
+
+// validateStrings checks all values with "validateString".
+func validateStrings(name string, values []string) error {
+	for _, value := range values {
+		if err := validateString(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateString(t *testing.T) {
+	testcases := []struct {
+		value string
+		valid bool
+		text  bool
+	}{
+		{"", true, true},
+		{"the-room-id", true, true},
+		{"Grüße 👋", true, true},
+		{"with\ttab", false, true},
+		{"multiple\nlines", false, true},
+		{"carriage\rreturn", false, false},
+		{"null\x00byte", false, false},
+		{"escape\x1b[31m", false, false},
+		{"delete\x7f", false, false},
+		{"c1\u0085control", false, false},
+		{"invalid\xffutf8", false, false},
+		{"\xc3", false, false},
+	}
+	for _, tc := range testcases {
+		if err := validateString("value", tc.value); tc.valid && err != nil {
+			t.Errorf("Expected %q to be valid, got %s", tc.value, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("Expected %q to be invalid", tc.value)
+		}
+		if err := validateText("value", tc.value); tc.text && err != nil {
+			t.Errorf("Expected text %q to be valid, got %s", tc.value, err)
+		} else if !tc.text && err == nil {
+			t.Errorf("Expected text %q to be invalid", tc.value)
+		}
+	}
+
+	if err := validateStrings("value", []string{"one", "two"}); err != nil {
+		t.Errorf("Expected values to be valid, got %s", err)
+	}
+	if err := validateStrings("value", []string{"one", "t\x00wo"}); err == nil {
+		t.Error("Expected values to be invalid")
+	}
+}
+
+func TestMessagesRejectControlCharacters(t *testing.T) {
+	params := json.RawMessage("{}")
+	data := json.RawMessage("{}")
+	messages := []testCheckValid{
+		&ClientMessage{
+			Type: "bye\n",
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			ResumeId: "the-resume\x00id",
+		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			Features: []string{"feature\x1b"},
+			Auth: HelloClientMessageAuth{
+				Params: &params,
+				Url:    "https://domain.invalid",
+			},
+		},
+		&ClientTypeInternalAuthParams{
+			Backend: "https://domain.invalid\n",
+		},
+		&RoomClientMessage{
+			RoomId: "the-room\nid",
+		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: "the-session\rid",
+			},
+			Data: &data,
+		},
+		&MessageClientMessageData{
+			Type:     "offer",
+			RoomType: "video\x00",
+			Sid:      "12345",
+		},
+		&AddSessionInternalClientMessage{
+			CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+				SessionId: "session",
+				RoomId:    "room",
+			},
+			UserId: "user\xff",
+		},
+		&KickClientMessage{
+			SessionId: "session",
+			Reason:    "reason\x1b[2J",
+		},
+		&TransientDataClientMessage{
+			Type: "set",
+			Key:  "key\x00",
+		},
+		&ParticipantsClientMessage{
+			RoomId: "room\x7f",
+		},
+		&CapabilitiesClientMessage{
+			Backends: []string{"backend\n"},
+		},
+		&ProxyClientMessage{
+			Type: "payload\n",
+		},
+		&CommandProxyClientMessage{
+			Type:       "create-publisher",
+			StreamType: "video\n",
+		},
+	}
+	for _, msg := range messages {
+		if err := msg.CheckValid(); err == nil {
+			t.Errorf("Message %+v should not be valid", msg)
+		}
+	}
+
+	// Kick reasons may contain multiple lines.
+	kick := &KickClientMessage{
+		SessionId: "session",
+		Reason:    "first line\nsecond line",
+	}
+	if err := kick.CheckValid(); err != nil {
+		t.Errorf("Message %+v should be valid, got %s", kick, err)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
@@ -46,7 +47,8 @@ var (
 )
 
 type TestBackendClientAuthParams struct {
-	UserId string `json:"userid"`
+	UserId   string `json:"userid"`
+	Observer bool   `json:"observer,omitempty"`
 }
 
 func getWebsocketUrl(url string) string {
@@ -117,6 +119,18 @@ func checkMessageType(message *ServerMessage, expectedType string) error {
 		if message.TransientData == nil {
 			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
 		}
+	case "receipt":
+		if message.Receipt == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "capabilities":
+		if message.Capabilities == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "renegotiate":
+		if message.Renegotiate == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
 	}
 
 	return nil
@@ -189,8 +203,12 @@ type TestClient struct {
 }
 
 func NewTestClient(t *testing.T, server *httptest.Server, hub *Hub) *TestClient {
+	return NewTestClientWithHeader(t, server, hub, nil)
+}
+
+func NewTestClientWithHeader(t *testing.T, server *httptest.Server, hub *Hub, header http.Header) *TestClient {
 	// Reference "hub" to prevent compiler error.
-	conn, _, err := websocket.DefaultDialer.Dial(getWebsocketUrl(server.URL), nil)
+	conn, _, err := websocket.DefaultDialer.Dial(getWebsocketUrl(server.URL), header)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -331,6 +349,13 @@ func (c *TestClient) SendHello(userid string) error {
 	return c.SendHelloParams(c.server.URL, "", params)
 }
 
+func (c *TestClient) SendHelloWithFeatures(userid string, features []string) error {
+	params := TestBackendClientAuthParams{
+		UserId: userid,
+	}
+	return c.sendHelloParamsWithFeatures(c.server.URL, "", params, features)
+}
+
 func (c *TestClient) SendHelloResume(resumeId string) error {
 	hello := &ClientMessage{
 		Id:   "1234",
@@ -351,11 +376,14 @@ func (c *TestClient) SendHelloClient(userid string) error {
 }
 
 func (c *TestClient) SendHelloInternal() error {
+	return c.SendHelloInternalWithBackend(c.server.URL)
+}
+
+func (c *TestClient) SendHelloInternalWithBackend(backend string) error {
 	random := newRandomString(48)
 	mac := hmac.New(sha256.New, testInternalSecret)
 	mac.Write([]byte(random)) // nolint
 	token := hex.EncodeToString(mac.Sum(nil))
-	backend := c.server.URL
 
 	params := ClientTypeInternalAuthParams{
 		Random:  random,
@@ -366,6 +394,10 @@ func (c *TestClient) SendHelloInternal() error {
 }
 
 func (c *TestClient) SendHelloParams(url string, clientType string, params interface{}) error {
+	return c.sendHelloParamsWithFeatures(url, clientType, params, nil)
+}
+
+func (c *TestClient) sendHelloParamsWithFeatures(url string, clientType string, params interface{}, features []string) error {
 	data, err := json.Marshal(params)
 	if err != nil {
 		c.t.Fatal(err)
@@ -375,7 +407,8 @@ func (c *TestClient) SendHelloParams(url string, clientType string, params inter
 		Id:   "1234",
 		Type: "hello",
 		Hello: &HelloClientMessage{
-			Version: HelloVersion,
+			Version:  HelloVersion,
+			Features: features,
 			Auth: HelloClientMessageAuth{
 				Type:   clientType,
 				Url:    url,
@@ -412,6 +445,26 @@ func (c *TestClient) SendMessage(recipient MessageClientMessageRecipient, data i
 	return c.WriteJSON(message)
 }
 
+func (c *TestClient) SendMessageWithReceipt(recipient MessageClientMessageRecipient, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	message := &ClientMessage{
+		Id:   "abcd",
+		Type: "message",
+		Message: &MessageClientMessage{
+			Recipient:      recipient,
+			RequestReceipt: true,
+			Data:           (*json.RawMessage)(&payload),
+			// Not serialized, the server checks the type of the sending client.
+			fromInternal: true,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
 func (c *TestClient) SetTransientData(key string, value interface{}) error {
 	payload, err := json.Marshal(value)
 	if err != nil {
@@ -672,6 +725,22 @@ func (c *TestClient) RunUntilLeft(ctx context.Context, hello *HelloServerMessage
 	return c.checkMessageRoomLeave(message, hello)
 }
 
+// RunUntilLeftWithReason waits for the leave event of the given session and
+// checks the reason why it left.
+func (c *TestClient) RunUntilLeftWithReason(ctx context.Context, hello *HelloServerMessage, reason string) error {
+	message, err := c.RunUntilMessage(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkMessageRoomLeave(message, hello); err != nil {
+		return err
+	} else if r := message.Event.LeaveReasons[hello.SessionId]; r != reason {
+		return fmt.Errorf("Expected leave reason %s, got %+v", reason, message.Event)
+	}
+	return nil
+}
+
 func checkMessageRoomlistUpdate(message *ServerMessage) (*RoomEventServerMessage, error) {
 	if err := checkMessageType(message, "event"); err != nil {
 		return nil, err
@@ -759,6 +828,18 @@ func (c *TestClient) RunUntilRoomMessage(ctx context.Context) (*RoomEventMessage
 	return checkMessageRoomMessage(message)
 }
 
+func checkMessageReceipt(message *ServerMessage, sessionId string, status string) error {
+	if err := checkMessageType(message, "receipt"); err != nil {
+		return err
+	} else if message.Receipt.Recipient == nil || message.Receipt.Recipient.SessionId != sessionId {
+		return fmt.Errorf("Expected receipt for session %s, got %+v", sessionId, message.Receipt.Recipient)
+	} else if message.Receipt.Status != status {
+		return fmt.Errorf("Expected receipt status %s, got %s", status, message.Receipt.Status)
+	}
+
+	return nil
+}
+
 func checkMessageError(message *ServerMessage, msgid string) error {
 	if err := checkMessageType(message, "error"); err != nil {
 		return err
@@ -769,6 +850,21 @@ func checkMessageError(message *ServerMessage, msgid string) error {
 	return nil
 }
 
+func checkResumeFailed(message *ServerMessage, reason string) error {
+	if err := checkMessageError(message, "resume_failed"); err != nil {
+		return err
+	}
+
+	details, ok := message.Error.Details.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Expected error details, got %+v", message.Error)
+	} else if r, _ := details["reason"].(string); r != reason {
+		return fmt.Errorf("Expected reason \"%s\", got \"%s\" (%+v)", reason, r, message.Error)
+	}
+
+	return nil
+}
+
 func (c *TestClient) RunUntilAnswer(ctx context.Context, answer string) error {
 	message, err := c.RunUntilMessage(ctx)
 	if err != nil {
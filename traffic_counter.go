@@ -0,0 +1,78 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// trafficCounter counts the bytes exchanged with clients. It must be the first
+// field of a struct to guarantee the 64-bit alignment that is required for
+// the atomic operations on 32-bit platforms.
+type trafficCounter struct {
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+// BytesSent returns the number of bytes sent to clients.
+func (t *trafficCounter) BytesSent() uint64 {
+	return atomic.LoadUint64(&t.bytesSent)
+}
+
+// BytesReceived returns the number of bytes received from clients.
+func (t *trafficCounter) BytesReceived() uint64 {
+	return atomic.LoadUint64(&t.bytesReceived)
+}
+
+func (t *trafficCounter) addBytesSent(n int) {
+	atomic.AddUint64(&t.bytesSent, uint64(n))
+}
+
+func (t *trafficCounter) addBytesReceived(n int) {
+	atomic.AddUint64(&t.bytesReceived, uint64(n))
+}
+
+func (t *trafficCounter) resetTraffic() {
+	atomic.StoreUint64(&t.bytesSent, 0)
+	atomic.StoreUint64(&t.bytesReceived, 0)
+}
+
+// addTraffic adds the traffic of another counter, e.g. when a backend is
+// replaced while reloading.
+func (t *trafficCounter) addTraffic(other *trafficCounter) {
+	atomic.AddUint64(&t.bytesSent, other.BytesSent())
+	atomic.AddUint64(&t.bytesReceived, other.BytesReceived())
+}
+
+// countingWriter counts the number of bytes written to the wrapped writer.
+type countingWriter struct {
+	io.Writer
+
+	written int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += n
+	return n, err
+}
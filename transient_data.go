@@ -24,6 +24,7 @@ package signaling
 import (
 	"reflect"
 	"sync"
+	"time"
 )
 
 type TransientListener interface {
@@ -34,6 +35,7 @@ type TransientData struct {
 	mu        sync.Mutex
 	data      map[string]interface{}
 	listeners map[TransientListener]bool
+	timers    map[string]*time.Timer
 }
 
 // NewTransientData creates a new transient data container.
@@ -70,6 +72,42 @@ func (t *TransientData) notifyDeleted(key string, prev interface{}) {
 	}
 }
 
+func (t *TransientData) removeAfterTTL(key string, value interface{}, timer **time.Timer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if existing, found := t.timers[key]; !found || existing != *timer {
+		// The value has been changed or removed in the meantime.
+		return
+	}
+
+	delete(t.timers, key)
+	if prev, found := t.data[key]; found && reflect.DeepEqual(prev, value) {
+		delete(t.data, key)
+		t.notifyDeleted(key, prev)
+	}
+}
+
+func (t *TransientData) updateTTL(key string, value interface{}, ttl time.Duration) {
+	if timer, found := t.timers[key]; found {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	if t.timers == nil {
+		t.timers = make(map[string]*time.Timer)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		t.removeAfterTTL(key, value, &timer)
+	})
+	t.timers[key] = timer
+}
+
 // AddListener adds a new listener to be notified about changes.
 func (t *TransientData) AddListener(listener TransientListener) {
 	t.mu.Lock()
@@ -102,6 +140,13 @@ func (t *TransientData) RemoveListener(listener TransientListener) {
 // Set sets a new value for the given key and notifies listeners
 // if the value has been changed.
 func (t *TransientData) Set(key string, value interface{}) bool {
+	return t.SetTTL(key, value, 0)
+}
+
+// SetTTL sets a new value for the given key with a time-to-live and notifies
+// listeners if the value has been changed. The value will be removed after the
+// ttl has expired, a ttl of zero disables expiration.
+func (t *TransientData) SetTTL(key string, value interface{}, ttl time.Duration) bool {
 	if value == nil {
 		return t.Remove(key)
 	}
@@ -111,6 +156,10 @@ func (t *TransientData) Set(key string, value interface{}) bool {
 
 	prev, found := t.data[key]
 	if found && reflect.DeepEqual(prev, value) {
+		if ttl > 0 {
+			// Refresh the expiration time of the existing value.
+			t.updateTTL(key, value, ttl)
+		}
 		return false
 	}
 
@@ -118,6 +167,7 @@ func (t *TransientData) Set(key string, value interface{}) bool {
 		t.data = make(map[string]interface{})
 	}
 	t.data[key] = value
+	t.updateTTL(key, value, ttl)
 	t.notifySet(key, prev, value)
 	return true
 }
@@ -125,6 +175,12 @@ func (t *TransientData) Set(key string, value interface{}) bool {
 // CompareAndSet sets a new value for the given key only for a given old value
 // and notifies listeners if the value has been changed.
 func (t *TransientData) CompareAndSet(key string, old, value interface{}) bool {
+	return t.CompareAndSetTTL(key, old, value, 0)
+}
+
+// CompareAndSetTTL sets a new value for the given key with a time-to-live only
+// for a given old value and notifies listeners if the value has been changed.
+func (t *TransientData) CompareAndSetTTL(key string, old, value interface{}, ttl time.Duration) bool {
 	if value == nil {
 		return t.CompareAndRemove(key, old)
 	}
@@ -139,7 +195,11 @@ func (t *TransientData) CompareAndSet(key string, old, value interface{}) bool {
 		return false
 	}
 
+	if t.data == nil {
+		t.data = make(map[string]interface{})
+	}
 	t.data[key] = value
+	t.updateTTL(key, value, ttl)
 	t.notifySet(key, prev, value)
 	return true
 }
@@ -156,6 +216,7 @@ func (t *TransientData) Remove(key string) bool {
 	}
 
 	delete(t.data, key)
+	t.updateTTL(key, nil, 0)
 	t.notifyDeleted(key, prev)
 	return true
 }
@@ -172,6 +233,7 @@ func (t *TransientData) CompareAndRemove(key string, old interface{}) bool {
 	}
 
 	delete(t.data, key)
+	t.updateTTL(key, nil, 0)
 	t.notifyDeleted(key, prev)
 	return true
 }
@@ -187,3 +249,14 @@ func (t *TransientData) GetData() map[string]interface{} {
 	}
 	return result
 }
+
+// Close stops all pending expirations of values.
+func (t *TransientData) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, timer := range t.timers {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+}
@@ -23,6 +23,7 @@ package signaling
 
 import (
 	"context"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -67,6 +68,70 @@ func Test_TransientData(t *testing.T) {
 	}
 }
 
+type testTransientListener struct {
+	messages chan *ServerMessage
+}
+
+func (l *testTransientListener) SendMessage(message *ServerMessage) bool {
+	l.messages <- message
+	return true
+}
+
+func Test_TransientDataTTL(t *testing.T) {
+	data := NewTransientData()
+	defer data.Close()
+
+	listener := &testTransientListener{
+		messages: make(chan *ServerMessage, 16),
+	}
+	data.AddListener(listener)
+
+	ttl := 100 * time.Millisecond
+	if !data.SetTTL("foo", "bar", ttl) {
+		t.Errorf("should have set value")
+	}
+	if !data.SetTTL("lala", "123", ttl) {
+		t.Errorf("should have set value")
+	}
+	// Values without ttl are not removed.
+	if !data.Set("test", "value") {
+		t.Errorf("should have set value")
+	}
+	// Changing a value without ttl disables expiration.
+	if !data.Set("lala", "456") {
+		t.Errorf("should have set value")
+	}
+	for i := 0; i < 4; i++ {
+		if err := checkMessageType(<-listener.messages, "transient"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case msg := <-listener.messages:
+		if err := checkMessageTransientRemove(msg, "foo", "bar"); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("value was not removed after ttl")
+	}
+
+	time.Sleep(2 * ttl)
+	select {
+	case msg := <-listener.messages:
+		t.Errorf("Expected no further message, got %+v", msg)
+	default:
+	}
+
+	expected := map[string]interface{}{
+		"lala": "456",
+		"test": "value",
+	}
+	if current := data.GetData(); !reflect.DeepEqual(current, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, current)
+	}
+}
+
 func Test_TransientMessages(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -0,0 +1,176 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies contains the networks of proxies that are allowed to pass
+// the address of the connecting client in forwarding headers.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// parseIPNet parses a single IP address or a network in CIDR notation.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse CIDR %s: %s", s, err)
+		}
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("could not parse IP %s", s)
+	}
+
+	var mask net.IPMask
+	if ipv4 := ip.To4(); ipv4 != nil {
+		mask = net.CIDRMask(32, 32)
+	} else {
+		mask = net.CIDRMask(128, 128)
+	}
+	return &net.IPNet{
+		IP:   ip,
+		Mask: mask,
+	}, nil
+}
+
+// ParseTrustedProxies parses a comma and / or space separated list of IP
+// addresses and networks in CIDR notation. An empty list trusts no proxies.
+func ParseTrustedProxies(s string) (*TrustedProxies, error) {
+	result := &TrustedProxies{}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		ipNet, err := parseIPNet(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		result.nets = append(result.nets, ipNet)
+	}
+	return result, nil
+}
+
+func (p *TrustedProxies) Empty() bool {
+	return p == nil || len(p.nets) == 0
+}
+
+func (p *TrustedProxies) String() string {
+	if p.Empty() {
+		return ""
+	}
+
+	entries := make([]string, 0, len(p.nets))
+	for _, n := range p.nets {
+		entries = append(entries, n.String())
+	}
+	return strings.Join(entries, ", ")
+}
+
+// Contains checks if the given IP address belongs to a trusted proxy.
+func (p *TrustedProxies) Contains(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *TrustedProxies) isTrusted(addr string) bool {
+	return p.Contains(net.ParseIP(addr))
+}
+
+// IsUntrustedForward returns true if the request contains forwarding headers
+// but was not received from a trusted proxy. The address of the client that
+// sent such a request is unknown.
+func (p *TrustedProxies) IsUntrustedForward(r *http.Request) bool {
+	if r.Header.Get("X-Real-IP") == "" && r.Header.Get("X-Forwarded-For") == "" {
+		return false
+	}
+
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return !p.isTrusted(addr)
+}
+
+// IsSharedProxy returns true if the client address of the request is the one
+// of a trusted proxy, i.e. the proxy didn't forward the address of the client
+// and the address is shared by all clients connecting through it.
+func (p *TrustedProxies) IsSharedProxy(r *http.Request) bool {
+	return p.isTrusted(p.GetClientIP(r))
+}
+
+// GetClientIP returns the address of the client that sent the request. The
+// forwarding headers are only evaluated if the request was received from a
+// trusted proxy.
+func (p *TrustedProxies) GetClientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !p.isTrusted(addr) {
+		return addr
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		if net.ParseIP(ip) != nil {
+			return ip
+		}
+		return addr
+	}
+
+	if header := r.Header.Get("X-Forwarded-For"); header != "" {
+		// The header contains a list "clientip, proxy1, proxy2" where each proxy
+		// appends the address it received the request from. Only the entries
+		// added by trusted proxies can be relied on, so use the last entry that
+		// was not added by a trusted proxy.
+		ips := strings.Split(header, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if net.ParseIP(ip) == nil {
+				break
+			}
+
+			addr = ip
+			if !p.isTrusted(ip) {
+				break
+			}
+		}
+	}
+
+	return addr
+}
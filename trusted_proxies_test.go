@@ -0,0 +1,218 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{"", "", true},
+		{"127.0.0.1", "127.0.0.1/32", true},
+		{"127.0.0.1, ::1", "127.0.0.1/32, ::1/128", true},
+		{"10.0.0.0/8 192.168.0.0/16", "10.0.0.0/8, 192.168.0.0/16", true},
+		{"fd00::/8,127.0.0.1", "fd00::/8, 127.0.0.1/32", true},
+		{"invalid", "", false},
+		{"10.0.0.0/50", "", false},
+	}
+
+	for _, tc := range testcases {
+		trusted, err := ParseTrustedProxies(tc.value)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected error for %s, got %s", tc.value, trusted)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Could not parse %s: %s", tc.value, err)
+			continue
+		}
+
+		if s := trusted.String(); s != tc.expected {
+			t.Errorf("Expected %s for %s, got %s", tc.expected, tc.value, s)
+		}
+		if empty := trusted.Empty(); empty != (tc.expected == "") {
+			t.Errorf("Expected empty %v for %s, got %v", tc.expected == "", tc.value, empty)
+		}
+	}
+}
+
+func TestTrustedProxiesContains(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"10.255.255.255", true},
+		{"11.0.0.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::1", false},
+	}
+
+	for _, tc := range testcases {
+		if contains := trusted.Contains(net.ParseIP(tc.ip)); contains != tc.expected {
+			t.Errorf("Expected %v for %s, got %v", tc.expected, tc.ip, contains)
+		}
+	}
+}
+
+func TestTrustedProxiesGetClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		remoteAddr    string
+		realIp        string
+		forwardedFor  string
+		expected      string
+		expectedEmpty string
+	}{
+		// Direct connections without headers.
+		{"1.2.3.4:12345", "", "", "1.2.3.4", "1.2.3.4"},
+		{"[::1]:12345", "", "", "::1", "::1"},
+		// Headers from untrusted peers are ignored.
+		{"1.2.3.4:12345", "5.6.7.8", "", "1.2.3.4", "1.2.3.4"},
+		{"1.2.3.4:12345", "", "5.6.7.8", "1.2.3.4", "1.2.3.4"},
+		// Headers from trusted peers are used.
+		{"10.0.0.1:12345", "5.6.7.8", "", "5.6.7.8", "10.0.0.1"},
+		{"[::1]:12345", "", "5.6.7.8", "5.6.7.8", "::1"},
+		{"10.0.0.1:12345", "", "5.6.7.8, 10.0.0.2", "5.6.7.8", "10.0.0.1"},
+		// Spoofed entries before the last untrusted entry are ignored.
+		{"10.0.0.1:12345", "", "9.9.9.9, 5.6.7.8", "5.6.7.8", "10.0.0.1"},
+		// Invalid headers are ignored.
+		{"10.0.0.1:12345", "invalid", "", "10.0.0.1", "10.0.0.1"},
+		{"10.0.0.1:12345", "", "5.6.7.8, invalid", "10.0.0.1", "10.0.0.1"},
+		// All entries are trusted proxies.
+		{"10.0.0.1:12345", "", "10.0.0.3, 10.0.0.2", "10.0.0.3", "10.0.0.1"},
+	}
+
+	for _, tc := range testcases {
+		request := &http.Request{
+			RemoteAddr: tc.remoteAddr,
+			Header:     http.Header{},
+		}
+		if tc.realIp != "" {
+			request.Header.Set("X-Real-IP", tc.realIp)
+		}
+		if tc.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+
+		if ip := trusted.GetClientIP(request); ip != tc.expected {
+			t.Errorf("Expected %s for %+v, got %s", tc.expected, tc, ip)
+		}
+		if ip := (*TrustedProxies)(nil).GetClientIP(request); ip != tc.expectedEmpty {
+			t.Errorf("Expected %s without trusted proxies for %+v, got %s", tc.expectedEmpty, tc, ip)
+		}
+	}
+}
+
+func TestTrustedProxiesIsUntrustedForward(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		remoteAddr    string
+		realIp        string
+		forwardedFor  string
+		expected      bool
+		expectedEmpty bool
+	}{
+		{"127.0.0.1:12345", "", "", false, false},
+		{"10.0.0.1:12345", "", "", false, false},
+		{"127.0.0.1:12345", "5.6.7.8", "", true, true},
+		{"127.0.0.1:12345", "", "5.6.7.8", true, true},
+		{"10.0.0.1:12345", "5.6.7.8", "", false, true},
+		{"10.0.0.1:12345", "", "5.6.7.8", false, true},
+	}
+
+	for _, tc := range testcases {
+		request := &http.Request{
+			RemoteAddr: tc.remoteAddr,
+			Header:     http.Header{},
+		}
+		if tc.realIp != "" {
+			request.Header.Set("X-Real-IP", tc.realIp)
+		}
+		if tc.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+
+		if untrusted := trusted.IsUntrustedForward(request); untrusted != tc.expected {
+			t.Errorf("Expected %t for %+v, got %t", tc.expected, tc, untrusted)
+		}
+		if untrusted := (*TrustedProxies)(nil).IsUntrustedForward(request); untrusted != tc.expectedEmpty {
+			t.Errorf("Expected %t without trusted proxies for %+v, got %t", tc.expectedEmpty, tc, untrusted)
+		}
+	}
+}
+
+func TestTrustedProxiesIsSharedProxy(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expected     bool
+	}{
+		{"1.2.3.4:12345", "", false},
+		{"10.0.0.1:12345", "", true},
+		{"10.0.0.1:12345", "5.6.7.8", false},
+		{"10.0.0.1:12345", "10.0.0.2", true},
+		// Forwarding headers of untrusted peers are ignored.
+		{"1.2.3.4:12345", "10.0.0.2", false},
+	}
+
+	for _, tc := range testcases {
+		request := &http.Request{
+			RemoteAddr: tc.remoteAddr,
+			Header:     http.Header{},
+		}
+		if tc.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+
+		if shared := trusted.IsSharedProxy(request); shared != tc.expected {
+			t.Errorf("Expected %t for %+v, got %t", tc.expected, tc, shared)
+		}
+	}
+}
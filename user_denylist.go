@@ -0,0 +1,92 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// UserDenylist contains patterns of user ids that may not connect.
+//
+// Patterns are matched against the complete (case-sensitive) user id using
+// the syntax of "path.Match", i.e. "*" matches any sequence of characters
+// except "/", "?" matches a single character except "/" and "[...]" matches a
+// character class. Escape special characters with "\".
+type UserDenylist struct {
+	patterns []string
+}
+
+// NewUserDenylist creates a denylist from a comma separated list of patterns.
+// Invalid patterns are logged and ignored. Returns nil if no valid patterns
+// are given.
+func NewUserDenylist(value string) *UserDenylist {
+	var patterns []string
+	for _, pattern := range getConfiguredValues(value) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("Ignoring invalid user denylist pattern %s: %s", pattern, err)
+			continue
+		}
+
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	return &UserDenylist{
+		patterns: patterns,
+	}
+}
+
+// Matches returns true if the user id matches one of the patterns. Anonymous
+// users (i.e. an empty user id) are never matched.
+func (l *UserDenylist) Matches(userId string) bool {
+	if l == nil || userId == "" {
+		return false
+	}
+
+	for _, pattern := range l.patterns {
+		if matched, _ := path.Match(pattern, userId); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns true if both denylists contain the same patterns.
+func (l *UserDenylist) Equal(other *UserDenylist) bool {
+	if l == nil || other == nil {
+		return l == other
+	}
+
+	return equalStringSlices(l.patterns, other.patterns)
+}
+
+func (l *UserDenylist) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(l.patterns, ", ")
+}
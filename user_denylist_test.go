@@ -0,0 +1,81 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2026 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+)
+
+func TestUserDenylist(t *testing.T) {
+	denylist := NewUserDenylist("admin, spam-*, user?, [ab]ot, invalid[, user\\*")
+	if denylist == nil {
+		t.Fatal("Expected denylist")
+	}
+	if s := denylist.String(); s != "admin, spam-*, user?, [ab]ot, user\\*" {
+		t.Errorf("Unexpected patterns %s", s)
+	}
+
+	testcases := []struct {
+		userId  string
+		matches bool
+	}{
+		{"", false},
+		{"admin", true},
+		{"Admin", false},
+		{"administrator", false},
+		{"spam-", true},
+		{"spam-user", true},
+		{"spam-user/other", false},
+		{"user1", true},
+		{"user", false},
+		{"user12", false},
+		{"aot", true},
+		{"bot", true},
+		{"cot", false},
+		{"user*", true},
+		{"invalid[", false},
+	}
+	for _, tc := range testcases {
+		if matches := denylist.Matches(tc.userId); matches != tc.matches {
+			t.Errorf("Expected %v for %q, got %v", tc.matches, tc.userId, matches)
+		}
+	}
+}
+
+func TestUserDenylistEmpty(t *testing.T) {
+	for _, value := range []string{"", " , ", "invalid["} {
+		if denylist := NewUserDenylist(value); denylist != nil {
+			t.Errorf("Expected no denylist for %q, got %s", value, denylist)
+		}
+	}
+
+	var denylist *UserDenylist
+	if denylist.Matches("admin") {
+		t.Error("Empty denylist should not match")
+	}
+	if !denylist.Equal(nil) || denylist.Equal(NewUserDenylist("admin")) {
+		t.Error("Empty denylist should only be equal to other empty denylists")
+	}
+	if !NewUserDenylist("admin, bot").Equal(NewUserDenylist("admin,bot")) {
+		t.Error("Denylists with the same patterns should be equal")
+	}
+}
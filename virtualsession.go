@@ -26,6 +26,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -38,6 +39,11 @@ const (
 )
 
 type VirtualSession struct {
+	// Virtual sessions don't exchange data with clients themselves, the
+	// counters are only used to implement the Session interface.
+	trafficCounter
+	sessionMetadata
+
 	hub       *Hub
 	session   *ClientSession
 	privateId string
@@ -47,9 +53,13 @@ type VirtualSession struct {
 
 	sessionId string
 	userId    string
-	userData  *json.RawMessage
 	flags     uint32
 	options   *AddSessionOptions
+
+	mu       sync.Mutex
+	userData *json.RawMessage
+	// displayName is parsed from the user data whenever it is set.
+	displayName string
 }
 
 func GetVirtualSessionId(session *ClientSession, sessionId string) string {
@@ -69,6 +79,8 @@ func NewVirtualSession(session *ClientSession, privateId string, publicId string
 		userData:  msg.User,
 		flags:     msg.Flags,
 		options:   msg.Options,
+
+		displayName: getUserDisplayName(msg.UserId, msg.User),
 	}
 }
 
@@ -84,6 +96,10 @@ func (s *VirtualSession) ClientType() string {
 	return HelloClientTypeVirtual
 }
 
+func (s *VirtualSession) ClientInfo() *HelloClientInfo {
+	return nil
+}
+
 func (s *VirtualSession) Data() *SessionIdData {
 	return s.data
 }
@@ -105,9 +121,37 @@ func (s *VirtualSession) UserId() string {
 }
 
 func (s *VirtualSession) UserData() *json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.userData
 }
 
+func (s *VirtualSession) DisplayName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.displayName
+}
+
+// SetUserData replaces the user data of the session. Returns false if the
+// data didn't change.
+func (s *VirtualSession) SetUserData(userData *json.RawMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if equalRawMessage(s.userData, userData) {
+		return false
+	}
+
+	s.userData = userData
+	s.displayName = getUserDisplayName(s.userId, userData)
+	return true
+}
+
+// RemoteAddr returns the address of the internal client that created the
+// virtual session.
+func (s *VirtualSession) RemoteAddr() string {
+	return s.session.RemoteAddr()
+}
+
 func (s *VirtualSession) SetRoom(room *Room) {
 	atomic.StorePointer(&s.room, unsafe.Pointer(room))
 }
@@ -116,14 +160,22 @@ func (s *VirtualSession) GetRoom() *Room {
 	return (*Room)(atomic.LoadPointer(&s.room))
 }
 
-func (s *VirtualSession) LeaveRoom(notify bool) *Room {
+func (s *VirtualSession) CurrentRoom() MessageRoom {
+	if room := s.GetRoom(); room != nil {
+		return room
+	}
+
+	return nil
+}
+
+func (s *VirtualSession) LeaveRoom(notify bool, reason string) *Room {
 	room := s.GetRoom()
 	if room == nil {
 		return nil
 	}
 
 	s.SetRoom(nil)
-	room.RemoveSession(s)
+	room.RemoveSession(s, reason)
 	return room
 }
 
@@ -136,9 +188,16 @@ func (s *VirtualSession) Close() {
 }
 
 func (s *VirtualSession) CloseWithFeedback(session *ClientSession, message *ClientMessage) {
+	s.closeWithReason(LeaveReasonDisconnected, session, message)
+}
+
+// closeWithReason removes the virtual session with one of the "LeaveReason*"
+// values and notifies the backend if the session was in a room.
+func (s *VirtualSession) closeWithReason(reason string, session *ClientSession, message *ClientMessage) {
 	room := s.GetRoom()
 	s.session.RemoveVirtualSession(s)
-	removed := s.session.hub.removeSession(s)
+	removed := s.session.hub.removeSession(s, reason)
+	s.clearData()
 	if removed && room != nil {
 		go s.notifyBackendRemoved(room, session, message)
 	}
@@ -161,7 +220,7 @@ func (s *VirtualSession) notifyBackendRemoved(room *Room, session *ClientSession
 			virtualSessionId := GetVirtualSessionId(s.session, s.PublicId())
 			log.Printf("Could not leave virtual session %s at backend %s: %s", virtualSessionId, s.BackendUrl(), err)
 			if session != nil && message != nil {
-				reply := message.NewErrorServerMessage(NewError("remove_failed", "Could not remove virtual session from backend."))
+				reply := message.NewErrorServerMessage(NewErrorCode(ErrorCodeRemoveFailed))
 				session.SendMessage(reply)
 			}
 			return
@@ -171,7 +230,7 @@ func (s *VirtualSession) notifyBackendRemoved(room *Room, session *ClientSession
 			virtualSessionId := GetVirtualSessionId(s.session, s.PublicId())
 			log.Printf("Could not leave virtual session %s at backend %s: %+v", virtualSessionId, s.BackendUrl(), response.Error)
 			if session != nil && message != nil {
-				reply := message.NewErrorServerMessage(NewError("remove_failed", response.Error.Error()))
+				reply := message.NewErrorServerMessage(NewError(ErrorCodeRemoveFailed, response.Error.Error()))
 				session.SendMessage(reply)
 			}
 			return
@@ -183,7 +242,7 @@ func (s *VirtualSession) notifyBackendRemoved(room *Room, session *ClientSession
 		if err != nil {
 			log.Printf("Could not remove virtual session %s from backend %s: %s", s.PublicId(), s.BackendUrl(), err)
 			if session != nil && message != nil {
-				reply := message.NewErrorServerMessage(NewError("remove_failed", "Could not remove virtual session from backend."))
+				reply := message.NewErrorServerMessage(NewErrorCode(ErrorCodeRemoveFailed))
 				session.SendMessage(reply)
 			}
 		}
@@ -51,7 +51,7 @@ func TestVirtualSession(t *testing.T) {
 
 	client := NewTestClient(t, server, hub)
 	defer client.CloseWithBye()
-	if err := client.SendHello(testDefaultUserId); err != nil {
+	if err := client.SendHelloWithFeatures(testDefaultUserId, []string{ServerFeatureLeaveReasons}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -307,6 +307,8 @@ func TestVirtualSession(t *testing.T) {
 	}
 	if err := client.checkMessageRoomLeaveSession(msg5, sessionId); err != nil {
 		t.Error(err)
+	} else if reason := msg5.Event.LeaveReasons[sessionId]; reason != LeaveReasonLeft {
+		t.Errorf("Expected leave reason %s, got %+v", LeaveReasonLeft, msg5.Event.LeaveReasons)
 	}
 }
 
@@ -455,6 +457,108 @@ func TestVirtualSessionCleanup(t *testing.T) {
 	}
 }
 
+func TestVirtualSessionKick(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	roomId := "the-room-id"
+	emptyProperties := json.RawMessage("{}")
+	backend := &Backend{
+		id:     "compat",
+		compat: true,
+	}
+	room, err := hub.createRoom(roomId, &emptyProperties, backend)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	defer room.Close()
+
+	clientInternal := NewTestClient(t, server, hub)
+	defer clientInternal.CloseWithBye()
+	if err := clientInternal.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := clientInternal.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	msgAdd := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "addsession",
+			AddSession: &AddSessionInternalClientMessage{
+				CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+					SessionId: "session1",
+					RoomId:    roomId,
+				},
+				UserId: "user1",
+			},
+		},
+	}
+	if err := clientInternal.WriteJSON(msgAdd); err != nil {
+		t.Fatal(err)
+	}
+
+	msg1, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.checkMessageJoinedSession(msg1, "", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	sessionId := msg1.Event.Join[0].SessionId
+
+	// Ignore the participants update of the virtual session.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	if err := hub.KickSession(sessionId, "the-reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Type != "kicked" || message.Event.Kicked == nil || message.Event.Kicked.SessionId != sessionId {
+		t.Errorf("Expected kicked event for %s, got %+v", sessionId, message.Event)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := client.checkMessageRoomLeaveSession(message, sessionId); err != nil {
+		t.Error(err)
+	}
+
+	if session := hub.GetSessionByPublicId(sessionId); session != nil {
+		t.Errorf("Virtual session %s should have been removed", sessionId)
+	}
+}
+
 func TestVirtualSessionFlags(t *testing.T) {
 	s := &VirtualSession{
 		publicId: "dummy-for-testing",
@@ -491,3 +595,160 @@ func TestVirtualSessionFlags(t *testing.T) {
 		t.Fatalf("Expected flags 2, got %d", s.Flags())
 	}
 }
+
+func TestVirtualSessionChangeUser(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	roomId := "the-room-id"
+	emptyProperties := json.RawMessage("{}")
+	backend := &Backend{
+		id:     "compat",
+		compat: true,
+	}
+	room, err := hub.createRoom(roomId, &emptyProperties, backend)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	defer room.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	clientInternal := NewTestClient(t, server, hub)
+	defer clientInternal.CloseWithBye()
+	if err := clientInternal.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientInternal.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client supports previous values, the second one doesn't.
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version:  HelloVersion,
+			Features: []string{ServerFeatureChangePrevious},
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*TestClient{client1, client2} {
+		if _, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	internalSessionId := "session1"
+	userId := "user1"
+	user1 := json.RawMessage(`{"displayname":"Alice"}`)
+	msgAdd := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "addsession",
+			AddSession: &AddSessionInternalClientMessage{
+				CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+					SessionId: internalSessionId,
+					RoomId:    roomId,
+				},
+				UserId: userId,
+				User:   &user1,
+			},
+		},
+	}
+	if err := clientInternal.WriteJSON(msgAdd); err != nil {
+		t.Fatal(err)
+	}
+
+	user2 := json.RawMessage(`{"displayname":"Bob"}`)
+	msgUpdate := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "updatesession",
+			UpdateSession: &UpdateSessionInternalClientMessage{
+				CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+					SessionId: internalSessionId,
+					RoomId:    roomId,
+				},
+				User: &user2,
+			},
+		},
+	}
+	if err := clientInternal.WriteJSON(msgUpdate); err != nil {
+		t.Fatal(err)
+	}
+
+	runUntilChange := func(client *TestClient) *EventServerMessageSessionEntry {
+		for {
+			msg, err := client.RunUntilMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == "event" && msg.Event.Target == "room" && msg.Event.Type == "change" {
+				if len(msg.Event.Change) != 1 {
+					t.Fatalf("Expected one changed session, got %+v", msg.Event.Change)
+				}
+				return msg.Event.Change[0]
+			}
+		}
+	}
+
+	entry1 := runUntilChange(client1)
+	if entry1.UserId != userId || entry1.DisplayName != "Bob" || entry1.User == nil || string(*entry1.User) != string(user2) {
+		t.Errorf("Expected current values, got %+v", entry1)
+	}
+	if entry1.Previous == nil {
+		t.Errorf("Expected previous values, got %+v", entry1)
+	} else {
+		if entry1.Previous.User == nil || string(*entry1.Previous.User) != string(user1) {
+			t.Errorf("Expected previous user %s, got %+v", string(user1), entry1.Previous)
+		}
+		if entry1.Previous.DisplayName == nil || *entry1.Previous.DisplayName != "Alice" {
+			t.Errorf("Expected previous display name Alice, got %+v", entry1.Previous)
+		}
+	}
+
+	entry2 := runUntilChange(client2)
+	if entry2.DisplayName != "Bob" {
+		t.Errorf("Expected display name Bob, got %+v", entry2)
+	}
+	if entry2.Previous != nil {
+		t.Errorf("Expected no previous values, got %+v", entry2.Previous)
+	}
+
+	session := hub.GetSessionByPublicId(entry1.SessionId)
+	if session == nil {
+		t.Fatalf("Could not get virtual session %s", entry1.SessionId)
+	}
+	// Updating with the same data doesn't trigger a change.
+	if session.(*VirtualSession).SetUserData(&user2) {
+		t.Errorf("Expected no change for same user data")
+	}
+}